@@ -0,0 +1,259 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"math/big"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/joho/godotenv"
+	_ "github.com/lib/pq"
+	"golang.org/x/net/context"
+	"google.golang.org/api/option"
+
+	"eventbus"
+	"messages"
+)
+
+var (
+	ctx      = context.Background()
+	logger   *Logger
+	db       *sql.DB
+	bqClient *bigquery.Client
+	eventBus eventbus.EventBus
+)
+
+// Logger struct to encapsulate the standard logger
+type Logger struct {
+	logger *log.Logger
+}
+
+// LogInfo writes an informational message
+func (l *Logger) LogInfo(format string, args ...interface{}) {
+	l.logger.Printf("[INFO] "+format, args...)
+}
+
+// LogWarn writes a warning message
+func (l *Logger) LogWarn(format string, args ...interface{}) {
+	l.logger.Printf("[WARN] "+format, args...)
+}
+
+// LogError writes an error message
+func (l *Logger) LogError(format string, args ...interface{}) {
+	l.logger.Printf("[ERROR] "+format, args...)
+}
+
+// LogFatal writes an error message and then exits the application
+func (l *Logger) LogFatal(format string, args ...interface{}) {
+	l.logger.Fatalf("[FATAL] "+format, args...)
+}
+
+// BatchProcessor structure for managing the batch process
+type BatchProcessor struct {
+	messages     []*eventbus.Message
+	batchMutex   sync.Mutex
+	batchTimer   *time.Timer
+	maxBatchSize int
+	maxWaitTime  time.Duration
+	ctx          context.Context
+}
+
+func NewBatchProcessor(ctx context.Context, maxBatchSize int, maxWaitTime time.Duration) *BatchProcessor {
+	return &BatchProcessor{
+		messages:     make([]*eventbus.Message, 0, maxBatchSize),
+		batchTimer:   time.NewTimer(maxWaitTime),
+		maxBatchSize: maxBatchSize,
+		maxWaitTime:  maxWaitTime,
+		ctx:          ctx,
+	}
+}
+
+func (bp *BatchProcessor) AddMessage(msg *eventbus.Message) {
+	bp.batchMutex.Lock()
+	defer bp.batchMutex.Unlock()
+
+	bp.messages = append(bp.messages, msg)
+
+	if len(bp.messages) >= bp.maxBatchSize {
+		// Process the batch if the size threshold is reached
+		bp.processBatch()
+	}
+}
+
+func (bp *BatchProcessor) StartBatchTimer() {
+	for {
+		select {
+		case <-bp.batchTimer.C:
+			// Process the batch if the time threshold is reached
+			bp.batchMutex.Lock()
+			if len(bp.messages) > 0 {
+				bp.processBatch()
+			}
+			bp.batchMutex.Unlock()
+
+			// Reset the timer for the next batch
+			bp.batchTimer.Reset(bp.maxWaitTime)
+		}
+	}
+}
+
+func (bp *BatchProcessor) processBatch() {
+	if len(bp.messages) == 0 {
+		return
+	}
+
+	logger.LogInfo("Processing %d messages", len(bp.messages))
+
+	startTime := time.Now()
+
+	// Messages to ack
+	var msgsToAck []*eventbus.Message
+
+	// Accumulate the rows to insert
+	var rows []*bigquery.ValuesSaver
+
+	// Extract data from the accumulated messages
+	for _, msg := range bp.messages {
+		var conversionDataPubSub messages.ConversionDataPubSub
+		envelope, err := messages.Decode(msg, &conversionDataPubSub)
+		if err != nil {
+			logger.LogError("Error unmarshalling message: %s", err.Error())
+			msg.Nack()
+			continue
+		}
+
+		logger.LogInfo("Processing conversion %s with uuid %s for brand %s", conversionDataPubSub.Name, conversionDataPubSub.UUID, conversionDataPubSub.Brand)
+
+		datetime := envelope.EventTime.UTC()
+		if envelope.EventTime.IsZero() {
+			datetime = time.Now().UTC()
+		}
+
+		// The conversions are inserted one by one since a redelivered message is skipped by the unique key of the table
+		query := `INSERT INTO conversion (datetime, brand, uuid, lead_uuid, name, offer_id, price, currency, article_url, url, source) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) ON CONFLICT (brand, uuid) DO NOTHING`
+		_, err = db.Exec(query, datetime, conversionDataPubSub.Brand, conversionDataPubSub.UUID, conversionDataPubSub.LeadUUID, conversionDataPubSub.Name, conversionDataPubSub.OfferID, conversionDataPubSub.Price, conversionDataPubSub.Currency, conversionDataPubSub.ArticleUrl, conversionDataPubSub.Url, conversionDataPubSub.Source)
+		if err != nil {
+			logger.LogError("Error inserting into conversion: %v", err)
+			msg.Nack()
+			continue
+		}
+
+		// The price is stored as a NUMERIC, parsed from its decimal representation to keep the cents exact
+		var price *big.Rat
+		if conversionDataPubSub.Price != nil {
+			price, _ = new(big.Rat).SetString(strconv.FormatFloat(*conversionDataPubSub.Price, 'f', -1, 64))
+		}
+
+		// Create a row to be inserted in BigQuery, the conversion UUID makes the redeliveries of a message idempotent
+		row := &bigquery.ValuesSaver{
+			InsertID: conversionDataPubSub.Brand + ":" + conversionDataPubSub.UUID,
+			Schema: bigquery.Schema{
+				{Name: "datetime", Type: bigquery.TimestampFieldType},
+				{Name: "brand", Type: bigquery.StringFieldType},
+				{Name: "uuid", Type: bigquery.StringFieldType},
+				{Name: "lead_uuid", Type: bigquery.StringFieldType},
+				{Name: "name", Type: bigquery.StringFieldType},
+				{Name: "offer_id", Type: bigquery.StringFieldType},
+				{Name: "price", Type: bigquery.NumericFieldType},
+				{Name: "currency", Type: bigquery.StringFieldType},
+				{Name: "article_url", Type: bigquery.StringFieldType},
+				{Name: "url", Type: bigquery.StringFieldType},
+				{Name: "source", Type: bigquery.StringFieldType},
+			},
+			Row: []bigquery.Value{
+				datetime,
+				conversionDataPubSub.Brand,
+				conversionDataPubSub.UUID,
+				conversionDataPubSub.LeadUUID,
+				conversionDataPubSub.Name,
+				conversionDataPubSub.OfferID,
+				price,
+				conversionDataPubSub.Currency,
+				conversionDataPubSub.ArticleUrl,
+				conversionDataPubSub.Url,
+				conversionDataPubSub.Source,
+			},
+		}
+
+		// Add the row to the batch
+		rows = append(rows, row)
+
+		// Add the message to messages to ack queue
+		msgsToAck = append(msgsToAck, msg)
+	}
+
+	// Perform batch insertion into BigQuery
+	inserter := bqClient.Dataset(os.Getenv("ENV") + "_weather").Table("conversion").Inserter()
+
+	if err := inserter.Put(bp.ctx, rows); err != nil {
+		logger.LogError("Failed to insert rows: %v", err)
+	} else {
+		for _, msg := range msgsToAck {
+			msg.Ack() // Acknowledge the message after processing
+		}
+
+		logger.LogInfo("Successfully inserted %d rows in BigQuery.", len(rows))
+	}
+
+	elapsedTime := time.Since(startTime).Milliseconds()
+
+	logger.LogInfo("Successfully processed %d out of %d messages in %dms.", len(msgsToAck), len(bp.messages), elapsedTime)
+
+	// Clear the batch after processing
+	bp.messages = bp.messages[:0]
+}
+
+// Initialize Redis and SQL clients
+func init() {
+	// Init logger
+	logger = &Logger{
+		logger: log.New(os.Stdout, "", log.LstdFlags),
+	}
+
+	var err error
+
+	// Load environment variables from .env file
+	if err = godotenv.Load(); err != nil {
+		logger.LogFatal("[SYSTEM] Error loading .env file")
+	}
+
+	db, err = sql.Open("postgres", os.Getenv("POSTGRES_DSN"))
+	if err != nil {
+		logger.LogFatal("[SYSTEM] Failed to connect to PostgreSQL: %v", err)
+	}
+	logger.LogInfo("[SYSTEM] Connected to PostgreSQL")
+
+	bqClient, err = bigquery.NewClient(ctx, os.Getenv("GCP_PROJECT_ID"), option.WithCredentialsFile(os.Getenv("GCP_CREDENTIALS_FILE")))
+	if err != nil {
+		logger.LogFatal("[SYSTEM] Failed to connect to BigQuery: %v", err)
+	}
+	logger.LogInfo("[SYSTEM] Connected to BigQuery")
+
+	eventBus, err = eventbus.NewEventBus(ctx, os.Getenv("EVENT_BUS"), logger)
+	if err != nil {
+		logger.LogFatal("[SYSTEM] Failed to create event bus: %v", err)
+	}
+	logger.LogInfo("[SYSTEM] Connected to event bus")
+}
+
+func main() {
+	// Create a BatchProcessor
+	batchProcessor := NewBatchProcessor(ctx, 10, 10*time.Second)
+
+	// Start the timer in a separate goroutine
+	go batchProcessor.StartBatchTimer()
+
+	// Receive the messages of the subscription
+	err := eventBus.Receive(ctx, os.Getenv("ENV")+"-conversion", os.Getenv("ENV")+"-conversion", func(ctx context.Context, msg *eventbus.Message) {
+		// Add messages to the batch processor
+		batchProcessor.AddMessage(msg)
+	})
+
+	if err != nil {
+		logger.LogFatal("Failed to receive messages: %v", err)
+	}
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"eventbus"
+	"extract"
+	"messages"
+	"urlnormaliser"
+)
+
+const (
+	// Sitemap indexes nesting deeper than this are not followed
+	maxSitemapDepth = 3
+
+	maxRobotsBytes = 512 << 10
+	maxFeedBytes   = 50 << 20
+	maxPageBytes   = 10 << 20
+)
+
+// CrawlState is what the crawler remembers of a page to make conditional requests
+type CrawlState struct {
+	ETag         string
+	LastModified string
+	FeedModified *time.Time
+}
+
+// CrawlStateStore stores the crawl state of the pages of a brand
+type CrawlStateStore interface {
+	Get(brandName string, pageURL string) (*CrawlState, error)
+	Save(brandName string, pageURL string, state *CrawlState) error
+}
+
+// PostgresCrawlStateStore stores the crawl state in the crawl_state table
+type PostgresCrawlStateStore struct {
+	db *sql.DB
+}
+
+func NewPostgresCrawlStateStore(db *sql.DB) *PostgresCrawlStateStore {
+	return &PostgresCrawlStateStore{db: db}
+}
+
+// Get returns the crawl state of a page, or nil if the page was never crawled
+func (s *PostgresCrawlStateStore) Get(brandName string, pageURL string) (*CrawlState, error) {
+	var state CrawlState
+	err := s.db.QueryRow(`
+		SELECT COALESCE(etag, ''), COALESCE(last_modified, ''), feed_modified
+		FROM crawl_state
+		WHERE brand = $1 AND url = $2
+	`, brandName, pageURL).Scan(&state.ETag, &state.LastModified, &state.FeedModified)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &state, nil
+}
+
+func (s *PostgresCrawlStateStore) Save(brandName string, pageURL string, state *CrawlState) error {
+	_, err := s.db.Exec(`
+		INSERT INTO crawl_state (brand, url, etag, last_modified, feed_modified, crawled_at)
+		VALUES ($1, $2, $3, $4, $5, NOW())
+		ON CONFLICT (brand, url)
+		DO UPDATE SET etag = $3, last_modified = $4, feed_modified = $5, crawled_at = NOW()
+	`, brandName, pageURL, state.ETag, state.LastModified, state.FeedModified)
+	return err
+}
+
+// CrawlBrand is a brand to crawl with its feeds and the maximum number of pages fetched per run
+type CrawlBrand struct {
+	Name        string
+	FeedURLs    []string
+	CrawlBudget int
+	URLRules    urlnormaliser.URLRules
+}
+
+// Crawler fetches the new and modified pages listed by the feeds of the brands and publishes their page data
+type Crawler struct {
+	client         *http.Client
+	userAgent      string
+	userAgentToken string
+	defaultDelay   time.Duration
+	store          CrawlStateStore
+	publisher      eventbus.Publisher
+	topic          string
+
+	robotsByHost map[string]*RobotsRules
+	robotsMutex  sync.Mutex
+
+	lastRequestByHost map[string]time.Time
+	delayMutex        sync.Mutex
+}
+
+// NewCrawler creates a crawler publishing the page data on the topic.
+// The user agent token is the product token matched against the robots.txt groups.
+func NewCrawler(client *http.Client, userAgent string, userAgentToken string, defaultDelay time.Duration, store CrawlStateStore, publisher eventbus.Publisher, topic string) *Crawler {
+	return &Crawler{
+		client:            client,
+		userAgent:         userAgent,
+		userAgentToken:    userAgentToken,
+		defaultDelay:      defaultDelay,
+		store:             store,
+		publisher:         publisher,
+		topic:             topic,
+		robotsByHost:      map[string]*RobotsRules{},
+		lastRequestByHost: map[string]time.Time{},
+	}
+}
+
+// CrawlResult sums up the crawl of a brand
+type CrawlResult struct {
+	Listed      int
+	Fetched     int
+	NotModified int
+	Published   int
+	Disallowed  int
+	Failed      int
+}
+
+// Crawl lists the pages of the feeds of a brand, newest first, and fetches the new and modified ones within the crawl budget
+func (c *Crawler) Crawl(brand CrawlBrand) CrawlResult {
+	var result CrawlResult
+
+	// The page URLs are normalised like the collector does
+	normaliser, err := urlnormaliser.NewURLNormaliser(brand.URLRules)
+	if err != nil {
+		logger.LogError("[CRAWL] Invalid URL rules for brand %s, applying the default rules: %v", brand.Name, err)
+		normaliser, _ = urlnormaliser.NewURLNormaliser(urlnormaliser.URLRules{})
+	}
+
+	entries := c.listEntries(brand)
+	result.Listed = len(entries)
+
+	// The budget goes to the most recent pages first, the undated ones come last
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].LastModified == nil {
+			return false
+		}
+		if entries[j].LastModified == nil {
+			return true
+		}
+		return entries[i].LastModified.After(*entries[j].LastModified)
+	})
+
+	for _, entry := range entries {
+		if result.Fetched >= brand.CrawlBudget {
+			logger.LogInfo("[CRAWL] Crawl budget of %d pages reached for brand %s", brand.CrawlBudget, brand.Name)
+			break
+		}
+
+		state, err := c.store.Get(brand.Name, entry.URL)
+		if err != nil {
+			logger.LogError("[CRAWL] Failed to get crawl state of %s for brand %s: %v", entry.URL, brand.Name, err)
+			result.Failed++
+			continue
+		}
+
+		// The feed tells that the page did not change since the last crawl
+		if state != nil && entry.LastModified != nil && state.FeedModified != nil && !entry.LastModified.After(*state.FeedModified) {
+			continue
+		}
+
+		pageURL, err := url.Parse(entry.URL)
+		if err != nil || (pageURL.Scheme != "http" && pageURL.Scheme != "https") {
+			logger.LogWarn("[CRAWL] Invalid page URL %q for brand %s", entry.URL, brand.Name)
+			result.Failed++
+			continue
+		}
+
+		if !c.robots(pageURL).Allowed(pageURL.EscapedPath()) {
+			result.Disallowed++
+			continue
+		}
+
+		result.Fetched++
+		published, modified, err := c.crawlPage(brand.Name, normaliser, pageURL, entry, state)
+		if err != nil {
+			logger.LogError("[CRAWL] Failed to crawl %s for brand %s: %v", entry.URL, brand.Name, err)
+			result.Failed++
+			continue
+		}
+
+		if !modified {
+			result.NotModified++
+		}
+		if published {
+			result.Published++
+		}
+	}
+
+	return result
+}
+
+// listEntries lists the pages of the feeds of a brand, following the sitemap indexes
+func (c *Crawler) listEntries(brand CrawlBrand) []FeedEntry {
+	var entries []FeedEntry
+	seen := map[string]bool{}
+
+	var list func(feedURL string, depth int)
+	list = func(feedURL string, depth int) {
+		if seen[feedURL] {
+			return
+		}
+		seen[feedURL] = true
+
+		feed, err := c.fetchFeed(feedURL)
+		if err != nil {
+			logger.LogError("[CRAWL] Failed to fetch feed %s for brand %s: %v", feedURL, brand.Name, err)
+			return
+		}
+
+		for _, entry := range feed.Entries {
+			if !seen[entry.URL] {
+				seen[entry.URL] = true
+				entries = append(entries, entry)
+			}
+		}
+
+		if depth >= maxSitemapDepth {
+			return
+		}
+
+		for _, sitemap := range feed.Sitemaps {
+			list(sitemap.URL, depth+1)
+		}
+	}
+
+	for _, feedURL := range brand.FeedURLs {
+		list(feedURL, 0)
+	}
+
+	return entries
+}
+
+// fetchFeed retrieves and parses a sitemap or a feed
+func (c *Crawler) fetchFeed(feedURL string) (*Feed, error) {
+	parsedURL, err := url.Parse(feedURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if !c.robots(parsedURL).Allowed(parsedURL.EscapedPath()) {
+		return nil, fmt.Errorf("Disallowed by robots.txt")
+	}
+
+	resp, err := c.get(parsedURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected status %d", resp.StatusCode)
+	}
+
+	return ParseFeed(io.LimitReader(resp.Body, maxFeedBytes))
+}
+
+// crawlPage fetches a page with a conditional request and publishes its page data when it is an article.
+// It returns whether the page data was published and whether the page was modified.
+func (c *Crawler) crawlPage(brandName string, normaliser *urlnormaliser.URLNormaliser, pageURL *url.URL, entry FeedEntry, state *CrawlState) (bool, bool, error) {
+	resp, err := c.get(pageURL, state)
+	if err != nil {
+		return false, false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && state != nil {
+		state.FeedModified = entry.LastModified
+		return false, false, c.store.Save(brandName, entry.URL, state)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return false, true, fmt.Errorf("Unexpected status %d", resp.StatusCode)
+	}
+
+	// Redirects are followed, the page is extracted from its final URL
+	extracted, err := extract.ExtractPageData(resp.Request.URL.String(), io.LimitReader(resp.Body, maxPageBytes))
+	if err != nil {
+		return false, true, err
+	}
+
+	pageData := newPageData(extracted)
+
+	pageData.URL = normaliser.Normalise(pageData.URL)
+
+	published := false
+	if pageData.Type == "article" {
+		if err := c.publish(brandName, pageData); err != nil {
+			return false, true, err
+		}
+		published = true
+	} else {
+		logger.LogInfo("[CRAWL] Skipping %s page %s for brand %s", pageData.Type, entry.URL, brandName)
+	}
+
+	newState := &CrawlState{
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		FeedModified: entry.LastModified,
+	}
+
+	return published, true, c.store.Save(brandName, entry.URL, newState)
+}
+
+// get sends a GET request, conditional when the page was already crawled, waiting for the crawl delay of the host
+func (c *Crawler) get(pageURL *url.URL, state *CrawlState) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pageURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", c.userAgent)
+
+	if state != nil {
+		if state.ETag != "" {
+			req.Header.Set("If-None-Match", state.ETag)
+		}
+		if state.LastModified != "" {
+			req.Header.Set("If-Modified-Since", state.LastModified)
+		}
+	}
+
+	c.waitCrawlDelay(pageURL)
+
+	return c.client.Do(req)
+}
+
+// waitCrawlDelay spaces the requests to a host by its robots.txt crawl delay, or by the default delay
+func (c *Crawler) waitCrawlDelay(pageURL *url.URL) {
+	delay := c.defaultDelay
+	if rules := c.robots(pageURL); rules.CrawlDelay > delay {
+		delay = rules.CrawlDelay
+	}
+
+	c.delayMutex.Lock()
+	next := c.lastRequestByHost[pageURL.Host].Add(delay)
+	now := time.Now()
+	if next.Before(now) {
+		next = now
+	}
+	c.lastRequestByHost[pageURL.Host] = next
+	c.delayMutex.Unlock()
+
+	time.Sleep(time.Until(next))
+}
+
+// publish publishes the page data of a page on the page topic, like the collector does
+func (c *Crawler) publish(brandName string, pageData PageData) error {
+	var modificationDate *time.Time
+
+	if pageData.ModificationDate != nil {
+		time := pageData.ModificationDate.Time()
+		modificationDate = &time
+	}
+
+	pageDataPubSub := messages.PageDataPubSub{
+		DateTime:         time.Now().UTC(),
+		Brand:            brandName,
+		URL:              pageData.URL,
+		Type:             pageData.Type,
+		Language:         pageData.Language,
+		PublicationDate:  pageData.PublicationDate.Time(),
+		ModificationDate: modificationDate,
+		Title:            pageData.Title,
+		Description:      pageData.Description,
+		Content:          pageData.Content,
+		Section:          pageData.Section,
+		SubSection:       pageData.SubSection,
+		Image:            pageData.Image,
+		IsPaid:           pageData.IsPaid,
+		Author:           pageData.Author,
+		Keywords:         pageData.Keywords,
+		WordCount:        pageData.WordCount,
+	}
+
+	msg, err := messages.NewEnvelopeMessage(messages.Envelope{
+		Type:      messages.TypePage,
+		Brand:     brandName,
+		EventTime: pageDataPubSub.DateTime,
+	}, pageDataPubSub)
+	if err != nil {
+		return err
+	}
+
+	result := c.publisher.Publish(ctx, c.topic, msg)
+
+	if _, err := result.Get(ctx); err != nil {
+		return err
+	}
+
+	logger.LogInfo("[CRAWL] Published page data of %s for brand %s", pageData.URL, brandName)
+
+	return nil
+}
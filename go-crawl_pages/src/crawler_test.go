@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"eventbus"
+	"messages"
+)
+
+func TestMain(m *testing.M) {
+	logger = &Logger{
+		logger: log.New(io.Discard, "", 0),
+	}
+
+	os.Exit(m.Run())
+}
+
+// memoryCrawlStateStore keeps the crawl state in memory
+type memoryCrawlStateStore struct {
+	mutex  sync.Mutex
+	states map[string]*CrawlState
+}
+
+func newMemoryCrawlStateStore() *memoryCrawlStateStore {
+	return &memoryCrawlStateStore{states: map[string]*CrawlState{}}
+}
+
+func (s *memoryCrawlStateStore) Get(brandName string, pageURL string) (*CrawlState, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if state, ok := s.states[brandName+" "+pageURL]; ok {
+		copied := *state
+		return &copied, nil
+	}
+
+	return nil, nil
+}
+
+func (s *memoryCrawlStateStore) Save(brandName string, pageURL string, state *CrawlState) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	copied := *state
+	s.states[brandName+" "+pageURL] = &copied
+
+	return nil
+}
+
+// Last modification time of the fixture articles, article 1 being the oldest
+var testArticleModified = map[string]time.Time{
+	"/articles/1": time.Date(2024, 9, 1, 8, 0, 0, 0, time.UTC),
+	"/articles/2": time.Date(2024, 9, 2, 8, 0, 0, 0, time.UTC),
+	"/articles/3": time.Date(2024, 9, 3, 8, 0, 0, 0, time.UTC),
+}
+
+// testSite serves a robots.txt, a sitemap, an RSS feed and articles, and counts the requests of each path
+type testSite struct {
+	*httptest.Server
+	mutex    sync.Mutex
+	requests map[string]int
+}
+
+func newTestSite(t *testing.T) *testSite {
+	t.Helper()
+
+	site := &testSite{requests: map[string]int{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/robots.txt", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "User-agent: *\nDisallow: /private/\n")
+	})
+	mux.HandleFunc("/sitemap.xml", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <url><loc>%[1]s/articles/1</loc><lastmod>2024-09-01T08:00:00Z</lastmod></url>
+  <url><loc>%[1]s/private/1</loc><lastmod>2024-09-04T08:00:00Z</lastmod></url>
+</urlset>`, site.URL)
+	})
+	mux.HandleFunc("/feed.xml", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<rss version="2.0">
+  <channel>
+    <item><link>%[1]s/articles/2</link><pubDate>Mon, 02 Sep 2024 08:00:00 GMT</pubDate></item>
+    <item><link>%[1]s/articles/3</link><pubDate>Tue, 03 Sep 2024 08:00:00 GMT</pubDate></item>
+  </channel>
+</rss>`, site.URL)
+	})
+	mux.HandleFunc("/articles/", func(w http.ResponseWriter, r *http.Request) {
+		modified, ok := testArticleModified[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		etag := `"` + strings.TrimPrefix(r.URL.Path, "/articles/") + `"`
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Last-Modified", modified.Format(http.TimeFormat))
+
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !modified.After(since) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		fmt.Fprintf(w, `<!DOCTYPE html>
+<html>
+<head>
+  <meta property="og:type" content="article">
+  <meta property="og:title" content="Article %[1]s">
+  <meta property="og:locale" content="fr_FR">
+  <meta property="og:article:published_time" content="%[2]s">
+</head>
+<body><article><p>Contenu de l'article %[1]s.</p></article></body>
+</html>`, strings.TrimPrefix(r.URL.Path, "/articles/"), modified.Format(time.RFC3339))
+	})
+
+	site.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		site.mutex.Lock()
+		site.requests[r.URL.Path]++
+		site.mutex.Unlock()
+
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(site.Close)
+
+	return site
+}
+
+func (s *testSite) requested(path string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.requests[path]
+}
+
+// newTestCrawler creates a crawler publishing on an in-memory bus and returns the channel of the published page data
+func newTestCrawler(t *testing.T, site *testSite, store CrawlStateStore) (*Crawler, <-chan messages.PageDataPubSub) {
+	t.Helper()
+
+	bus := eventbus.NewChannelEventBus(10)
+
+	receiveCtx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	published := make(chan messages.PageDataPubSub, 10)
+	go bus.Receive(receiveCtx, "test-page", "test-page", func(ctx context.Context, msg *eventbus.Message) {
+		var pageDataPubSub messages.PageDataPubSub
+		if _, err := messages.Decode(msg, &pageDataPubSub); err != nil {
+			t.Errorf("messages.Decode() error = %v", err)
+		}
+		msg.Ack()
+		published <- pageDataPubSub
+	})
+
+	return NewCrawler(site.Client(), crawlerUserAgent, crawlerUserAgentToken, 0, store, bus, "test-page"), published
+}
+
+func newTestBrand(site *testSite, crawlBudget int) CrawlBrand {
+	return CrawlBrand{
+		Name:        "test",
+		FeedURLs:    []string{site.URL + "/sitemap.xml", site.URL + "/feed.xml"},
+		CrawlBudget: crawlBudget,
+	}
+}
+
+// publishedPaths waits for a number of published page data and returns their sorted paths
+func publishedPaths(t *testing.T, published <-chan messages.PageDataPubSub, count int) []string {
+	t.Helper()
+
+	var paths []string
+	for i := 0; i < count; i++ {
+		select {
+		case pageDataPubSub := <-published:
+			if pageDataPubSub.Brand != "test" || pageDataPubSub.Type != "article" {
+				t.Errorf("published %s page of brand %s, want an article of brand test", pageDataPubSub.Type, pageDataPubSub.Brand)
+			}
+
+			pageURL, err := url.Parse(pageDataPubSub.URL)
+			if err != nil {
+				t.Fatalf("url.Parse(%s) error = %v", pageDataPubSub.URL, err)
+			}
+			paths = append(paths, pageURL.Path)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%d page data published, want %d", i, count)
+		}
+	}
+
+	select {
+	case pageDataPubSub := <-published:
+		t.Errorf("unexpected page data published for %s", pageDataPubSub.URL)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	sort.Strings(paths)
+
+	return paths
+}
+
+func TestCrawlPublishesArticles(t *testing.T) {
+	site := newTestSite(t)
+	crawler, published := newTestCrawler(t, site, newMemoryCrawlStateStore())
+
+	result := crawler.Crawl(newTestBrand(site, 10))
+
+	want := CrawlResult{Listed: 4, Fetched: 3, Published: 3, Disallowed: 1}
+	if result != want {
+		t.Errorf("Crawl() = %+v, want %+v", result, want)
+	}
+
+	if paths := publishedPaths(t, published, 3); strings.Join(paths, " ") != "/articles/1 /articles/2 /articles/3" {
+		t.Errorf("published %v, want the three articles", paths)
+	}
+
+	if count := site.requested("/private/1"); count != 0 {
+		t.Errorf("disallowed page requested %d times, want 0", count)
+	}
+	if count := site.requested("/robots.txt"); count != 1 {
+		t.Errorf("robots.txt requested %d times, want 1", count)
+	}
+}
+
+func TestCrawlNotModified(t *testing.T) {
+	site := newTestSite(t)
+	store := newMemoryCrawlStateStore()
+
+	// Article 1 was crawled with its ETag and article 2 with its modification date, article 3 changed since
+	store.Save("test", site.URL+"/articles/1", &CrawlState{ETag: `"1"`})
+	store.Save("test", site.URL+"/articles/2", &CrawlState{LastModified: testArticleModified["/articles/2"].Format(http.TimeFormat)})
+	store.Save("test", site.URL+"/articles/3", &CrawlState{LastModified: testArticleModified["/articles/2"].Format(http.TimeFormat)})
+
+	crawler, published := newTestCrawler(t, site, store)
+
+	result := crawler.Crawl(newTestBrand(site, 10))
+
+	want := CrawlResult{Listed: 4, Fetched: 3, NotModified: 2, Published: 1, Disallowed: 1}
+	if result != want {
+		t.Errorf("Crawl() = %+v, want %+v", result, want)
+	}
+
+	if paths := publishedPaths(t, published, 1); strings.Join(paths, " ") != "/articles/3" {
+		t.Errorf("published %v, want the modified article only", paths)
+	}
+
+	// The feed date is remembered so that the unchanged pages are not requested again
+	state, _ := store.Get("test", site.URL+"/articles/1")
+	if state.FeedModified == nil || !state.FeedModified.Equal(testArticleModified["/articles/1"]) {
+		t.Errorf("feed modification date = %v, want %v", state.FeedModified, testArticleModified["/articles/1"])
+	}
+
+	crawler.Crawl(newTestBrand(site, 10))
+	if count := site.requested("/articles/1"); count != 1 {
+		t.Errorf("unchanged article requested %d times, want 1", count)
+	}
+}
+
+func TestCrawlBudget(t *testing.T) {
+	site := newTestSite(t)
+	crawler, published := newTestCrawler(t, site, newMemoryCrawlStateStore())
+
+	result := crawler.Crawl(newTestBrand(site, 2))
+
+	want := CrawlResult{Listed: 4, Fetched: 2, Published: 2, Disallowed: 1}
+	if result != want {
+		t.Errorf("Crawl() = %+v, want %+v", result, want)
+	}
+
+	// The budget goes to the most recent allowed articles, the disallowed page not counting
+	if paths := publishedPaths(t, published, 2); strings.Join(paths, " ") != "/articles/2 /articles/3" {
+		t.Errorf("published %v, want the two most recent articles", paths)
+	}
+	if count := site.requested("/articles/1"); count != 0 {
+		t.Errorf("article beyond the budget requested %d times, want 0", count)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html/charset"
+)
+
+// Layouts of the dates found in the sitemaps and the RSS and Atom feeds
+var feedDateLayouts = []string{
+	time.RFC3339,
+	time.RFC1123Z,
+	time.RFC1123,
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02",
+}
+
+// FeedEntry is a page listed by a sitemap or a feed, with its last modification date when the feed provides it
+type FeedEntry struct {
+	URL          string
+	LastModified *time.Time
+}
+
+// Feed is the content of a sitemap, a sitemap index, an RSS feed or an Atom feed.
+// Sitemaps lists the nested sitemaps of a sitemap index.
+type Feed struct {
+	Entries  []FeedEntry
+	Sitemaps []FeedEntry
+}
+
+type sitemapURLSet struct {
+	URLs []struct {
+		Loc     string `xml:"loc"`
+		LastMod string `xml:"lastmod"`
+		News    struct {
+			PublicationDate string `xml:"publication_date"`
+		} `xml:"news"`
+	} `xml:"url"`
+}
+
+type sitemapIndex struct {
+	Sitemaps []struct {
+		Loc     string `xml:"loc"`
+		LastMod string `xml:"lastmod"`
+	} `xml:"sitemap"`
+}
+
+type rssFeed struct {
+	Items []struct {
+		Link    string `xml:"link"`
+		GUID    string `xml:"guid"`
+		PubDate string `xml:"pubDate"`
+		Updated string `xml:"http://purl.org/dc/elements/1.1/ date"`
+	} `xml:"channel>item"`
+}
+
+type atomFeed struct {
+	Entries []struct {
+		Links []struct {
+			Href string `xml:"href,attr"`
+			Rel  string `xml:"rel,attr"`
+		} `xml:"link"`
+		Updated   string `xml:"updated"`
+		Published string `xml:"published"`
+	} `xml:"entry"`
+}
+
+// ParseFeed parses a sitemap, a sitemap index, an RSS feed or an Atom feed from its root element
+func ParseFeed(body io.Reader) (*Feed, error) {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := feedRootElement(data)
+	if err != nil {
+		return nil, err
+	}
+
+	feed := &Feed{}
+
+	switch root {
+	case "urlset":
+		var urlSet sitemapURLSet
+		if err := newFeedDecoder(data).Decode(&urlSet); err != nil {
+			return nil, err
+		}
+		for _, u := range urlSet.URLs {
+			feed.addEntry(u.Loc, u.LastMod, u.News.PublicationDate)
+		}
+	case "sitemapindex":
+		var index sitemapIndex
+		if err := newFeedDecoder(data).Decode(&index); err != nil {
+			return nil, err
+		}
+		for _, s := range index.Sitemaps {
+			if loc := strings.TrimSpace(s.Loc); loc != "" {
+				feed.Sitemaps = append(feed.Sitemaps, FeedEntry{URL: loc, LastModified: parseFeedDate(s.LastMod)})
+			}
+		}
+	case "rss":
+		var rss rssFeed
+		if err := newFeedDecoder(data).Decode(&rss); err != nil {
+			return nil, err
+		}
+		for _, item := range rss.Items {
+			link := item.Link
+			if strings.TrimSpace(link) == "" && strings.HasPrefix(strings.TrimSpace(item.GUID), "http") {
+				link = item.GUID
+			}
+			feed.addEntry(link, item.Updated, item.PubDate)
+		}
+	case "feed":
+		var atom atomFeed
+		if err := newFeedDecoder(data).Decode(&atom); err != nil {
+			return nil, err
+		}
+		for _, entry := range atom.Entries {
+			for _, link := range entry.Links {
+				if link.Rel == "" || link.Rel == "alternate" {
+					feed.addEntry(link.Href, entry.Updated, entry.Published)
+					break
+				}
+			}
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported feed format <%s>", root)
+	}
+
+	return feed, nil
+}
+
+// addEntry adds a page to the feed, dated with the first date available
+func (f *Feed) addEntry(loc string, dates ...string) {
+	loc = strings.TrimSpace(loc)
+	if loc == "" {
+		return
+	}
+
+	entry := FeedEntry{URL: loc}
+	for _, date := range dates {
+		if lastModified := parseFeedDate(date); lastModified != nil {
+			entry.LastModified = lastModified
+			break
+		}
+	}
+
+	f.Entries = append(f.Entries, entry)
+}
+
+// feedRootElement returns the local name of the root element of an XML document
+func feedRootElement(data []byte) (string, error) {
+	decoder := newFeedDecoder(data)
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return "", fmt.Errorf("Invalid feed: %v", err)
+		}
+
+		if start, ok := token.(xml.StartElement); ok {
+			return start.Name.Local, nil
+		}
+	}
+}
+
+// newFeedDecoder returns an XML decoder supporting the encodings declared by the feeds
+func newFeedDecoder(data []byte) *xml.Decoder {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	decoder.CharsetReader = charset.NewReaderLabel
+	return decoder
+}
+
+func parseFeedDate(value string) *time.Time {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil
+	}
+
+	for _, layout := range feedDateLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			t = t.UTC()
+			return &t
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/joho/godotenv"
+	"github.com/lib/pq"
+	"golang.org/x/net/context"
+
+	"eventbus"
+	"extract"
+)
+
+// User agent of the crawler, the product token is matched against the robots.txt groups
+const (
+	crawlerUserAgentToken = "WeatherCrawler"
+	crawlerUserAgent      = crawlerUserAgentToken + "/1.0"
+)
+
+var (
+	ctx      = context.Background()
+	logger   *Logger
+	db       *sql.DB
+	eventBus eventbus.EventBus
+)
+
+// Logger struct to encapsulate the standard logger
+type Logger struct {
+	logger *log.Logger
+}
+
+// LogInfo writes an informational message
+func (l *Logger) LogInfo(format string, args ...interface{}) {
+	l.logger.Printf("[INFO] "+format, args...)
+}
+
+// LogWarn writes a warning message
+func (l *Logger) LogWarn(format string, args ...interface{}) {
+	l.logger.Printf("[WARN] "+format, args...)
+}
+
+// LogError writes an error message
+func (l *Logger) LogError(format string, args ...interface{}) {
+	l.logger.Printf("[ERROR] "+format, args...)
+}
+
+// LogFatal writes an error message and then exits the application
+func (l *Logger) LogFatal(format string, args ...interface{}) {
+	l.logger.Fatalf("[FATAL] "+format, args...)
+}
+
+// Structs for storing page data
+type PageData struct {
+	URL              string               `json:"url"`
+	Type             string               `json:"type"`
+	Language         string               `json:"language"`
+	PublicationDate  PublicationDateTime  `json:"publicationDate"`
+	ModificationDate *PublicationDateTime `json:"modificationDate"`
+	Title            string               `json:"title"`
+	Description      string               `json:"description"`
+	Content          string               `json:"content"`
+	Section          string               `json:"section"`
+	SubSection       *string              `json:"subSection"`
+	Image            *string              `json:"image"`
+	IsPaid           bool                 `json:"isPaid"`
+	Author           *string              `json:"author"`
+	Keywords         []string             `json:"keywords"`
+	WordCount        int                  `json:"wordCount"`
+}
+
+type PublicationDateTime time.Time
+
+func (ct PublicationDateTime) Time() time.Time {
+	return time.Time(ct)
+}
+
+// newPageData converts the page data extracted from an HTML page
+func newPageData(extracted extract.PageData) PageData {
+	pageData := PageData{
+		URL:             extracted.URL,
+		Type:            extracted.Type,
+		Language:        extracted.Language,
+		PublicationDate: PublicationDateTime(extracted.PublicationDate),
+		Title:           extracted.Title,
+		Description:     extracted.Description,
+		Content:         extracted.Content,
+		Section:         extracted.Section,
+		SubSection:      extracted.SubSection,
+		Image:           extracted.Image,
+		IsPaid:          extracted.IsPaid,
+		Author:          extracted.Author,
+		Keywords:        extracted.Keywords,
+		WordCount:       extracted.WordCount,
+	}
+
+	if extracted.ModificationDate != nil {
+		modificationDate := PublicationDateTime(*extracted.ModificationDate)
+		pageData.ModificationDate = &modificationDate
+	}
+
+	return pageData
+}
+
+// Initialize SQL client and event bus
+func setup() {
+	// Init logger
+	logger = &Logger{
+		logger: log.New(os.Stdout, "", log.LstdFlags),
+	}
+
+	var err error
+
+	// Load environment variables from .env file
+	if err = godotenv.Load(); err != nil {
+		logger.LogFatal("[SYSTEM] Error loading .env file")
+	}
+
+	db, err = sql.Open("postgres", os.Getenv("POSTGRES_DSN"))
+	if err != nil {
+		logger.LogFatal("[SYSTEM] Failed to connect to PostgreSQL: %v", err)
+	}
+	logger.LogInfo("[SYSTEM] Connected to PostgreSQL")
+
+	eventBus, err = eventbus.NewEventBus(ctx, os.Getenv("EVENT_BUS"), logger)
+	if err != nil {
+		logger.LogFatal("[SYSTEM] Failed to create event bus: %v", err)
+	}
+	logger.LogInfo("[SYSTEM] Connected to event bus")
+}
+
+func main() {
+	setup()
+	defer eventBus.Close()
+
+	defaultCrawlBudget, err := strconv.Atoi(os.Getenv("CRAWL_BUDGET"))
+	if err != nil || defaultCrawlBudget < 1 {
+		defaultCrawlBudget = 100
+	}
+
+	crawlDelay, err := time.ParseDuration(os.Getenv("CRAWL_DELAY"))
+	if err != nil || crawlDelay < 0 {
+		crawlDelay = 1 * time.Second
+	}
+
+	crawler := NewCrawler(
+		&http.Client{Timeout: 30 * time.Second},
+		crawlerUserAgent,
+		crawlerUserAgentToken,
+		crawlDelay,
+		NewPostgresCrawlStateStore(db),
+		eventBus,
+		os.Getenv("ENV")+"-page",
+	)
+
+	// Query to get the brands with sitemaps or feeds to crawl
+	brandsQuery := "SELECT name, feed_urls, COALESCE(crawl_budget, 0), COALESCE(url_rules, '{}') FROM brand WHERE cardinality(feed_urls) > 0"
+	brandsRows, err := db.Query(brandsQuery)
+	if err != nil {
+		logger.LogError("Failed to retrieve brands: %v", err)
+		return
+	}
+	defer brandsRows.Close()
+
+	var wg sync.WaitGroup
+
+	// Iterate over each brand
+	for brandsRows.Next() {
+		var brand CrawlBrand
+		var feedURLs []string
+		var urlRules []byte
+		if err := brandsRows.Scan(&brand.Name, pq.Array(&feedURLs), &brand.CrawlBudget, &urlRules); err != nil {
+			logger.LogError("Failed to scan brand: %v", err)
+			return
+		}
+
+		if err := json.Unmarshal(urlRules, &brand.URLRules); err != nil {
+			logger.LogError("Failed to parse URL rules of brand %s: %v", brand.Name, err)
+			continue
+		}
+
+		for _, feedURL := range feedURLs {
+			if feedURL = strings.TrimSpace(feedURL); feedURL != "" {
+				brand.FeedURLs = append(brand.FeedURLs, feedURL)
+			}
+		}
+
+		if brand.CrawlBudget < 1 {
+			brand.CrawlBudget = defaultCrawlBudget
+		}
+
+		wg.Add(1) // Add to the WaitGroup for each brand
+
+		// Launch a goroutine for each brand
+		go func(brand CrawlBrand) {
+			defer wg.Done() // Mark the goroutine as done when finished
+
+			result := crawler.Crawl(brand)
+
+			logger.LogInfo("Pages crawled for brand %s: %d listed, %d fetched, %d not modified, %d published, %d disallowed, %d failed",
+				brand.Name, result.Listed, result.Fetched, result.NotModified, result.Published, result.Disallowed, result.Failed)
+		}(brand) // Pass the brand as an argument to the goroutine
+	}
+
+	// Wait for all goroutines to complete
+	wg.Wait()
+
+	logger.LogInfo("Pages crawled successfully.")
+}
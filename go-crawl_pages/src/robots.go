@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// robotsRule is an allow or disallow path pattern of robots.txt
+type robotsRule struct {
+	pattern    string
+	expression *regexp.Regexp
+}
+
+// RobotsRules are the rules of a robots.txt group applying to the crawler
+type RobotsRules struct {
+	allow      []robotsRule
+	disallow   []robotsRule
+	CrawlDelay time.Duration
+}
+
+// Rules applied when robots.txt does not exist, everything is allowed
+var robotsAllowAll = &RobotsRules{}
+
+// Rules applied when robots.txt is unreachable, nothing is allowed until it can be read
+var robotsDisallowAll = &RobotsRules{disallow: []robotsRule{newRobotsRule("/")}}
+
+// Allowed checks a path against the rules, the longest matching rule wins and allow wins ties
+func (r *RobotsRules) Allowed(path string) bool {
+	if path == "" {
+		path = "/"
+	}
+
+	longestAllow := longestMatch(r.allow, path)
+	longestDisallow := longestMatch(r.disallow, path)
+
+	return longestDisallow < 0 || longestAllow >= longestDisallow
+}
+
+func longestMatch(rules []robotsRule, path string) int {
+	longest := -1
+	for _, rule := range rules {
+		if rule.expression.MatchString(path) && len(rule.pattern) > longest {
+			longest = len(rule.pattern)
+		}
+	}
+	return longest
+}
+
+// newRobotsRule compiles a robots.txt path pattern, supporting the * wildcard and the $ end anchor
+func newRobotsRule(pattern string) robotsRule {
+	original := pattern
+	anchored := strings.HasSuffix(pattern, "$")
+	pattern = strings.TrimSuffix(pattern, "$")
+
+	parts := strings.Split(pattern, "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+
+	expression := "^" + strings.Join(parts, ".*")
+	if anchored {
+		expression += "$"
+	}
+
+	return robotsRule{pattern: original, expression: regexp.MustCompile(expression)}
+}
+
+// ParseRobots parses a robots.txt and returns the rules of the group matching the user agent token,
+// or the rules of the * group if no group matches
+func ParseRobots(body io.Reader, userAgentToken string) *RobotsRules {
+	userAgentToken = strings.ToLower(userAgentToken)
+
+	var matched, wildcard *RobotsRules
+	var current []*RobotsRules
+	inUserAgents := false
+
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		key, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		if key == "user-agent" {
+			// Consecutive user-agent lines share the same group
+			if !inUserAgents {
+				current = nil
+			}
+			inUserAgents = true
+
+			agent := strings.ToLower(value)
+			switch {
+			case agent == "*":
+				if wildcard == nil {
+					wildcard = &RobotsRules{}
+				}
+				current = append(current, wildcard)
+			case userAgentToken != "" && strings.Contains(userAgentToken, agent):
+				if matched == nil {
+					matched = &RobotsRules{}
+				}
+				current = append(current, matched)
+			}
+			continue
+		}
+		inUserAgents = false
+
+		for _, rules := range current {
+			switch key {
+			case "allow":
+				if value != "" {
+					rules.allow = append(rules.allow, newRobotsRule(value))
+				}
+			case "disallow":
+				// An empty disallow allows everything
+				if value != "" {
+					rules.disallow = append(rules.disallow, newRobotsRule(value))
+				}
+			case "crawl-delay":
+				if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds > 0 {
+					rules.CrawlDelay = time.Duration(seconds * float64(time.Second))
+				}
+			}
+		}
+	}
+
+	if matched != nil {
+		return matched
+	}
+	if wildcard != nil {
+		return wildcard
+	}
+	return robotsAllowAll
+}
+
+// fetchRobots retrieves the robots.txt rules of the host of a URL
+func (c *Crawler) fetchRobots(pageURL *url.URL) *RobotsRules {
+	robotsURL := url.URL{Scheme: pageURL.Scheme, Host: pageURL.Host, Path: "/robots.txt"}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, robotsURL.String(), nil)
+	if err != nil {
+		return robotsDisallowAll
+	}
+	req.Header.Set("User-Agent", c.userAgent)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		logger.LogWarn("[ROBOTS] Unable to fetch %s: %v", robotsURL.String(), err)
+		return robotsDisallowAll
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return ParseRobots(io.LimitReader(resp.Body, maxRobotsBytes), c.userAgentToken)
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		return robotsAllowAll
+	default:
+		logger.LogWarn("[ROBOTS] Unexpected status %d for %s", resp.StatusCode, robotsURL.String())
+		return robotsDisallowAll
+	}
+}
+
+// robots returns the robots.txt rules of the host of a URL, fetched once per host
+func (c *Crawler) robots(pageURL *url.URL) *RobotsRules {
+	c.robotsMutex.Lock()
+	defer c.robotsMutex.Unlock()
+
+	if rules, ok := c.robotsByHost[pageURL.Host]; ok {
+		return rules
+	}
+
+	rules := c.fetchRobots(pageURL)
+	c.robotsByHost[pageURL.Host] = rules
+
+	return rules
+}
@@ -0,0 +1,437 @@
+// Package eventbus publishes and receives the messages exchanged by the services,
+// on Google Pub/Sub, Redis Streams or in-process channels.
+package eventbus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/go-redis/redis/v8"
+	"google.golang.org/api/option"
+)
+
+// Event bus backends, selected with the EVENT_BUS environment variable
+const (
+	BackendPubSub  = "pubsub"
+	BackendRedis   = "redis"
+	BackendChannel = "channel"
+)
+
+// Logger reports the errors that cannot be returned to the caller, such as failed acknowledgements
+type Logger interface {
+	LogError(format string, args ...interface{})
+}
+
+// Message is a message published on or received from the event bus
+type Message struct {
+	ID         string
+	Data       []byte
+	Attributes map[string]string
+	ack        func()
+	nack       func()
+}
+
+// Ack acknowledges the message so that it is not delivered again
+func (m *Message) Ack() {
+	if m.ack != nil {
+		m.ack()
+	}
+}
+
+// Nack signals that the message could not be processed and must be delivered again
+func (m *Message) Nack() {
+	if m.nack != nil {
+		m.nack()
+	}
+}
+
+// PublishResult holds the result of an asynchronous publish
+type PublishResult interface {
+	// Get blocks until the message is published and returns its server-assigned ID
+	Get(ctx context.Context) (string, error)
+}
+
+// Publisher publishes messages on a topic
+type Publisher interface {
+	Publish(ctx context.Context, topic string, msg *Message) PublishResult
+	Close() error
+}
+
+// Subscriber delivers the messages of a subscription to a callback until the context is done.
+// The topic is required by the backends whose subscriptions are not bound to a topic.
+type Subscriber interface {
+	Receive(ctx context.Context, topic string, subscription string, f func(context.Context, *Message)) error
+	Close() error
+}
+
+// EventBus is both a Publisher and a Subscriber
+type EventBus interface {
+	Publisher
+	Subscriber
+}
+
+// NewEventBus creates the event bus of the given backend, defaulting to Google Pub/Sub
+func NewEventBus(ctx context.Context, backend string, logger Logger) (EventBus, error) {
+	switch backend {
+	case "", BackendPubSub:
+		client, err := pubsub.NewClient(ctx, os.Getenv("GCP_PROJECT_ID"), option.WithCredentialsFile(os.Getenv("GCP_CREDENTIALS_FILE")))
+		if err != nil {
+			return nil, err
+		}
+		return NewPubSubEventBus(client), nil
+	case BackendRedis:
+		addr := os.Getenv("EVENT_BUS_REDIS_ADDR")
+		if addr == "" {
+			addr = os.Getenv("REDIS_ADDR")
+		}
+
+		client := redis.NewClient(&redis.Options{
+			Addr: addr,
+		})
+		if _, err := client.Ping(ctx).Result(); err != nil {
+			return nil, err
+		}
+
+		maxLen, _ := strconv.ParseInt(os.Getenv("EVENT_BUS_REDIS_MAX_LEN"), 10, 64)
+		return NewRedisEventBus(client, maxLen, logger), nil
+	case BackendChannel:
+		return NewChannelEventBus(1000), nil
+	}
+
+	return nil, fmt.Errorf("Unknown event bus backend: %s", backend)
+}
+
+// PubSubEventBus is the Google Pub/Sub event bus
+type PubSubEventBus struct {
+	client     *pubsub.Client
+	topics     map[string]*pubsub.Topic
+	topicMutex sync.Mutex
+}
+
+func NewPubSubEventBus(client *pubsub.Client) *PubSubEventBus {
+	return &PubSubEventBus{
+		client: client,
+		topics: make(map[string]*pubsub.Topic),
+	}
+}
+
+// topic returns the topic handle, reusing it so that Pub/Sub can bundle the messages
+func (b *PubSubEventBus) topic(id string) *pubsub.Topic {
+	b.topicMutex.Lock()
+	defer b.topicMutex.Unlock()
+
+	topic, ok := b.topics[id]
+	if !ok {
+		topic = b.client.Topic(id)
+		b.topics[id] = topic
+	}
+
+	return topic
+}
+
+func (b *PubSubEventBus) Publish(ctx context.Context, topic string, msg *Message) PublishResult {
+	return b.topic(topic).Publish(ctx, &pubsub.Message{
+		Data:       msg.Data,
+		Attributes: msg.Attributes,
+	})
+}
+
+func (b *PubSubEventBus) Receive(ctx context.Context, topic string, subscription string, f func(context.Context, *Message)) error {
+	return b.client.Subscription(subscription).Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
+		f(ctx, &Message{
+			ID:         msg.ID,
+			Data:       msg.Data,
+			Attributes: msg.Attributes,
+			ack:        msg.Ack,
+			nack:       msg.Nack,
+		})
+	})
+}
+
+func (b *PubSubEventBus) Close() error {
+	b.topicMutex.Lock()
+	for _, topic := range b.topics {
+		topic.Stop()
+	}
+	b.topicMutex.Unlock()
+
+	return b.client.Close()
+}
+
+// RedisEventBus is the Redis Streams event bus, topics are streams and subscriptions are consumer groups
+type RedisEventBus struct {
+	client   *redis.Client
+	maxLen   int64
+	consumer string
+	logger   Logger
+}
+
+// Messages left pending by a consumer for longer than this are claimed again
+const redisEventBusClaimMinIdle = 1 * time.Minute
+
+func NewRedisEventBus(client *redis.Client, maxLen int64, logger Logger) *RedisEventBus {
+	hostname, _ := os.Hostname()
+
+	return &RedisEventBus{
+		client:   client,
+		maxLen:   maxLen,
+		consumer: fmt.Sprintf("%s-%d", hostname, os.Getpid()),
+		logger:   logger,
+	}
+}
+
+// redisPublishResult is the result of a publish to a Redis stream, which is synchronous
+type redisPublishResult struct {
+	id  string
+	err error
+}
+
+func (r *redisPublishResult) Get(ctx context.Context) (string, error) {
+	return r.id, r.err
+}
+
+func (b *RedisEventBus) Publish(ctx context.Context, topic string, msg *Message) PublishResult {
+	attributesJSON, err := json.Marshal(msg.Attributes)
+	if err != nil {
+		return &redisPublishResult{err: err}
+	}
+
+	id, err := b.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: topic,
+		MaxLen: b.maxLen,
+		Approx: b.maxLen > 0,
+		Values: map[string]interface{}{
+			"data":       msg.Data,
+			"attributes": attributesJSON,
+		},
+	}).Result()
+
+	return &redisPublishResult{id: id, err: err}
+}
+
+func (b *RedisEventBus) Receive(ctx context.Context, topic string, subscription string, f func(context.Context, *Message)) error {
+	// Create the consumer group, reading the stream from the beginning
+	err := b.client.XGroupCreateMkStream(ctx, topic, subscription, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+
+	lastClaim := time.Time{}
+
+	for ctx.Err() == nil {
+		var messages []redis.XMessage
+
+		// Claim the messages left pending by crashed consumers or nacked messages
+		if time.Since(lastClaim) >= redisEventBusClaimMinIdle {
+			claimed, err := b.claim(ctx, topic, subscription)
+			if err != nil {
+				return err
+			}
+
+			messages = append(messages, claimed...)
+			lastClaim = time.Now()
+		}
+
+		// Read the new messages
+		streams, err := b.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    subscription,
+			Consumer: b.consumer,
+			Streams:  []string{topic, ">"},
+			Count:    100,
+			Block:    5 * time.Second,
+		}).Result()
+		if err != nil && err != redis.Nil {
+			if ctx.Err() != nil {
+				break
+			}
+			return err
+		}
+
+		for _, stream := range streams {
+			messages = append(messages, stream.Messages...)
+		}
+
+		for _, xMessage := range messages {
+			msg, err := b.message(topic, subscription, xMessage)
+			if err != nil {
+				// A corrupted entry would be claimed again forever, it is dropped
+				b.logger.LogError("[EVENT_BUS] Dropping corrupted message %s of stream %s: %v", xMessage.ID, topic, err)
+				msg.Ack()
+				continue
+			}
+
+			f(ctx, msg)
+		}
+	}
+
+	return nil
+}
+
+// claim takes over the messages left idle in the pending list of the subscription.
+// XAUTOCLAIM is not used as go-redis v8 cannot parse its reply since Redis 7.
+func (b *RedisEventBus) claim(ctx context.Context, topic string, subscription string) ([]redis.XMessage, error) {
+	pending, err := b.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream: topic,
+		Group:  subscription,
+		Idle:   redisEventBusClaimMinIdle,
+		Start:  "-",
+		End:    "+",
+		Count:  100,
+	}).Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	if len(pending) == 0 {
+		return nil, nil
+	}
+
+	ids := make([]string, 0, len(pending))
+	for _, entry := range pending {
+		ids = append(ids, entry.ID)
+	}
+
+	claimed, err := b.client.XClaim(ctx, &redis.XClaimArgs{
+		Stream:   topic,
+		Group:    subscription,
+		Consumer: b.consumer,
+		MinIdle:  redisEventBusClaimMinIdle,
+		Messages: ids,
+	}).Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	return claimed, nil
+}
+
+// message converts a stream entry to a Message, the message is returned with an error to be acknowledged
+// when its attributes cannot be decoded
+func (b *RedisEventBus) message(topic string, subscription string, xMessage redis.XMessage) (*Message, error) {
+	msg := &Message{
+		ID: xMessage.ID,
+		ack: func() {
+			if err := b.client.XAck(context.Background(), topic, subscription, xMessage.ID).Err(); err != nil {
+				b.logger.LogError("[EVENT_BUS] Failed to acknowledge message %s of stream %s: %v", xMessage.ID, topic, err)
+			}
+		},
+		// Nacked messages stay pending and are claimed again once idle
+		nack: func() {},
+	}
+
+	if data, ok := xMessage.Values["data"].(string); ok {
+		msg.Data = []byte(data)
+	}
+
+	if attributes, ok := xMessage.Values["attributes"].(string); ok {
+		if err := json.Unmarshal([]byte(attributes), &msg.Attributes); err != nil {
+			return msg, fmt.Errorf("Invalid attributes: %v", err)
+		}
+	}
+
+	return msg, nil
+}
+
+func (b *RedisEventBus) Close() error {
+	return b.client.Close()
+}
+
+// ChannelEventBus is an in-process event bus backed by channels, meant for tests and local runs.
+// Each topic is a single queue shared by all its subscriptions.
+type ChannelEventBus struct {
+	bufferSize int
+	topics     map[string]chan *Message
+	topicMutex sync.Mutex
+	sequence   int64
+}
+
+func NewChannelEventBus(bufferSize int) *ChannelEventBus {
+	return &ChannelEventBus{
+		bufferSize: bufferSize,
+		topics:     make(map[string]chan *Message),
+	}
+}
+
+// channelPublishResult is the result of a publish to a channel, which is synchronous
+type channelPublishResult struct {
+	id  string
+	err error
+}
+
+func (r *channelPublishResult) Get(ctx context.Context) (string, error) {
+	return r.id, r.err
+}
+
+// topic returns the channel of the topic, creating it if needed
+func (b *ChannelEventBus) topic(id string) chan *Message {
+	b.topicMutex.Lock()
+	defer b.topicMutex.Unlock()
+
+	topic, ok := b.topics[id]
+	if !ok {
+		topic = make(chan *Message, b.bufferSize)
+		b.topics[id] = topic
+	}
+
+	return topic
+}
+
+func (b *ChannelEventBus) Publish(ctx context.Context, topic string, msg *Message) PublishResult {
+	b.topicMutex.Lock()
+	b.sequence++
+	id := strconv.FormatInt(b.sequence, 10)
+	b.topicMutex.Unlock()
+
+	published := &Message{
+		ID:         id,
+		Data:       msg.Data,
+		Attributes: msg.Attributes,
+	}
+
+	select {
+	case b.topic(topic) <- published:
+		return &channelPublishResult{id: id}
+	case <-ctx.Done():
+		return &channelPublishResult{err: ctx.Err()}
+	default:
+		return &channelPublishResult{err: errors.New("Topic buffer is full")}
+	}
+}
+
+func (b *ChannelEventBus) Receive(ctx context.Context, topic string, subscription string, f func(context.Context, *Message)) error {
+	messages := b.topic(topic)
+
+	for {
+		select {
+		case msg := <-messages:
+			delivered := &Message{
+				ID:         msg.ID,
+				Data:       msg.Data,
+				Attributes: msg.Attributes,
+			}
+			delivered.nack = func() {
+				// Deliver the message again
+				go func() {
+					select {
+					case messages <- msg:
+					case <-ctx.Done():
+					}
+				}()
+			}
+			f(ctx, delivered)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (b *ChannelEventBus) Close() error {
+	return nil
+}
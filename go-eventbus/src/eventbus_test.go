@@ -0,0 +1,224 @@
+package eventbus
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+// testLogger records the logged errors
+type testLogger struct {
+	mutex  sync.Mutex
+	errors []string
+}
+
+func (l *testLogger) LogError(format string, args ...interface{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.errors = append(l.errors, fmt.Sprintf(format, args...))
+}
+
+func (l *testLogger) count() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return len(l.errors)
+}
+
+// receive delivers the messages of the subscription to a channel until the test ends
+func receive(t *testing.T, bus Subscriber, topic string) <-chan *Message {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	messages := make(chan *Message, 10)
+	go bus.Receive(ctx, topic, topic, func(ctx context.Context, msg *Message) {
+		messages <- msg
+	})
+
+	return messages
+}
+
+// next returns the next received message, failing the test when none comes in time
+func next(t *testing.T, messages <-chan *Message) *Message {
+	t.Helper()
+
+	select {
+	case msg := <-messages:
+		return msg
+	case <-time.After(2 * time.Second):
+		t.Fatal("no message received")
+		return nil
+	}
+}
+
+func TestChannelEventBusRoundTrip(t *testing.T) {
+	bus := NewChannelEventBus(10)
+	messages := receive(t, bus, "page")
+
+	for _, data := range []string{"first", "second"} {
+		id, err := bus.Publish(context.Background(), "page", &Message{
+			Data:       []byte(data),
+			Attributes: map[string]string{"type": "page"},
+		}).Get(context.Background())
+		if err != nil {
+			t.Fatalf("Publish(%s) error = %v", data, err)
+		}
+		if id == "" {
+			t.Errorf("Publish(%s) returned an empty ID", data)
+		}
+	}
+
+	for _, data := range []string{"first", "second"} {
+		msg := next(t, messages)
+		if string(msg.Data) != data || msg.Attributes["type"] != "page" {
+			t.Errorf("received %q %v, want %q with the attributes", msg.Data, msg.Attributes, data)
+		}
+		msg.Ack()
+	}
+}
+
+func TestChannelEventBusNack(t *testing.T) {
+	bus := NewChannelEventBus(10)
+	messages := receive(t, bus, "page")
+
+	if _, err := bus.Publish(context.Background(), "page", &Message{Data: []byte("page")}).Get(context.Background()); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+
+	first := next(t, messages)
+	first.Nack()
+
+	again := next(t, messages)
+	if again.ID != first.ID || string(again.Data) != "page" {
+		t.Errorf("redelivered %s %q, want %s %q", again.ID, again.Data, first.ID, "page")
+	}
+}
+
+func TestChannelEventBusFullBuffer(t *testing.T) {
+	bus := NewChannelEventBus(1)
+
+	if _, err := bus.Publish(context.Background(), "page", &Message{}).Get(context.Background()); err != nil {
+		t.Fatalf("first Publish() error = %v", err)
+	}
+	if _, err := bus.Publish(context.Background(), "page", &Message{}).Get(context.Background()); err == nil {
+		t.Error("Publish() on a full topic error = nil, want an error")
+	}
+}
+
+func TestChannelEventBusReceiveStops(t *testing.T) {
+	bus := NewChannelEventBus(1)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan error)
+	go func() {
+		done <- bus.Receive(ctx, "page", "page", func(ctx context.Context, msg *Message) {})
+	}()
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Receive() error = %v, want nil", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Receive() did not return once the context was done")
+	}
+}
+
+func newTestRedisEventBus(t *testing.T) (*RedisEventBus, *miniredis.Miniredis, *testLogger) {
+	t.Helper()
+
+	server := miniredis.RunT(t)
+	logger := &testLogger{}
+	bus := NewRedisEventBus(redis.NewClient(&redis.Options{Addr: server.Addr()}), 0, logger)
+	t.Cleanup(func() { bus.Close() })
+
+	return bus, server, logger
+}
+
+// pending returns the number of messages delivered to the subscription but not acknowledged
+func pending(t *testing.T, bus *RedisEventBus, topic string) int64 {
+	t.Helper()
+
+	summary, err := bus.client.XPending(context.Background(), topic, topic).Result()
+	if err != nil {
+		t.Fatalf("XPending() error = %v", err)
+	}
+
+	return summary.Count
+}
+
+func TestRedisEventBusRoundTrip(t *testing.T) {
+	bus, _, logger := newTestRedisEventBus(t)
+	messages := receive(t, bus, "page")
+
+	id, err := bus.Publish(context.Background(), "page", &Message{
+		Data:       []byte("page"),
+		Attributes: map[string]string{"type": "page"},
+	}).Get(context.Background())
+	if err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+
+	msg := next(t, messages)
+	if msg.ID != id || string(msg.Data) != "page" || msg.Attributes["type"] != "page" {
+		t.Errorf("received %s %q %v, want %s %q with the attributes", msg.ID, msg.Data, msg.Attributes, id, "page")
+	}
+
+	msg.Ack()
+	if count := pending(t, bus, "page"); count != 0 {
+		t.Errorf("%d pending messages after the ack, want 0", count)
+	}
+	if count := logger.count(); count != 0 {
+		t.Errorf("%d logged errors, want 0", count)
+	}
+}
+
+func TestRedisEventBusCorruptedAttributes(t *testing.T) {
+	bus, server, logger := newTestRedisEventBus(t)
+	messages := receive(t, bus, "page")
+
+	server.XAdd("page", "*", []string{"data", "corrupted", "attributes", "{"})
+	if _, err := bus.Publish(context.Background(), "page", &Message{Data: []byte("page")}).Get(context.Background()); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+
+	// The corrupted message is dropped, only the next one is delivered
+	msg := next(t, messages)
+	if string(msg.Data) != "page" {
+		t.Fatalf("received %q, want %q", msg.Data, "page")
+	}
+	msg.Ack()
+
+	if count := pending(t, bus, "page"); count != 0 {
+		t.Errorf("%d pending messages, want the corrupted message to be acknowledged", count)
+	}
+	if count := logger.count(); count != 1 {
+		t.Errorf("%d logged errors, want 1", count)
+	}
+}
+
+func TestRedisEventBusAckError(t *testing.T) {
+	bus, server, logger := newTestRedisEventBus(t)
+	messages := receive(t, bus, "page")
+
+	if _, err := bus.Publish(context.Background(), "page", &Message{Data: []byte("page")}).Get(context.Background()); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+
+	msg := next(t, messages)
+	server.Close()
+	msg.Ack()
+
+	if count := logger.count(); count != 1 {
+		t.Errorf("%d logged errors, want the failed ack to be logged", count)
+	}
+}
@@ -0,0 +1,417 @@
+// Package extract extracts the page data of an HTML page, with the rules of the SDK.
+package extract
+
+import (
+	"encoding/json"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+// Layouts of the dates found in the ld+json and the Open Graph metas
+var pageDateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05Z0700",
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02",
+}
+
+// Elements whose text is not part of the article content
+var pageSkippedElements = map[string]bool{
+	"script":   true,
+	"style":    true,
+	"noscript": true,
+	"template": true,
+	"svg":      true,
+}
+
+// Elements rendered on their own line, like innerText does
+var pageBlockElements = map[string]bool{
+	"p": true, "div": true, "section": true, "header": true, "footer": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"ul": true, "ol": true, "li": true, "blockquote": true, "figure": true,
+	"figcaption": true, "pre": true, "table": true, "tr": true, "br": true,
+}
+
+// PageData is the page data extracted from an HTML page
+type PageData struct {
+	URL              string     `json:"url"`
+	Type             string     `json:"type"`
+	Language         string     `json:"language"`
+	PublicationDate  time.Time  `json:"publicationDate"`
+	ModificationDate *time.Time `json:"modificationDate"`
+	Title            string     `json:"title"`
+	Description      string     `json:"description"`
+	Content          string     `json:"content"`
+	Section          string     `json:"section"`
+	SubSection       *string    `json:"subSection"`
+	Image            *string    `json:"image"`
+	IsPaid           bool       `json:"isPaid"`
+	Author           *string    `json:"author"`
+	Keywords         []string   `json:"keywords"`
+	WordCount        int        `json:"wordCount"`
+}
+
+// pageDocument holds the parts of a page used by the extraction rules of the SDK
+type pageDocument struct {
+	canonical string
+	metas     map[string]string
+	tags      []string
+	ldJSON    map[string]interface{}
+	article   *html.Node
+}
+
+// ExtractPageData extracts the page data of an HTML page with the same rules as PageDataCollector in weather.js.
+// It also extracts the author, the keywords and the word count of the page.
+func ExtractPageData(pageURL string, body io.Reader) (PageData, error) {
+	root, err := html.Parse(body)
+	if err != nil {
+		return PageData{}, err
+	}
+
+	doc := &pageDocument{metas: map[string]string{}}
+	doc.walk(root)
+
+	pageData := PageData{
+		URL:         doc.canonicalURL(pageURL),
+		Type:        doc.pageType(pageURL),
+		Language:    doc.metas["og:locale"],
+		Title:       firstNonEmpty(doc.ldString("headline"), doc.metas["og:title"]),
+		Description: firstNonEmpty(doc.ldString("description"), doc.metas["og:description"]),
+		Content:     innerText(doc.article),
+		IsPaid:      doc.isPaid(),
+	}
+
+	publicationDate := firstNonEmpty(doc.ldString("datePublished"), doc.metas["og:article:published_time"])
+	if t, ok := parsePageDate(publicationDate); ok {
+		pageData.PublicationDate = t
+	}
+
+	if t, ok := parsePageDate(doc.ldString("dateModified")); ok {
+		pageData.ModificationDate = &t
+	}
+
+	pageData.Section, pageData.SubSection = doc.sections()
+
+	if image := firstNonEmpty(doc.ldImage(), doc.metas["og:image"]); image != "" {
+		pageData.Image = &image
+	}
+
+	if author := firstNonEmpty(doc.ldAuthor(), doc.metas["author"], doc.metas["article:author"], doc.metas["og:article:author"]); author != "" {
+		pageData.Author = &author
+	}
+
+	pageData.Keywords = doc.keywords()
+	pageData.WordCount = doc.wordCount(pageData.Content)
+
+	return pageData, nil
+}
+
+// walk collects the canonical link, the metas, the first ld+json script and the first article of the page
+func (d *pageDocument) walk(n *html.Node) {
+	if n.Type == html.ElementNode {
+		switch n.Data {
+		case "link":
+			if d.canonical == "" && strings.EqualFold(attr(n, "rel"), "canonical") {
+				d.canonical = strings.TrimSpace(attr(n, "href"))
+			}
+		case "meta":
+			key := attr(n, "property")
+			if key == "" {
+				key = attr(n, "name")
+			}
+			if _, exists := d.metas[key]; key != "" && !exists {
+				d.metas[key] = strings.TrimSpace(attr(n, "content"))
+			}
+			// The article tags are repeated, one meta per tag
+			if key == "article:tag" || key == "og:article:tag" {
+				if tag := strings.TrimSpace(attr(n, "content")); tag != "" {
+					d.tags = append(d.tags, tag)
+				}
+			}
+		case "script":
+			// The SDK only reads the first ld+json script
+			if d.ldJSON == nil && attr(n, "type") == "application/ld+json" && n.FirstChild != nil {
+				var ldJSON map[string]interface{}
+				if err := json.Unmarshal([]byte(n.FirstChild.Data), &ldJSON); err == nil {
+					d.ldJSON = ldJSON
+				} else {
+					d.ldJSON = map[string]interface{}{}
+				}
+			}
+		case "article":
+			if d.article == nil {
+				d.article = n
+			}
+		}
+	}
+
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		d.walk(c)
+	}
+}
+
+func (d *pageDocument) ldString(key string) string {
+	if value, ok := d.ldJSON[key].(string); ok {
+		return strings.TrimSpace(value)
+	}
+	return ""
+}
+
+// ldImage returns the ld+json image, which is either a URL, an ImageObject or a list of them
+func (d *pageDocument) ldImage() string {
+	image := d.ldJSON["image"]
+	if images, ok := image.([]interface{}); ok && len(images) > 0 {
+		image = images[0]
+	}
+
+	switch value := image.(type) {
+	case string:
+		return strings.TrimSpace(value)
+	case map[string]interface{}:
+		if imageURL, ok := value["url"].(string); ok {
+			return strings.TrimSpace(imageURL)
+		}
+	}
+
+	return ""
+}
+
+// ldAuthor returns the names of the ld+json authors, which are either names, Person objects or a list of them
+func (d *pageDocument) ldAuthor() string {
+	authors, ok := d.ldJSON["author"].([]interface{})
+	if !ok {
+		authors = []interface{}{d.ldJSON["author"]}
+	}
+
+	var names []string
+	for _, author := range authors {
+		switch value := author.(type) {
+		case string:
+			if name := strings.TrimSpace(value); name != "" {
+				names = append(names, name)
+			}
+		case map[string]interface{}:
+			if name, ok := value["name"].(string); ok && strings.TrimSpace(name) != "" {
+				names = append(names, strings.TrimSpace(name))
+			}
+		}
+	}
+
+	return strings.Join(names, ", ")
+}
+
+// keywords returns the ld+json keywords, which are either a comma separated list or a list,
+// falling back to the keywords meta and then to the article tags
+func (d *pageDocument) keywords() []string {
+	var keywords []string
+
+	switch value := d.ldJSON["keywords"].(type) {
+	case string:
+		keywords = strings.Split(value, ",")
+	case []interface{}:
+		for _, keyword := range value {
+			if keyword, ok := keyword.(string); ok {
+				keywords = append(keywords, keyword)
+			}
+		}
+	}
+
+	if len(keywords) == 0 && d.metas["keywords"] != "" {
+		keywords = strings.Split(d.metas["keywords"], ",")
+	}
+
+	if len(keywords) == 0 {
+		keywords = d.tags
+	}
+
+	var cleaned []string
+	seen := map[string]bool{}
+	for _, keyword := range keywords {
+		keyword = strings.TrimSpace(keyword)
+		if keyword != "" && !seen[strings.ToLower(keyword)] {
+			seen[strings.ToLower(keyword)] = true
+			cleaned = append(cleaned, keyword)
+		}
+	}
+
+	return cleaned
+}
+
+// wordCount returns the ld+json word count, or the number of words of the content
+func (d *pageDocument) wordCount(content string) int {
+	switch value := d.ldJSON["wordCount"].(type) {
+	case float64:
+		if value > 0 {
+			return int(value)
+		}
+	case string:
+		if count, err := strconv.Atoi(strings.TrimSpace(value)); err == nil && count > 0 {
+			return count
+		}
+	}
+
+	return len(strings.Fields(content))
+}
+
+// canonicalURL returns the canonical link resolved against the page URL, or the page URL without canonical link
+func (d *pageDocument) canonicalURL(pageURL string) string {
+	if d.canonical == "" {
+		return pageURL
+	}
+
+	base, err := url.Parse(pageURL)
+	if err != nil {
+		return d.canonical
+	}
+
+	canonical, err := base.Parse(d.canonical)
+	if err != nil {
+		return pageURL
+	}
+
+	return canonical.String()
+}
+
+func (d *pageDocument) pageType(pageURL string) string {
+	switch ldType := d.ldString("@type"); {
+	case ldType == "NewsArticle":
+		return "article"
+	case ldType == "BreadcrumbList":
+		return "section"
+	case ldType != "":
+		return "home"
+	}
+
+	if d.metas["og:type"] == "article" {
+		return "article"
+	}
+
+	if u, err := url.Parse(pageURL); err == nil && (u.Path == "" || u.Path == "/") {
+		return "home"
+	}
+
+	return "section"
+}
+
+// isPaid reads isAccessibleForFree from the ld+json, falling back to the Open Graph content tier
+func (d *pageDocument) isPaid() bool {
+	switch isAccessibleForFree := d.ldJSON["isAccessibleForFree"].(type) {
+	case string:
+		if isAccessibleForFree != "" {
+			return strings.EqualFold(isAccessibleForFree, "false")
+		}
+	case bool:
+		return !isAccessibleForFree
+	}
+
+	if contentTier, ok := d.metas["og:article:content_tier"]; ok {
+		return contentTier != "free"
+	}
+
+	return false
+}
+
+// sections returns the section and the sub-section from the ld+json articleSection, or the Open Graph section
+func (d *pageDocument) sections() (string, *string) {
+	switch articleSection := d.ldJSON["articleSection"].(type) {
+	case string:
+		if articleSection != "" {
+			return articleSection, nil
+		}
+	case []interface{}:
+		if len(articleSection) > 0 {
+			section, _ := articleSection[0].(string)
+
+			var subSection *string
+			if len(articleSection) > 1 {
+				if value, ok := articleSection[1].(string); ok && value != "" {
+					subSection = &value
+				}
+			}
+
+			return section, subSection
+		}
+	}
+
+	return d.metas["og:article:section"], nil
+}
+
+// innerText approximates the rendered text of an element, one line per block
+func innerText(n *html.Node) string {
+	if n == nil {
+		return ""
+	}
+
+	var lines []string
+	var line strings.Builder
+
+	flush := func() {
+		if text := strings.Join(strings.Fields(line.String()), " "); text != "" {
+			lines = append(lines, text)
+		}
+		line.Reset()
+	}
+
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		switch n.Type {
+		case html.TextNode:
+			line.WriteString(n.Data)
+			return
+		case html.ElementNode:
+			if pageSkippedElements[n.Data] {
+				return
+			}
+			if pageBlockElements[n.Data] {
+				flush()
+				defer flush()
+			}
+		}
+
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(n)
+	flush()
+
+	return strings.Join(lines, "\n")
+}
+
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+func parsePageDate(value string) (time.Time, bool) {
+	if value == "" {
+		return time.Time{}, false
+	}
+
+	for _, layout := range pageDateLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, true
+		}
+	}
+
+	return time.Time{}, false
+}
@@ -0,0 +1,63 @@
+package extract
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+// Test pages of the SDK, served by the collector
+const testPagesDir = "../../go-weather/assets/html/test"
+
+func TestExtractPageDataGolden(t *testing.T) {
+	tests := []struct {
+		page    string
+		pageURL string
+	}{
+		{"article1.html", "https://www.example.com/test/article1.html"},
+		{"article2.html", "https://www.example.com/test/article2.html"},
+		{"index.html", "https://www.example.com/test/index.html"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.page, func(t *testing.T) {
+			page, err := os.Open(filepath.Join(testPagesDir, tt.page))
+			if err != nil {
+				t.Fatalf("os.Open() error = %v", err)
+			}
+			defer page.Close()
+
+			pageData, err := ExtractPageData(tt.pageURL, page)
+			if err != nil {
+				t.Fatalf("ExtractPageData() error = %v", err)
+			}
+
+			got, err := json.MarshalIndent(pageData, "", "  ")
+			if err != nil {
+				t.Fatalf("json.MarshalIndent() error = %v", err)
+			}
+			got = append(got, '\n')
+
+			golden := filepath.Join("testdata", tt.page[:len(tt.page)-len(filepath.Ext(tt.page))]+".golden.json")
+			if *update {
+				if err := os.WriteFile(golden, got, 0644); err != nil {
+					t.Fatalf("os.WriteFile() error = %v", err)
+				}
+			}
+
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("os.ReadFile() error = %v", err)
+			}
+
+			if !bytes.Equal(got, want) {
+				t.Errorf("ExtractPageData() of %s differs from %s:\n%s", tt.page, golden, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,5 @@
+module extract
+
+go 1.23.1
+
+require golang.org/x/net v0.28.0
@@ -7,6 +7,7 @@ require (
 	cloud.google.com/go/pubsub v1.43.0
 	github.com/joho/godotenv v1.5.1
 	github.com/lib/pq v1.10.9
+	github.com/reiver/go-porterstemmer v1.0.1
 	golang.org/x/net v0.29.0
 	google.golang.org/api v0.198.0
 )
@@ -31,7 +32,6 @@ require (
 	github.com/klauspost/compress v1.16.7 // indirect
 	github.com/klauspost/cpuid/v2 v2.2.5 // indirect
 	github.com/pierrec/lz4/v4 v4.1.18 // indirect
-	github.com/reiver/go-porterstemmer v1.0.1 // indirect
 	github.com/zeebo/xxh3 v1.0.2 // indirect
 	go.opencensus.io v0.24.0 // indirect
 	go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc v0.54.0 // indirect
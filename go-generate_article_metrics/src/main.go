@@ -6,7 +6,6 @@ import (
 	"log"
 	"os"
 	"sync"
-	"time"
 
 	"cloud.google.com/go/bigquery"
 	"github.com/joho/godotenv"
@@ -77,15 +76,13 @@ func init() {
 
 func main() {
 	type ArticleMetrics struct {
-		URL            string  `bigquery:"url"`
-		ViewCount      int64   `bigquery:"view_count"`
-		AvgTimeSpent   float64 `bigquery:"avg_time_spent"`
-		AvgReadingRate float64 `bigquery:"avg_reading_rate"`
+		URL               string  `bigquery:"url"`
+		ViewCount         int64   `bigquery:"view_count"`
+		AvgTimeSpent      float64 `bigquery:"avg_time_spent"`
+		AvgReadingRate    float64 `bigquery:"avg_reading_rate"`
+		CalculationPeriod string  `bigquery:"calculation_period"`
 	}
 
-	calculationDate := time.Now()
-	currentHour := calculationDate.Format("2006-01-02 15") + ":00:00"
-
 	// Query to get all brands
 	brandsQuery := `SELECT name FROM brand`
 	brands, err := db.Query(brandsQuery)
@@ -121,10 +118,12 @@ func main() {
 		go func(brandName string) {
 			defer wg.Done() // Mark the goroutine as done when finished
 
-			// Query to get metrics for articles in the last 10 minutes for the current brand
+			// Query to get metrics for the articles of the events ingested in the last minute for the current brand,
+			// a late event is counted in the hour it happened
 			metricsQuery := fmt.Sprintf(`
 			SELECT 
 				url,
+				FORMAT_TIMESTAMP('%%F %%H:00:00', datetime) AS calculation_period,
 				COUNT(*) AS view_count,
 				ROUND(AVG(CAST(JSON_VALUE(metas, '$.timeSpent') AS FLOAT64)), 2) AS avg_time_spent,
 				ROUND(AVG(CAST(JSON_VALUE(metas, '$.readingRate') AS FLOAT64)), 2) AS avg_reading_rate
@@ -133,10 +132,11 @@ func main() {
 			WHERE 
 				brand = '%s'
 				AND page_type = 'article'
-				AND datetime >= TIMESTAMP_SUB(CURRENT_TIMESTAMP(), INTERVAL 1 MINUTE)
-				AND datetime < CURRENT_TIMESTAMP()
+				AND (bot_classification IS NULL OR bot_classification = 'human')
+				AND COALESCE(ingested_at, datetime) >= TIMESTAMP_SUB(CURRENT_TIMESTAMP(), INTERVAL 1 MINUTE)
+				AND COALESCE(ingested_at, datetime) < CURRENT_TIMESTAMP()
 			GROUP BY 
-				url
+				url, calculation_period
 		`, os.Getenv("ENV"), brandName)
 
 			// Execute the query
@@ -167,7 +167,7 @@ func main() {
 				}
 
 				// Insert the metrics into the article_metrics table
-				_, err = db.Exec(insertQuery, brandName, articleMetrics.URL, articleMetrics.ViewCount, articleMetrics.AvgTimeSpent, articleMetrics.AvgReadingRate, currentHour)
+				_, err = db.Exec(insertQuery, brandName, articleMetrics.URL, articleMetrics.ViewCount, articleMetrics.AvgTimeSpent, articleMetrics.AvgReadingRate, articleMetrics.CalculationPeriod)
 				if err != nil {
 					logger.LogError("Error inserting metrics into article_metrics for brand %s: %v", brandName, err)
 				}
@@ -147,6 +147,7 @@ func main() {
 				WHERE 
 					brand = @brand
 					AND datetime >= @intervalStart AND datetime < @intervalEnd
+					AND (bot_classification IS NULL OR bot_classification = 'human')
 				GROUP BY 
 					brand, url;
 			`, os.Getenv("ENV"))
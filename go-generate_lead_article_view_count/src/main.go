@@ -6,7 +6,6 @@ import (
 	"log"
 	"os"
 	"sync"
-	"time"
 
 	"cloud.google.com/go/bigquery"
 	"github.com/joho/godotenv"
@@ -77,13 +76,11 @@ func init() {
 
 func main() {
 	type LeadViewCount struct {
-		LeadUUID  string `bigquery:"lead_uuid"`
-		ViewCount int64  `bigquery:"view_count"`
+		LeadUUID          string `bigquery:"lead_uuid"`
+		ViewCount         int64  `bigquery:"view_count"`
+		CalculationPeriod string `bigquery:"calculation_period"`
 	}
 
-	calculationDate := time.Now()
-	currentDate := calculationDate.Format("2006-01-02")
-
 	// Step 1: Fetch the distinct brands from PostgreSQL
 	brandsQuery := `
 		SELECT name 
@@ -141,20 +138,21 @@ func main() {
 				return
 			}
 
-			// Step 5: Fetch view count data for the current brand from BigQuery
+			// Step 5: Fetch view count data for the current brand from BigQuery, by day of the events ingested in the last minute
 			brandQuery := fmt.Sprintf(`
 			SELECT
 				le.lead_uuid,
+				FORMAT_TIMESTAMP('%%F', le.datetime) AS calculation_period,
 				COUNT(*) AS view_count
 			FROM
 				%s_weather.lead_event le
 			WHERE
 				le.page_type = 'article'
 				AND le.brand = @brand
-				AND le.datetime >= TIMESTAMP_SUB(CURRENT_TIMESTAMP(), INTERVAL 1 MINUTE)
-				AND le.datetime <= CURRENT_TIMESTAMP()
+				AND COALESCE(le.ingested_at, le.datetime) >= TIMESTAMP_SUB(CURRENT_TIMESTAMP(), INTERVAL 1 MINUTE)
+				AND COALESCE(le.ingested_at, le.datetime) <= CURRENT_TIMESTAMP()
 			GROUP BY
-				le.lead_uuid
+				le.lead_uuid, calculation_period
 		`, os.Getenv("ENV"))
 
 			// Prepare the query job
@@ -191,7 +189,7 @@ func main() {
 
 			// Step 7: Insert the data into PostgreSQL for the current brand
 			for _, lvc := range results {
-				if _, err = tx.Exec(insertQuery, brand, lvc.LeadUUID, lvc.ViewCount, currentDate); err != nil {
+				if _, err = tx.Exec(insertQuery, brand, lvc.LeadUUID, lvc.ViewCount, lvc.CalculationPeriod); err != nil {
 					logger.LogError("Failed to insert view count for brand %s into PostgreSQL: %v", brand, err)
 					_ = tx.Rollback() // Rollback the transaction
 					return
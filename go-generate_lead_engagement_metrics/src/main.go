@@ -6,7 +6,6 @@ import (
 	"log"
 	"os"
 	"sync"
-	"time"
 
 	"cloud.google.com/go/bigquery"
 	"github.com/joho/godotenv"
@@ -76,15 +75,13 @@ func init() {
 }
 
 func main() {
-	calculationDate := time.Now()
-	currentDay := calculationDate.Format("2006-01-02 ") + "00:00:00"
-
 	// Structure to store the results from BigQuery
 	type ViewCount struct {
-		LeadUUID       string  `bigquery:"lead_uuid"`
-		ViewCount      int     `bigquery:"view_count"`
-		AvgTimeSpent   float64 `bigquery:"avg_time_spent"`
-		AvgReadingRate float64 `bigquery:"avg_reading_rate"`
+		LeadUUID          string  `bigquery:"lead_uuid"`
+		ViewCount         int     `bigquery:"view_count"`
+		AvgTimeSpent      float64 `bigquery:"avg_time_spent"`
+		AvgReadingRate    float64 `bigquery:"avg_reading_rate"`
+		CalculationPeriod string  `bigquery:"calculation_period"`
 	}
 
 	// Step 1: Retrieve unique brands from PostgreSQL
@@ -127,7 +124,7 @@ func main() {
 				return
 			}
 
-			// Step 4: Define the BigQuery query for the current brand
+			// Step 4: Define the BigQuery query for the current brand, the events ingested in the last minute are counted in the day they happened
 			query := fmt.Sprintf(`
 				WITH leads AS (
 					SELECT 
@@ -144,6 +141,7 @@ func main() {
 				)
 				SELECT 
 					le.lead_uuid,
+					FORMAT_TIMESTAMP('%%F 00:00:00', le.datetime) AS calculation_period,
 					COUNT(*) AS view_count,
 					ROUND(AVG(CAST(JSON_VALUE(le.metas, '$.timeSpent') AS FLOAT64)), 2) AS avg_time_spent,
 					ROUND(AVG(CAST(JSON_VALUE(le.metas, '$.readingRate') AS FLOAT64)), 2) AS avg_reading_rate
@@ -154,10 +152,10 @@ func main() {
 				WHERE 
 					le.brand = '%s'
 					AND l.lead_uuid IS NOT NULL
-					AND le.datetime >= TIMESTAMP_SUB(CURRENT_TIMESTAMP(), INTERVAL 1 MINUTE)
-					AND le.datetime < CURRENT_TIMESTAMP()
+					AND COALESCE(le.ingested_at, le.datetime) >= TIMESTAMP_SUB(CURRENT_TIMESTAMP(), INTERVAL 1 MINUTE)
+					AND COALESCE(le.ingested_at, le.datetime) < CURRENT_TIMESTAMP()
 				GROUP BY 
-					le.lead_uuid
+					le.lead_uuid, calculation_period
 			`, os.Getenv("ENV"), brand, pageViewThreshold, os.Getenv("ENV"), brand)
 
 			// Run BigQuery query
@@ -200,7 +198,7 @@ func main() {
 						avg_time_spent = (lead_engagement_metrics.avg_time_spent + EXCLUDED.avg_time_spent) / (lead_engagement_metrics.view_count + EXCLUDED.view_count), 
 						avg_reading_rate = (lead_engagement_metrics.avg_reading_rate + EXCLUDED.avg_reading_rate) / (lead_engagement_metrics.view_count + EXCLUDED.view_count);
 				`
-				_, err := db.Exec(insertQuery, brand, v.LeadUUID, v.ViewCount, v.AvgTimeSpent, v.AvgReadingRate, currentDay)
+				_, err := db.Exec(insertQuery, brand, v.LeadUUID, v.ViewCount, v.AvgTimeSpent, v.AvgReadingRate, v.CalculationPeriod)
 				if err != nil {
 					logger.LogError("Failed to insert data into PostgreSQL for brand %s : %v", brand, err)
 					return
@@ -134,7 +134,7 @@ func main() {
 			}
 			logger.LogInfo("Successfully deleted old read articles for brand: %s", brand)
 
-			// Step 3: Execute the BigQuery query to retrieve articles
+			// Step 3: Execute the BigQuery query to retrieve the articles of the page views ingested in the last minute
 			bqQuery := fmt.Sprintf(`
             SELECT 
                 le.brand, 
@@ -150,8 +150,8 @@ func main() {
                 AND le.name = 'page_view'
                 AND p.type = 'article'
                 AND p.publication_date > TIMESTAMP_SUB(CURRENT_TIMESTAMP(), INTERVAL 15 DAY)
-                AND le.datetime >= TIMESTAMP_SUB(CURRENT_TIMESTAMP(), INTERVAL 1 MINUTE)
-                AND le.datetime <= CURRENT_TIMESTAMP()
+                AND COALESCE(le.ingested_at, le.datetime) >= TIMESTAMP_SUB(CURRENT_TIMESTAMP(), INTERVAL 1 MINUTE)
+                AND COALESCE(le.ingested_at, le.datetime) <= CURRENT_TIMESTAMP()
             GROUP BY 
                 le.brand, le.lead_uuid, le.url
         `, os.Getenv("ENV"), os.Getenv("ENV"), brand)
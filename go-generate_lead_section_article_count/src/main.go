@@ -6,7 +6,6 @@ import (
 	"log"
 	"os"
 	"sync"
-	"time"
 
 	"cloud.google.com/go/bigquery"
 	"github.com/joho/godotenv"
@@ -76,15 +75,13 @@ func init() {
 }
 
 func main() {
-	calculationDate := time.Now()
-	currentDate := calculationDate.Format("2006-01-02")
-
 	type ArticleCount struct {
-		LeadUUID       string  `bigquery:"lead_uuid"`
-		Section        string  `bigquery:"section"`
-		ArticleCount   int     `bigquery:"article_count"`
-		AvgTimeSpent   float64 `bigquery:"avg_time_spent"`
-		AvgReadingRate float64 `bigquery:"avg_reading_rate"`
+		LeadUUID          string  `bigquery:"lead_uuid"`
+		Section           string  `bigquery:"section"`
+		ArticleCount      int     `bigquery:"article_count"`
+		AvgTimeSpent      float64 `bigquery:"avg_time_spent"`
+		AvgReadingRate    float64 `bigquery:"avg_reading_rate"`
+		CalculationPeriod string  `bigquery:"calculation_period"`
 	}
 
 	// 1. Fetch the brands from the `brand` table in PostgreSQL
@@ -145,11 +142,12 @@ func main() {
 			}
 			logger.LogInfo("Successfully deleted old lead section article count for brand: %s", brand)
 
-			// 5. Build and execute the BigQuery query for each brand
+			// 5. Build and execute the BigQuery query for each brand, on the events ingested in the last minute by day of event
 			query := fmt.Sprintf(`
 				SELECT 
 					le.lead_uuid, 
 					p.section, 
+					FORMAT_TIMESTAMP('%%F', le.datetime) AS calculation_period,
 					COUNT(DISTINCT le.url) AS article_count,
 					ROUND(AVG(CAST(JSON_VALUE(le.metas, '$.timeSpent') AS FLOAT64)), 2) AS avg_time_spent,
 					ROUND(AVG(CAST(JSON_VALUE(le.metas, '$.readingRate') AS FLOAT64)), 2) AS avg_reading_rate
@@ -159,10 +157,10 @@ func main() {
 					%s_weather.page AS p ON p.url = le.url AND p.brand = @brand
 				WHERE 
 					le.brand = @brand
-					AND le.datetime >= TIMESTAMP_SUB(CURRENT_TIMESTAMP(), INTERVAL 1 MINUTE)
-					AND le.datetime <= CURRENT_TIMESTAMP()
+					AND COALESCE(le.ingested_at, le.datetime) >= TIMESTAMP_SUB(CURRENT_TIMESTAMP(), INTERVAL 1 MINUTE)
+					AND COALESCE(le.ingested_at, le.datetime) <= CURRENT_TIMESTAMP()
 				GROUP BY 
-					le.lead_uuid, p.section, DATE_TRUNC(le.datetime, MONTH)
+					le.lead_uuid, p.section, calculation_period
 				HAVING 
 					COUNT(*) > 0
 			`, os.Getenv("ENV"), os.Getenv("ENV"))
@@ -196,7 +194,7 @@ func main() {
 				}
 
 				// Execute the insert statement
-				_, err = insertStmt.Exec(brand, articleCount.LeadUUID, articleCount.Section, articleCount.ArticleCount, articleCount.AvgTimeSpent, articleCount.AvgReadingRate, currentDate)
+				_, err = insertStmt.Exec(brand, articleCount.LeadUUID, articleCount.Section, articleCount.ArticleCount, articleCount.AvgTimeSpent, articleCount.AvgReadingRate, articleCount.CalculationPeriod)
 				if err != nil {
 					logger.LogError("Failed to insert data for brand %s: %v", brand, err)
 					break
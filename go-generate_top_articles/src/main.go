@@ -6,7 +6,6 @@ import (
 	"log"
 	"os"
 	"sync"
-	"time"
 
 	"cloud.google.com/go/bigquery"
 	"github.com/joho/godotenv"
@@ -76,18 +75,16 @@ func init() {
 }
 
 func main() {
-	calculationDate := time.Now()
-	currentHour := calculationDate.Format("2006-01-02 15") + ":00:00"
-
 	type Article struct {
-		Brand          string              `bigquery:"brand"`
-		URL            string              `bigquery:"url"`
-		Section        string              `bigquery:"section"`
-		SubSection     bigquery.NullString `bigquery:"sub_section"`
-		ViewCount      int                 `bigquery:"view_count"`
-		AvgReadingRate float64             `bigquery:"avg_reading_rate"`
-		AvgTimeSpent   float64             `bigquery:"avg_time_spent"`
-		RecencyWeight  float64             `bigquery:"recency_weight"`
+		Brand             string              `bigquery:"brand"`
+		URL               string              `bigquery:"url"`
+		CalculationPeriod string              `bigquery:"calculation_period"`
+		Section           string              `bigquery:"section"`
+		SubSection        bigquery.NullString `bigquery:"sub_section"`
+		ViewCount         int                 `bigquery:"view_count"`
+		AvgReadingRate    float64             `bigquery:"avg_reading_rate"`
+		AvgTimeSpent      float64             `bigquery:"avg_time_spent"`
+		RecencyWeight     float64             `bigquery:"recency_weight"`
 	}
 
 	type TopArticle struct {
@@ -97,6 +94,12 @@ func main() {
 		RecencyWeight  float64 `bigquery:"recency_weight"`
 	}
 
+	// The late events are counted in the hour they happened, an article may have several calculation periods
+	type ArticlePeriod struct {
+		URL               string
+		CalculationPeriod string
+	}
+
 	// Step 1: Get all brands from PostgreSQL
 	brandsQuery := `SELECT DISTINCT name FROM brand`
 	brandsRows, err := db.Query(brandsQuery)
@@ -126,7 +129,7 @@ func main() {
 			deleteQuery := `
 				DELETE FROM top_articles
 				WHERE brand = $1
-				AND calculation_period < NOW() - INTERVAL '2 DAYS'
+				AND calculation_period < NOW() - INTERVAL '7 DAYS'
 			`
 			_, err := db.Exec(deleteQuery, brand)
 			if err != nil {
@@ -140,6 +143,7 @@ func main() {
 				SELECT
 					p.brand,
 					p.url,
+					FORMAT_TIMESTAMP('%%F %%H:00:00', le.datetime) AS calculation_period,
 					p.section,
 					p.sub_section,
 					COUNT(*) AS view_count,
@@ -151,11 +155,12 @@ func main() {
 				JOIN
 					%s_weather.page p ON p.url = le.url
 				WHERE
-					le.datetime >= TIMESTAMP_SUB(CURRENT_TIMESTAMP(), INTERVAL 1 MINUTE)
-					AND le.datetime < CURRENT_TIMESTAMP()
+					COALESCE(le.ingested_at, le.datetime) >= TIMESTAMP_SUB(CURRENT_TIMESTAMP(), INTERVAL 1 MINUTE)
+					AND COALESCE(le.ingested_at, le.datetime) < CURRENT_TIMESTAMP()
 					AND p.brand = '%s'
+					AND (le.bot_classification IS NULL OR le.bot_classification = 'human')
 				GROUP BY
-					p.brand, p.url, p.section, p.sub_section
+					p.brand, p.url, calculation_period, p.section, p.sub_section
 				ORDER BY
 					recency_weight DESC
 			`, os.Getenv("ENV"), os.Getenv("ENV"), brand)
@@ -169,9 +174,9 @@ func main() {
 			}
 
 			// Process and insert results into PostgreSQL
-			topArticles := make(map[string]TopArticle)
-			topArticlesSection := make(map[string]map[string]TopArticle)
-			topArticlesSectionSubSection := make(map[string]map[string]map[string]TopArticle)
+			topArticles := make(map[ArticlePeriod]TopArticle)
+			topArticlesSection := make(map[ArticlePeriod]map[string]TopArticle)
+			topArticlesSectionSubSection := make(map[ArticlePeriod]map[string]map[string]TopArticle)
 
 			for {
 				var article Article
@@ -185,18 +190,20 @@ func main() {
 					return
 				}
 
-				topArticles[article.URL] = TopArticle{
+				articlePeriod := ArticlePeriod{URL: article.URL, CalculationPeriod: article.CalculationPeriod}
+
+				topArticles[articlePeriod] = TopArticle{
 					ViewCount:      article.ViewCount,
 					AvgReadingRate: article.AvgReadingRate,
 					AvgTimeSpent:   article.AvgTimeSpent,
 					RecencyWeight:  article.RecencyWeight,
 				}
 
-				if topArticlesSection[article.URL] == nil {
-					topArticlesSection[article.URL] = make(map[string]TopArticle)
+				if topArticlesSection[articlePeriod] == nil {
+					topArticlesSection[articlePeriod] = make(map[string]TopArticle)
 				}
 
-				topArticlesSection[article.URL][article.Section] = TopArticle{
+				topArticlesSection[articlePeriod][article.Section] = TopArticle{
 					ViewCount:      article.ViewCount,
 					AvgReadingRate: article.AvgReadingRate,
 					AvgTimeSpent:   article.AvgTimeSpent,
@@ -204,15 +211,15 @@ func main() {
 				}
 
 				if article.SubSection.Valid && article.SubSection.String() != "" {
-					if topArticlesSectionSubSection[article.URL] == nil {
-						topArticlesSectionSubSection[article.URL] = make(map[string]map[string]TopArticle)
+					if topArticlesSectionSubSection[articlePeriod] == nil {
+						topArticlesSectionSubSection[articlePeriod] = make(map[string]map[string]TopArticle)
 					}
 
-					if topArticlesSectionSubSection[article.URL][article.Section] == nil {
-						topArticlesSectionSubSection[article.URL][article.Section] = make(map[string]TopArticle)
+					if topArticlesSectionSubSection[articlePeriod][article.Section] == nil {
+						topArticlesSectionSubSection[articlePeriod][article.Section] = make(map[string]TopArticle)
 					}
 
-					topArticlesSectionSubSection[article.URL][article.Section][article.SubSection.String()] = TopArticle{
+					topArticlesSectionSubSection[articlePeriod][article.Section][article.SubSection.String()] = TopArticle{
 						ViewCount:      article.ViewCount,
 						AvgReadingRate: article.AvgReadingRate,
 						AvgTimeSpent:   article.AvgTimeSpent,
@@ -233,38 +240,38 @@ func main() {
 					recency_weight = (top_articles.recency_weight + EXCLUDED.recency_weight) / (top_articles.view_count + EXCLUDED.view_count);
 			`
 
-			for url, topArticle := range topArticles {
+			for articlePeriod, topArticle := range topArticles {
 				// Insert into PostgreSQL
-				_, err = db.Exec(insertQuery, brand, url, topArticle.ViewCount, topArticle.AvgReadingRate, topArticle.AvgTimeSpent, topArticle.RecencyWeight, nil, nil, currentHour)
+				_, err = db.Exec(insertQuery, brand, articlePeriod.URL, topArticle.ViewCount, topArticle.AvgReadingRate, topArticle.AvgTimeSpent, topArticle.RecencyWeight, nil, nil, articlePeriod.CalculationPeriod)
 				if err != nil {
 					logger.LogError("Failed to insert top article for brand %s: %v", brand, err)
 					return
 				}
-				logger.LogInfo("Successfully inserted top article for brand: %s, url: %s", brand, url)
+				logger.LogInfo("Successfully inserted top article for brand: %s, url: %s", brand, articlePeriod.URL)
 			}
 
-			for url, sections := range topArticlesSection {
+			for articlePeriod, sections := range topArticlesSection {
 				for section, topArticle := range sections {
 					// Insert into PostgreSQL
-					_, err = db.Exec(insertQuery, brand, url, topArticle.ViewCount, topArticle.AvgReadingRate, topArticle.AvgTimeSpent, topArticle.RecencyWeight, section, nil, currentHour)
+					_, err = db.Exec(insertQuery, brand, articlePeriod.URL, topArticle.ViewCount, topArticle.AvgReadingRate, topArticle.AvgTimeSpent, topArticle.RecencyWeight, section, nil, articlePeriod.CalculationPeriod)
 					if err != nil {
 						logger.LogError("Failed to insert top article for brand %s and section %s: %v", brand, err, section)
 						return
 					}
-					logger.LogInfo("Successfully inserted top article for brand: %s, url: %s, section: %s", brand, url, section)
+					logger.LogInfo("Successfully inserted top article for brand: %s, url: %s, section: %s", brand, articlePeriod.URL, section)
 				}
 			}
 
-			for url, sections := range topArticlesSectionSubSection {
+			for articlePeriod, sections := range topArticlesSectionSubSection {
 				for section, subSections := range sections {
 					for subSection, topArticle := range subSections {
 						// Insert into PostgreSQL
-						_, err = db.Exec(insertQuery, brand, url, topArticle.ViewCount, topArticle.AvgReadingRate, topArticle.AvgTimeSpent, topArticle.RecencyWeight, section, subSection, currentHour)
+						_, err = db.Exec(insertQuery, brand, articlePeriod.URL, topArticle.ViewCount, topArticle.AvgReadingRate, topArticle.AvgTimeSpent, topArticle.RecencyWeight, section, subSection, articlePeriod.CalculationPeriod)
 						if err != nil {
 							logger.LogError("Failed to insert top article for brand %s, section %s and sub section %s: %v", brand, err, section, subSection)
 							return
 						}
-						logger.LogInfo("Successfully inserted top article for brand: %s, url: %s, section: %s, sub section: %s", brand, url, section, subSection)
+						logger.LogInfo("Successfully inserted top article for brand: %s, url: %s, section: %s, sub section: %s", brand, articlePeriod.URL, section, subSection)
 					}
 				}
 			}
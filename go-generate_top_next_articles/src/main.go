@@ -6,7 +6,6 @@ import (
 	"log"
 	"os"
 	"sync"
-	"time"
 
 	"cloud.google.com/go/bigquery"
 	"github.com/joho/godotenv"
@@ -76,15 +75,13 @@ func init() {
 }
 
 func main() {
-	calculationDate := time.Now()
-	currentHour := calculationDate.Format("2006-01-02 15") + ":00:00"
-
 	type Article struct {
-		URL            string  `bigquery:"url"`
-		NextUrl        string  `bigquery:"next_url"`
-		ViewCount      int     `bigquery:"view_count"`
-		AvgReadingRate float64 `bigquery:"avg_reading_rate"`
-		AvgTimeSpent   float64 `bigquery:"avg_time_spent"`
+		URL               string  `bigquery:"url"`
+		NextUrl           string  `bigquery:"next_url"`
+		CalculationPeriod string  `bigquery:"calculation_period"`
+		ViewCount         int     `bigquery:"view_count"`
+		AvgReadingRate    float64 `bigquery:"avg_reading_rate"`
+		AvgTimeSpent      float64 `bigquery:"avg_time_spent"`
 	}
 
 	type TopNextArticle struct {
@@ -93,6 +90,12 @@ func main() {
 		AvgTimeSpent   float64 `bigquery:"avg_time_spent"`
 	}
 
+	// The late events are counted in the hour they happened, an article may have several calculation periods
+	type ArticlePeriod struct {
+		URL               string
+		CalculationPeriod string
+	}
+
 	// Step 1: Get all brands from PostgreSQL
 	brandsQuery := `SELECT DISTINCT name FROM brand`
 	brandsRows, err := db.Query(brandsQuery)
@@ -137,10 +140,11 @@ func main() {
 					SELECT 
 						le.relevant_referrer AS url,
 						le.url AS next_url,
+						FORMAT_TIMESTAMP('%%F %%H:00:00', le.datetime) AS calculation_period,
 						COUNT(*) AS view_count,
 						ROUND(AVG(CAST(JSON_VALUE(le.metas, '$.readingRate') AS FLOAT64)), 2) AS avg_reading_rate,
 						ROUND(AVG(CAST(JSON_VALUE(le.metas, '$.timeSpent') AS FLOAT64)), 2) AS avg_time_spent,
-						ROW_NUMBER() OVER (PARTITION BY le.relevant_referrer ORDER BY COUNT(*) DESC) AS row_num
+						ROW_NUMBER() OVER (PARTITION BY le.relevant_referrer, FORMAT_TIMESTAMP('%%F %%H:00:00', le.datetime) ORDER BY COUNT(*) DESC) AS row_num
 					FROM 
 						%s_weather.lead_event le
 					WHERE 
@@ -148,14 +152,15 @@ func main() {
 						AND le.relevant_referrer != ""
 						AND le.url != le.relevant_referrer
 						AND le.page_type = 'article'
-						AND le.datetime >= TIMESTAMP_SUB(CURRENT_TIMESTAMP(), INTERVAL 1 MINUTE)
-						AND le.datetime < CURRENT_TIMESTAMP()
+						AND COALESCE(le.ingested_at, le.datetime) >= TIMESTAMP_SUB(CURRENT_TIMESTAMP(), INTERVAL 1 MINUTE)
+						AND COALESCE(le.ingested_at, le.datetime) < CURRENT_TIMESTAMP()
 					GROUP BY 
-						le.relevant_referrer, le.url
+						le.relevant_referrer, le.url, calculation_period
 				)
 				SELECT 
 					url,
 					next_url,
+					calculation_period,
 					view_count,
 					avg_reading_rate,
 					avg_time_spent
@@ -176,7 +181,7 @@ func main() {
 			}
 
 			// Process and insert results into PostgreSQL
-			topNextArticles := make(map[string]map[string]TopNextArticle)
+			topNextArticles := make(map[ArticlePeriod]map[string]TopNextArticle)
 
 			for {
 				var article Article
@@ -190,11 +195,13 @@ func main() {
 					return
 				}
 
-				if topNextArticles[article.URL] == nil {
-					topNextArticles[article.URL] = make(map[string]TopNextArticle)
+				articlePeriod := ArticlePeriod{URL: article.URL, CalculationPeriod: article.CalculationPeriod}
+
+				if topNextArticles[articlePeriod] == nil {
+					topNextArticles[articlePeriod] = make(map[string]TopNextArticle)
 				}
 
-				topNextArticles[article.URL][article.NextUrl] = TopNextArticle{
+				topNextArticles[articlePeriod][article.NextUrl] = TopNextArticle{
 					ViewCount:      article.ViewCount,
 					AvgReadingRate: article.AvgReadingRate,
 					AvgTimeSpent:   article.AvgTimeSpent,
@@ -212,15 +219,15 @@ func main() {
 					avg_reading_rate = (top_next_articles.avg_reading_rate + EXCLUDED.avg_reading_rate) / (top_next_articles.view_count + EXCLUDED.view_count);
 			`
 
-			for url, nextURLs := range topNextArticles {
+			for articlePeriod, nextURLs := range topNextArticles {
 				for nextURL, topNextArticle := range nextURLs {
 					// Insert into PostgreSQL
-					_, err = db.Exec(insertQuery, brand, url, nextURL, topNextArticle.ViewCount, topNextArticle.AvgReadingRate, topNextArticle.AvgTimeSpent, currentHour)
+					_, err = db.Exec(insertQuery, brand, articlePeriod.URL, nextURL, topNextArticle.ViewCount, topNextArticle.AvgReadingRate, topNextArticle.AvgTimeSpent, articlePeriod.CalculationPeriod)
 					if err != nil {
 						logger.LogError("Failed to insert top article for brand %s: %v", brand, err)
 						return
 					}
-					logger.LogInfo("Successfully inserted top next article for brand: %s, url: %s, next url: %s", brand, url, nextURL)
+					logger.LogInfo("Successfully inserted top next article for brand: %s, url: %s, next url: %s", brand, articlePeriod.URL, nextURL)
 				}
 			}
 		}(brand) // Pass the brand as an argument to the goroutine
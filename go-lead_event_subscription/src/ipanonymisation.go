@@ -0,0 +1,56 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"os"
+	"time"
+)
+
+// IP anonymisation modes of a brand, sent by the collector with each lead event
+const (
+	ipAnonymisationFull     = "full"
+	ipAnonymisationTruncate = "truncate"
+	ipAnonymisationHash     = "hash"
+)
+
+// anonymiseIP applies the anonymisation mode of the brand to an IP, truncating it by default
+func anonymiseIP(ipAddress string, mode string, datetime time.Time) string {
+	ip := net.ParseIP(ipAddress)
+	if ip == nil {
+		return ""
+	}
+
+	switch mode {
+	case ipAnonymisationFull:
+		return ip.String()
+	case ipAnonymisationHash:
+		return hashIP(ip, datetime)
+	}
+
+	return truncateIP(ip)
+}
+
+// truncateIP keeps the /24 network of an IPv4 and the /48 network of an IPv6
+func truncateIP(ip net.IP) string {
+	if ipv4 := ip.To4(); ipv4 != nil {
+		return ipv4.Mask(net.CIDRMask(24, 32)).String()
+	}
+
+	return ip.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// hashIP returns a keyed hash of an IP with a salt rotating every day,
+// so that the same IP can be counted within a day but not followed across days
+func hashIP(ip net.IP, datetime time.Time) string {
+	saltMac := hmac.New(sha256.New, []byte(os.Getenv("IP_HASH_SECRET")))
+	saltMac.Write([]byte(datetime.UTC().Format("2006-01-02")))
+	salt := saltMac.Sum(nil)
+
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(ip.To16())
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -9,40 +9,24 @@ import (
 	"time"
 
 	"cloud.google.com/go/bigquery"
-	"cloud.google.com/go/pubsub"
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
 	"github.com/oschwald/geoip2-golang"
 	"golang.org/x/net/context"
 	"google.golang.org/api/option"
+
+	"eventbus"
+	"messages"
 )
 
 var (
 	ctx      = context.Background()
 	logger   *Logger
 	bqClient *bigquery.Client
-	psClient *pubsub.Client
+	eventBus eventbus.EventBus
 	ipDb     *geoip2.Reader
 )
 
-// Structs for storing lead event data
-type LeadEventDataPubSub struct {
-	Brand            string                 `json:"brand"`
-	UUID             string                 `json:"uuid"`
-	LeadUUID         string                 `json:"lead_uuid"`
-	Name             string                 `json:"name"`
-	PageType         string                 `json:"page_type"`
-	PageLanguage     string                 `json:"page_language"`
-	Device           string                 `json:"device"`
-	Url              string                 `json:"url"`
-	Referrer         string                 `json:"referrer"`
-	ReferrerType     string                 `json:"referrer_type"`
-	RelevantReferrer string                 `json:"relevant_referrer"`
-	Metas            map[string]interface{} `json:"metas"`
-	Consent          bool                   `json:"consent"`
-	IP               string                 `json:"ip"`
-}
-
 type IPLocation struct {
 	Country string
 	City    string
@@ -75,7 +59,7 @@ func (l *Logger) LogFatal(format string, args ...interface{}) {
 
 // BatchProcessor structure for managing the batch process
 type BatchProcessor struct {
-	messages     []*pubsub.Message
+	messages     []*eventbus.Message
 	batchMutex   sync.Mutex
 	batchTimer   *time.Timer
 	maxBatchSize int
@@ -85,7 +69,7 @@ type BatchProcessor struct {
 
 func NewBatchProcessor(ctx context.Context, maxBatchSize int, maxWaitTime time.Duration) *BatchProcessor {
 	return &BatchProcessor{
-		messages:     make([]*pubsub.Message, 0, maxBatchSize),
+		messages:     make([]*eventbus.Message, 0, maxBatchSize),
 		batchTimer:   time.NewTimer(maxWaitTime),
 		maxBatchSize: maxBatchSize,
 		maxWaitTime:  maxWaitTime,
@@ -93,7 +77,7 @@ func NewBatchProcessor(ctx context.Context, maxBatchSize int, maxWaitTime time.D
 	}
 }
 
-func (bp *BatchProcessor) AddMessage(msg *pubsub.Message) {
+func (bp *BatchProcessor) AddMessage(msg *eventbus.Message) {
 	bp.batchMutex.Lock()
 	defer bp.batchMutex.Unlock()
 
@@ -136,8 +120,9 @@ func (bp *BatchProcessor) processBatch() {
 
 	// Extract data from the accumulated messages
 	for _, msg := range bp.messages {
-		var leadEventDataPubSub LeadEventDataPubSub
-		if err := json.Unmarshal(msg.Data, &leadEventDataPubSub); err != nil {
+		var leadEventDataPubSub messages.LeadEventDataPubSub
+		envelope, err := messages.Decode(msg, &leadEventDataPubSub)
+		if err != nil {
 			logger.LogError("Error unmarshalling message: %s", err.Error())
 			msg.Nack()
 			continue
@@ -153,6 +138,12 @@ func (bp *BatchProcessor) processBatch() {
 
 		logger.LogInfo("Processing lead event of type %s with uuid %s", leadEventDataPubSub.Name, leadEventDataPubSub.UUID)
 
+		// Messages published before the bot detection have no classification
+		botClassification := leadEventDataPubSub.BotClassification
+		if botClassification == "" {
+			botClassification = "human"
+		}
+
 		var locationCounty, locationCity string
 		if leadEventDataPubSub.Name != "page_behavior" && leadEventDataPubSub.IP != "" {
 			ipLocation := getIpLocation(leadEventDataPubSub.IP)
@@ -160,8 +151,42 @@ func (bp *BatchProcessor) processBatch() {
 			locationCity = ipLocation.City
 		}
 
+		// The version 2 messages carry the corrected time of the event, the version 1 ones only for the events sent by servers
+		ingestedAt := time.Now().UTC()
+		datetime := ingestedAt
+		if !envelope.EventTime.IsZero() {
+			datetime = envelope.EventTime.UTC()
+		} else if leadEventDataPubSub.EventTime != nil {
+			datetime = leadEventDataPubSub.EventTime.UTC()
+		}
+
+		// The messages published before the receiving time were dated when they were received
+		receivedAt := datetime
+		if envelope.ReceivedAt != nil {
+			receivedAt = envelope.ReceivedAt.UTC()
+		}
+
+		var clientEventTime interface{}
+		if envelope.ClientEventTime != nil {
+			clientEventTime = envelope.ClientEventTime.UTC()
+		}
+
+		// The IP is anonymised after the GeoIP lookup, which needs the full IP
+		var ip string
+		if leadEventDataPubSub.IP != "" {
+			ip = anonymiseIP(leadEventDataPubSub.IP, leadEventDataPubSub.IPAnonymisation, datetime)
+		}
+
+		// The event UUID makes the redeliveries of a message idempotent, BigQuery drops the rows already inserted.
+		// The page behavior shares the UUID of its page view, so the name is part of the insert ID.
+		var insertID string
+		if leadEventDataPubSub.UUID != "" {
+			insertID = leadEventDataPubSub.Brand + ":" + leadEventDataPubSub.Name + ":" + leadEventDataPubSub.UUID
+		}
+
 		// Create a row to be inserted
 		row := &bigquery.ValuesSaver{
+			InsertID: insertID,
 			Schema: bigquery.Schema{
 				{Name: "datetime", Type: bigquery.TimestampFieldType},
 				{Name: "brand", Type: bigquery.StringFieldType},
@@ -180,9 +205,28 @@ func (bp *BatchProcessor) processBatch() {
 				{Name: "ip", Type: bigquery.StringFieldType},
 				{Name: "location_country", Type: bigquery.StringFieldType},
 				{Name: "location_city", Type: bigquery.StringFieldType},
+				{Name: "bot_classification", Type: bigquery.StringFieldType},
+				{Name: "consent_storage", Type: bigquery.BooleanFieldType},
+				{Name: "consent_measurement", Type: bigquery.BooleanFieldType},
+				{Name: "consent_personalisation", Type: bigquery.BooleanFieldType},
+				{Name: "os_family", Type: bigquery.StringFieldType},
+				{Name: "os_version", Type: bigquery.StringFieldType},
+				{Name: "browser_family", Type: bigquery.StringFieldType},
+				{Name: "browser_version", Type: bigquery.StringFieldType},
+				{Name: "is_bot", Type: bigquery.BooleanFieldType},
+				{Name: "utm_source", Type: bigquery.StringFieldType},
+				{Name: "utm_medium", Type: bigquery.StringFieldType},
+				{Name: "utm_campaign", Type: bigquery.StringFieldType},
+				{Name: "utm_content", Type: bigquery.StringFieldType},
+				{Name: "click_id", Type: bigquery.StringFieldType},
+				{Name: "click_id_type", Type: bigquery.StringFieldType},
+				{Name: "channel", Type: bigquery.StringFieldType},
+				{Name: "client_event_time", Type: bigquery.TimestampFieldType},
+				{Name: "received_at", Type: bigquery.TimestampFieldType},
+				{Name: "ingested_at", Type: bigquery.TimestampFieldType},
 			},
 			Row: []bigquery.Value{
-				time.Now().UTC(),
+				datetime,
 				leadEventDataPubSub.Brand,
 				leadEventDataPubSub.UUID,
 				leadEventDataPubSub.LeadUUID,
@@ -196,9 +240,28 @@ func (bp *BatchProcessor) processBatch() {
 				leadEventDataPubSub.RelevantReferrer,
 				string(metasJSONBytes),
 				leadEventDataPubSub.Consent,
-				leadEventDataPubSub.IP,
+				ip,
 				locationCounty,
 				locationCity,
+				botClassification,
+				leadEventDataPubSub.ConsentStorage,
+				leadEventDataPubSub.ConsentMeasurement,
+				leadEventDataPubSub.ConsentPersonalisation,
+				leadEventDataPubSub.OSFamily,
+				leadEventDataPubSub.OSVersion,
+				leadEventDataPubSub.BrowserFamily,
+				leadEventDataPubSub.BrowserVersion,
+				leadEventDataPubSub.IsBot,
+				leadEventDataPubSub.UTMSource,
+				leadEventDataPubSub.UTMMedium,
+				leadEventDataPubSub.UTMCampaign,
+				leadEventDataPubSub.UTMContent,
+				leadEventDataPubSub.ClickID,
+				leadEventDataPubSub.ClickIDType,
+				leadEventDataPubSub.Channel,
+				clientEventTime,
+				receivedAt,
+				ingestedAt,
 			},
 		}
 
@@ -229,13 +292,19 @@ func getIpLocation(ipAddress string) IPLocation {
 	// Parse the IP address
 	ip := net.ParseIP(ipAddress)
 
+	var ipLocation IPLocation
+	if ip == nil {
+		logger.LogError("Invalid IP address: %s", ipAddress)
+		return ipLocation
+	}
+
 	// Get the IP address info
 	record, err := ipDb.City(ip)
 	if err != nil {
-		log.Fatal(err)
+		logger.LogError("Error looking up IP location: %v", err)
+		return ipLocation
 	}
 
-	var ipLocation IPLocation
 	ipLocation.Country = record.Country.Names["en"]
 	ipLocation.City = record.City.Names["en"]
 
@@ -262,11 +331,11 @@ func init() {
 	}
 	logger.LogInfo("[SYSTEM] Connected to BigQuery")
 
-	psClient, err = pubsub.NewClient(ctx, os.Getenv("GCP_PROJECT_ID"), option.WithCredentialsFile(os.Getenv("GCP_CREDENTIALS_FILE")))
+	eventBus, err = eventbus.NewEventBus(ctx, os.Getenv("EVENT_BUS"), logger)
 	if err != nil {
-		logger.LogFatal("[SYSTEM] Failed to create Pub/Sub client: %v", err)
+		logger.LogFatal("[SYSTEM] Failed to create event bus: %v", err)
 	}
-	logger.LogInfo("[SYSTEM] Connected to PubSub")
+	logger.LogInfo("[SYSTEM] Connected to event bus")
 
 	// Open the GeoLite2 database
 	ipDb, err = geoip2.Open("GeoLite2-City.mmdb")
@@ -274,6 +343,11 @@ func init() {
 		logger.LogFatal("[SYSTEM] Unable to open the GeoLite2 IP database: %v", err)
 	}
 	logger.LogInfo("[SYSTEM] Successfully opened the GeoLite2 IP database")
+
+	// Key the hashed IPs, an unkeyed hash can be reversed by brute force
+	if os.Getenv("IP_HASH_SECRET") == "" {
+		logger.LogFatal("[SYSTEM] IP_HASH_SECRET is required to hash the IPs")
+	}
 }
 
 func main() {
@@ -283,11 +357,8 @@ func main() {
 	// Start the timer in a separate goroutine
 	go batchProcessor.StartBatchTimer()
 
-	// Get the subscription
-	sub := psClient.Subscription(os.Getenv("ENV") + "-lead_event")
-
-	// Callback function to process messages
-	err := sub.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
+	// Receive the messages of the subscription
+	err := eventBus.Receive(ctx, os.Getenv("ENV")+"-lead_event", os.Getenv("ENV")+"-lead_event", func(ctx context.Context, msg *eventbus.Message) {
 		// Add messages to the batch processor
 		batchProcessor.AddMessage(msg)
 	})
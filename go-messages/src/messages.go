@@ -0,0 +1,182 @@
+// Package messages defines the payloads exchanged on the event bus and their versioned envelope.
+package messages
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"eventbus"
+)
+
+// Attributes of the event bus messages
+const (
+	SchemaVersionAttribute = "schema_version"
+	TypeAttribute          = "type"
+)
+
+// Schema versions of the event bus messages.
+// Version 1 messages are the bare payloads, published without attributes.
+// Version 2 messages are envelopes holding the payload with the metadata of the event.
+const (
+	SchemaVersion1 = 1
+	SchemaVersion2 = 2
+)
+
+// Types of the event bus messages
+const (
+	TypePage       = "page"
+	TypeUser       = "user"
+	TypeLeadEvent  = "lead_event"
+	TypeConversion = "conversion"
+)
+
+// Envelope is the body of a version 2 message, data holds a PageDataPubSub, a UserDataPubSub,
+// a LeadEventDataPubSub or a ConversionDataPubSub depending on the type.
+// The event time is corrected of the clock skew of the client, the client event time is the one it sent
+// and the received time is the one of the collector. The messages published before the received time have none.
+type Envelope struct {
+	SchemaVersion   int             `json:"schema_version"`
+	Type            string          `json:"type"`
+	Brand           string          `json:"brand"`
+	EventTime       time.Time       `json:"event_time"`
+	ClientEventTime *time.Time      `json:"client_event_time,omitempty"`
+	ReceivedAt      *time.Time      `json:"received_at,omitempty"`
+	SentAt          *time.Time      `json:"sent_at,omitempty"`
+	SDKVersion      string          `json:"sdk_version,omitempty"`
+	Data            json.RawMessage `json:"data"`
+}
+
+// Structs for storing page data
+type PageDataPubSub struct {
+	DateTime         time.Time  `json:"datetime"`
+	Brand            string     `json:"brand"`
+	URL              string     `json:"url"`
+	Type             string     `json:"type"`
+	Language         string     `json:"language"`
+	PublicationDate  time.Time  `json:"publication_date"`
+	ModificationDate *time.Time `json:"modification_date"`
+	Title            string     `json:"title"`
+	Description      string     `json:"description"`
+	Content          string     `json:"content"`
+	Section          string     `json:"section"`
+	SubSection       *string    `json:"sub_section"`
+	Image            *string    `json:"image"`
+	IsPaid           bool       `json:"is_paid"`
+	Author           *string    `json:"author"`
+	Keywords         []string   `json:"keywords"`
+	WordCount        int        `json:"word_count"`
+}
+
+// Structs for storing user data
+type UserDataPubSub struct {
+	DateTime     time.Time `json:"datetime"`
+	Brand        string    `json:"brand"`
+	LeadUUID     string    `json:"lead_uuid"`
+	UserID       string    `json:"user_id"`
+	Email        string    `json:"email"`
+	FirstName    string    `json:"first_name"`
+	LastName     string    `json:"last_name"`
+	IsSubscriber bool      `json:"is_subscriber"`
+}
+
+// Structs for storing lead event data, the event time of the version 1 messages is only set for the server events
+type LeadEventDataPubSub struct {
+	Brand                  string                 `json:"brand"`
+	UUID                   string                 `json:"uuid"`
+	LeadUUID               string                 `json:"lead_uuid"`
+	Name                   string                 `json:"name"`
+	PageType               string                 `json:"page_type"`
+	PageLanguage           string                 `json:"page_language"`
+	Device                 string                 `json:"device"`
+	Url                    string                 `json:"url"`
+	Referrer               string                 `json:"referrer"`
+	ReferrerType           string                 `json:"referrer_type"`
+	RelevantReferrer       string                 `json:"relevant_referrer"`
+	Metas                  map[string]interface{} `json:"metas"`
+	Consent                bool                   `json:"consent"`
+	IP                     string                 `json:"ip"`
+	BotClassification      string                 `json:"bot_classification"`
+	EventTime              *time.Time             `json:"event_time,omitempty"`
+	ConsentStorage         bool                   `json:"consent_storage"`
+	ConsentMeasurement     bool                   `json:"consent_measurement"`
+	ConsentPersonalisation bool                   `json:"consent_personalisation"`
+	IPAnonymisation        string                 `json:"ip_anonymisation"`
+	OSFamily               string                 `json:"os_family"`
+	OSVersion              string                 `json:"os_version"`
+	BrowserFamily          string                 `json:"browser_family"`
+	BrowserVersion         string                 `json:"browser_version"`
+	IsBot                  bool                   `json:"is_bot"`
+	UTMSource              string                 `json:"utm_source"`
+	UTMMedium              string                 `json:"utm_medium"`
+	UTMCampaign            string                 `json:"utm_campaign"`
+	UTMContent             string                 `json:"utm_content"`
+	ClickID                string                 `json:"click_id"`
+	ClickIDType            string                 `json:"click_id_type"`
+	Channel                string                 `json:"channel"`
+}
+
+// Structs for storing conversion data, the price is null for the conversions without payment
+type ConversionDataPubSub struct {
+	Brand      string   `json:"brand"`
+	UUID       string   `json:"uuid"`
+	LeadUUID   string   `json:"lead_uuid"`
+	Name       string   `json:"name"`
+	OfferID    string   `json:"offer_id"`
+	Price      *float64 `json:"price"`
+	Currency   string   `json:"currency"`
+	ArticleUrl string   `json:"article_url"`
+	Url        string   `json:"url"`
+	Source     string   `json:"source"`
+}
+
+// NewEnvelopeMessage wraps a payload in a version 2 envelope
+func NewEnvelopeMessage(envelope Envelope, payload interface{}) (*eventbus.Message, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	envelope.SchemaVersion = SchemaVersion2
+	envelope.Data = data
+
+	envelopeJSON, err := json.Marshal(envelope)
+	if err != nil {
+		return nil, err
+	}
+
+	return &eventbus.Message{
+		Data: envelopeJSON,
+		Attributes: map[string]string{
+			SchemaVersionAttribute: strconv.Itoa(SchemaVersion2),
+			TypeAttribute:          envelope.Type,
+		},
+	}, nil
+}
+
+// Decode decodes the payload of a message of any schema version.
+// The envelope of a version 1 message only holds its schema version.
+func Decode(msg *eventbus.Message, payload interface{}) (Envelope, error) {
+	schemaVersion := SchemaVersion1
+	if value, ok := msg.Attributes[SchemaVersionAttribute]; ok {
+		version, err := strconv.Atoi(value)
+		if err != nil {
+			return Envelope{}, fmt.Errorf("Invalid schema version %q", value)
+		}
+		schemaVersion = version
+	}
+
+	switch schemaVersion {
+	case SchemaVersion1:
+		return Envelope{SchemaVersion: SchemaVersion1}, json.Unmarshal(msg.Data, payload)
+	case SchemaVersion2:
+		var envelope Envelope
+		if err := json.Unmarshal(msg.Data, &envelope); err != nil {
+			return Envelope{}, err
+		}
+		return envelope, json.Unmarshal(envelope.Data, payload)
+	}
+
+	return Envelope{}, fmt.Errorf("Unsupported schema version %d", schemaVersion)
+}
@@ -0,0 +1,67 @@
+package messages
+
+import (
+	"testing"
+	"time"
+
+	"eventbus"
+)
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	eventTime := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	msg, err := NewEnvelopeMessage(Envelope{
+		Type:       TypeUser,
+		Brand:      "test",
+		EventTime:  eventTime,
+		SDKVersion: "1.0.0",
+	}, UserDataPubSub{Brand: "test", LeadUUID: "lead", IsSubscriber: true})
+	if err != nil {
+		t.Fatalf("NewEnvelopeMessage() error = %v", err)
+	}
+
+	if msg.Attributes[SchemaVersionAttribute] != "2" || msg.Attributes[TypeAttribute] != TypeUser {
+		t.Errorf("attributes = %v, want the version 2 and the user type", msg.Attributes)
+	}
+
+	var userDataPubSub UserDataPubSub
+	envelope, err := Decode(msg, &userDataPubSub)
+	if err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+
+	if envelope.SchemaVersion != SchemaVersion2 || envelope.Type != TypeUser || envelope.Brand != "test" || !envelope.EventTime.Equal(eventTime) || envelope.SDKVersion != "1.0.0" {
+		t.Errorf("envelope = %+v, want the published envelope", envelope)
+	}
+	if userDataPubSub.LeadUUID != "lead" || !userDataPubSub.IsSubscriber {
+		t.Errorf("payload = %+v, want the published payload", userDataPubSub)
+	}
+}
+
+func TestDecodeVersion1(t *testing.T) {
+	var pageDataPubSub PageDataPubSub
+	envelope, err := Decode(&eventbus.Message{Data: []byte(`{"brand": "test", "url": "https://example.com/article"}`)}, &pageDataPubSub)
+	if err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+
+	if envelope.SchemaVersion != SchemaVersion1 {
+		t.Errorf("schema version = %d, want %d", envelope.SchemaVersion, SchemaVersion1)
+	}
+	if pageDataPubSub.URL != "https://example.com/article" {
+		t.Errorf("URL = %q, want the bare payload URL", pageDataPubSub.URL)
+	}
+}
+
+func TestDecodeUnsupportedVersion(t *testing.T) {
+	for _, version := range []string{"3", "two"} {
+		msg := &eventbus.Message{
+			Data:       []byte(`{}`),
+			Attributes: map[string]string{SchemaVersionAttribute: version},
+		}
+
+		if _, err := Decode(msg, &PageDataPubSub{}); err == nil {
+			t.Errorf("Decode() of schema version %q error = nil, want an error", version)
+		}
+	}
+}
@@ -0,0 +1,11 @@
+module normalise_urls
+
+go 1.23.1
+
+require (
+	github.com/joho/godotenv v1.5.1
+	github.com/lib/pq v1.10.9
+	urlnormaliser v0.0.0
+)
+
+replace urlnormaliser => ../../go-urlnormaliser/src
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/joho/godotenv"
+	_ "github.com/lib/pq"
+
+	"urlnormaliser"
+)
+
+var (
+	logger *Logger
+	db     *sql.DB
+	dryRun bool
+)
+
+// Logger struct to encapsulate the standard logger
+type Logger struct {
+	logger *log.Logger
+}
+
+// LogInfo writes an informational message
+func (l *Logger) LogInfo(format string, args ...interface{}) {
+	l.logger.Printf("[INFO] "+format, args...)
+}
+
+// LogWarn writes a warning message
+func (l *Logger) LogWarn(format string, args ...interface{}) {
+	l.logger.Printf("[WARN] "+format, args...)
+}
+
+// LogError writes an error message
+func (l *Logger) LogError(format string, args ...interface{}) {
+	l.logger.Printf("[ERROR] "+format, args...)
+}
+
+// LogFatal writes an error message and then exits the application
+func (l *Logger) LogFatal(format string, args ...interface{}) {
+	l.logger.Fatalf("[FATAL] "+format, args...)
+}
+
+// URLColumn is a column holding page URLs.
+// OtherKeys are the columns of the unique key of the table besides the brand and the URL column.
+// Merge is the SET clause merging a duplicate row (src) into the row of the normalised URL (dst),
+// without merge the row of the normalised URL is kept as is.
+type URLColumn struct {
+	Table     string
+	Column    string
+	OtherKeys []string
+	Merge     string
+}
+
+// Metrics are merged by summing the view counts and weighting the averages by the view counts
+const articleMetricsMerge = `
+	view_count = dst.view_count + src.view_count,
+	avg_time_spent = (dst.avg_time_spent * dst.view_count + src.avg_time_spent * src.view_count) / GREATEST(dst.view_count + src.view_count, 1),
+	avg_reading_rate = (dst.avg_reading_rate * dst.view_count + src.avg_reading_rate * src.view_count) / GREATEST(dst.view_count + src.view_count, 1)
+`
+
+// The URL columns of the pipeline. The lead events are stored in BigQuery and are not rewritten.
+var urlColumns = []URLColumn{
+	{Table: "page", Column: "url"},
+	{Table: "article_metrics", Column: "url", OtherKeys: []string{"calculation_period"}, Merge: articleMetricsMerge},
+	{Table: "top_articles", Column: "url", OtherKeys: []string{"calculation_period"}, Merge: articleMetricsMerge + `,
+	recency_weight = (dst.recency_weight * dst.view_count + src.recency_weight * src.view_count) / GREATEST(dst.view_count + src.view_count, 1)
+	`},
+	{Table: "top_next_articles", Column: "initial_url", OtherKeys: []string{"next_url", "calculation_period"}, Merge: articleMetricsMerge},
+	{Table: "top_next_articles", Column: "next_url", OtherKeys: []string{"initial_url", "calculation_period"}, Merge: articleMetricsMerge},
+	{Table: "content_based_articles", Column: "article_url_1", OtherKeys: []string{"article_url_2"}},
+	{Table: "content_based_articles", Column: "article_url_2", OtherKeys: []string{"article_url_1"}},
+	{Table: "lead_read_articles", Column: "url", OtherKeys: []string{"lead_uuid"}, Merge: "first_read_at = LEAST(dst.first_read_at, src.first_read_at)"},
+	{Table: "conversion", Column: "article_url", OtherKeys: []string{"uuid"}},
+}
+
+// Pairs of a page with itself left by the normalisation of both URLs
+var selfPairCleanups = []string{
+	"DELETE FROM top_next_articles WHERE brand = $1 AND initial_url = next_url",
+	"DELETE FROM content_based_articles WHERE brand = $1 AND article_url_1 = article_url_2",
+}
+
+// Initialize SQL client
+func init() {
+	// Init logger
+	logger = &Logger{
+		logger: log.New(os.Stdout, "", log.LstdFlags),
+	}
+
+	var err error
+
+	// Load environment variables from .env file
+	if err = godotenv.Load(); err != nil {
+		logger.LogFatal("[SYSTEM] Error loading .env file")
+	}
+
+	db, err = sql.Open("postgres", os.Getenv("POSTGRES_DSN"))
+	if err != nil {
+		logger.LogFatal("[SYSTEM] Failed to connect to PostgreSQL: %v", err)
+	}
+	logger.LogInfo("[SYSTEM] Connected to PostgreSQL")
+
+	// Only log the rewrites unless DRY_RUN is false
+	dryRun = os.Getenv("DRY_RUN") != "false"
+}
+
+// rewriteURL moves the rows of a URL to its normalised URL, merging them into the rows already there
+func rewriteURL(brandName string, urlColumn URLColumn, oldURL string, newURL string) error {
+	var otherKeysConditions []string
+	for _, key := range urlColumn.OtherKeys {
+		otherKeysConditions = append(otherKeysConditions, fmt.Sprintf("AND existing.%[1]s = %[2]s.%[1]s", key, urlColumn.Table))
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Move the rows without counterpart at the normalised URL
+	moveQuery := fmt.Sprintf(`
+		UPDATE %[1]s
+		SET %[2]s = $3
+		WHERE brand = $1 AND %[2]s = $2
+		AND NOT EXISTS (
+			SELECT 1 FROM %[1]s AS existing
+			WHERE existing.brand = $1 AND existing.%[2]s = $3 %[3]s
+		)
+	`, urlColumn.Table, urlColumn.Column, strings.Join(otherKeysConditions, " "))
+	if _, err := tx.Exec(moveQuery, brandName, oldURL, newURL); err != nil {
+		return fmt.Errorf("Failed to move rows: %v", err)
+	}
+
+	// Merge the remaining rows into their counterpart
+	if urlColumn.Merge != "" {
+		var otherKeysJoin []string
+		for _, key := range urlColumn.OtherKeys {
+			otherKeysJoin = append(otherKeysJoin, fmt.Sprintf("AND dst.%[1]s = src.%[1]s", key))
+		}
+
+		mergeQuery := fmt.Sprintf(`
+			UPDATE %[1]s AS dst
+			SET %[3]s
+			FROM %[1]s AS src
+			WHERE src.brand = $1 AND src.%[2]s = $2
+			AND dst.brand = $1 AND dst.%[2]s = $3 %[4]s
+		`, urlColumn.Table, urlColumn.Column, urlColumn.Merge, strings.Join(otherKeysJoin, " "))
+		if _, err := tx.Exec(mergeQuery, brandName, oldURL, newURL); err != nil {
+			return fmt.Errorf("Failed to merge rows: %v", err)
+		}
+	}
+
+	deleteQuery := fmt.Sprintf("DELETE FROM %s WHERE brand = $1 AND %s = $2", urlColumn.Table, urlColumn.Column)
+	if _, err := tx.Exec(deleteQuery, brandName, oldURL); err != nil {
+		return fmt.Errorf("Failed to delete merged rows: %v", err)
+	}
+
+	return tx.Commit()
+}
+
+// normaliseURLColumn rewrites the URLs of a column for a brand and returns the number of rewritten URLs
+func normaliseURLColumn(brandName string, normaliser *urlnormaliser.URLNormaliser, urlColumn URLColumn) (int, error) {
+	rows, err := db.Query(fmt.Sprintf("SELECT DISTINCT %s FROM %s WHERE brand = $1", urlColumn.Column, urlColumn.Table), brandName)
+	if err != nil {
+		return 0, err
+	}
+
+	var urls []string
+	for rows.Next() {
+		var url string
+		if err := rows.Scan(&url); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		urls = append(urls, url)
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	rewritten := 0
+	for _, url := range urls {
+		normalisedURL := normaliser.Normalise(url)
+		if normalisedURL == url {
+			continue
+		}
+
+		if dryRun {
+			logger.LogInfo("[DRY_RUN] %s.%s for brand %s: %s -> %s", urlColumn.Table, urlColumn.Column, brandName, url, normalisedURL)
+			rewritten++
+			continue
+		}
+
+		if err := rewriteURL(brandName, urlColumn, url, normalisedURL); err != nil {
+			logger.LogError("Failed to rewrite %s.%s %s for brand %s: %v", urlColumn.Table, urlColumn.Column, url, brandName, err)
+			continue
+		}
+		rewritten++
+	}
+
+	return rewritten, nil
+}
+
+func main() {
+	if dryRun {
+		logger.LogInfo("Dry run, set DRY_RUN=false to rewrite the URLs")
+	}
+
+	// Query to get the brands with their URL rules
+	brandsQuery := "SELECT name, COALESCE(url_rules, '{}') FROM brand"
+	brandsRows, err := db.Query(brandsQuery)
+	if err != nil {
+		logger.LogError("Failed to retrieve brands: %v", err)
+		return
+	}
+	defer brandsRows.Close()
+
+	var wg sync.WaitGroup
+
+	// Iterate over each brand
+	for brandsRows.Next() {
+		var brand string
+		var urlRulesJSON []byte
+		if err := brandsRows.Scan(&brand, &urlRulesJSON); err != nil {
+			logger.LogError("Failed to scan brand: %v", err)
+			return
+		}
+
+		var urlRules urlnormaliser.URLRules
+		if err := json.Unmarshal(urlRulesJSON, &urlRules); err != nil {
+			logger.LogError("Failed to parse URL rules of brand %s: %v", brand, err)
+			continue
+		}
+
+		normaliser, err := urlnormaliser.NewURLNormaliser(urlRules)
+		if err != nil {
+			logger.LogError("Invalid URL rules for brand %s: %v", brand, err)
+			continue
+		}
+
+		wg.Add(1) // Add to the WaitGroup for each brand
+
+		// Launch a goroutine for each brand
+		go func(brand string) {
+			defer wg.Done() // Mark the goroutine as done when finished
+
+			for _, urlColumn := range urlColumns {
+				rewritten, err := normaliseURLColumn(brand, normaliser, urlColumn)
+				if err != nil {
+					logger.LogError("Failed to normalise %s.%s for brand %s: %v", urlColumn.Table, urlColumn.Column, brand, err)
+					continue
+				}
+
+				logger.LogInfo("%d URLs of %s.%s normalised for brand %s", rewritten, urlColumn.Table, urlColumn.Column, brand)
+			}
+
+			if dryRun {
+				return
+			}
+
+			for _, cleanupQuery := range selfPairCleanups {
+				if _, err := db.Exec(cleanupQuery, brand); err != nil {
+					logger.LogError("Failed to clean up self pairs for brand %s: %v", brand, err)
+				}
+			}
+		}(brand) // Pass the brand as an argument to the goroutine
+	}
+
+	// Wait for all goroutines to complete
+	wg.Wait()
+
+	logger.LogInfo("URLs normalised successfully.")
+}
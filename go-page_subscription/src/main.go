@@ -2,20 +2,21 @@ package main
 
 import (
 	"database/sql"
-	"encoding/json"
 	"log"
 	"os"
 	"sync"
 	"time"
 
 	"cloud.google.com/go/bigquery"
-	"cloud.google.com/go/pubsub"
 	"github.com/abadojack/whatlanggo"
 	"github.com/joho/godotenv"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"golang.org/x/net/context"
 	"golang.org/x/text/language"
 	"google.golang.org/api/option"
+
+	"eventbus"
+	"messages"
 )
 
 var (
@@ -23,7 +24,7 @@ var (
 	logger   *Logger
 	db       *sql.DB
 	bqClient *bigquery.Client
-	psClient *pubsub.Client
+	eventBus eventbus.EventBus
 )
 
 // Structs for storing page data
@@ -40,24 +41,9 @@ type PageData struct {
 	SubSection       *string              `json:"subSection"`
 	Image            *string              `json:"image"`
 	IsPaid           bool                 `json:"isPaid"`
-}
-
-// Structs for storing page data
-type PageDataPubSub struct {
-	DateTime         time.Time  `json:"datetime"`
-	Brand            string     `json:"brand"`
-	URL              string     `json:"url"`
-	Type             string     `json:"type"`
-	Language         string     `json:"language"`
-	PublicationDate  time.Time  `json:"publication_date"`
-	ModificationDate *time.Time `json:"modification_date"`
-	Title            string     `json:"title"`
-	Description      string     `json:"description"`
-	Content          string     `json:"content"`
-	Section          string     `json:"section"`
-	SubSection       *string    `json:"sub_section"`
-	Image            *string    `json:"image"`
-	IsPaid           bool       `json:"is_paid"`
+	Author           *string              `json:"author"`
+	Keywords         []string             `json:"keywords"`
+	WordCount        int                  `json:"wordCount"`
 }
 
 // Logger struct to encapsulate the standard logger
@@ -110,7 +96,7 @@ func (ct PublicationDateTime) Time() time.Time {
 
 // BatchProcessor structure for managing the batch process
 type BatchProcessor struct {
-	messages     []*pubsub.Message
+	messages     []*eventbus.Message
 	batchMutex   sync.Mutex
 	batchTimer   *time.Timer
 	maxBatchSize int
@@ -120,7 +106,7 @@ type BatchProcessor struct {
 
 func NewBatchProcessor(ctx context.Context, maxBatchSize int, maxWaitTime time.Duration) *BatchProcessor {
 	return &BatchProcessor{
-		messages:     make([]*pubsub.Message, 0, maxBatchSize),
+		messages:     make([]*eventbus.Message, 0, maxBatchSize),
 		batchTimer:   time.NewTimer(maxWaitTime),
 		maxBatchSize: maxBatchSize,
 		maxWaitTime:  maxWaitTime,
@@ -128,7 +114,7 @@ func NewBatchProcessor(ctx context.Context, maxBatchSize int, maxWaitTime time.D
 	}
 }
 
-func (bp *BatchProcessor) AddMessage(msg *pubsub.Message) {
+func (bp *BatchProcessor) AddMessage(msg *eventbus.Message) {
 	bp.batchMutex.Lock()
 	defer bp.batchMutex.Unlock()
 
@@ -174,7 +160,7 @@ func (bp *BatchProcessor) processBatch() {
 	}
 
 	// Messages to ack
-	var msgsToAck []*pubsub.Message
+	var msgsToAck []*eventbus.Message
 
 	// Accumulate the rows to insert
 	var rows []*bigquery.ValuesSaver
@@ -182,8 +168,8 @@ func (bp *BatchProcessor) processBatch() {
 	// Extract data from the accumulated messages
 	for _, msg := range bp.messages {
 		logger.LogInfo(string(msg.Data))
-		var pageDataPubSub PageDataPubSub
-		if err := json.Unmarshal(msg.Data, &pageDataPubSub); err != nil {
+		var pageDataPubSub messages.PageDataPubSub
+		if _, err := messages.Decode(msg, &pageDataPubSub); err != nil {
 			logger.LogError("Error unmarshalling message: %s", err.Error())
 			msg.Nack()
 			continue
@@ -221,8 +207,8 @@ func (bp *BatchProcessor) processBatch() {
 			logger.LogInfo("Page is new")
 
 			// Add insert to the transaction
-			query := `INSERT INTO page (brand, type, language, url, publication_date, modification_date, title, description, content, section, sub_section, image, is_paid) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)`
-			_, err := tx.Exec(query, pageDataPubSub.Brand, pageDataPubSub.Type, pageDataPubSub.Language, pageDataPubSub.URL, pageDataPubSub.PublicationDate, pageDataPubSub.ModificationDate, pageDataPubSub.Title, pageDataPubSub.Description, pageDataPubSub.Content, pageDataPubSub.Section, pageDataPubSub.SubSection, pageDataPubSub.Image, pageDataPubSub.IsPaid)
+			query := `INSERT INTO page (brand, type, language, url, publication_date, modification_date, title, description, content, section, sub_section, image, is_paid, author, keywords, word_count) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)`
+			_, err := tx.Exec(query, pageDataPubSub.Brand, pageDataPubSub.Type, pageDataPubSub.Language, pageDataPubSub.URL, pageDataPubSub.PublicationDate, pageDataPubSub.ModificationDate, pageDataPubSub.Title, pageDataPubSub.Description, pageDataPubSub.Content, pageDataPubSub.Section, pageDataPubSub.SubSection, pageDataPubSub.Image, pageDataPubSub.IsPaid, pageDataPubSub.Author, pq.Array(pageDataPubSub.Keywords), pageDataPubSub.WordCount)
 			if err != nil {
 				tx.Rollback()
 				logger.LogError("Error inserting into page: ", err)
@@ -247,6 +233,9 @@ func (bp *BatchProcessor) processBatch() {
 					{Name: "sub_section", Type: bigquery.StringFieldType},
 					{Name: "image", Type: bigquery.StringFieldType},
 					{Name: "is_paid", Type: bigquery.BooleanFieldType},
+					{Name: "author", Type: bigquery.StringFieldType},
+					{Name: "keywords", Type: bigquery.StringFieldType, Repeated: true},
+					{Name: "word_count", Type: bigquery.IntegerFieldType},
 				},
 				Row: []bigquery.Value{
 					pageDataPubSub.DateTime,
@@ -263,6 +252,9 @@ func (bp *BatchProcessor) processBatch() {
 					pageDataPubSub.SubSection,
 					pageDataPubSub.Image,
 					pageDataPubSub.IsPaid,
+					pageDataPubSub.Author,
+					pageDataPubSub.Keywords,
+					pageDataPubSub.WordCount,
 				},
 			}
 
@@ -296,9 +288,12 @@ func (bp *BatchProcessor) processBatch() {
 					section = $5,
 					sub_section = $6,
 					image = $7,
-					is_paid = $8
+					is_paid = $8,
+					author = $9,
+					keywords = $10,
+					word_count = $11
 				WHERE
-					brand = $9 AND url = $10
+					brand = $12 AND url = $13
 			`
 
 				_, err = tx.Exec(query,
@@ -310,6 +305,9 @@ func (bp *BatchProcessor) processBatch() {
 					pageDataPubSub.SubSection,
 					pageDataPubSub.Image,
 					pageDataPubSub.IsPaid,
+					pageDataPubSub.Author,
+					pq.Array(pageDataPubSub.Keywords),
+					pageDataPubSub.WordCount,
 					pageDataPubSub.Brand,
 					pageDataPubSub.URL,
 				)
@@ -336,6 +334,9 @@ func (bp *BatchProcessor) processBatch() {
 						{Name: "sub_section", Type: bigquery.StringFieldType},
 						{Name: "image", Type: bigquery.StringFieldType},
 						{Name: "is_paid", Type: bigquery.BooleanFieldType},
+						{Name: "author", Type: bigquery.StringFieldType},
+						{Name: "keywords", Type: bigquery.StringFieldType, Repeated: true},
+						{Name: "word_count", Type: bigquery.IntegerFieldType},
 					},
 					Row: []bigquery.Value{
 						pageDataPubSub.DateTime,
@@ -352,6 +353,9 @@ func (bp *BatchProcessor) processBatch() {
 						pageDataPubSub.SubSection,
 						pageDataPubSub.Image,
 						pageDataPubSub.IsPaid,
+						pageDataPubSub.Author,
+						pageDataPubSub.Keywords,
+						pageDataPubSub.WordCount,
 					},
 				}
 
@@ -464,11 +468,11 @@ func init() {
 	}
 	logger.LogInfo("[SYSTEM] Connected to BigQuery")
 
-	psClient, err = pubsub.NewClient(ctx, os.Getenv("GCP_PROJECT_ID"), option.WithCredentialsFile(os.Getenv("GCP_CREDENTIALS_FILE")))
+	eventBus, err = eventbus.NewEventBus(ctx, os.Getenv("EVENT_BUS"), logger)
 	if err != nil {
-		logger.LogFatal("[SYSTEM] Failed to create Pub/Sub client: %v", err)
+		logger.LogFatal("[SYSTEM] Failed to create event bus: %v", err)
 	}
-	logger.LogInfo("[SYSTEM] Connected to PubSub")
+	logger.LogInfo("[SYSTEM] Connected to event bus")
 }
 
 func main() {
@@ -478,11 +482,8 @@ func main() {
 	// Start the timer in a separate goroutine
 	go batchProcessor.StartBatchTimer()
 
-	// Get the subscription
-	sub := psClient.Subscription(os.Getenv("ENV") + "-page")
-
-	// Callback function to process messages
-	err := sub.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
+	// Receive the messages of the subscription
+	err := eventBus.Receive(ctx, os.Getenv("ENV")+"-page", os.Getenv("ENV")+"-page", func(ctx context.Context, msg *eventbus.Message) {
 		// Add messages to the batch processor
 		batchProcessor.AddMessage(msg)
 	})
@@ -0,0 +1,3 @@
+module urlnormaliser
+
+go 1.23.1
@@ -0,0 +1,130 @@
+// Package urlnormaliser turns the URLs of the pages of a brand into their canonical URL, with the URL rules of the brand.
+package urlnormaliser
+
+import (
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// AMP path patterns applied to the brands without their own patterns
+var defaultAMPPatterns = []string{
+	`/amp/?$`,
+	`^/amp/`,
+	`\.amp\b`,
+}
+
+var duplicateSlashes = regexp.MustCompile(`/{2,}`)
+
+// URLRules are the URL normalisation rules of a brand.
+// KeepParams are the query parameters identifying a page, every other parameter is dropped.
+// AMPPatterns are regular expressions removed from the path of the AMP variants, nil applies the default patterns.
+// HostAliases maps the alternative hosts of the brand site to its canonical host.
+type URLRules struct {
+	KeepParams  []string          `json:"keep_params"`
+	AMPPatterns []string          `json:"amp_patterns"`
+	HostAliases map[string]string `json:"host_aliases"`
+}
+
+// URLNormaliser turns the URLs of a page into its canonical URL, which is used as join key by the whole pipeline
+type URLNormaliser struct {
+	keepParams  map[string]bool
+	ampPatterns []*regexp.Regexp
+	hostAliases map[string]string
+}
+
+func NewURLNormaliser(rules URLRules) (*URLNormaliser, error) {
+	n := &URLNormaliser{
+		keepParams:  make(map[string]bool, len(rules.KeepParams)),
+		hostAliases: make(map[string]string, len(rules.HostAliases)),
+	}
+
+	for _, param := range rules.KeepParams {
+		n.keepParams[strings.ToLower(param)] = true
+	}
+
+	ampPatterns := rules.AMPPatterns
+	if ampPatterns == nil {
+		ampPatterns = defaultAMPPatterns
+	}
+
+	for _, pattern := range ampPatterns {
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		n.ampPatterns = append(n.ampPatterns, compiled)
+	}
+
+	for alias, host := range rules.HostAliases {
+		n.hostAliases[NormaliseHost(alias)] = NormaliseHost(host)
+	}
+
+	return n, nil
+}
+
+// Normalise returns the canonical URL of a page: https, lowercase host without default port nor alias,
+// no AMP variant, no duplicate nor trailing slash, only the kept query parameters in order and no fragment.
+// Values that are not absolute HTTP URLs are returned unchanged.
+func (n *URLNormaliser) Normalise(rawURL string) string {
+	rawURL = strings.TrimSpace(rawURL)
+
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return rawURL
+	}
+
+	u.Scheme = "https"
+	u.User = nil
+	u.Fragment = ""
+	u.RawFragment = ""
+
+	u.Host = NormaliseHost(u.Host)
+	if host, ok := n.hostAliases[u.Host]; ok {
+		u.Host = host
+	}
+
+	// The duplicate slashes are removed first so that the AMP patterns anchored on a slash match
+	path := duplicateSlashes.ReplaceAllString(u.EscapedPath(), "/")
+	for _, pattern := range n.ampPatterns {
+		path = pattern.ReplaceAllString(path, "")
+	}
+	path = duplicateSlashes.ReplaceAllString("/"+path, "/")
+	if len(path) > 1 {
+		path = strings.TrimSuffix(path, "/")
+	}
+
+	if unescaped, err := url.PathUnescape(path); err == nil {
+		u.Path = unescaped
+		u.RawPath = path
+	}
+
+	query := u.Query()
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		if n.keepParams[strings.ToLower(key)] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var kept []string
+	for _, key := range keys {
+		for _, value := range query[key] {
+			kept = append(kept, url.QueryEscape(key)+"="+url.QueryEscape(value))
+		}
+	}
+	u.RawQuery = strings.Join(kept, "&")
+	u.ForceQuery = false
+
+	return u.String()
+}
+
+// NormaliseHost lowercases a host and removes its default HTTP ports and its trailing dot
+func NormaliseHost(host string) string {
+	host = strings.ToLower(strings.TrimSpace(host))
+	host = strings.TrimSuffix(host, ":443")
+	host = strings.TrimSuffix(host, ":80")
+	return strings.TrimSuffix(host, ".")
+}
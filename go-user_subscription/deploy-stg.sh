@@ -21,9 +21,9 @@ echo "Authenticating to Google Cloud..."
 gcloud config set project $PROJECT_ID
 gcloud container clusters get-credentials $CLUSTER_NAME --region $CLUSTER_REGION
 
-# 2. Build the Docker image
+# 2. Build the Docker image, from the repository root to include the shared modules
 echo "Building Docker image..."
-docker build -t $IMAGE_REGION-docker.pkg.dev/$PROJECT_ID/$DEPOSIT_NAME/$IMAGE_NAME:$TIMESTAMP .
+docker build -f Dockerfile -t $IMAGE_REGION-docker.pkg.dev/$PROJECT_ID/$DEPOSIT_NAME/$IMAGE_NAME:$TIMESTAMP ..
 
 # 3. Push the image to Google Container Registry
 echo "Pushing Docker image to Google Container Registry..."
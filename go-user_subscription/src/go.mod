@@ -5,10 +5,13 @@ go 1.23.1
 require (
 	cloud.google.com/go/bigquery v1.63.0
 	cloud.google.com/go/pubsub v1.43.0
+	eventbus v0.0.0
+	github.com/go-redis/redis/v8 v8.11.5
 	github.com/joho/godotenv v1.5.1
 	github.com/lib/pq v1.10.9
 	golang.org/x/net v0.29.0
 	google.golang.org/api v0.198.0
+	messages v0.0.0
 )
 
 require (
@@ -18,6 +21,8 @@ require (
 	cloud.google.com/go/compute/metadata v0.5.1 // indirect
 	cloud.google.com/go/iam v1.2.0 // indirect
 	github.com/apache/arrow/go/v15 v15.0.2 // indirect
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
 	github.com/felixge/httpsnoop v1.0.4 // indirect
 	github.com/go-logr/logr v1.4.2 // indirect
 	github.com/go-logr/stdr v1.2.2 // indirect
@@ -54,3 +59,8 @@ require (
 	google.golang.org/grpc v1.66.2 // indirect
 	google.golang.org/protobuf v1.34.2 // indirect
 )
+
+replace (
+	eventbus => ../../go-eventbus/src
+	messages => ../../go-messages/src
+)
@@ -2,18 +2,19 @@ package main
 
 import (
 	"database/sql"
-	"encoding/json"
 	"log"
 	"os"
 	"sync"
 	"time"
 
 	"cloud.google.com/go/bigquery"
-	"cloud.google.com/go/pubsub"
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
 	"golang.org/x/net/context"
 	"google.golang.org/api/option"
+
+	"eventbus"
+	"messages"
 )
 
 var (
@@ -21,7 +22,7 @@ var (
 	logger   *Logger
 	db       *sql.DB
 	bqClient *bigquery.Client
-	psClient *pubsub.Client
+	eventBus eventbus.EventBus
 )
 
 // Structs for storing user data
@@ -34,18 +35,6 @@ type UserData struct {
 	IsSubscriber bool   `json:"isSubscriber"`
 }
 
-// Structs for storing user data
-type UserDataPubSub struct {
-	DateTime     time.Time `json:"datetime"`
-	Brand        string    `json:"brand"`
-	LeadUUID     string    `json:"lead_uuid"`
-	UserID       string    `json:"user_id"`
-	Email        string    `json:"email"`
-	FirstName    string    `json:"first_name"`
-	LastName     string    `json:"last_name"`
-	IsSubscriber bool      `json:"is_subscriber"`
-}
-
 // Logger struct to encapsulate the standard logger
 type Logger struct {
 	logger *log.Logger
@@ -73,7 +62,7 @@ func (l *Logger) LogFatal(format string, args ...interface{}) {
 
 // BatchProcessor structure for managing the batch process
 type BatchProcessor struct {
-	messages     []*pubsub.Message
+	messages     []*eventbus.Message
 	batchMutex   sync.Mutex
 	batchTimer   *time.Timer
 	maxBatchSize int
@@ -83,7 +72,7 @@ type BatchProcessor struct {
 
 func NewBatchProcessor(ctx context.Context, maxBatchSize int, maxWaitTime time.Duration) *BatchProcessor {
 	return &BatchProcessor{
-		messages:     make([]*pubsub.Message, 0, maxBatchSize),
+		messages:     make([]*eventbus.Message, 0, maxBatchSize),
 		batchTimer:   time.NewTimer(maxWaitTime),
 		maxBatchSize: maxBatchSize,
 		maxWaitTime:  maxWaitTime,
@@ -91,7 +80,7 @@ func NewBatchProcessor(ctx context.Context, maxBatchSize int, maxWaitTime time.D
 	}
 }
 
-func (bp *BatchProcessor) AddMessage(msg *pubsub.Message) {
+func (bp *BatchProcessor) AddMessage(msg *eventbus.Message) {
 	bp.batchMutex.Lock()
 	defer bp.batchMutex.Unlock()
 
@@ -137,15 +126,15 @@ func (bp *BatchProcessor) processBatch() {
 	}
 
 	// Messages to ack
-	var msgsToAck []*pubsub.Message
+	var msgsToAck []*eventbus.Message
 
 	// Accumulate the rows to insert
 	var rows []*bigquery.ValuesSaver
 
 	// Extract data from the accumulated messages
 	for _, msg := range bp.messages {
-		var userDataPubSub UserDataPubSub
-		if err := json.Unmarshal(msg.Data, &userDataPubSub); err != nil {
+		var userDataPubSub messages.UserDataPubSub
+		if _, err := messages.Decode(msg, &userDataPubSub); err != nil {
 			logger.LogError("Error unmarshalling message: %s", err.Error())
 			msg.Nack()
 			continue
@@ -317,11 +306,11 @@ func init() {
 	}
 	logger.LogInfo("[SYSTEM] Connected to BigQuery")
 
-	psClient, err = pubsub.NewClient(ctx, os.Getenv("GCP_PROJECT_ID"), option.WithCredentialsFile(os.Getenv("GCP_CREDENTIALS_FILE")))
+	eventBus, err = eventbus.NewEventBus(ctx, os.Getenv("EVENT_BUS"), logger)
 	if err != nil {
-		logger.LogFatal("[SYSTEM] Failed to create Pub/Sub client: %v", err)
+		logger.LogFatal("[SYSTEM] Failed to create event bus: %v", err)
 	}
-	logger.LogInfo("[SYSTEM] Connected to PubSub")
+	logger.LogInfo("[SYSTEM] Connected to event bus")
 }
 
 func main() {
@@ -331,11 +320,8 @@ func main() {
 	// Start the timer in a separate goroutine
 	go batchProcessor.StartBatchTimer()
 
-	// Get the subscription
-	sub := psClient.Subscription(os.Getenv("ENV") + "-user")
-
-	// Callback function to process messages
-	err := sub.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
+	// Receive the messages of the subscription
+	err := eventBus.Receive(ctx, os.Getenv("ENV")+"-user", os.Getenv("ENV")+"-user", func(ctx context.Context, msg *eventbus.Message) {
 		// Add messages to the batch processor
 		batchProcessor.AddMessage(msg)
 	})
@@ -1,31 +1,12 @@
 (function() {
     class PageDataCollector {
         /**
-         * Collect page data from meta tags.
+         * Send the page HTML, the collector extracts the page data from the meta tags.
          */
         collect() {
-            let isPaid = false;
-            const ogContentTier = document.querySelector('meta[property="og:article:content_tier"]');
-
-            if (getLdJsonValue('isAccessibleForFree')) {
-                isPaid = getLdJsonValue('isAccessibleForFree') === 'False';
-            } else if(ogContentTier) {
-                isPaid = ogContentTier.content !== "free";
-            }
-
             const pageData = {
-                url: document.querySelector('link[rel="canonical"]')?.href || window.location.href,
-                type: getPageType(),
-                language: document.querySelector('meta[property="og:locale"]')?.content || "",
-                publicationDate: getLdJsonValue('datePublished') || document.querySelector('meta[property="og:article:published_time"]')?.content || null,
-                modificationDate: getLdJsonValue('dateModified') || null,
-                title: getLdJsonValue('headline') || document.querySelector('meta[property="og:title"]')?.content || "",
-                description: getLdJsonValue('description') || document.querySelector('meta[property="og:description"]')?.content || "",
-                content: document.querySelector('article')?.innerText || "",
-                section: getLdJsonValue('articleSection') ? getLdJsonValue('articleSection')[0] : document.querySelector('meta[property="og:article:section"]')?.content || "",
-                subSection: getLdJsonValue('articleSection') ? getLdJsonValue('articleSection')[1] : "",
-                image: getLdJsonValue('image') || document.querySelector('meta[property="og:image"]')?.content || "",
-                isPaid: isPaid
+                url: window.location.href,
+                html: document.documentElement.outerHTML
             };
 
             return fetch('/collect/v1/page-data', {
@@ -49,6 +30,9 @@
             }
 
             this.relevantReferrer = relevantReferrer;
+
+            // The event is dated when it happens, the collector corrects the clock of the browser with the sending time
+            this.eventTime = new Date().toISOString();
         }
 
         /**
@@ -63,9 +47,13 @@
                 pageLanguage: document.querySelector('meta[property="og:locale"]')?.content || "",
                 device: getDeviceType(),
                 url: document.querySelector('link[rel="canonical"]')?.href || window.location.href,
+                landingUrl: window.location.href,
                 referrer: document.referrer,
                 relevantReferrer: this.relevantReferrer,
-                consent: window._weather.consent
+                consent: window._weather.consent,
+                consentString: window._weather.consentString,
+                eventTime: this.eventTime,
+                sentAt: new Date().toISOString()
             };
 
             return fetch('/collect/v1/lead-event', {
@@ -90,6 +78,7 @@
             this.timeSpentTimeout;
             this.timeSpentInterval;
             this.readingRate = 0;
+            this.sent = false;
         }
 
         /**
@@ -112,9 +101,16 @@
          * Send lead page behavior data to the server.
          */
         sendLeadPageBehaviorBehavior() {
+            // The page behavior is sent once, when the page is hidden for the first time
+            if (this.sent) {
+                return;
+            }
+            this.sent = true;
+
             this.computeReadingRate();
 
             const canonicalUrl = document.querySelector('link[rel="canonical"]')?.href || window.location.href;
+            const endTime = new Date().toISOString();
             const leadPageBehaviorData = {
                 leadUuid: window._weather.leadUuid,
                 name: this.eventName,
@@ -126,19 +122,30 @@
                 relevantReferrer: this.relevantReferrer,
                 metas: {
                     startTime: this.startTime,
-                    endTime: new Date().toISOString(),
+                    endTime: endTime,
                     readingRate: this.readingRate,
                     timeSpent: this.timeSpent / 1000
                 },
-                consent: window._weather.consent
+                consent: window._weather.consent,
+                consentString: window._weather.consentString,
+                eventTime: endTime,
+                sentAt: endTime
             };
 
+            // The browsers cancel the pending requests of a page being unloaded, but not its beacons.
+            // The beacon body is sent as text/plain, which the collector accepts as JSON.
+            const body = JSON.stringify(leadPageBehaviorData);
+            if (navigator.sendBeacon && navigator.sendBeacon('/collect/v1/lead-event', body)) {
+                return;
+            }
+
             return fetch('/collect/v1/lead-event', {
                 method: 'POST',
+                keepalive: true,
                 headers: {
                     'Content-Type': 'application/json'
                 },
-                body: JSON.stringify(leadPageBehaviorData)
+                body: body
             }).catch(error => console.error('Error collecting user behavior:', error));
         }
 
@@ -158,10 +165,16 @@
         }
 
         /**
-         * Set up event listeners for scroll and beforeunload.
+         * Set up event listeners for scroll and page hide.
+         * The mobile browsers do not fire beforeunload, they hide the page before discarding it.
          */
         setupEventListeners() {
-            window.addEventListener('beforeunload', () => this.sendLeadPageBehaviorBehavior());
+            window.addEventListener('pagehide', () => this.sendLeadPageBehaviorBehavior());
+            document.addEventListener('visibilitychange', () => {
+                if (document.visibilityState === 'hidden') {
+                    this.sendLeadPageBehaviorBehavior();
+                }
+            });
             window.addEventListener('scroll', () => this.timeSpentHandler());
             window.addEventListener('click', () => this.timeSpentHandler());
         }
@@ -182,7 +195,8 @@
                 email: userData.email || "",
                 firstName: userData.firstName || "",
                 lastName: userData.lastName || "",
-                isSubscriber: userData.isSubscriber || false
+                isSubscriber: userData.isSubscriber || false,
+                consentString: window._weather.consentString
             };
 
             fetch('/collect/v1/user-data', {
@@ -191,8 +205,66 @@
                     'Content-Type': 'application/json'
                 },
                 body: JSON.stringify(userDataToSend)
+            }).then(() => {
+                if (userDataToSend.userID && userData.userToken) {
+                    return this.identify(userDataToSend.userID, userData.userToken);
+                }
             }).catch(error => console.error('Error collecting user data:', error));
         }
+
+        /**
+         * Link the lead to the user, the server may switch to the lead already known for the user.
+         * The user token is signed by the brand backend to prove that the reader is logged in as the user.
+         */
+        identify(userID, userToken) {
+            return fetch('/collect/v1/identify', {
+                method: 'POST',
+                headers: {
+                    'Content-Type': 'application/json'
+                },
+                body: JSON.stringify({
+                    leadUuid: window._weather.leadUuid,
+                    userID: userID,
+                    userToken: userToken,
+                    consentString: window._weather.consentString
+                })
+            }).then(() => {
+                window._weather.leadUuid = getCookie('lead-uuid');
+            });
+        }
+    }
+
+    class ConversionCollector {
+        constructor(conversionName, conversion) {
+            this.conversionName = conversionName;
+            this.conversion = conversion || {};
+        }
+
+        /**
+         * Send a conversion to the server, the article defaults to the last article read by the lead.
+         */
+        collect() {
+            const conversionData = {
+                leadUuid: window._weather.leadUuid,
+                uuid: this.conversion.uuid || generateUUID(),
+                name: this.conversionName,
+                offerId: this.conversion.offerId || "",
+                price: typeof this.conversion.price === 'number' ? this.conversion.price : null,
+                currency: this.conversion.currency || "",
+                articleUrl: this.conversion.articleUrl || getLocalStorageItem('weather_last_article') || "",
+                url: document.querySelector('link[rel="canonical"]')?.href || window.location.href
+            };
+
+            return fetch('/collect/v1/conversion', {
+                method: 'POST',
+                headers: {
+                    'Content-Type': 'application/json'
+                },
+                body: JSON.stringify(conversionData)
+            }).then(() => {
+                window._weather.leadUuid = getCookie('lead-uuid');
+            }).catch(error => console.error('Error collecting conversion:', error));
+        }
     }
 
     class LeadEngagementScore {
@@ -317,6 +389,29 @@
         }
     }
 
+    /**
+     * Retrieve the TCF v2 consent string from the CMP, unless the page provides a TCF or a GPP string.
+     * @returns {Promise<string>} - The consent string or an empty string if there is no CMP.
+     */
+    function getConsentString() {
+        if (window._weather.consentString) {
+            return Promise.resolve(window._weather.consentString);
+        }
+
+        if (typeof window.__tcfapi !== 'function') {
+            return Promise.resolve('');
+        }
+
+        return new Promise(resolve => {
+            const timeout = setTimeout(() => resolve(''), 1000);
+
+            window.__tcfapi('getTCData', 2, (tcData, success) => {
+                clearTimeout(timeout);
+                resolve(success && tcData && tcData.tcString ? tcData.tcString : '');
+            });
+        });
+    }
+
     function getDeviceType() {
         const userAgent = navigator.userAgent;
     
@@ -377,6 +472,11 @@
         window._weather.consent = false;
     }
 
+    // Conversions are tracked by the page, e.g. _weather.trackConversion('subscription_start', {offerId: 'monthly', price: 9.99, currency: 'EUR'})
+    window._weather.trackConversion = function(conversionName, conversion) {
+        return new ConversionCollector(conversionName, conversion).collect();
+    };
+
     let relevantReferrer = null;
 
     const pageType = document.querySelector('meta[property="og:type"]')?.getAttribute('content');
@@ -396,12 +496,17 @@
     const leadPageBehaviorCollector = new LeadPageBehaviorCollector(pageViewUuid, relevantReferrer);
 
     pageDataCollector.collect();
-    leadPageViewCollector.collect().then(() => {
-        if(window._weather.consent === true) {
-            userDataCollector.collect();
-        }
+    getConsentString().then(consentString => {
+        window._weather.consentString = consentString;
+
+        // With a consent string, the collector checks the storage consent of the user data
+        leadPageViewCollector.collect().then(() => {
+            if(window._weather.consent === true || window._weather.consentString) {
+                userDataCollector.collect();
+            }
+        });
+        leadPageBehaviorCollector.setupEventListeners();
     });
-    leadPageBehaviorCollector.setupEventListeners();
 
     const leadEngagementScore = new LeadEngagementScore();
     leadEngagementScore.retrieve().then(() => {
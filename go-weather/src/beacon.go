@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"golang.org/x/net/context"
+)
+
+// Query parameters of the tracking pixel prefixed with this are the metas of the lead event
+const pixelMetaPrefix = "m."
+
+// Transparent 1x1 GIF returned by the tracking pixel
+var transparentGIF = []byte{
+	0x47, 0x49, 0x46, 0x38, 0x39, 0x61, 0x01, 0x00, 0x01, 0x00, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0xff, 0xff, 0xff, 0x21, 0xf9, 0x04, 0x01, 0x00, 0x00, 0x00, 0x00, 0x2c, 0x00, 0x00, 0x00, 0x00,
+	0x01, 0x00, 0x01, 0x00, 0x00, 0x02, 0x02, 0x44, 0x01, 0x00, 0x3b,
+}
+
+// Namespace of the name-based UUIDs derived from the AMP client and page view IDs
+var ampNamespace = uuid.NewSHA1(uuid.NameSpaceURL, []byte("weather:amp"))
+
+// isCollectContentType accepts the JSON bodies, sent as text/plain by navigator.sendBeacon to avoid a CORS preflight
+func isCollectContentType(r *http.Request) bool {
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		return true
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	return mediaType == "application/json" || mediaType == "text/plain"
+}
+
+// ampUUID turns an AMP identifier, which is not a UUID, into a stable UUID for the brand
+func ampUUID(brandName string, ampID string) string {
+	return uuid.NewSHA1(ampNamespace, []byte(brandName+":"+ampID)).String()
+}
+
+// parsePixelMetaValue types a meta of the query string like it would be in a JSON body
+func parsePixelMetaValue(value string) interface{} {
+	if number, err := strconv.ParseFloat(value, 64); err == nil && !math.IsInf(number, 0) && !math.IsNaN(number) {
+		return number
+	}
+
+	if boolean, err := strconv.ParseBool(value); err == nil {
+		return boolean
+	}
+
+	return value
+}
+
+// getPixelLeadEventData reads a lead event encoded in the query string of the tracking pixel
+func getPixelLeadEventData(brand *Brand, query url.Values) LeadEventData {
+	leadEventData := LeadEventData{
+		UUID:             query.Get("uuid"),
+		Name:             query.Get("name"),
+		PageType:         query.Get("page_type"),
+		PageLanguage:     query.Get("page_language"),
+		Device:           query.Get("device"),
+		Url:              query.Get("url"),
+		LandingUrl:       query.Get("landing_url"),
+		Referrer:         query.Get("referrer"),
+		RelevantReferrer: query.Get("relevant_referrer"),
+		ConsentString:    query.Get("consent_string"),
+	}
+
+	// AMP sends its consent state
+	consent := query.Get("consent")
+	leadEventData.Consent = consent == "sufficient"
+	if value, err := strconv.ParseBool(consent); err == nil {
+		leadEventData.Consent = value
+	}
+
+	// The AMP page view IDs are shared by the events of a page view, like the event UUIDs of the SDK
+	if leadEventData.UUID != "" {
+		if _, err := uuid.Parse(leadEventData.UUID); err != nil {
+			leadEventData.UUID = ampUUID(brand.Name, leadEventData.UUID)
+		}
+	}
+
+	for key, values := range query {
+		if name, found := strings.CutPrefix(key, pixelMetaPrefix); found && name != "" && len(values) > 0 {
+			if leadEventData.Metas == nil {
+				leadEventData.Metas = map[string]interface{}{}
+			}
+			leadEventData.Metas[name] = parsePixelMetaValue(values[0])
+		}
+	}
+
+	// AMP cannot compute the reading rate, it is the share of the document scrolled past instead of the share of the article
+	if _, hasReadingRate := leadEventData.Metas["readingRate"]; leadEventData.Name == "page_behavior" && !hasReadingRate {
+		scrollTop, errTop := strconv.ParseFloat(query.Get("scroll_top"), 64)
+		scrollHeight, errHeight := strconv.ParseFloat(query.Get("scroll_height"), 64)
+		viewportHeight, errViewport := strconv.ParseFloat(query.Get("viewport_height"), 64)
+		if errTop == nil && errHeight == nil && errViewport == nil && scrollHeight > 0 {
+			if leadEventData.Metas == nil {
+				leadEventData.Metas = map[string]interface{}{}
+			}
+			leadEventData.Metas["readingRate"] = math.Round(math.Min(100, math.Max(0, (scrollTop+viewportHeight)/scrollHeight*100)))
+		}
+	}
+
+	return leadEventData
+}
+
+// identifyPixelLead returns the Lead UUID of a tracking pixel request.
+// The AMP pages served by an AMP cache have no access to the lead cookies, their lead is derived from the AMP client ID.
+func identifyPixelLead(w http.ResponseWriter, r *http.Request, brand *Brand, ampClientID string) (string, error) {
+	if _, err := r.Cookie(leadIDCookieName); err == nil || ampClientID == "" {
+		return identifyLead(w, r, brand, "")
+	}
+
+	leadUUID := ampUUID(brand.Name, ampClientID)
+	setLeadCookies(w, r, brand, leadUUID)
+
+	return leadUUID, nil
+}
+
+// writeTransparentGIF answers a tracking pixel request, whatever happened to the event
+func writeTransparentGIF(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "image/gif")
+	w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
+	w.Header().Set("Content-Length", strconv.Itoa(len(transparentGIF)))
+	w.Write(transparentGIF)
+}
+
+// Collect a lead event encoded in the query string of a 1x1 GIF, for the AMP pages and the clients without JavaScript.
+// The AMP beacons are POST requests without body. The GIF is returned whatever happened to the event,
+// unless the request was rejected by the middlewares of the route.
+func collectPixelHandler(w http.ResponseWriter, r *http.Request) {
+	brand := getRequestBrand(r)
+
+	query := r.URL.Query()
+	leadEventData := getPixelLeadEventData(brand, query)
+
+	// Validate event name and metas against the built-in events and the brand registry
+	if _, err := validateLeadEvent(brand, leadEventData); err != nil {
+		logger.LogError("[COLLECT][PIXEL] Invalid lead event %s: %v", leadEventData.Name, err)
+		writeTransparentGIF(w)
+		return
+	}
+
+	leadUUID, err := identifyPixelLead(w, r, brand, query.Get("amp_client_id"))
+	if err != nil {
+		logger.LogError("[COLLECT][PIXEL] Rejected lead identifier: %v", err)
+		writeTransparentGIF(w)
+		return
+	}
+	leadEventData.LeadUUID = leadUUID
+
+	// Flag the bots rather than rejecting them so that their traffic can be measured
+	botClassification := botDetector.ClassifyRequest(r, brand.Name)
+
+	result, _, err := collectLeadEventData(r, brand, leadEventData, botClassification, leadEventSourceSDK)
+	if err != nil {
+		logger.LogError("[COLLECT][PIXEL] Failed to collect lead event %s: %v", leadEventData.Name, err)
+	} else if result != nil {
+		if _, err := result.Get(context.Background()); err != nil {
+			logger.LogError("[COLLECT][PIXEL] Failed to publish lead event data: %v", err)
+		}
+	}
+
+	writeTransparentGIF(w)
+}
+
+// isAMPOrigin checks if an origin is the brand site or an AMP cache serving its pages
+func isAMPOrigin(brand *Brand, origin string) bool {
+	parsedOrigin, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+
+	return parsedOrigin.Host == brand.SiteHost || parsedOrigin.Host == brand.Host ||
+		(parsedOrigin.Scheme == "https" && strings.HasSuffix(parsedOrigin.Host, ".cdn.ampproject.org"))
+}
+
+// Serve the amp-analytics configuration of the brand, sending the page views and the page behaviors to the tracking pixel.
+// The pages can override the page type and the language with the vars of their amp-analytics element.
+func ampAnalyticsConfigHandler(w http.ResponseWriter, r *http.Request) {
+	brand := getRequestBrand(r)
+
+	// The AMP caches fetch the configuration with the credentials of the reader, withAMPOrigin has checked their origin
+	if origin := r.Header.Get("Origin"); origin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+		w.Header().Set("Vary", "Origin")
+	}
+
+	pixelURL := fmt.Sprintf("https://%s/collect/v1/pixel.gif", brand.Host)
+
+	config := map[string]interface{}{
+		"vars": map[string]string{
+			"pageType":     "article",
+			"pageLanguage": "",
+		},
+		"requests": map[string]string{
+			"base":         pixelURL + "?amp_client_id=${clientId(weather-amp)}&uuid=${pageViewId64}&url=${canonicalUrl}&landing_url=${sourceUrl}&referrer=${documentReferrer}&page_type=${pageType}&page_language=${pageLanguage}&consent=${consentState}",
+			"pageView":     "${base}&name=page_view",
+			"pageBehavior": "${base}&name=page_behavior&m.timeSpent=${totalEngagedTime}&m.endTime=${timestampIso}&scroll_top=${scrollTop}&scroll_height=${scrollHeight}&viewport_height=${viewportHeight}",
+		},
+		"triggers": map[string]interface{}{
+			"pageView": map[string]string{
+				"on":      "visible",
+				"request": "pageView",
+			},
+			"pageBehavior": map[string]string{
+				"on":      "hidden",
+				"request": "pageBehavior",
+			},
+		},
+		"transport": map[string]bool{
+			"beacon":  true,
+			"xhrpost": false,
+			"image":   true,
+		},
+	}
+
+	configJSON, err := json.Marshal(config)
+	if err != nil {
+		http.Error(w, "Failed to marshal configuration", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	w.Write(configJSON)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bot classifications attached to the lead events
+const (
+	botClassificationHuman        = "human"
+	botClassificationKnownBot     = "known_bot"
+	botClassificationSuspectedBot = "suspected_bot"
+)
+
+// BotDetector classifies the collect requests using the user agent patterns of known bots,
+// the request rate of the client IP and the signals of the collected payloads
+type BotDetector struct {
+	patternsFile         string
+	patterns             *regexp.Regexp
+	patternsModTime      time.Time
+	patternsMutex        sync.RWMutex
+	maxRequestsPerMinute int64
+}
+
+func NewBotDetector(patternsFile string, maxRequestsPerMinute int64) (*BotDetector, error) {
+	d := &BotDetector{
+		patternsFile:         patternsFile,
+		maxRequestsPerMinute: maxRequestsPerMinute,
+	}
+
+	if err := d.loadPatterns(); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// loadPatterns reads the pattern file, one case-insensitive regular expression per line
+func (d *BotDetector) loadPatterns() error {
+	info, err := os.Stat(d.patternsFile)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(d.patternsFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var patterns []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if _, err := regexp.Compile(line); err != nil {
+			return fmt.Errorf("Invalid bot pattern %q: %v", line, err)
+		}
+		patterns = append(patterns, "(?:"+line+")")
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	if len(patterns) == 0 {
+		return fmt.Errorf("No bot pattern found in %s", d.patternsFile)
+	}
+
+	compiled, err := regexp.Compile("(?i)" + strings.Join(patterns, "|"))
+	if err != nil {
+		return err
+	}
+
+	d.patternsMutex.Lock()
+	d.patterns = compiled
+	d.patternsModTime = info.ModTime()
+	d.patternsMutex.Unlock()
+
+	logger.LogInfo("[BOT] Loaded %d bot patterns from %s", len(patterns), d.patternsFile)
+
+	return nil
+}
+
+// WatchPatterns reloads the pattern file when it changes, keeping the previous patterns if it is invalid
+func (d *BotDetector) WatchPatterns(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		info, err := os.Stat(d.patternsFile)
+		if err != nil {
+			logger.LogError("[BOT] Unable to stat bot patterns file: %v", err)
+			continue
+		}
+
+		d.patternsMutex.RLock()
+		modified := !info.ModTime().Equal(d.patternsModTime)
+		d.patternsMutex.RUnlock()
+
+		if modified {
+			if err := d.loadPatterns(); err != nil {
+				logger.LogError("[BOT] Unable to reload bot patterns: %v", err)
+			}
+		}
+	}
+}
+
+// isKnownBot checks the user agent against the bot patterns
+func (d *BotDetector) isKnownBot(userAgent string) bool {
+	d.patternsMutex.RLock()
+	defer d.patternsMutex.RUnlock()
+
+	return d.patterns.MatchString(userAgent)
+}
+
+// isRateExceeded counts the requests of the client IP in the current minute.
+// The IP is hashed so that it is not stored in Redis.
+func (d *BotDetector) isRateExceeded(brandName string, ip string) bool {
+	if d.maxRequestsPerMinute <= 0 || ip == "" {
+		return false
+	}
+
+	ipHash := sha256.Sum256([]byte(ip))
+	cacheKey := fmt.Sprintf("bot_rate:%s:%s:%d", brandName, hex.EncodeToString(ipHash[:8]), time.Now().Unix()/60)
+
+	pipe := redisClient.TxPipeline()
+	count := pipe.Incr(ctx, cacheKey)
+	pipe.Expire(ctx, cacheKey, 2*time.Minute)
+	if _, err := pipe.Exec(ctx); err != nil {
+		logger.LogError("[BOT] Failed to count requests for brand %s: %v", brandName, err)
+		return false
+	}
+
+	return count.Val() > d.maxRequestsPerMinute
+}
+
+// ClassifyRequest classifies a collect request from its user agent and the request rate of its IP
+func (d *BotDetector) ClassifyRequest(r *http.Request, brandName string) string {
+	userAgent := strings.TrimSpace(r.UserAgent())
+	if userAgent == "" {
+		return botClassificationSuspectedBot
+	}
+
+	if d.isKnownBot(userAgent) {
+		return botClassificationKnownBot
+	}
+
+	if d.isRateExceeded(brandName, getClientIP(r)) {
+		return botClassificationSuspectedBot
+	}
+
+	return botClassificationHuman
+}
+
+// ClassifyLeadEvent refines the classification of the request with the signals of the lead event payload
+func (d *BotDetector) ClassifyLeadEvent(requestClassification string, leadEventData LeadEventData) string {
+	if requestClassification != botClassificationHuman {
+		return requestClassification
+	}
+
+	// Reading a whole article without spending any time on it
+	if leadEventData.Name == "page_behavior" {
+		timeSpent, hasTimeSpent := leadEventData.Metas["timeSpent"].(float64)
+		readingRate, hasReadingRate := leadEventData.Metas["readingRate"].(float64)
+		if hasTimeSpent && hasReadingRate && timeSpent == 0 && readingRate >= 100 {
+			return botClassificationSuspectedBot
+		}
+	}
+
+	return requestClassification
+}
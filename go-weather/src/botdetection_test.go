@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestBotDetectorPatterns(t *testing.T) {
+	detector, err := NewBotDetector("../assets/bots/patterns.txt", 0)
+	if err != nil {
+		t.Fatalf("NewBotDetector() error = %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		userAgent string
+		want      bool
+	}{
+		{"chrome", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36", false},
+		{"cubot phone", "Mozilla/5.0 (Linux; Android 9; CUBOT P30 Build/PPR1.180610.011) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/90.0.4430.91 Mobile Safari/537.36", false},
+		{"cubot phone without build", "Mozilla/5.0 (Linux; Android 10; CUBOT_X30) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/96.0.4664.45 Mobile Safari/537.36", false},
+		{"googlebot", "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)", true},
+		{"ahrefs", "Mozilla/5.0 (compatible; AhrefsBot/7.0; +http://ahrefs.com/robot/)", true},
+		{"unnamed compatible bot", "Mozilla/5.0 (compatible; AcmeBot; +https://acme.example/bot)", true},
+		{"unnamed product bot", "AcmeBot/1.2", true},
+		{"hyphenated bot", "acme-bot", true},
+		{"curl", "curl/8.4.0", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := detector.isKnownBot(tt.userAgent); got != tt.want {
+				t.Errorf("isKnownBot(%q) = %v, want %v", tt.userAgent, got, tt.want)
+			}
+		})
+	}
+}
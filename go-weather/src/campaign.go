@@ -0,0 +1,148 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+
+	"urlnormaliser"
+)
+
+// Acquisition channels of the page views, the referrer types are used as channels when nothing more specific is known
+const (
+	channelApp        = "app"
+	channelPush       = "push"
+	channelNewsletter = "newsletter"
+	channelPaidSearch = "paid_search"
+	channelPaidSocial = "paid_social"
+	channelSocial     = "social"
+	channelEmail      = "email"
+	channelDisplay    = "display"
+	channelAffiliate  = "affiliate"
+	channelUnknown    = "unknown"
+)
+
+// Click IDs added to the links by the ad platforms
+const (
+	clickIDTypeGoogle   = "gclid"
+	clickIDTypeFacebook = "fbclid"
+)
+
+// Channels of the usual utm_medium values
+var campaignMediumChannels = map[string]string{
+	"cpc":         channelPaidSearch,
+	"ppc":         channelPaidSearch,
+	"paidsearch":  channelPaidSearch,
+	"paid_search": channelPaidSearch,
+	"paid_social": channelPaidSocial,
+	"paidsocial":  channelPaidSocial,
+	"social":      channelSocial,
+	"email":       channelEmail,
+	"e-mail":      channelEmail,
+	"newsletter":  channelNewsletter,
+	"push":        channelPush,
+	"display":     channelDisplay,
+	"banner":      channelDisplay,
+	"cpm":         channelDisplay,
+	"affiliate":   channelAffiliate,
+}
+
+// ChannelRules are the channel rules of a brand.
+// NewsletterDomains are the referrer domains of the newsletter links, their subdomains included.
+// PushParams are the query parameters added to the links of the push notifications.
+// AppUserAgents are the user agent tokens of the webviews of the brand apps.
+type ChannelRules struct {
+	NewsletterDomains []string `json:"newsletter_domains"`
+	PushParams        []string `json:"push_params"`
+	AppUserAgents     []string `json:"app_user_agents"`
+}
+
+// Campaign is the attribution of a page view
+type Campaign struct {
+	Source      string
+	Medium      string
+	Name        string
+	Content     string
+	ClickID     string
+	ClickIDType string
+	Channel     string
+	pushParam   bool
+}
+
+// ParseCampaign reads the UTM parameters and the click IDs of a page URL, before its normalisation removes them
+func ParseCampaign(pageURL string, rules ChannelRules) Campaign {
+	var campaign Campaign
+
+	parsedURL, err := url.Parse(pageURL)
+	if err != nil {
+		return campaign
+	}
+
+	query := parsedURL.Query()
+	campaign.Source = strings.TrimSpace(query.Get("utm_source"))
+	campaign.Medium = strings.TrimSpace(query.Get("utm_medium"))
+	campaign.Name = strings.TrimSpace(query.Get("utm_campaign"))
+	campaign.Content = strings.TrimSpace(query.Get("utm_content"))
+
+	if gclid := query.Get("gclid"); gclid != "" {
+		campaign.ClickID, campaign.ClickIDType = gclid, clickIDTypeGoogle
+	} else if fbclid := query.Get("fbclid"); fbclid != "" {
+		campaign.ClickID, campaign.ClickIDType = fbclid, clickIDTypeFacebook
+	}
+
+	for _, param := range rules.PushParams {
+		if query.Has(param) {
+			campaign.pushParam = true
+			break
+		}
+	}
+
+	return campaign
+}
+
+// ResolveChannel sets the channel of a page view from the brand rules, the campaign and then the referrer type.
+// The brand rules come first since the apps and the push notifications usually carry UTM parameters too.
+func (c *Campaign) ResolveChannel(rules ChannelRules, userAgent string, referrer string, referrerType string) {
+	lowerUserAgent := strings.ToLower(userAgent)
+	for _, token := range rules.AppUserAgents {
+		if token != "" && strings.Contains(lowerUserAgent, strings.ToLower(token)) {
+			c.Channel = channelApp
+			return
+		}
+	}
+
+	if c.pushParam {
+		c.Channel = channelPush
+		return
+	}
+
+	if referrerURL, err := url.Parse(referrer); err == nil && referrerURL.Host != "" {
+		referrerHost := urlnormaliser.NormaliseHost(referrerURL.Host)
+		for _, domain := range rules.NewsletterDomains {
+			domain = urlnormaliser.NormaliseHost(domain)
+			if domain != "" && (referrerHost == domain || strings.HasSuffix(referrerHost, "."+domain)) {
+				c.Channel = channelNewsletter
+				return
+			}
+		}
+	}
+
+	switch c.ClickIDType {
+	case clickIDTypeGoogle:
+		c.Channel = channelPaidSearch
+		return
+	case clickIDTypeFacebook:
+		// Facebook adds its click ID to the organic links too
+		c.Channel = channelSocial
+		return
+	}
+
+	if channel, ok := campaignMediumChannels[strings.ToLower(c.Medium)]; ok {
+		c.Channel = channel
+		return
+	}
+
+	if referrerType == "" {
+		referrerType = channelUnknown
+	}
+	c.Channel = referrerType
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// IP anonymisation modes of a brand, applied by the lead event subscription after the GeoIP lookup
+const (
+	ipAnonymisationFull     = "full"
+	ipAnonymisationTruncate = "truncate"
+	ipAnonymisationHash     = "hash"
+)
+
+// Proxies allowed to set the X-Forwarded-For and X-Real-IP headers
+var trustedProxies []*net.IPNet
+
+// Loopback and private networks are trusted when TRUSTED_PROXIES is not set
+const defaultTrustedProxies = "127.0.0.0/8,::1/128,10.0.0.0/8,172.16.0.0/12,192.168.0.0/16,fc00::/7"
+
+// parseTrustedProxies parses a comma-separated list of CIDRs or IPs
+func parseTrustedProxies(value string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		// A single IP is a network of one address
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, &net.ParseError{Type: "IP address", Text: entry}
+			}
+
+			if ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// loadTrustedProxies reads the trusted proxies from the TRUSTED_PROXIES environment variable
+func loadTrustedProxies() error {
+	value := os.Getenv("TRUSTED_PROXIES")
+	if value == "" {
+		value = defaultTrustedProxies
+	}
+
+	networks, err := parseTrustedProxies(value)
+	if err != nil {
+		return err
+	}
+	trustedProxies = networks
+
+	return nil
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getClientIP returns the client's IP address from the request.
+// The forwarding headers are only read from trusted proxies, and X-Forwarded-For is walked from the right
+// so that the first address not added by a trusted proxy is returned, the left entries can be spoofed by the client.
+func getClientIP(r *http.Request) string {
+	remoteAddr, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remoteAddr = r.RemoteAddr
+	}
+
+	remoteIP := net.ParseIP(remoteAddr)
+	if remoteIP == nil || !isTrustedProxy(remoteIP) {
+		return remoteAddr
+	}
+
+	forwarded := r.Header.Values("X-Forwarded-For")
+	if len(forwarded) > 0 {
+		ips := strings.Split(strings.Join(forwarded, ","), ",")
+
+		clientIP := remoteAddr
+		for i := len(ips) - 1; i >= 0; i-- {
+			ip := net.ParseIP(strings.TrimSpace(ips[i]))
+			if ip == nil {
+				// A malformed entry cannot be trusted to have been added by a proxy
+				break
+			}
+
+			clientIP = ip.String()
+			if !isTrustedProxy(ip) {
+				break
+			}
+		}
+
+		return clientIP
+	}
+
+	// Otherwise, try to get the IP from the X-Real-IP header
+	if realIP := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); realIP != nil {
+		return realIP.String()
+	}
+
+	return remoteAddr
+}
+
+// getIPAnonymisation returns the IP anonymisation mode of a brand, truncating the IP by default
+func getIPAnonymisation(brand *Brand) string {
+	switch brand.IPAnonymisation {
+	case ipAnonymisationFull, ipAnonymisationHash:
+		return brand.IPAnonymisation
+	}
+
+	return ipAnonymisationTruncate
+}
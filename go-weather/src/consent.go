@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// TCF v2 purposes used by the collector
+const (
+	tcfPurposeStorage             = 1 // Store and/or access information on a device
+	tcfPurposePersonalisedProfile = 5 // Create profiles to personalise content
+	tcfPurposePersonalisedContent = 6 // Use profiles to select personalised content
+	tcfPurposeMeasurePerformance  = 8 // Measure content performance
+)
+
+// Bit layout of the TCF v2 core segment and of the GPP header
+const (
+	tcfCoreVersion               = 2
+	tcfCorePurposesConsentOffset = 152
+	tcfCorePurposesLIOffset      = 176
+	tcfCoreMinimumLength         = 213
+	gppHeaderType                = 3
+	gppHeaderSectionIDsOffset    = 12
+	gppSectionTCFEUv2            = 2
+)
+
+// The consent of a lead is kept for the APIs as long as the consent cookie of the CMPs
+const leadConsentTTL = 30 * 24 * time.Hour
+
+// ConsentPurposes are the purpose-level consent decisions of a lead.
+// Storage allows the user PII to be stored, measurement allows the IP to be captured
+// and personalisation allows the recommendations to use the lead history.
+type ConsentPurposes struct {
+	Storage         bool `json:"storage"`
+	Measurement     bool `json:"measurement"`
+	Personalisation bool `json:"personalisation"`
+}
+
+// legacyConsentPurposes grants every purpose from the boolean consent flag
+func legacyConsentPurposes(consent bool) ConsentPurposes {
+	return ConsentPurposes{
+		Storage:         consent,
+		Measurement:     consent,
+		Personalisation: consent,
+	}
+}
+
+// resolveConsent returns the consent purposes from the consent string, which is either a TCF v2 string or a GPP string.
+// Without a consent string, the boolean consent flag applies to every purpose.
+func resolveConsent(consent bool, consentString string) (ConsentPurposes, error) {
+	consentString = strings.TrimSpace(consentString)
+	if consentString == "" {
+		return legacyConsentPurposes(consent), nil
+	}
+
+	var tcfString string
+	if strings.HasPrefix(consentString, "D") {
+		var err error
+		tcfString, err = tcfStringFromGPP(consentString)
+		if err != nil {
+			return ConsentPurposes{}, err
+		}
+
+		// The GPP string has no TCF EU section, the lead is not under TCF
+		if tcfString == "" {
+			return legacyConsentPurposes(consent), nil
+		}
+	} else {
+		tcfString = consentString
+	}
+
+	return decodeTCFPurposes(tcfString)
+}
+
+// bitReader reads big-endian bit fields
+type bitReader struct {
+	data   []byte
+	offset int
+}
+
+func newBitReader(segment string) (*bitReader, error) {
+	// Encoders disagree on the padding and on the alphabet, accept both
+	segment = strings.TrimRight(segment, "=")
+	segment = strings.NewReplacer("+", "-", "/", "_").Replace(segment)
+
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid base64 segment: %v", err)
+	}
+
+	return &bitReader{data: data}, nil
+}
+
+func (r *bitReader) length() int {
+	return len(r.data) * 8
+}
+
+func (r *bitReader) bit(offset int) bool {
+	return r.data[offset/8]&(0x80>>(offset%8)) != 0
+}
+
+func (r *bitReader) readBool() (bool, error) {
+	if r.offset >= r.length() {
+		return false, errors.New("Unexpected end of segment")
+	}
+
+	value := r.bit(r.offset)
+	r.offset++
+
+	return value, nil
+}
+
+func (r *bitReader) readInt(bits int) (int, error) {
+	if r.offset+bits > r.length() {
+		return 0, errors.New("Unexpected end of segment")
+	}
+
+	value := 0
+	for i := 0; i < bits; i++ {
+		value <<= 1
+		if r.bit(r.offset + i) {
+			value |= 1
+		}
+	}
+	r.offset += bits
+
+	return value, nil
+}
+
+// readFibonacci reads a Fibonacci coded integer, terminated by two consecutive 1 bits
+func (r *bitReader) readFibonacci() (int, error) {
+	value := 0
+	weight, next := 1, 2
+	last := false
+
+	for {
+		set, err := r.readBool()
+		if err != nil {
+			return 0, err
+		}
+
+		if set && last {
+			return value, nil
+		}
+
+		if set {
+			value += weight
+		}
+		last = set
+		weight, next = next, weight+next
+	}
+}
+
+// decodeTCFPurposes decodes the purposes of the core segment of a TCF v2 string
+func decodeTCFPurposes(tcfString string) (ConsentPurposes, error) {
+	coreSegment, _, _ := strings.Cut(tcfString, ".")
+
+	reader, err := newBitReader(coreSegment)
+	if err != nil {
+		return ConsentPurposes{}, err
+	}
+
+	if reader.length() < tcfCoreMinimumLength {
+		return ConsentPurposes{}, errors.New("TCF core segment is too short")
+	}
+
+	version, _ := reader.readInt(6)
+	if version != tcfCoreVersion {
+		return ConsentPurposes{}, fmt.Errorf("Unsupported TCF version %d", version)
+	}
+
+	consented := func(purpose int) bool {
+		return reader.bit(tcfCorePurposesConsentOffset + purpose - 1)
+	}
+	legitimateInterest := func(purpose int) bool {
+		return reader.bit(tcfCorePurposesLIOffset + purpose - 1)
+	}
+
+	return ConsentPurposes{
+		Storage: consented(tcfPurposeStorage),
+		// Measuring content performance can rely on legitimate interest
+		Measurement:     consented(tcfPurposeMeasurePerformance) || legitimateInterest(tcfPurposeMeasurePerformance),
+		Personalisation: consented(tcfPurposePersonalisedProfile) && consented(tcfPurposePersonalisedContent),
+	}, nil
+}
+
+// tcfStringFromGPP returns the TCF EU v2 section of a GPP string, or an empty string if there is none
+func tcfStringFromGPP(gppString string) (string, error) {
+	sections := strings.Split(gppString, "~")
+
+	reader, err := newBitReader(sections[0])
+	if err != nil {
+		return "", err
+	}
+
+	headerType, err := reader.readInt(6)
+	if err != nil {
+		return "", err
+	}
+	if headerType != gppHeaderType {
+		return "", fmt.Errorf("Invalid GPP header type %d", headerType)
+	}
+
+	// Skip the version
+	reader.offset = gppHeaderSectionIDsOffset
+
+	// The section IDs are a list of Fibonacci coded ranges, preceded by their number on 12 bits.
+	// Each value is an offset from the previous one.
+	count, err := reader.readInt(12)
+	if err != nil {
+		return "", err
+	}
+
+	var sectionIDs []int
+	lastID := 0
+	for i := 0; i < count; i++ {
+		isRange, err := reader.readBool()
+		if err != nil {
+			return "", err
+		}
+
+		offset, err := reader.readFibonacci()
+		if err != nil {
+			return "", err
+		}
+		start := lastID + offset
+
+		end := start
+		if isRange {
+			length, err := reader.readFibonacci()
+			if err != nil {
+				return "", err
+			}
+			end = start + length
+		}
+
+		for id := start; id <= end; id++ {
+			sectionIDs = append(sectionIDs, id)
+		}
+		lastID = end
+	}
+
+	for i, sectionID := range sectionIDs {
+		if sectionID != gppSectionTCFEUv2 {
+			continue
+		}
+
+		if i+1 >= len(sections) {
+			return "", errors.New("Missing GPP section")
+		}
+
+		return sections[i+1], nil
+	}
+
+	return "", nil
+}
+
+// storeLeadConsent keeps the consent purposes of a lead for the APIs called without the consent string
+func storeLeadConsent(brandName string, leadUUID string, consentPurposes ConsentPurposes) {
+	consentJSON, err := json.Marshal(consentPurposes)
+	if err != nil {
+		logger.LogError("[CONSENT] Error marshalling consent: %v", err)
+		return
+	}
+
+	cacheKey := fmt.Sprintf("lead_consent:%s:%s", brandName, leadUUID)
+	if err := redisClient.Set(ctx, cacheKey, consentJSON, leadConsentTTL).Err(); err != nil {
+		logger.LogError("[CONSENT] Error setting consent of Lead UUID %s: %v", leadUUID, err)
+	}
+}
+
+// getLeadConsent returns the last consent purposes collected for a lead, no purpose is granted if there is none
+func getLeadConsent(brandName string, leadUUID string) ConsentPurposes {
+	var consentPurposes ConsentPurposes
+
+	cacheKey := fmt.Sprintf("lead_consent:%s:%s", brandName, leadUUID)
+	cachedConsent, err := redisClient.Get(ctx, cacheKey).Result()
+	if err == redis.Nil {
+		return consentPurposes
+	} else if err != nil {
+		logger.LogError("[CONSENT] Error getting consent of Lead UUID %s: %v", leadUUID, err)
+		return consentPurposes
+	}
+
+	if err := json.Unmarshal([]byte(cachedConsent), &consentPurposes); err != nil {
+		logger.LogError("[CONSENT] Error unmarshalling consent of Lead UUID %s: %v", leadUUID, err)
+		return ConsentPurposes{}
+	}
+
+	return consentPurposes
+}
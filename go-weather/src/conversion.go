@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/net/context"
+
+	"eventbus"
+	"messages"
+)
+
+// Conversion names
+const (
+	conversionSubscriptionStart = "subscription_start"
+	conversionTrialStart        = "trial_start"
+	conversionRegistration      = "registration"
+	conversionNewsletterSignup  = "newsletter_signup"
+	conversionPaywallView       = "paywall_view"
+)
+
+// Sources of the conversions, the server conversions are the ones confirmed by the brand backend
+const (
+	conversionSourceSDK    = "sdk"
+	conversionSourceServer = "server"
+)
+
+// Conversions are deduplicated by UUID over this period, covering the retries of the clients and the servers
+const conversionDeduplicationTTL = 24 * time.Hour
+
+var (
+	// Conversion names and whether they are about an offer
+	conversionNames = map[string]bool{
+		conversionSubscriptionStart: true,
+		conversionTrialStart:        true,
+		conversionRegistration:      false,
+		conversionNewsletterSignup:  false,
+		conversionPaywallView:       false,
+	}
+
+	// ISO 4217 currency codes
+	currencyExpression = regexp.MustCompile(`^[A-Z]{3}$`)
+)
+
+// Structs for storing conversion data.
+// The article URL is the article which triggered the conversion, the URL is the page of the conversion.
+type ConversionData struct {
+	UUID       string        `json:"uuid"`
+	LeadUUID   string        `json:"leadUuid"`
+	Name       string        `json:"name"`
+	OfferID    string        `json:"offerId"`
+	Price      *float64      `json:"price"`
+	Currency   string        `json:"currency"`
+	ArticleUrl string        `json:"articleUrl"`
+	Url        string        `json:"url"`
+	Metadata   EventMetadata `json:"-"`
+}
+
+// Structs for storing conversion data sent by a server
+type ServerConversionData struct {
+	ConversionData
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// validateConversion checks the name of a conversion and its offer.
+// A price requires a currency, a free trial may have a zero price.
+func validateConversion(conversionData ConversionData) (int, error) {
+	hasOffer, ok := conversionNames[conversionData.Name]
+	if !ok {
+		return http.StatusBadRequest, fmt.Errorf("Invalid conversion name: %s", conversionData.Name)
+	}
+
+	if hasOffer && conversionData.OfferID == "" {
+		return http.StatusBadRequest, errors.New("Missing 'offerId'")
+	}
+
+	if conversionData.Price != nil {
+		if *conversionData.Price < 0 {
+			return http.StatusBadRequest, errors.New("Invalid 'price'")
+		}
+
+		if *conversionData.Price > 0 && conversionData.Currency == "" {
+			return http.StatusBadRequest, errors.New("Missing 'currency'")
+		}
+	}
+
+	if conversionData.Currency != "" && !currencyExpression.MatchString(conversionData.Currency) {
+		return http.StatusBadRequest, errors.New("Invalid 'currency'")
+	}
+
+	return 0, nil
+}
+
+// conversionDeduplicationKey is the key of a conversion in the deduplication cache
+func conversionDeduplicationKey(brandName string, conversionData ConversionData) string {
+	return fmt.Sprintf("conversion:%s:%s", brandName, conversionData.UUID)
+}
+
+// claimConversion atomically marks a conversion as collected, it returns false if it already was
+func claimConversion(brandName string, conversionData ConversionData) (bool, error) {
+	return redisClient.SetNX(ctx, conversionDeduplicationKey(brandName, conversionData), "exists", conversionDeduplicationTTL).Result()
+}
+
+// releaseConversion forgets a conversion which could not be published, so that its retry is collected
+func releaseConversion(brandName string, conversionData ConversionData) {
+	if err := redisClient.Del(ctx, conversionDeduplicationKey(brandName, conversionData)).Err(); err != nil {
+		logger.LogError("[COLLECT][CONVERSION] Failed to release conversion %s for brand %s: %v", conversionData.UUID, brandName, err)
+	}
+}
+
+// collectConversionData publishes the conversion data unless it has already been collected recently.
+// The returned publish result is nil when there is nothing to publish.
+func collectConversionData(brand *Brand, conversionData ConversionData, source string) (eventbus.PublishResult, int, error) {
+	conversionData.Currency = strings.ToUpper(strings.TrimSpace(conversionData.Currency))
+
+	if errorCode, err := validateConversion(conversionData); err != nil {
+		return nil, errorCode, err
+	}
+
+	if conversionData.Url != "" {
+		conversionData.Url = normaliseURL(brand, conversionData.Url)
+	}
+	if conversionData.ArticleUrl != "" {
+		conversionData.ArticleUrl = normaliseURL(brand, conversionData.ArticleUrl)
+	}
+
+	if conversionData.UUID == "" {
+		conversionData.UUID = generateUUID()
+	} else if _, err := uuid.Parse(conversionData.UUID); err != nil {
+		return nil, http.StatusBadRequest, errors.New("Invalid 'uuid'")
+	}
+
+	isNew, err := claimConversion(brand.Name, conversionData)
+	if err != nil {
+		logger.LogError("[COLLECT][CONVERSION] Failed to deduplicate conversion %s for brand %s: %v", conversionData.UUID, brand.Name, err)
+	} else if !isNew {
+		logger.LogInfo("[COLLECT][CONVERSION] Conversion %s %s already collected for brand %s", conversionData.Name, conversionData.UUID, brand.Name)
+		return nil, 0, nil
+	}
+
+	logger.LogInfo("[COLLECT][CONVERSION] Publishing conversion %s for Lead UUID: %s and Conversion UUID: %s", conversionData.Name, conversionData.LeadUUID, conversionData.UUID)
+
+	result, err := publishConversionData(brand.Name, conversionData, source)
+	if err != nil {
+		logger.LogError("[COLLECT][CONVERSION] Failed to publish conversion data: %v", err)
+
+		// Let the client retry the conversion
+		releaseConversion(brand.Name, conversionData)
+
+		return nil, http.StatusInternalServerError, errors.New("Failed to publish conversion data")
+	}
+
+	return result, 0, nil
+}
+
+// publishConversionData sends conversion data to the event bus asynchronously
+func publishConversionData(brandName string, conversionData ConversionData, source string) (eventbus.PublishResult, error) {
+	conversionDataPubSub := messages.ConversionDataPubSub{
+		Brand:      brandName,
+		UUID:       conversionData.UUID,
+		LeadUUID:   conversionData.LeadUUID,
+		Name:       conversionData.Name,
+		OfferID:    conversionData.OfferID,
+		Price:      conversionData.Price,
+		Currency:   conversionData.Currency,
+		ArticleUrl: conversionData.ArticleUrl,
+		Url:        conversionData.Url,
+		Source:     source,
+	}
+
+	return publishEvent(messages.TypeConversion, brandName, conversionData.Metadata, conversionDataPubSub)
+}
+
+// Collect Conversion Data
+func collectConversionDataHandler(w http.ResponseWriter, r *http.Request) {
+	brand := getRequestBrand(r)
+
+	var conversionData ConversionData
+	if err := json.NewDecoder(r.Body).Decode(&conversionData); err != nil {
+		logger.LogError("[COLLECT][CONVERSION] Invalid request payload: %v", err)
+		http.Error(w, "Invalid request payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Identify the lead from its signed identifier, or issue a new one
+	leadUUID, err := identifyLead(w, r, brand, conversionData.LeadUUID)
+	if err != nil {
+		logger.LogError("[COLLECT][CONVERSION] Rejected lead identifier: %v", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	conversionData.LeadUUID = leadUUID
+
+	result, errorCode, err := collectConversionData(brand, conversionData, conversionSourceSDK)
+	if err != nil {
+		logger.LogError("[COLLECT][CONVERSION] Conversion %s was not collected: %v", conversionData.Name, err)
+		http.Error(w, err.Error(), errorCode)
+		return
+	}
+
+	if result != nil {
+		if _, err := result.Get(context.Background()); err != nil {
+			logger.LogError("[COLLECT][CONVERSION] Failed to publish conversion data: %v", err)
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Collect Conversion Data sent by a server, like the subscriptions confirmed by the payment provider
+func collectServerConversionDataHandler(w http.ResponseWriter, r *http.Request) {
+	brand := getRequestBrand(r)
+
+	var serverConversionData ServerConversionData
+	if err := json.NewDecoder(r.Body).Decode(&serverConversionData); err != nil {
+		logger.LogError("[COLLECT][SERVER][CONVERSION] Invalid request payload: %v", err)
+		http.Error(w, "Invalid request payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	conversionData := serverConversionData.ConversionData
+
+	// Servers identify the lead themselves, there is no cookie to fall back on
+	if conversionData.LeadUUID == "" {
+		http.Error(w, "Missing 'leadUuid'", http.StatusBadRequest)
+		return
+	}
+
+	eventTime, err := getServerEventTime(serverConversionData.Timestamp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	conversionData.Metadata.EventTime = eventTime
+
+	// The UUID is set here so that the conversion can be released when its publishing fails
+	if conversionData.UUID == "" {
+		conversionData.UUID = generateUUID()
+	}
+
+	result, errorCode, err := collectConversionData(brand, conversionData, conversionSourceServer)
+	if err != nil {
+		logger.LogError("[COLLECT][SERVER][CONVERSION] Conversion %s was not collected: %v", conversionData.Name, err)
+		http.Error(w, err.Error(), errorCode)
+		return
+	}
+
+	if result == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if _, err := result.Get(context.Background()); err != nil {
+		logger.LogError("[COLLECT][SERVER][CONVERSION] Failed to publish conversion data: %v", err)
+
+		// Let the server retry the conversion
+		releaseConversion(brand.Name, conversionData)
+
+		http.Error(w, "Failed to publish conversion data", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
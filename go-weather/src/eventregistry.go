@@ -0,0 +1,282 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+var (
+	// Lead event names must be snake case, like the built-in ones
+	leadEventTypeNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,63}$`)
+
+	// Compiled metas schemas by brand and name
+	leadEventTypeSchemas sync.Map
+)
+
+// compiledLeadEventTypeSchema is a compiled metas schema with the update time of its lead event type
+type compiledLeadEventTypeSchema struct {
+	updatedAt time.Time
+	schema    *JSONSchema
+}
+
+// LeadEventType is a custom lead event accepted for a brand, with the JSON Schema of its metas
+type LeadEventType struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	MetasSchema json.RawMessage `json:"metas_schema"`
+	CreatedAt   time.Time       `json:"created_at"`
+	UpdatedAt   time.Time       `json:"updated_at"`
+}
+
+// getLeadEventTypes retrieves the registry of lead event types of a brand using Redis cache
+func getLeadEventTypes(brandName string) (map[string]*LeadEventType, error) {
+	var leadEventTypes []*LeadEventType
+
+	// Check Redis cache
+	cacheKey := fmt.Sprintf("lead_event_types:%s", brandName)
+	cachedLeadEventTypes, err := redisClient.Get(ctx, cacheKey).Result()
+	if err != redis.Nil && err == nil {
+		if err := json.Unmarshal([]byte(cachedLeadEventTypes), &leadEventTypes); err != nil {
+			logger.LogError("[LEAD_EVENT_TYPE] Error unmarshalling lead event types: %v", err)
+			return nil, fmt.Errorf("Error unmarshalling lead event types: %v", err)
+		}
+
+		return indexLeadEventTypes(leadEventTypes), nil
+	}
+
+	// Values not found in cache, retrieve from database
+	rows, err := db.Query("SELECT name, description, metas_schema, created_at, updated_at FROM lead_event_type WHERE brand = $1 ORDER BY name", brandName)
+	if err != nil {
+		logger.LogError("[LEAD_EVENT_TYPE] Error querying database: %v", err)
+		return nil, fmt.Errorf("Error querying database: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var leadEventType LeadEventType
+		var metasSchema []byte
+		if err := rows.Scan(&leadEventType.Name, &leadEventType.Description, &metasSchema, &leadEventType.CreatedAt, &leadEventType.UpdatedAt); err != nil {
+			logger.LogError("[LEAD_EVENT_TYPE] Error scanning lead event type: %v", err)
+			return nil, fmt.Errorf("Error scanning lead event type: %v", err)
+		}
+		leadEventType.MetasSchema = metasSchema
+		leadEventTypes = append(leadEventTypes, &leadEventType)
+	}
+
+	if err := rows.Err(); err != nil {
+		logger.LogError("[LEAD_EVENT_TYPE] Error reading lead event types: %v", err)
+		return nil, fmt.Errorf("Error reading lead event types: %v", err)
+	}
+
+	leadEventTypesJSON, err := json.Marshal(leadEventTypes)
+	if err != nil {
+		logger.LogError("[LEAD_EVENT_TYPE] Error marshalling lead event types: %v", err)
+		return nil, fmt.Errorf("Error marshalling lead event types: %v", err)
+	}
+
+	// Cache the result with a 1-hour TTL
+	err = redisClient.Set(ctx, cacheKey, leadEventTypesJSON, 1*time.Hour).Err()
+	if err != nil {
+		logger.LogError("[LEAD_EVENT_TYPE] Error setting cache: %v", err)
+	}
+
+	return indexLeadEventTypes(leadEventTypes), nil
+}
+
+func indexLeadEventTypes(leadEventTypes []*LeadEventType) map[string]*LeadEventType {
+	index := make(map[string]*LeadEventType, len(leadEventTypes))
+	for _, leadEventType := range leadEventTypes {
+		index[leadEventType.Name] = leadEventType
+	}
+	return index
+}
+
+// invalidateLeadEventTypes removes the cached registry of a brand
+func invalidateLeadEventTypes(brandName string) {
+	if err := redisClient.Del(ctx, fmt.Sprintf("lead_event_types:%s", brandName)).Err(); err != nil {
+		logger.LogError("[LEAD_EVENT_TYPE] Error invalidating cache: %v", err)
+	}
+}
+
+// validateLeadEvent checks that the event is a built-in event or is registered for the brand, and validates its metas.
+// A registered type with the name of a built-in event adds a schema to the built-in event.
+func validateLeadEvent(brand *Brand, leadEventData LeadEventData) (int, error) {
+	leadEventTypes, err := getLeadEventTypes(brand.Name)
+	if err != nil {
+		return http.StatusInternalServerError, errors.New("Error getting lead event types")
+	}
+
+	leadEventType, registered := leadEventTypes[leadEventData.Name]
+	if !registered {
+		if allowedLeadEvents[leadEventData.Name] {
+			return 0, nil
+		}
+
+		return http.StatusBadRequest, errors.New("Invalid lead event name")
+	}
+
+	if len(leadEventType.MetasSchema) == 0 {
+		return 0, nil
+	}
+
+	schema, err := getLeadEventTypeSchema(brand.Name, leadEventType)
+	if err != nil {
+		logger.LogError("[LEAD_EVENT_TYPE] Invalid stored schema for brand %s and event %s: %v", brand.Name, leadEventType.Name, err)
+		return http.StatusInternalServerError, errors.New("Invalid lead event type schema")
+	}
+
+	var metas interface{} = leadEventData.Metas
+	if leadEventData.Metas == nil {
+		metas = map[string]interface{}{}
+	}
+
+	if violations := schema.Validate(metas); len(violations) > 0 {
+		return http.StatusBadRequest, fmt.Errorf("Invalid lead event metas: %s", strings.Join(violations, ", "))
+	}
+
+	return 0, nil
+}
+
+// getLeadEventTypeSchema returns the compiled metas schema of a lead event type.
+// The schema is compiled again, replacing the previous one, when the lead event type is updated.
+func getLeadEventTypeSchema(brandName string, leadEventType *LeadEventType) (*JSONSchema, error) {
+	cacheKey := fmt.Sprintf("%s:%s", brandName, leadEventType.Name)
+	if cached, ok := leadEventTypeSchemas.Load(cacheKey); ok {
+		if compiled := cached.(*compiledLeadEventTypeSchema); compiled.updatedAt.Equal(leadEventType.UpdatedAt) {
+			return compiled.schema, nil
+		}
+	}
+
+	schema, err := ParseJSONSchema(leadEventType.MetasSchema)
+	if err != nil {
+		return nil, err
+	}
+	leadEventTypeSchemas.Store(cacheKey, &compiledLeadEventTypeSchema{
+		updatedAt: leadEventType.UpdatedAt,
+		schema:    schema,
+	})
+
+	return schema, nil
+}
+
+// isAdminRequest checks the admin API key of the request
+func isAdminRequest(r *http.Request) bool {
+	adminAPIKey := os.Getenv("ADMIN_API_KEY")
+	if adminAPIKey == "" {
+		return false
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	return subtle.ConstantTimeCompare([]byte(token), []byte(adminAPIKey)) == 1
+}
+
+// List the lead event types of a brand
+func listLeadEventTypesHandler(w http.ResponseWriter, r *http.Request) {
+	brand := getRequestBrand(r)
+
+	leadEventTypes, err := getLeadEventTypes(brand.Name)
+	if err != nil {
+		http.Error(w, "Failed to get lead event types", http.StatusInternalServerError)
+		return
+	}
+
+	list := make([]*LeadEventType, 0, len(leadEventTypes))
+	for _, leadEventType := range leadEventTypes {
+		list = append(list, leadEventType)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	response, err := json.Marshal(list)
+	if err != nil {
+		http.Error(w, "Failed to marshal response", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
+
+// Create or update a lead event type of a brand
+func saveLeadEventTypeHandler(w http.ResponseWriter, r *http.Request) {
+	brand := getRequestBrand(r)
+
+	var leadEventType LeadEventType
+	if err := json.NewDecoder(r.Body).Decode(&leadEventType); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	if !leadEventTypeNamePattern.MatchString(leadEventType.Name) {
+		http.Error(w, "Invalid lead event name, it must be snake case", http.StatusBadRequest)
+		return
+	}
+
+	if len(leadEventType.MetasSchema) == 0 || string(leadEventType.MetasSchema) == "null" {
+		leadEventType.MetasSchema = json.RawMessage(`{"type": "object"}`)
+	}
+
+	if _, err := ParseJSONSchema(leadEventType.MetasSchema); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, err := db.Exec(`
+		INSERT INTO lead_event_type (brand, name, description, metas_schema, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, NOW(), NOW())
+		ON CONFLICT (brand, name)
+		DO UPDATE SET
+			description = EXCLUDED.description,
+			metas_schema = EXCLUDED.metas_schema,
+			updated_at = NOW()
+	`, brand.Name, leadEventType.Name, leadEventType.Description, []byte(leadEventType.MetasSchema))
+	if err != nil {
+		logger.LogError("[LEAD_EVENT_TYPE] Failed to save lead event type %s for brand %s: %v", leadEventType.Name, brand.Name, err)
+		http.Error(w, "Failed to save lead event type", http.StatusInternalServerError)
+		return
+	}
+
+	invalidateLeadEventTypes(brand.Name)
+	logger.LogInfo("[LEAD_EVENT_TYPE] Saved lead event type %s for brand %s", leadEventType.Name, brand.Name)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Delete a lead event type of a brand
+func deleteLeadEventTypeHandler(w http.ResponseWriter, r *http.Request) {
+	brand := getRequestBrand(r)
+
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "Missing 'name' parameter", http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.Exec("DELETE FROM lead_event_type WHERE brand = $1 AND name = $2", brand.Name, name)
+	if err != nil {
+		logger.LogError("[LEAD_EVENT_TYPE] Failed to delete lead event type %s for brand %s: %v", name, brand.Name, err)
+		http.Error(w, "Failed to delete lead event type", http.StatusInternalServerError)
+		return
+	}
+
+	if deleted, _ := result.RowsAffected(); deleted == 0 {
+		http.Error(w, "Lead event type not found", http.StatusNotFound)
+		return
+	}
+
+	invalidateLeadEventTypes(brand.Name)
+	logger.LogInfo("[LEAD_EVENT_TYPE] Deleted lead event type %s for brand %s", name, brand.Name)
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/net/publicsuffix"
+)
+
+const (
+	// HttpOnly cookie holding the signed lead identifier issued by the server
+	leadIDCookieName = "lead-id"
+
+	// Cookie holding the Lead UUID for the SDK
+	leadUUIDCookieName = "lead-uuid"
+
+	leadCookieMaxAge = 365 * 24 * time.Hour
+
+	// Maximum lifetime of a user token, so that a leaked token cannot link leads for long
+	maxUserTokenLifetime = 24 * time.Hour
+)
+
+var (
+	errForgedLeadID     = errors.New("Invalid lead identifier")
+	errUnknownLeadID    = errors.New("Unknown lead identifier")
+	errInvalidUserToken = errors.New("Invalid user token")
+)
+
+// Structs for storing identify data, linking the lead to a user
+type IdentifyData struct {
+	LeadUUID      string `json:"leadUuid"`
+	UserID        string `json:"userID"`
+	UserToken     string `json:"userToken"`
+	ConsentString string `json:"consentString"`
+}
+
+// Structs for the identify response, with the Lead UUID to use from now on
+type IdentifyResponse struct {
+	LeadUUID string `json:"lead_uuid"`
+}
+
+// signLeadUUID returns the signed lead identifier of a Lead UUID, bound to the brand
+func signLeadUUID(brandName string, leadUUID string) string {
+	mac := hmac.New(sha256.New, []byte(os.Getenv("LEAD_ID_SECRET")))
+	mac.Write([]byte(brandName + ":" + leadUUID))
+
+	return leadUUID + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// verifyLeadID returns the Lead UUID of a signed lead identifier
+func verifyLeadID(brandName string, leadID string) (string, bool) {
+	leadUUID, _, found := strings.Cut(leadID, ".")
+	if !found {
+		return "", false
+	}
+
+	return leadUUID, hmac.Equal([]byte(signLeadUUID(brandName, leadUUID)), []byte(leadID))
+}
+
+// isLegacyLeadIDAccepted allows the Lead UUIDs issued before the signed identifiers while the cookies are migrated
+func isLegacyLeadIDAccepted() bool {
+	return os.Getenv("LEAD_ID_ACCEPT_LEGACY") == "true"
+}
+
+// getCookieDomain returns the registrable domain of the brand site when the collector shares it,
+// so that the cookies are first-party for the site. Otherwise the cookies are limited to the collector host.
+func getCookieDomain(r *http.Request, brand *Brand) string {
+	siteHost := brand.SiteHost
+	if host, _, err := net.SplitHostPort(siteHost); err == nil {
+		siteHost = host
+	}
+
+	domain, err := publicsuffix.EffectiveTLDPlusOne(siteHost)
+	if err != nil {
+		return ""
+	}
+
+	requestHost := r.Host
+	if host, _, err := net.SplitHostPort(requestHost); err == nil {
+		requestHost = host
+	}
+
+	if requestHost != domain && !strings.HasSuffix(requestHost, "."+domain) {
+		return ""
+	}
+
+	return domain
+}
+
+// isSecureRequest checks if the request was made over HTTPS, directly or through a trusted proxy
+func isSecureRequest(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+
+	remoteAddr, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remoteAddr = r.RemoteAddr
+	}
+
+	if remoteIP := net.ParseIP(remoteAddr); remoteIP != nil && isTrustedProxy(remoteIP) {
+		return r.Header.Get("X-Forwarded-Proto") == "https"
+	}
+
+	return false
+}
+
+// setLeadCookies stores the signed lead identifier and the Lead UUID in the cookies of the brand site
+func setLeadCookies(w http.ResponseWriter, r *http.Request, brand *Brand, leadUUID string) {
+	domain := getCookieDomain(r, brand)
+	secure := isSecureRequest(r)
+	expires := time.Now().Add(leadCookieMaxAge)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     leadIDCookieName,
+		Value:    signLeadUUID(brand.Name, leadUUID),
+		Path:     "/",
+		Domain:   domain,
+		Expires:  expires,
+		Secure:   secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	// The SDK reads the Lead UUID, the signed identifier stays out of reach of the scripts
+	http.SetCookie(w, &http.Cookie{
+		Name:     leadUUIDCookieName,
+		Value:    leadUUID,
+		Path:     "/",
+		Domain:   domain,
+		Expires:  expires,
+		Secure:   secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// getCookieLeadUUID returns the Lead UUID of the signed lead identifier of a request, without issuing one
+func getCookieLeadUUID(r *http.Request, brand *Brand) (string, bool) {
+	cookie, err := r.Cookie(leadIDCookieName)
+	if err != nil {
+		return "", false
+	}
+
+	return verifyLeadID(brand.Name, cookie.Value)
+}
+
+// isRequestLeadAllowed checks if a request may read the data of a lead.
+// The anonymous requests of the browsers may only read their own lead, the requests with an API key may read any lead.
+func isRequestLeadAllowed(r *http.Request, brand *Brand, leadUUID string) bool {
+	if getRequestAPIKey(r) != nil {
+		return true
+	}
+
+	cookieLeadUUID, ok := getCookieLeadUUID(r, brand)
+	return ok && cookieLeadUUID == leadUUID
+}
+
+// identifyLead returns the Lead UUID of a request from its signed lead identifier and refreshes the lead cookies.
+// A lead without identifier gets a new one. The Lead UUID claimed by the client must match the identifier.
+// During the migration, the legacy Lead UUIDs are only read from the cookie of the SDK, never from the request body.
+func identifyLead(w http.ResponseWriter, r *http.Request, brand *Brand, claimedLeadUUID string) (string, error) {
+	if cookie, err := r.Cookie(leadIDCookieName); err == nil {
+		leadUUID, valid := verifyLeadID(brand.Name, cookie.Value)
+		if !valid {
+			return "", errForgedLeadID
+		}
+
+		if claimedLeadUUID != "" && claimedLeadUUID != leadUUID {
+			return "", errForgedLeadID
+		}
+
+		setLeadCookies(w, r, brand, leadUUID)
+		return leadUUID, nil
+	}
+
+	if cookie, err := r.Cookie(leadUUIDCookieName); err == nil && isLegacyLeadIDAccepted() {
+		legacyLeadUUID := cookie.Value
+		if _, err := uuid.Parse(legacyLeadUUID); err != nil {
+			return "", errUnknownLeadID
+		}
+
+		if claimedLeadUUID != "" && claimedLeadUUID != legacyLeadUUID {
+			return "", errForgedLeadID
+		}
+
+		logger.LogInfo("[IDENTITY] Migrating legacy Lead UUID: %s", legacyLeadUUID)
+		setLeadCookies(w, r, brand, legacyLeadUUID)
+		return legacyLeadUUID, nil
+	}
+
+	if claimedLeadUUID != "" {
+		return "", errUnknownLeadID
+	}
+
+	leadUUID := generateUUID()
+	setLeadCookies(w, r, brand, leadUUID)
+	logger.LogInfo("[IDENTITY] Generated new Lead UUID: %s", leadUUID)
+
+	return leadUUID, nil
+}
+
+// signUserToken returns the user token of a user valid until the expiry, as signed by the brand backend
+func signUserToken(brand *Brand, userID string, expiry time.Time) string {
+	timestamp := strconv.FormatInt(expiry.Unix(), 10)
+
+	mac := hmac.New(sha256.New, []byte(brand.IdentifySecret))
+	mac.Write([]byte(brand.Name + ":" + userID + ":" + timestamp))
+
+	return timestamp + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyUserToken checks the user token proving that the reader is logged in as the user on the brand site.
+// The token is formatted as <unix expiry>.<hex HMAC-SHA256>, the signed payload being the brand, the user ID
+// and the expiry joined by colons, with the identify secret of the brand.
+func verifyUserToken(brand *Brand, userID string, token string) error {
+	if brand.IdentifySecret == "" {
+		return errors.New("Identify is not enabled for the brand")
+	}
+
+	timestamp, _, found := strings.Cut(token, ".")
+	if !found {
+		return errInvalidUserToken
+	}
+
+	unixExpiry, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errInvalidUserToken
+	}
+
+	expiry := time.Unix(unixExpiry, 0)
+	if time.Now().After(expiry) || time.Until(expiry) > maxUserTokenLifetime {
+		return errors.New("User token is expired or valid for too long")
+	}
+
+	if !hmac.Equal([]byte(signUserToken(brand, userID, expiry)), []byte(token)) {
+		return errInvalidUserToken
+	}
+
+	return nil
+}
+
+// linkLeadToUser stores the alias of a lead for a user and returns the canonical lead of the user,
+// which is the first lead linked to the user
+func linkLeadToUser(brandName string, leadUUID string, userID string) (string, error) {
+	_, err := db.Exec(`
+		INSERT INTO lead_alias (brand, lead_uuid, user_id, created_at)
+		VALUES ($1, $2, $3, NOW())
+		ON CONFLICT (brand, lead_uuid, user_id) DO NOTHING
+	`, brandName, leadUUID, userID)
+	if err != nil {
+		return "", err
+	}
+
+	var canonicalLeadUUID string
+	err = db.QueryRow(`
+		SELECT lead_uuid
+		FROM lead_alias
+		WHERE brand = $1 AND user_id = $2
+		ORDER BY created_at, lead_uuid
+		LIMIT 1
+	`, brandName, userID).Scan(&canonicalLeadUUID)
+	if err == sql.ErrNoRows {
+		return leadUUID, nil
+	} else if err != nil {
+		return "", err
+	}
+
+	return canonicalLeadUUID, nil
+}
+
+// Link the lead of the request to a user, and switch the lead to the canonical lead of the user
+// so that the reader keeps a single lead across devices and cookie losses.
+// The user is proven by a token signed by the brand backend, otherwise anyone could take over the lead of a user.
+func identifyHandler(w http.ResponseWriter, r *http.Request) {
+	brand := getRequestBrand(r)
+
+	var identifyData IdentifyData
+	if err := json.NewDecoder(r.Body).Decode(&identifyData); err != nil {
+		logger.LogError("[IDENTITY] Invalid request payload: %v", err)
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	if identifyData.UserID == "" {
+		http.Error(w, "Missing 'userID'", http.StatusBadRequest)
+		return
+	}
+
+	if err := verifyUserToken(brand, identifyData.UserID, identifyData.UserToken); err != nil {
+		logger.LogError("[IDENTITY] Rejected user token of user %s: %v", identifyData.UserID, err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	// The link between the lead and the user is stored like the user PII
+	if identifyData.ConsentString != "" {
+		consentPurposes, err := resolveConsent(false, identifyData.ConsentString)
+		if err != nil {
+			logger.LogWarn("[IDENTITY] Invalid consent string for Lead UUID %s: %v", identifyData.LeadUUID, err)
+		}
+
+		if !consentPurposes.Storage {
+			http.Error(w, "Storage consent is required to identify the lead", http.StatusForbidden)
+			return
+		}
+	}
+
+	leadUUID, err := identifyLead(w, r, brand, identifyData.LeadUUID)
+	if err != nil {
+		logger.LogError("[IDENTITY] Rejected lead identifier: %v", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	canonicalLeadUUID, err := linkLeadToUser(brand.Name, leadUUID, identifyData.UserID)
+	if err != nil {
+		logger.LogError("[IDENTITY] Failed to link Lead UUID %s to user %s: %v", leadUUID, identifyData.UserID, err)
+		http.Error(w, "Failed to identify lead", http.StatusInternalServerError)
+		return
+	}
+
+	if canonicalLeadUUID != leadUUID {
+		logger.LogInfo("[IDENTITY] Stitching Lead UUID %s to Lead UUID %s of user %s", leadUUID, canonicalLeadUUID, identifyData.UserID)
+		setLeadCookies(w, r, brand, canonicalLeadUUID)
+	}
+
+	response, err := json.Marshal(IdentifyResponse{LeadUUID: canonicalLeadUUID})
+	if err != nil {
+		http.Error(w, "Failed to marshal response", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testLeadUUID      = "3f6c1b9e-8a0e-4a53-9d43-2a1f6f0c0b01"
+	testOtherLeadUUID = "3f6c1b9e-8a0e-4a53-9d43-2a1f6f0c0b02"
+)
+
+// newIdentityRequest creates a request of the brand with the cookies
+func newIdentityRequest(brand *Brand, cookies ...*http.Cookie) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/collect/v1/lead-event", nil)
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+
+	return r.WithContext(context.WithValue(r.Context(), brandContextKey, brand))
+}
+
+// responseLeadCookie returns the Lead UUID of the signed lead identifier set by a response
+func responseLeadCookie(t *testing.T, brand *Brand, recorder *httptest.ResponseRecorder) string {
+	t.Helper()
+
+	for _, cookie := range recorder.Result().Cookies() {
+		if cookie.Name == leadIDCookieName {
+			leadUUID, valid := verifyLeadID(brand.Name, cookie.Value)
+			if !valid {
+				t.Fatalf("response lead identifier %q is not signed", cookie.Value)
+			}
+			return leadUUID
+		}
+	}
+
+	return ""
+}
+
+func TestIdentifyLead(t *testing.T) {
+	brand := &Brand{Name: "test"}
+	t.Setenv("LEAD_ID_SECRET", "test-secret")
+
+	signedCookie := &http.Cookie{Name: leadIDCookieName, Value: signLeadUUID(brand.Name, testLeadUUID)}
+	legacyCookie := &http.Cookie{Name: leadUUIDCookieName, Value: testLeadUUID}
+
+	tests := []struct {
+		name          string
+		cookies       []*http.Cookie
+		claimed       string
+		legacy        bool
+		wantLeadUUID  string
+		wantErr       error
+		wantGenerated bool
+	}{
+		{name: "new lead", wantGenerated: true},
+		{name: "signed identifier", cookies: []*http.Cookie{signedCookie}, wantLeadUUID: testLeadUUID},
+		{name: "signed identifier claimed", cookies: []*http.Cookie{signedCookie}, claimed: testLeadUUID, wantLeadUUID: testLeadUUID},
+		{name: "mismatched claim", cookies: []*http.Cookie{signedCookie}, claimed: testOtherLeadUUID, wantErr: errForgedLeadID},
+		{name: "forged signature", cookies: []*http.Cookie{{Name: leadIDCookieName, Value: testLeadUUID + ".forged"}}, wantErr: errForgedLeadID},
+		{name: "identifier of another brand", cookies: []*http.Cookie{{Name: leadIDCookieName, Value: signLeadUUID("other", testLeadUUID)}}, wantErr: errForgedLeadID},
+		{name: "legacy cookie", cookies: []*http.Cookie{legacyCookie}, claimed: testLeadUUID, legacy: true, wantLeadUUID: testLeadUUID},
+		{name: "legacy cookie unclaimed", cookies: []*http.Cookie{legacyCookie}, legacy: true, wantLeadUUID: testLeadUUID},
+		{name: "legacy cookie mismatched claim", cookies: []*http.Cookie{legacyCookie}, claimed: testOtherLeadUUID, legacy: true, wantErr: errForgedLeadID},
+		{name: "legacy cookie malformed", cookies: []*http.Cookie{{Name: leadUUIDCookieName, Value: "not-a-uuid"}}, legacy: true, wantErr: errUnknownLeadID},
+		{name: "legacy claim from the body", claimed: testLeadUUID, legacy: true, wantErr: errUnknownLeadID},
+		{name: "legacy cookie after the migration", cookies: []*http.Cookie{legacyCookie}, wantGenerated: true},
+		{name: "claim after the migration", claimed: testLeadUUID, wantErr: errUnknownLeadID},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.legacy {
+				t.Setenv("LEAD_ID_ACCEPT_LEGACY", "true")
+			} else {
+				t.Setenv("LEAD_ID_ACCEPT_LEGACY", "false")
+			}
+
+			recorder := httptest.NewRecorder()
+			leadUUID, err := identifyLead(recorder, newIdentityRequest(brand, tt.cookies...), brand, tt.claimed)
+
+			if err != tt.wantErr {
+				t.Fatalf("identifyLead() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if cookie := responseLeadCookie(t, brand, recorder); cookie != "" {
+					t.Errorf("rejected lead got the lead identifier of %s", cookie)
+				}
+				return
+			}
+
+			if tt.wantGenerated {
+				if leadUUID == "" || leadUUID == testLeadUUID {
+					t.Errorf("identifyLead() = %q, want a new Lead UUID", leadUUID)
+				}
+			} else if leadUUID != tt.wantLeadUUID {
+				t.Errorf("identifyLead() = %q, want %q", leadUUID, tt.wantLeadUUID)
+			}
+
+			if cookie := responseLeadCookie(t, brand, recorder); cookie != leadUUID {
+				t.Errorf("lead identifier cookie of %q, want %q", cookie, leadUUID)
+			}
+		})
+	}
+}
+
+func TestVerifyUserToken(t *testing.T) {
+	brand := &Brand{Name: "test", IdentifySecret: "identify-secret"}
+	expiry := time.Now().Add(time.Hour)
+	token := signUserToken(brand, "user123", expiry)
+
+	if err := verifyUserToken(brand, "user123", token); err != nil {
+		t.Errorf("verifyUserToken() error = %v, want nil", err)
+	}
+
+	tests := []struct {
+		name   string
+		brand  *Brand
+		userID string
+		token  string
+	}{
+		{"another user", brand, "user456", token},
+		{"another brand", &Brand{Name: "other", IdentifySecret: "identify-secret"}, "user123", token},
+		{"another secret", &Brand{Name: "test", IdentifySecret: "other-secret"}, "user123", token},
+		{"brand without secret", &Brand{Name: "test"}, "user123", signUserToken(&Brand{Name: "test"}, "user123", expiry)},
+		{"forged signature", brand, "user123", strings.Split(token, ".")[0] + ".forged"},
+		{"extended expiry", brand, "user123", strconv.FormatInt(expiry.Add(time.Minute).Unix(), 10) + token[strings.Index(token, "."):]},
+		{"expired", brand, "user123", signUserToken(brand, "user123", time.Now().Add(-time.Minute))},
+		{"valid for too long", brand, "user123", signUserToken(brand, "user123", time.Now().Add(2*maxUserTokenLifetime))},
+		{"malformed", brand, "user123", "token"},
+		{"missing", brand, "user123", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := verifyUserToken(tt.brand, tt.userID, tt.token); err == nil {
+				t.Errorf("verifyUserToken() error = nil, want an error")
+			}
+		})
+	}
+}
+
+func TestIdentifyHandlerRequiresUserToken(t *testing.T) {
+	brand := &Brand{Name: "test", IdentifySecret: "identify-secret"}
+	t.Setenv("LEAD_ID_SECRET", "test-secret")
+
+	for _, body := range []string{
+		`{"userID": "user123"}`,
+		`{"userID": "user123", "userToken": "` + signUserToken(brand, "user456", time.Now().Add(time.Hour)) + `"}`,
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/collect/v1/identify", strings.NewReader(body))
+		r.AddCookie(&http.Cookie{Name: leadIDCookieName, Value: signLeadUUID(brand.Name, testLeadUUID)})
+		r = r.WithContext(context.WithValue(r.Context(), brandContextKey, brand))
+
+		// The lead is not linked, so the database is not reached
+		recorder := httptest.NewRecorder()
+		identifyHandler(recorder, r)
+
+		if recorder.Code != http.StatusForbidden {
+			t.Errorf("identify of %s status = %d, want %d", body, recorder.Code, http.StatusForbidden)
+		}
+		if cookie := responseLeadCookie(t, brand, recorder); cookie != "" {
+			t.Errorf("identify of %s set the lead identifier of %s", body, cookie)
+		}
+	}
+}
+
+func TestArticleTopNextArticlesRequiresRequestLead(t *testing.T) {
+	brand := &Brand{Name: "test"}
+	t.Setenv("LEAD_ID_SECRET", "test-secret")
+
+	// The lead of the cookie may not read the recommendations personalised for another lead
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/article/top-next-articles?url=https://www.example.com/article&lead_uuid="+testOtherLeadUUID, nil)
+	r.AddCookie(&http.Cookie{Name: leadIDCookieName, Value: signLeadUUID(brand.Name, testLeadUUID)})
+	r = r.WithContext(context.WithValue(r.Context(), brandContextKey, brand))
+
+	recorder := httptest.NewRecorder()
+	getArticleTopNextArticles(recorder, r)
+
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("status = %d, want %d", recorder.Code, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+)
+
+// Location of the schema being compiled, the metas schemas are self-contained
+const jsonSchemaResource = "metas.json"
+
+// Keywords of the JSON Schema subset used to validate lead event metas.
+// Unsupported keywords are rejected when the schema is parsed rather than silently ignored.
+var jsonSchemaKeywords = map[string]bool{
+	"$schema":              true,
+	"$id":                  true,
+	"title":                true,
+	"description":          true,
+	"default":              true,
+	"examples":             true,
+	"type":                 true,
+	"enum":                 true,
+	"const":                true,
+	"properties":           true,
+	"required":             true,
+	"additionalProperties": true,
+	"items":                true,
+	"minItems":             true,
+	"maxItems":             true,
+	"minLength":            true,
+	"maxLength":            true,
+	"pattern":              true,
+	"minimum":              true,
+	"maximum":              true,
+	"exclusiveMinimum":     true,
+	"exclusiveMaximum":     true,
+}
+
+// JSONSchema is a compiled metas schema
+type JSONSchema struct {
+	schema *jsonschema.Schema
+}
+
+// ParseJSONSchema parses and compiles a schema, the schemas without $schema follow the 2020-12 draft
+func ParseJSONSchema(data []byte) (*JSONSchema, error) {
+	document, err := jsonschema.UnmarshalJSON(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid schema: %v", err)
+	}
+
+	if err := checkJSONSchemaKeywords("#", document); err != nil {
+		return nil, fmt.Errorf("Invalid schema: %v", err)
+	}
+
+	compiler := jsonschema.NewCompiler()
+	compiler.DefaultDraft(jsonschema.Draft2020)
+
+	if err := compiler.AddResource(jsonSchemaResource, document); err != nil {
+		return nil, fmt.Errorf("Invalid schema: %v", err)
+	}
+
+	schema, err := compiler.Compile(jsonSchemaResource)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid schema: %v", err)
+	}
+
+	return &JSONSchema{schema: schema}, nil
+}
+
+// checkJSONSchemaKeywords rejects the keywords outside the supported subset in a schema and its subschemas
+func checkJSONSchemaKeywords(path string, document interface{}) error {
+	if _, ok := document.(bool); ok {
+		return nil
+	}
+
+	schema, ok := document.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("%s: schema must be an object or a boolean", path)
+	}
+
+	keywords := make([]string, 0, len(schema))
+	for keyword := range schema {
+		keywords = append(keywords, keyword)
+	}
+	sort.Strings(keywords)
+
+	for _, keyword := range keywords {
+		if !jsonSchemaKeywords[keyword] {
+			return fmt.Errorf("%s: unsupported keyword %s", path, keyword)
+		}
+	}
+
+	if properties, ok := schema["properties"].(map[string]interface{}); ok {
+		for name, property := range properties {
+			if err := checkJSONSchemaKeywords(path+"/properties/"+name, property); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, keyword := range []string{"additionalProperties", "items"} {
+		if subschema, ok := schema[keyword]; ok {
+			if err := checkJSONSchemaKeywords(path+"/"+keyword, subschema); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Validate validates a value decoded by encoding/json and returns the list of violations
+func (s *JSONSchema) Validate(value interface{}) []string {
+	err := s.schema.Validate(value)
+	if err == nil {
+		return nil
+	}
+
+	var validationError *jsonschema.ValidationError
+	if !errors.As(err, &validationError) {
+		return []string{err.Error()}
+	}
+
+	var violations []string
+	collectJSONSchemaViolations(validationError, &violations)
+
+	return violations
+}
+
+// collectJSONSchemaViolations flattens the causes of a validation error, each leaf being a violation
+func collectJSONSchemaViolations(validationError *jsonschema.ValidationError, violations *[]string) {
+	if len(validationError.Causes) == 0 {
+		*violations = append(*violations, validationError.Error())
+		return
+	}
+
+	for _, cause := range validationError.Causes {
+		collectJSONSchemaViolations(cause, violations)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJSONSchemaKeywords(t *testing.T) {
+	tests := []struct {
+		name    string
+		schema  string
+		valid   []string
+		invalid []string
+	}{
+		{
+			name:    "type",
+			schema:  `{"type": "object", "properties": {"count": {"type": "integer"}, "label": {"type": ["string", "null"]}}}`,
+			valid:   []string{`{"count": 3}`, `{"label": null}`, `{"label": "news"}`},
+			invalid: []string{`{"count": 3.5}`, `{"count": "3"}`, `{"label": 1}`},
+		},
+		{
+			name:    "enum",
+			schema:  `{"properties": {"plan": {"enum": ["free", "premium"]}}}`,
+			valid:   []string{`{"plan": "free"}`},
+			invalid: []string{`{"plan": "gold"}`},
+		},
+		{
+			name:    "const",
+			schema:  `{"properties": {"version": {"const": 2}}}`,
+			valid:   []string{`{"version": 2}`},
+			invalid: []string{`{"version": 1}`},
+		},
+		{
+			name:    "required",
+			schema:  `{"required": ["offer_id"]}`,
+			valid:   []string{`{"offer_id": "monthly"}`},
+			invalid: []string{`{}`},
+		},
+		{
+			name:    "additionalProperties false",
+			schema:  `{"properties": {"plan": {"type": "string"}}, "additionalProperties": false}`,
+			valid:   []string{`{"plan": "free"}`},
+			invalid: []string{`{"plan": "free", "price": 10}`},
+		},
+		{
+			name:    "additionalProperties schema",
+			schema:  `{"additionalProperties": {"type": "number"}}`,
+			valid:   []string{`{"price": 10, "discount": 0.5}`},
+			invalid: []string{`{"price": "10"}`},
+		},
+		{
+			name:    "items",
+			schema:  `{"properties": {"tags": {"type": "array", "items": {"type": "string"}, "minItems": 1, "maxItems": 2}}}`,
+			valid:   []string{`{"tags": ["a"]}`, `{"tags": ["a", "b"]}`},
+			invalid: []string{`{"tags": []}`, `{"tags": ["a", "b", "c"]}`, `{"tags": [1]}`},
+		},
+		{
+			name:    "string length and pattern",
+			schema:  `{"properties": {"code": {"type": "string", "minLength": 2, "maxLength": 4, "pattern": "^\\p{Lu}+$"}}}`,
+			valid:   []string{`{"code": "FR"}`, `{"code": "ÉTÉ"}`},
+			invalid: []string{`{"code": "F"}`, `{"code": "FRANCE"}`, `{"code": "fr"}`},
+		},
+		{
+			name:    "number bounds",
+			schema:  `{"properties": {"rate": {"minimum": 0, "maximum": 100}, "ratio": {"exclusiveMinimum": 0, "exclusiveMaximum": 1}}}`,
+			valid:   []string{`{"rate": 0}`, `{"rate": 100}`, `{"ratio": 0.5}`},
+			invalid: []string{`{"rate": -1}`, `{"rate": 101}`, `{"ratio": 0}`, `{"ratio": 1}`},
+		},
+		{
+			name:    "annotations",
+			schema:  `{"$schema": "https://json-schema.org/draft/2020-12/schema", "title": "Subscription", "description": "A subscription", "default": {}, "examples": [{"plan": "free"}], "type": "object"}`,
+			valid:   []string{`{}`},
+			invalid: []string{`[]`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schema, err := ParseJSONSchema([]byte(tt.schema))
+			if err != nil {
+				t.Fatalf("ParseJSONSchema() error = %v", err)
+			}
+
+			for _, metas := range tt.valid {
+				if violations := schema.Validate(decodeMetas(t, metas)); len(violations) > 0 {
+					t.Errorf("Validate(%s) = %v, want no violation", metas, violations)
+				}
+			}
+
+			for _, metas := range tt.invalid {
+				if violations := schema.Validate(decodeMetas(t, metas)); len(violations) == 0 {
+					t.Errorf("Validate(%s) has no violation", metas)
+				}
+			}
+		})
+	}
+}
+
+func TestJSONSchemaUnsupportedKeywords(t *testing.T) {
+	tests := []struct {
+		name    string
+		schema  string
+		keyword string
+	}{
+		{"typo", `{"type": "object", "requried": ["plan"]}`, "requried"},
+		{"composition", `{"oneOf": [{"type": "string"}, {"type": "number"}]}`, "oneOf"},
+		{"reference", `{"$ref": "https://example.com/schema.json"}`, "$ref"},
+		{"format", `{"type": "string", "format": "email"}`, "format"},
+		{"property", `{"properties": {"email": {"type": "string", "format": "email"}}}`, "format"},
+		{"additionalProperties", `{"additionalProperties": {"if": {"type": "string"}}}`, "if"},
+		{"items", `{"items": {"uniqueItems": true}}`, "uniqueItems"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseJSONSchema([]byte(tt.schema))
+			if err == nil {
+				t.Fatal("ParseJSONSchema() error = nil, want an unsupported keyword error")
+			}
+			if !strings.Contains(err.Error(), "unsupported keyword "+tt.keyword) {
+				t.Errorf("ParseJSONSchema() error = %v, want unsupported keyword %s", err, tt.keyword)
+			}
+		})
+	}
+}
+
+func TestJSONSchemaInvalid(t *testing.T) {
+	for _, schema := range []string{`{"type": "text"}`, `{"pattern": "("}`, `{"minLength": "2"}`, `"object"`, `{`} {
+		if _, err := ParseJSONSchema([]byte(schema)); err == nil {
+			t.Errorf("ParseJSONSchema(%s) error = nil, want an error", schema)
+		}
+	}
+}
+
+func TestGetLeadEventTypeSchemaReplacesUpdatedSchema(t *testing.T) {
+	updatedAt := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	leadEventType := &LeadEventType{
+		Name:        "subscription_test",
+		MetasSchema: json.RawMessage(`{"required": ["plan"]}`),
+		UpdatedAt:   updatedAt,
+	}
+
+	schema, err := getLeadEventTypeSchema("test", leadEventType)
+	if err != nil {
+		t.Fatalf("getLeadEventTypeSchema() error = %v", err)
+	}
+
+	cached, err := getLeadEventTypeSchema("test", leadEventType)
+	if err != nil {
+		t.Fatalf("getLeadEventTypeSchema() error = %v", err)
+	}
+	if cached != schema {
+		t.Error("getLeadEventTypeSchema() compiled the schema again for the same update time")
+	}
+
+	leadEventType.MetasSchema = json.RawMessage(`{"required": ["offer_id"]}`)
+	leadEventType.UpdatedAt = updatedAt.Add(time.Minute)
+
+	updated, err := getLeadEventTypeSchema("test", leadEventType)
+	if err != nil {
+		t.Fatalf("getLeadEventTypeSchema() error = %v", err)
+	}
+	if violations := updated.Validate(map[string]interface{}{"plan": "free"}); len(violations) == 0 {
+		t.Error("getLeadEventTypeSchema() returned the schema of the previous update")
+	}
+
+	entries := 0
+	leadEventTypeSchemas.Range(func(key, value interface{}) bool {
+		if strings.HasPrefix(key.(string), "test:subscription_test") {
+			entries++
+		}
+		return true
+	})
+	if entries != 1 {
+		t.Errorf("%d cached schemas for the lead event type, want 1", entries)
+	}
+}
+
+func decodeMetas(t *testing.T, metas string) interface{} {
+	t.Helper()
+
+	var value interface{}
+	if err := json.Unmarshal([]byte(metas), &value); err != nil {
+		t.Fatalf("json.Unmarshal(%s) error = %v", metas, err)
+	}
+
+	return value
+}
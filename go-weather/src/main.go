@@ -6,15 +6,16 @@ import (
 	"errors"
 	"fmt"
 	"log"
-	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
-	"cloud.google.com/go/pubsub"
 	"github.com/go-redis/redis/v8"
 	"github.com/google/uuid"
 	"github.com/joho/godotenv"
@@ -23,7 +24,11 @@ import (
 	"github.com/tdewolff/minify/v2"
 	"github.com/tdewolff/minify/v2/js"
 	"golang.org/x/net/context"
-	"google.golang.org/api/option"
+
+	"eventbus"
+	"extract"
+	"messages"
+	"urlnormaliser"
 )
 
 var (
@@ -31,19 +36,53 @@ var (
 	logger      *Logger
 	redisClient *redis.Client
 	db          *sql.DB
-	psClient    *pubsub.Client
+	eventBus    eventbus.Publisher
+	botDetector *BotDetector
+
+	// Compiled URL normalisers by brand and URL rules
+	urlNormalisers sync.Map
 
-	// Allowed lead event names
+	// Built-in lead event names, other events must be registered in the brand lead event types
 	allowedLeadEvents = map[string]bool{
 		"page_view":     true,
 		"page_behavior": true,
 	}
 )
 
+const (
+	// Maximum number of items and body size accepted by the batch collector
+	maxBatchItems    = 500
+	maxBatchBodySize = 5 << 20
+
+	// Maximum body size accepted by the page data collector, which receives the HTML of the pages
+	maxPageDataBodySize = 10 << 20
+
+	// Lead events are deduplicated by event UUID over this period, covering the retries of the clients
+	leadEventDeduplicationTTL = 24 * time.Hour
+
+	// The versions of a page are only published once over this period
+	pageDeduplicationTTL = 10 * time.Minute
+
+	// Sources of the lead events, the server events are sent by the brand backend on behalf of the lead
+	leadEventSourceSDK    = "sdk"
+	leadEventSourceServer = "server"
+
+	// Batch item statuses
+	batchItemStatusAccepted  = "accepted"
+	batchItemStatusDuplicate = "duplicate"
+	batchItemStatusRejected  = "rejected"
+	batchItemStatusFailed    = "failed"
+)
+
 type Brand struct {
-	Name     string `json:"name"`
-	Host     string `json:"host"`
-	SiteHost string `json:"site_host"`
+	Name                  string                 `json:"name"`
+	Host                  string                 `json:"host"`
+	SiteHost              string                 `json:"site_host"`
+	IPAnonymisation       string                 `json:"ip_anonymisation"`
+	URLRules              urlnormaliser.URLRules `json:"url_rules"`
+	ChannelRules          ChannelRules           `json:"channel_rules"`
+	RecommendationWeights RecommendationWeights  `json:"recommendation_weights"`
+	IdentifySecret        string                 `json:"identify_secret"`
 }
 
 // Structs for storing page data
@@ -60,46 +99,29 @@ type PageData struct {
 	SubSection       *string              `json:"subSection"`
 	Image            *string              `json:"image"`
 	IsPaid           bool                 `json:"isPaid"`
+	Author           *string              `json:"author"`
+	Keywords         []string             `json:"keywords"`
+	WordCount        int                  `json:"wordCount"`
+	Metadata         EventMetadata        `json:"-"`
 }
 
-// Structs for storing page data
-type PageDataPubSub struct {
-	DateTime         time.Time  `json:"datetime"`
-	Brand            string     `json:"brand"`
-	URL              string     `json:"url"`
-	Type             string     `json:"type"`
-	Language         string     `json:"language"`
-	PublicationDate  time.Time  `json:"publication_date"`
-	ModificationDate *time.Time `json:"modification_date"`
-	Title            string     `json:"title"`
-	Description      string     `json:"description"`
-	Content          string     `json:"content"`
-	Section          string     `json:"section"`
-	SubSection       *string    `json:"sub_section"`
-	Image            *string    `json:"image"`
-	IsPaid           bool       `json:"is_paid"`
+// Structs for storing the page data payload, either the page data extracted by the SDK
+// or the HTML of the page for the collector to extract the page data
+type PageDataPayload struct {
+	PageData
+	HTML string `json:"html"`
 }
 
 // Structs for storing user data
 type UserData struct {
-	LeadUUID     string `json:"leadUuid"`
-	UserID       string `json:"userID"`
-	Email        string `json:"email"`
-	FirstName    string `json:"firstName"`
-	LastName     string `json:"lastName"`
-	IsSubscriber bool   `json:"isSubscriber"`
-}
-
-// Structs for storing user data
-type UserDataPubSub struct {
-	DateTime     time.Time `json:"datetime"`
-	Brand        string    `json:"brand"`
-	LeadUUID     string    `json:"lead_uuid"`
-	UserID       string    `json:"user_id"`
-	Email        string    `json:"email"`
-	FirstName    string    `json:"first_name"`
-	LastName     string    `json:"last_name"`
-	IsSubscriber bool      `json:"is_subscriber"`
+	LeadUUID      string        `json:"leadUuid"`
+	UserID        string        `json:"userID"`
+	Email         string        `json:"email"`
+	FirstName     string        `json:"firstName"`
+	LastName      string        `json:"lastName"`
+	IsSubscriber  bool          `json:"isSubscriber"`
+	ConsentString string        `json:"consentString"`
+	Metadata      EventMetadata `json:"-"`
 }
 
 // Structs for storing lead event data
@@ -114,26 +136,34 @@ type LeadEventData struct {
 	Referrer         string                 `json:"referrer"`
 	ReferrerType     string                 `json:"referrer_type"`
 	RelevantReferrer string                 `json:"relevantReferrer"`
+	LandingUrl       string                 `json:"landingUrl"`
 	Metas            map[string]interface{} `json:"metas"`
 	Consent          bool                   `json:"consent"`
+	ConsentString    string                 `json:"consentString"`
+	EventTime        *time.Time             `json:"eventTime"`
+	SentAt           *time.Time             `json:"sentAt"`
+	Metadata         EventMetadata          `json:"-"`
+	ConsentPurposes  ConsentPurposes        `json:"-"`
+	UserAgent        UserAgent              `json:"-"`
+	Campaign         Campaign               `json:"-"`
 }
 
-// Structs for storing lead event data
-type LeadEventDataPubSub struct {
-	Brand            string                 `json:"brand"`
-	UUID             string                 `json:"uuid"`
-	LeadUUID         string                 `json:"lead_uuid"`
-	Name             string                 `json:"name"`
-	PageType         string                 `json:"page_type"`
-	PageLanguage     string                 `json:"page_language"`
-	Device           string                 `json:"device"`
-	Url              string                 `json:"url"`
-	Referrer         string                 `json:"referrer"`
-	ReferrerType     string                 `json:"referrer_type"`
-	RelevantReferrer string                 `json:"relevant_referrer"`
-	Metas            map[string]interface{} `json:"metas"`
-	Consent          bool                   `json:"consent"`
-	IP               string                 `json:"ip"`
+// Structs for storing a batch item, data holds a PageData, a UserData, a LeadEventData or a ConversionData depending on the type
+type BatchItem struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+// Structs for reporting the status of each batch item
+type BatchItemStatus struct {
+	Index  int    `json:"index"`
+	Type   string `json:"type"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type BatchResponse struct {
+	Items []BatchItemStatus `json:"items"`
 }
 
 // Struct for page metrics
@@ -192,48 +222,6 @@ func (ct PublicationDateTime) Time() time.Time {
 	return time.Time(ct)
 }
 
-func isUserAgentBlocked(userAgent string) (bool, error) {
-	// List of blocked user agents
-	blockedUserAgents := []string{
-		"curl",
-		"wget",
-		"PostmanRuntime",
-		"Apache-HttpClient",
-		"Python-urllib",
-		"Java/1.",
-		"libwww-perl",
-		"PHP",
-		"Go-http-client",
-		"HTTrack",
-		"Rogue Wave",
-		"Mozilla/4.0 (compatible; MSIE 6.0; Windows NT 5.1; SV1; .NET CLR 1.1.4322)",
-		"Mozilla/4.0 (compatible; MSIE 6.0; Windows NT 5.0; SV1; .NET CLR 1.1.4322)",
-		"Mozilla/4.0 (compatible; MSIE 6.0; Windows NT 5.1; SV1; .NET CLR 1.0.3705)",
-		"Mozilla/4.0 (compatible; MSIE 6.0; Windows NT 5.1; SV1; .NET CLR 1.0.3705; .NET CLR 1.1.4322)",
-		"Mozilla/4.0 (compatible; MSIE 6.0; Windows NT 5.1; SV1; .NET CLR 1.0.3705; .NET CLR 1.1.4322; .NET CLR 2.0.50727)",
-		"Mozilla/4.0 (compatible; MSIE 6.0; Windows NT 5.1; SV1; .NET CLR 3.0.04506.30)",
-		"Mozilla/4.0 (compatible; MSIE 6.0; Windows NT 5.1; SV1; .NET CLR 3.5.30729)",
-		"Mozilla/4.0 (compatible; MSIE 7.0; Windows NT 6.0; Trident/4.0)",
-		"Mozilla/4.0 (compatible; MSIE 8.0; Windows NT 6.0; Trident/4.0)",
-		"Mozilla/4.0 (compatible; MSIE 9.0; Windows NT 6.1; Trident/5.0)",
-		"Mozilla/4.0 (compatible; MSIE 10.0; Windows NT 6.1; Trident/6.0)",
-		"Mozilla/5.0 (compatible; Yahoo! Slurp; http://help.yahoo.com/help/us/ysearch/slurp)",
-		"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)",
-		"Mozilla/5.0 (compatible; Bingbot/2.0; +http://www.bing.com/bingbot.htm)",
-		"Mozilla/5.0 (compatible; Baiduspider/2.0; +http://www.baidu.com/search/spider.html)",
-		"Mozilla/5.0 (compatible; YandexBot/3.0; +http://yandex.com/bots)",
-	}
-
-	// Check blocked user agents
-	for _, blocked := range blockedUserAgents {
-		if strings.Contains(userAgent, blocked) {
-			return true, fmt.Errorf("User agent is blocked: %s", userAgent)
-		}
-	}
-
-	return false, nil
-}
-
 // getBrandFromHost retrieves the brand details for a given host using Redis cache.
 func getBrandFromHost(host string) (*Brand, error) {
 	var brand Brand
@@ -253,12 +241,28 @@ func getBrandFromHost(host string) (*Brand, error) {
 	brand.Host = host
 
 	// Values not found in cache, retrieve from database
-	err = db.QueryRow("SELECT name, site_host FROM brand WHERE host = $1", host).Scan(&brand.Name, &brand.SiteHost)
+	var urlRules, channelRules, recommendationWeights []byte
+	err = db.QueryRow("SELECT name, site_host, COALESCE(ip_anonymisation, ''), COALESCE(url_rules, '{}'), COALESCE(channel_rules, '{}'), COALESCE(recommendation_weights, '{}'), COALESCE(identify_secret, '') FROM brand WHERE host = $1", host).Scan(&brand.Name, &brand.SiteHost, &brand.IPAnonymisation, &urlRules, &channelRules, &recommendationWeights, &brand.IdentifySecret)
 	if err != nil {
 		logger.LogError("[BRAND] Error querying database: %v", err)
 		return nil, fmt.Errorf("Error querying database: %v", err)
 	}
 
+	if err := json.Unmarshal(urlRules, &brand.URLRules); err != nil {
+		logger.LogError("[BRAND] Error unmarshalling URL rules of brand %s: %v", brand.Name, err)
+		return nil, fmt.Errorf("Error unmarshalling URL rules: %v", err)
+	}
+
+	if err := json.Unmarshal(channelRules, &brand.ChannelRules); err != nil {
+		logger.LogError("[BRAND] Error unmarshalling channel rules of brand %s: %v", brand.Name, err)
+		return nil, fmt.Errorf("Error unmarshalling channel rules: %v", err)
+	}
+
+	if err := json.Unmarshal(recommendationWeights, &brand.RecommendationWeights); err != nil {
+		logger.LogError("[BRAND] Error unmarshalling recommendation weights of brand %s: %v", brand.Name, err)
+		return nil, fmt.Errorf("Error unmarshalling recommendation weights: %v", err)
+	}
+
 	// Convert the page data to JSON
 	brandJSON, err := json.Marshal(brand)
 	if err != nil {
@@ -275,70 +279,129 @@ func getBrandFromHost(host string) (*Brand, error) {
 	return &brand, nil
 }
 
-// Health check
-func healthCheckHandler(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusOK)
-}
-
-func isCollectAllowed(r *http.Request) (*Brand, int, error) {
-	if r.Method != http.MethodPost {
-		return nil, http.StatusMethodNotAllowed, errors.New("Invalid request method")
-	}
-
-	// Check if the user agent is blocked
-	userAgentBlocked, err := isUserAgentBlocked(r.UserAgent())
+// normaliseURL returns the canonical URL of a page of the brand.
+// The normalisers are compiled once per version of the brand URL rules.
+func normaliseURL(brand *Brand, rawURL string) string {
+	rulesJSON, err := json.Marshal(brand.URLRules)
 	if err != nil {
-		return nil, http.StatusForbidden, err
-	}
-
-	if userAgentBlocked {
-		return nil, http.StatusForbidden, err
+		return rawURL
 	}
 
-	// Extract host from the request's Host header
-	host := r.Host
-	if host == "" {
-		return nil, http.StatusBadRequest, errors.New("Host header is required")
+	cacheKey := brand.Name + ":" + string(rulesJSON)
+	if normaliser, ok := urlNormalisers.Load(cacheKey); ok {
+		return normaliser.(*urlnormaliser.URLNormaliser).Normalise(rawURL)
 	}
 
-	// Get the brand name
-	brand, err := getBrandFromHost(host)
+	normaliser, err := urlnormaliser.NewURLNormaliser(brand.URLRules)
 	if err != nil {
-		return nil, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error getting brand: %v", err))
+		logger.LogError("[BRAND] Invalid URL rules for brand %s, applying the default rules: %v", brand.Name, err)
+		normaliser, _ = urlnormaliser.NewURLNormaliser(urlnormaliser.URLRules{})
 	}
+	urlNormalisers.Store(cacheKey, normaliser)
 
-	// Check if the Origin header matches the Host header
-	origin := r.Header.Get("Origin")
-	if origin != "" {
-		parsedOrigin, err := url.Parse(origin)
-		if err != nil {
-			return nil, http.StatusBadRequest, errors.New("Invalid Origin header")
-		}
+	return normaliser.Normalise(rawURL)
+}
 
-		if parsedOrigin.Host != brand.SiteHost && parsedOrigin.Host != brand.Host {
-			return nil, http.StatusForbidden, errors.New("Origin header must match Site host")
-		}
+// normaliseLeadEventURLs normalises the page URLs of a lead event, the referrer is left as is since it is mostly external
+func normaliseLeadEventURLs(brand *Brand, leadEventData LeadEventData) LeadEventData {
+	leadEventData.Url = normaliseURL(brand, leadEventData.Url)
+	if leadEventData.RelevantReferrer != "" {
+		leadEventData.RelevantReferrer = normaliseURL(brand, leadEventData.RelevantReferrer)
 	}
 
-	return brand, 0, nil
+	return leadEventData
+}
+
+// Health check
+func healthCheckHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
 }
 
 // Collect Page Data
 func collectPageDataHandler(w http.ResponseWriter, r *http.Request) {
-	brand, errorCode, err := isCollectAllowed(r)
+	brand := getRequestBrand(r)
+
+	var pageDataPayload PageDataPayload
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPageDataBodySize)).Decode(&pageDataPayload); err != nil {
+		logger.LogError("[COLLECT][PAGE] Invalid request payload, error: %v", err)
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	pageData, errorCode, err := getPayloadPageData(pageDataPayload)
 	if err != nil {
-		logger.LogError("[COLLECT][PAGE] Collect is not allowed: %v", err)
 		http.Error(w, err.Error(), errorCode)
 		return
 	}
 
-	var pageData PageData
-	if err := json.NewDecoder(r.Body).Decode(&pageData); err != nil {
-		logger.LogError("[COLLECT][PAGE] Invalid request payload, error: %v", err)
-		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+	if _, errorCode, err := collectPageData(brand, pageData); err != nil {
+		http.Error(w, err.Error(), errorCode)
 		return
 	}
 
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getPayloadPageData returns the page data of a payload, extracting it from the HTML of the page when the payload has one
+func getPayloadPageData(pageDataPayload PageDataPayload) (PageData, int, error) {
+	if pageDataPayload.HTML == "" {
+		return pageDataPayload.PageData, 0, nil
+	}
+
+	if pageDataPayload.URL == "" {
+		return PageData{}, http.StatusBadRequest, errors.New("Missing 'url'")
+	}
+
+	extracted, err := extract.ExtractPageData(pageDataPayload.URL, strings.NewReader(pageDataPayload.HTML))
+	if err != nil {
+		logger.LogError("[COLLECT][PAGE] Failed to extract page data from the HTML of %s: %v", pageDataPayload.URL, err)
+		return PageData{}, http.StatusBadRequest, errors.New("Invalid page HTML")
+	}
+
+	return newPageData(extracted), 0, nil
+}
+
+// newPageData converts the page data extracted from an HTML page
+func newPageData(extracted extract.PageData) PageData {
+	pageData := PageData{
+		URL:             extracted.URL,
+		Type:            extracted.Type,
+		Language:        extracted.Language,
+		PublicationDate: PublicationDateTime(extracted.PublicationDate),
+		Title:           extracted.Title,
+		Description:     extracted.Description,
+		Content:         extracted.Content,
+		Section:         extracted.Section,
+		SubSection:      extracted.SubSection,
+		Image:           extracted.Image,
+		IsPaid:          extracted.IsPaid,
+		Author:          extracted.Author,
+		Keywords:        extracted.Keywords,
+		WordCount:       extracted.WordCount,
+	}
+
+	if extracted.ModificationDate != nil {
+		modificationDate := PublicationDateTime(*extracted.ModificationDate)
+		pageData.ModificationDate = &modificationDate
+	}
+
+	return pageData
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// collectPageData publishes the page data unless it has already been collected recently.
+// The returned publish result is nil when there is nothing to publish, the page is released when publishing fails.
+func collectPageData(brand *Brand, pageData PageData) (eventbus.PublishResult, int, error) {
+	pageData.URL = normaliseURL(brand, pageData.URL)
+
 	// Log initial indiquant le début de la collecte des données
 	logger.LogInfo("[COLLECT][PAGE] Collecting page data for URL: %s", pageData.URL)
 
@@ -348,42 +411,52 @@ func collectPageDataHandler(w http.ResponseWriter, r *http.Request) {
 		modificationDateString = pageData.ModificationDate.Time().String()
 	}
 
-	// Check cache
-	cacheKey := fmt.Sprintf("page:%s:%s:%s", brand.Name, pageData.URL, modificationDateString)
-	_, err = redisClient.Get(ctx, cacheKey).Result()
-	if err == redis.Nil {
-		// Cache miss, publish the page data
-		logger.LogInfo("[COLLECT][PAGE] Cache miss for page: %s", pageData.URL)
-
-		logger.LogInfo("[COLLECT][PAGE] Publishing new page data for URL: %s", pageData.URL)
-		err := publishPageData(brand.Name, pageData)
-		if err != nil {
-			logger.LogError("[COLLECT][PAGE] Failed to publish page data: %v", err)
-		}
-
-		// Set cache with TTL of 10 minutes
-		err = redisClient.Set(ctx, cacheKey, "exists", 10*time.Minute).Err()
-		if err != nil {
-			logger.LogError("[COLLECT][PAGE] Failed to set cache for page: %s, error: %v", pageData.URL, err)
-		} else {
-			logger.LogInfo("[COLLECT][PAGE] Cache set for page: %s with TTL 24 hours", pageData.URL)
-		}
-	} else if err != nil {
+	isNew, err := claimPage(brand.Name, pageData.URL, modificationDateString)
+	if err != nil {
 		logger.LogError("[COLLECT][PAGE] Failed to check cache for page: %s, error: %v", pageData.URL, err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
-	} else {
-		logger.LogInfo("[COLLECT][PAGE] Page already exists in Redis cache for URL: %s", pageData.URL)
+		return nil, http.StatusInternalServerError, errors.New("Internal server error")
+	} else if !isNew {
 		// Data already processed
-		w.WriteHeader(http.StatusNoContent)
-		return
+		logger.LogInfo("[COLLECT][PAGE] Page already exists in Redis cache for URL: %s", pageData.URL)
+		return nil, 0, nil
 	}
 
-	w.WriteHeader(http.StatusNoContent)
+	logger.LogInfo("[COLLECT][PAGE] Publishing new page data for URL: %s", pageData.URL)
+	result, err := publishPageData(brand.Name, pageData)
+	if err == nil {
+		_, err = result.Get(context.Background())
+	}
+	if err != nil {
+		logger.LogError("[COLLECT][PAGE] Failed to publish page data: %v", err)
+
+		// Let the client retry the page
+		releasePage(brand.Name, pageData.URL, modificationDateString)
+
+		return nil, http.StatusInternalServerError, errors.New("Failed to publish page data")
+	}
+
+	return result, 0, nil
 }
 
-// Publish Page Data to Pub/Sub
-func publishPageData(brandName string, pageData PageData) error {
+// pageDeduplicationKey is the key of a version of a page in the deduplication cache
+func pageDeduplicationKey(brandName string, url string, modificationDate string) string {
+	return fmt.Sprintf("page:%s:%s:%s", brandName, url, modificationDate)
+}
+
+// claimPage atomically marks a version of a page as collected, it returns false if it already was
+func claimPage(brandName string, url string, modificationDate string) (bool, error) {
+	return redisClient.SetNX(ctx, pageDeduplicationKey(brandName, url, modificationDate), "exists", pageDeduplicationTTL).Result()
+}
+
+// releasePage forgets a version of a page which could not be published, so that its retry is collected
+func releasePage(brandName string, url string, modificationDate string) {
+	if err := redisClient.Del(ctx, pageDeduplicationKey(brandName, url, modificationDate)).Err(); err != nil {
+		logger.LogError("[COLLECT][PAGE] Failed to release page %s for brand %s: %v", url, brandName, err)
+	}
+}
+
+// Publish Page Data to the event bus
+func publishPageData(brandName string, pageData PageData) (eventbus.PublishResult, error) {
 	var modificationDate *time.Time
 
 	if pageData.ModificationDate != nil {
@@ -391,7 +464,7 @@ func publishPageData(brandName string, pageData PageData) error {
 		modificationDate = &time
 	}
 
-	pageDataPubSub := PageDataPubSub{
+	pageDataPubSub := messages.PageDataPubSub{
 		DateTime:         time.Now().UTC(),
 		Brand:            brandName,
 		URL:              pageData.URL,
@@ -406,37 +479,17 @@ func publishPageData(brandName string, pageData PageData) error {
 		SubSection:       pageData.SubSection,
 		Image:            pageData.Image,
 		IsPaid:           pageData.IsPaid,
+		Author:           pageData.Author,
+		Keywords:         pageData.Keywords,
+		WordCount:        pageData.WordCount,
 	}
 
-	// Convert the page data to JSON
-	pageDataPubSubJSON, err := json.Marshal(pageDataPubSub)
-	if err != nil {
-		return err
-	}
-
-	// Publish the message to the Pub/Sub topic asynchronously
-	topic := psClient.Topic(os.Getenv("ENV") + "-page")
-	result := topic.Publish(context.Background(), &pubsub.Message{
-		Data: pageDataPubSubJSON,
-	})
-
-	// Log any errors from the publishing result
-	_, err = result.Get(context.Background())
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return publishEvent(messages.TypePage, brandName, pageData.Metadata, pageDataPubSub)
 }
 
 // Collect User Data
 func collectUserDataHandler(w http.ResponseWriter, r *http.Request) {
-	brand, errorCode, err := isCollectAllowed(r)
-	if err != nil {
-		logger.LogError("[COLLECT][USER] Collect is not allowed: %v", err)
-		http.Error(w, err.Error(), errorCode)
-		return
-	}
+	brand := getRequestBrand(r)
 
 	var userData UserData
 	if err := json.NewDecoder(r.Body).Decode(&userData); err != nil {
@@ -445,18 +498,58 @@ func collectUserDataHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Identify the lead from its signed identifier, or issue a new one
+	leadUUID, err := identifyLead(w, r, brand, userData.LeadUUID)
+	if err != nil {
+		logger.LogError("[COLLECT][USER] Rejected lead identifier: %v", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	userData.LeadUUID = leadUUID
+
+	result, errorCode, err := collectUserData(brand, userData)
+	if err != nil {
+		http.Error(w, err.Error(), errorCode)
+		return
+	}
+
+	if result != nil {
+		if _, err := result.Get(context.Background()); err != nil {
+			logger.LogError("[COLLECT][USER] Failed to insert user data: %v", err)
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// collectUserData publishes the user data unless it has already been collected recently.
+// The returned publish result is nil when there is nothing to publish.
+func collectUserData(brand *Brand, userData UserData) (eventbus.PublishResult, int, error) {
+	// The user PII is only stored with the storage consent, the SDK only sends it with the consent when there is no consent string
+	if userData.ConsentString != "" {
+		consentPurposes, err := resolveConsent(false, userData.ConsentString)
+		if err != nil {
+			logger.LogWarn("[COLLECT][USER] Invalid consent string for Lead UUID %s: %v", userData.LeadUUID, err)
+		}
+
+		if !consentPurposes.Storage {
+			return nil, http.StatusForbidden, errors.New("Storage consent is required to collect user data")
+		}
+	}
+
 	// Check cache
-	cacheKey := fmt.Sprintf("user_data:%s:%s:%s", brand.Name, userData.LeadUUID, userData.IsSubscriber)
-	_, err = redisClient.Get(ctx, cacheKey).Result()
+	cacheKey := fmt.Sprintf("user_data:%s:%s:%t", brand.Name, userData.LeadUUID, userData.IsSubscriber)
+	_, err := redisClient.Get(ctx, cacheKey).Result()
 	if err == redis.Nil {
 		// Cache miss, check database
 		logger.LogInfo("[COLLECT][USER] Cache miss for Lead UUID: %s", userData.LeadUUID)
 
 		// User not found in database, insert the data
 		logger.LogInfo("[COLLECT][USER] Publishing new user data for Lead UUID: %s", userData.LeadUUID)
-		err := publishUserData(brand.Name, userData)
+		result, err := publishUserData(brand.Name, userData)
 		if err != nil {
 			logger.LogError("[COLLECT][USER] Failed to insert user data: %v", err)
+			return nil, http.StatusInternalServerError, errors.New("Failed to publish user data")
 		}
 
 		// Set cache with TTL of 1 second
@@ -465,28 +558,20 @@ func collectUserDataHandler(w http.ResponseWriter, r *http.Request) {
 			logger.LogError("[COLLECT][USER] Failed to set cache for Lead UUID: %s, error: %v", userData.LeadUUID, err)
 		}
 
-		// Set cache in case of cache miss
-		err = redisClient.Set(ctx, cacheKey, "exists", 1*time.Second).Err()
-		if err != nil {
-			logger.LogError("[COLLECT][USER] Failed to set cache for Lead UUID: %s, error: %v", userData.LeadUUID, err)
-		}
+		return result, 0, nil
 	} else if err != nil {
 		logger.LogError("[COLLECT][USER] Internal server error while checking cache: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
-	} else {
-		logger.LogInfo("[COLLECT][USER] User already exists in Redis cache: %s", userData.LeadUUID)
-		// Data already processed
-		w.WriteHeader(http.StatusNoContent)
-		return
+		return nil, http.StatusInternalServerError, errors.New("Internal server error")
 	}
 
-	w.WriteHeader(http.StatusNoContent)
+	// Data already processed
+	logger.LogInfo("[COLLECT][USER] User already exists in Redis cache: %s", userData.LeadUUID)
+	return nil, 0, nil
 }
 
-// Publish Page Data to Pub/Sub
-func publishUserData(brandName string, userData UserData) error {
-	userDataPubSub := UserDataPubSub{
+// Publish User Data to the event bus
+func publishUserData(brandName string, userData UserData) (eventbus.PublishResult, error) {
+	userDataPubSub := messages.UserDataPubSub{
 		DateTime:     time.Now().UTC(),
 		Brand:        brandName,
 		LeadUUID:     userData.LeadUUID,
@@ -497,35 +582,12 @@ func publishUserData(brandName string, userData UserData) error {
 		IsSubscriber: userData.IsSubscriber,
 	}
 
-	// Convert the user data to JSON
-	pageDataPubSubJSON, err := json.Marshal(userDataPubSub)
-	if err != nil {
-		return err
-	}
-
-	// Publish the message to the Pub/Sub topic asynchronously
-	topic := psClient.Topic(os.Getenv("ENV") + "-user")
-	result := topic.Publish(context.Background(), &pubsub.Message{
-		Data: pageDataPubSubJSON,
-	})
-
-	// Log any errors from the publishing result
-	_, err = result.Get(context.Background())
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return publishEvent(messages.TypeUser, brandName, userData.Metadata, userDataPubSub)
 }
 
 // Collect Lead Event Data
 func collectLeadEventDataHandler(w http.ResponseWriter, r *http.Request) {
-	brand, errorCode, err := isCollectAllowed(r)
-	if err != nil {
-		logger.LogError("[COLLECT][LEAD_EVENT] Error in isCollectAllowed: %v", err)
-		http.Error(w, err.Error(), errorCode)
-		return
-	}
+	brand := getRequestBrand(r)
 
 	var leadEventData LeadEventData
 	if err := json.NewDecoder(r.Body).Decode(&leadEventData); err != nil {
@@ -534,45 +596,89 @@ func collectLeadEventDataHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Validate event name
-	if !allowedLeadEvents[leadEventData.Name] {
-		logger.LogError("[COLLECT][LEAD_EVENT] Invalid lead event name: %s", leadEventData.Name)
-		http.Error(w, "Invalid lead event name", http.StatusBadRequest)
+	// The SDK dates the page views when the page is loaded, they are sent once the consent is known
+	leadEventData.Metadata = newEventMetadata(leadEventData.EventTime, leadEventData.SentAt, "", time.Now().UTC())
+
+	// Validate event name and metas against the built-in events and the brand registry
+	if errorCode, err := validateLeadEvent(brand, leadEventData); err != nil {
+		logger.LogError("[COLLECT][LEAD_EVENT] Invalid lead event %s: %v", leadEventData.Name, err)
+		http.Error(w, err.Error(), errorCode)
 		return
 	}
 
-	// Check if Lead UUID is present
-	if leadEventData.LeadUUID == "" {
-		// Generate new Lead UUID if not present
-		leadEventData.LeadUUID = generateUUID()
-		http.SetCookie(w, &http.Cookie{
-			Name:    "lead-uuid",
-			Value:   leadEventData.LeadUUID,
-			Path:    "/",
-			Expires: time.Now().Add(365 * 24 * time.Hour), // Cookie valid for 1 year
-		})
-		logger.LogInfo("[COLLECT][LEAD_EVENT] Generated new Lead UUID: %s", leadEventData.LeadUUID)
+	// Identify the lead from its signed identifier, or issue a new one
+	leadUUID, err := identifyLead(w, r, brand, leadEventData.LeadUUID)
+	if err != nil {
+		logger.LogError("[COLLECT][LEAD_EVENT] Rejected lead identifier: %v", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
 	}
+	leadEventData.LeadUUID = leadUUID
 
-	// Check cache
-	cacheKey := fmt.Sprintf("lead_event:%s:%s:%s:%s", brand.Name, leadEventData.LeadUUID, leadEventData.Name, leadEventData.Url)
-	_, err = redisClient.Get(ctx, cacheKey).Result()
-	if err == redis.Nil {
-		// Set cache with TTL of 10 seconds
-		err = redisClient.Set(ctx, cacheKey, "exists", 10*time.Second).Err()
-		if err != nil {
-			logger.LogError("[COLLECT][PAGE] Failed to set cache of lead event for brand %s, leadUuid: %s, name: %s, url: %s, error: %v", brand.Name, leadEventData.LeadUUID, leadEventData.Name, leadEventData.Url, err)
-		}
-	} else if err != nil {
-		logger.LogError("[COLLECT][PAGE] Failed to get cache of lead event for brand %s, leadUuid: %s, name: %s, url: %s", brand.Name, leadEventData.LeadUUID, leadEventData.Name, leadEventData.Url)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	} else {
-		logger.LogInfo("[COLLECT][PAGE] Lead event already collected for brand %s, leadUuid: %s, name: %s, url: %s", brand.Name, leadEventData.LeadUUID, leadEventData.Name, leadEventData.Url)
-		w.WriteHeader(http.StatusNoContent)
+	// Flag the bots rather than rejecting them so that their traffic can be measured
+	botClassification := botDetector.ClassifyRequest(r, brand.Name)
+
+	result, errorCode, err := collectLeadEventData(r, brand, leadEventData, botClassification, leadEventSourceSDK)
+	if err != nil {
+		logger.LogError("[COLLECT][LEAD_EVENT] Failed to collect lead event %s: %v", leadEventData.Name, err)
+		http.Error(w, err.Error(), errorCode)
 		return
 	}
 
+	if result != nil {
+		if _, err := result.Get(context.Background()); err != nil {
+			logger.LogError("[COLLECT][LEAD_EVENT] Failed to publish lead event data: %v", err)
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// leadEventDeduplicationKey is the key of a lead event in the deduplication cache.
+// The page behavior of a page view shares its event UUID, so the event name is part of the key.
+func leadEventDeduplicationKey(brandName string, leadEventData LeadEventData) string {
+	return fmt.Sprintf("lead_event:%s:%s:%s", brandName, leadEventData.Name, leadEventData.UUID)
+}
+
+// claimLeadEvent atomically marks a lead event as collected, it returns false if it already was
+func claimLeadEvent(brandName string, leadEventData LeadEventData) (bool, error) {
+	return redisClient.SetNX(ctx, leadEventDeduplicationKey(brandName, leadEventData), "exists", leadEventDeduplicationTTL).Result()
+}
+
+// releaseLeadEvent forgets a lead event which could not be published, so that its retry is collected
+func releaseLeadEvent(brandName string, leadEventData LeadEventData) {
+	if err := redisClient.Del(ctx, leadEventDeduplicationKey(brandName, leadEventData)).Err(); err != nil {
+		logger.LogError("[COLLECT][LEAD_EVENT] Failed to release lead event %s for brand %s: %v", leadEventData.UUID, brandName, err)
+	}
+}
+
+// collectLeadEventData publishes the lead event data unless it has already been collected recently.
+// The user agent and the IP of the server events are the ones of the brand backend, they are not the lead's.
+// The returned publish result is nil when there is nothing to publish.
+func collectLeadEventData(r *http.Request, brand *Brand, leadEventData LeadEventData, requestBotClassification string, source string) (eventbus.PublishResult, int, error) {
+	// The campaign parameters are read from the URL of the browser, the page URL is the canonical one
+	// and its parameters are removed by the normalisation anyway
+	if leadEventData.Name == "page_view" {
+		leadEventData.Campaign = ParseCampaign(firstNonEmpty(leadEventData.LandingUrl, leadEventData.Url), brand.ChannelRules)
+	}
+
+	leadEventData = normaliseLeadEventURLs(brand, leadEventData)
+
+	// Every view has its own event UUID, only the retries of an event are dropped
+	if leadEventData.UUID == "" {
+		leadEventData.UUID = generateUUID()
+	} else if _, err := uuid.Parse(leadEventData.UUID); err != nil {
+		return nil, http.StatusBadRequest, errors.New("Invalid 'uuid'")
+	}
+
+	isNew, err := claimLeadEvent(brand.Name, leadEventData)
+	if err != nil {
+		logger.LogError("[COLLECT][LEAD_EVENT] Failed to deduplicate lead event %s for brand %s: %v", leadEventData.UUID, brand.Name, err)
+	} else if !isNew {
+		logger.LogInfo("[COLLECT][LEAD_EVENT] Lead event %s %s already collected for brand %s", leadEventData.Name, leadEventData.UUID, brand.Name)
+		return nil, 0, nil
+	}
+
 	if leadEventData.Name == "page_view" {
 		if leadEventData.Referrer == "" {
 			leadEventData.ReferrerType = "direct"
@@ -598,92 +704,355 @@ func collectLeadEventDataHandler(w http.ResponseWriter, r *http.Request) {
 				leadEventData.ReferrerType = parsedReferrer.Medium
 			}
 		}
+
+		userAgent := r.UserAgent()
+		if source == leadEventSourceServer {
+			userAgent = ""
+		}
+
+		leadEventData.Campaign.ResolveChannel(brand.ChannelRules, userAgent, leadEventData.Referrer, leadEventData.ReferrerType)
 	}
 
 	logger.LogInfo("[COLLECT][LEAD_EVENT] Publishing lead event data for Lead UUID: %s and Event UUID: %s", leadEventData.LeadUUID, leadEventData.UUID)
 
+	leadEventData.ConsentPurposes = resolveLeadEventConsent(brand, leadEventData)
+
 	clientIp := ""
-	if leadEventData.Consent {
-		clientIp = getClientIP(r)
+	botClassification := requestBotClassification
+
+	if source != leadEventSourceServer {
+		// The device is the one of the User-Agent header, the one sent by the client is only kept when the header is unknown
+		leadEventData.UserAgent = ParseUserAgent(r.UserAgent())
+		if requestBotClassification == botClassificationKnownBot {
+			leadEventData.UserAgent.IsBot = true
+			leadEventData.UserAgent.DeviceClass = deviceClassBot
+		}
+		if leadEventData.UserAgent.DeviceClass != "" {
+			leadEventData.Device = leadEventData.UserAgent.DeviceClass
+		}
+
+		// The IP is only captured for measurement
+		if leadEventData.ConsentPurposes.Measurement {
+			clientIp = getClientIP(r)
+		}
+
+		botClassification = botDetector.ClassifyLeadEvent(requestBotClassification, leadEventData)
+		if botClassification != botClassificationHuman {
+			logger.LogInfo("[COLLECT][LEAD_EVENT] Lead event %s of Lead UUID %s classified as %s", leadEventData.UUID, leadEventData.LeadUUID, botClassification)
+		}
 	}
 
-	err = publishLeadEventData(brand.Name, leadEventData, clientIp)
+	result, err := publishLeadEventData(brand, leadEventData, clientIp, botClassification)
 	if err != nil {
 		logger.LogError("[COLLECT][LEAD_EVENT] Failed to publish lead event data: %v", err)
+
+		// Let the client retry the event
+		releaseLeadEvent(brand.Name, leadEventData)
+
+		return nil, http.StatusInternalServerError, errors.New("Failed to publish lead event data")
 	}
 
-	w.WriteHeader(http.StatusNoContent)
+	return result, 0, nil
 }
 
-// publishLeadEventData sends lead event data to a Pub/Sub topic asynchronously
-func publishLeadEventData(brandName string, leadEventData LeadEventData, clientIp string) error {
-	leadEventDataPubSub := LeadEventDataPubSub{
-		Brand:            brandName,
-		UUID:             leadEventData.UUID,
-		LeadUUID:         leadEventData.LeadUUID,
-		Name:             leadEventData.Name,
-		PageType:         leadEventData.PageType,
-		PageLanguage:     leadEventData.PageLanguage,
-		Device:           leadEventData.Device,
-		Url:              leadEventData.Url,
-		Referrer:         leadEventData.Referrer,
-		ReferrerType:     leadEventData.ReferrerType,
-		RelevantReferrer: leadEventData.RelevantReferrer,
-		Metas:            leadEventData.Metas,
-		Consent:          leadEventData.Consent,
-		IP:               clientIp,
-	}
-
-	// Convert the lead event data to JSON
-	leadEventDataPubSubJSON, err := json.Marshal(leadEventDataPubSub)
+// resolveLeadEventConsent decodes the consent purposes of a lead event and keeps them for the APIs.
+// An invalid consent string grants no purpose.
+func resolveLeadEventConsent(brand *Brand, leadEventData LeadEventData) ConsentPurposes {
+	consentPurposes, err := resolveConsent(leadEventData.Consent, leadEventData.ConsentString)
 	if err != nil {
-		return err
+		logger.LogWarn("[COLLECT][LEAD_EVENT] Invalid consent string for Lead UUID %s: %v", leadEventData.LeadUUID, err)
 	}
 
-	// Publish the message to the Pub/Sub topic asynchronously
-	topic := psClient.Topic(os.Getenv("ENV") + "-lead_event")
-	result := topic.Publish(context.Background(), &pubsub.Message{
-		Data: leadEventDataPubSubJSON,
-	})
+	storeLeadConsent(brand.Name, leadEventData.LeadUUID, consentPurposes)
 
-	// Log any errors from the publishing result
-	_, err = result.Get(context.Background())
-	if err != nil {
-		return err
-	}
+	return consentPurposes
+}
 
-	return nil
+// publishLeadEventData sends lead event data to the event bus asynchronously
+func publishLeadEventData(brand *Brand, leadEventData LeadEventData, clientIp string, botClassification string) (eventbus.PublishResult, error) {
+	leadEventDataPubSub := messages.LeadEventDataPubSub{
+		Brand:                  brand.Name,
+		UUID:                   leadEventData.UUID,
+		LeadUUID:               leadEventData.LeadUUID,
+		Name:                   leadEventData.Name,
+		PageType:               leadEventData.PageType,
+		PageLanguage:           leadEventData.PageLanguage,
+		Device:                 leadEventData.Device,
+		Url:                    leadEventData.Url,
+		Referrer:               leadEventData.Referrer,
+		ReferrerType:           leadEventData.ReferrerType,
+		RelevantReferrer:       leadEventData.RelevantReferrer,
+		Metas:                  leadEventData.Metas,
+		Consent:                leadEventData.Consent,
+		IP:                     clientIp,
+		BotClassification:      botClassification,
+		ConsentStorage:         leadEventData.ConsentPurposes.Storage,
+		ConsentMeasurement:     leadEventData.ConsentPurposes.Measurement,
+		ConsentPersonalisation: leadEventData.ConsentPurposes.Personalisation,
+		IPAnonymisation:        getIPAnonymisation(brand),
+		OSFamily:               leadEventData.UserAgent.OSFamily,
+		OSVersion:              leadEventData.UserAgent.OSVersion,
+		BrowserFamily:          leadEventData.UserAgent.BrowserFamily,
+		BrowserVersion:         leadEventData.UserAgent.BrowserVersion,
+		IsBot:                  leadEventData.UserAgent.IsBot,
+		UTMSource:              leadEventData.Campaign.Source,
+		UTMMedium:              leadEventData.Campaign.Medium,
+		UTMCampaign:            leadEventData.Campaign.Name,
+		UTMContent:             leadEventData.Campaign.Content,
+		ClickID:                leadEventData.Campaign.ClickID,
+		ClickIDType:            leadEventData.Campaign.ClickIDType,
+		Channel:                leadEventData.Campaign.Channel,
+	}
+
+	return publishEvent(messages.TypeLeadEvent, brand.Name, leadEventData.Metadata, leadEventDataPubSub)
 }
 
-// Handler to recommend similar articles based on precomputed similarities
-func getArticleContentBasedArticlesHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+// Collect a batch of page, user, lead event and conversion data
+func collectBatchHandler(w http.ResponseWriter, r *http.Request) {
+	brand := getRequestBrand(r)
+
+	var batchItems []BatchItem
+	r.Body = http.MaxBytesReader(w, r.Body, maxBatchBodySize)
+	if err := json.NewDecoder(r.Body).Decode(&batchItems); err != nil {
+		logger.LogError("[COLLECT][BATCH] Invalid request payload: %v", err)
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
 		return
 	}
 
-	// Extract host from the request's Host header
-	host := r.Host
-	if host == "" {
-		http.Error(w, "Host header is required", http.StatusBadRequest)
+	collectRequest := upgradeV1Batch(batchItems)
+	if errorCode, err := validateCollectRequest(collectRequest); err != nil {
+		logger.LogError("[COLLECT][BATCH] Invalid batch: %v", err)
+		http.Error(w, err.Error(), errorCode)
 		return
 	}
 
-	// Get the brand name
-	brand, err := getBrandFromHost(host)
+	logger.LogInfo("[COLLECT][BATCH] Collecting %d items for brand %s", len(batchItems), brand.Name)
+
+	writeBatchResponse(w, collectEvents(w, r, brand, collectRequest))
+}
+
+// collectEvents validates and publishes the events of a collect request and reports the status of each event
+func collectEvents(w http.ResponseWriter, r *http.Request, brand *Brand, collectRequest CollectRequest) BatchResponse {
+	// The lead is identified once for all the items, which must all belong to it
+	var leadUUID string
+	var leadErr error
+	leadIdentified := false
+	getLeadUUID := func(claimedLeadUUID string) (string, error) {
+		if !leadIdentified {
+			leadUUID, leadErr = identifyLead(w, r, brand, claimedLeadUUID)
+			leadIdentified = true
+			return leadUUID, leadErr
+		}
+
+		if leadErr != nil {
+			return "", leadErr
+		}
+
+		if claimedLeadUUID != "" && claimedLeadUUID != leadUUID {
+			return "", errForgedLeadID
+		}
+
+		return leadUUID, nil
+	}
+
+	// The events of the request share its receiving time, from which the clock skew of the client is measured
+	receivedAt := time.Now().UTC()
+
+	// The request is classified once for all its lead events
+	botClassification := botDetector.ClassifyRequest(r, brand.Name)
+
+	statuses := make([]BatchItemStatus, len(collectRequest.Events))
+	results := make([]eventbus.PublishResult, len(collectRequest.Events))
+
+	// Validate and publish every item without waiting for the publish results
+	for i, event := range collectRequest.Events {
+		statuses[i] = BatchItemStatus{Index: i, Type: event.Type}
+
+		metadata := newEventMetadata(event.EventTime, collectRequest.SentAt, collectRequest.SDKVersion, receivedAt)
+
+		var result eventbus.PublishResult
+		var errorCode int
+		var err error
+
+		// The page and user data are not tagged with a bot classification, the ones of the known bots are rejected
+		if botClassification == botClassificationKnownBot && (event.Type == messages.TypePage || event.Type == messages.TypeUser) {
+			logger.LogInfo("[COLLECT][BATCH] Item %d of type %s rejected for known bot: %s", i, event.Type, r.UserAgent())
+			statuses[i].Status = batchItemStatusRejected
+			statuses[i].Error = "User agent is not allowed"
+			continue
+		}
+
+		switch event.Type {
+		case messages.TypePage:
+			var pageDataPayload PageDataPayload
+			if pageDataPayload, err = decodePageDataPayload(collectRequest.SchemaVersion, event.Data); err != nil {
+				errorCode = http.StatusBadRequest
+				err = errors.New("Invalid page data")
+				break
+			}
+			var pageData PageData
+			if pageData, errorCode, err = getPayloadPageData(pageDataPayload); err != nil {
+				break
+			}
+			pageData.Metadata = metadata
+			result, errorCode, err = collectPageData(brand, pageData)
+		case messages.TypeUser:
+			var userData UserData
+			if userData, err = decodeUserData(collectRequest.SchemaVersion, event.Data); err != nil {
+				errorCode = http.StatusBadRequest
+				err = errors.New("Invalid user data")
+				break
+			}
+			if userData.LeadUUID, err = getLeadUUID(userData.LeadUUID); err != nil {
+				errorCode = http.StatusForbidden
+				break
+			}
+			userData.Metadata = metadata
+			result, errorCode, err = collectUserData(brand, userData)
+		case messages.TypeLeadEvent:
+			var leadEventData LeadEventData
+			if leadEventData, err = decodeLeadEventData(collectRequest.SchemaVersion, event.Data); err != nil {
+				errorCode = http.StatusBadRequest
+				err = errors.New("Invalid lead event data")
+				break
+			}
+			if errorCode, err = validateLeadEvent(brand, leadEventData); err != nil {
+				break
+			}
+			if leadEventData.LeadUUID, err = getLeadUUID(leadEventData.LeadUUID); err != nil {
+				errorCode = http.StatusForbidden
+				break
+			}
+			leadEventData.Metadata = metadata
+			if event.EventTime == nil && leadEventData.EventTime != nil {
+				// The v1 lead events carry their own times
+				leadEventData.Metadata = newEventMetadata(leadEventData.EventTime, leadEventData.SentAt, collectRequest.SDKVersion, receivedAt)
+			}
+			result, errorCode, err = collectLeadEventData(r, brand, leadEventData, botClassification, leadEventSourceSDK)
+		case messages.TypeConversion:
+			var conversionData ConversionData
+			if conversionData, err = decodeConversionData(collectRequest.SchemaVersion, event.Data); err != nil {
+				errorCode = http.StatusBadRequest
+				err = errors.New("Invalid conversion data")
+				break
+			}
+			if conversionData.LeadUUID, err = getLeadUUID(conversionData.LeadUUID); err != nil {
+				errorCode = http.StatusForbidden
+				break
+			}
+			conversionData.Metadata = metadata
+			result, errorCode, err = collectConversionData(brand, conversionData, conversionSourceSDK)
+		default:
+			errorCode = http.StatusBadRequest
+			err = fmt.Errorf("Invalid item type: %s", event.Type)
+		}
+
+		if err != nil {
+			logger.LogError("[COLLECT][BATCH] Item %d of type %s was not collected: %v", i, event.Type, err)
+			statuses[i].Error = err.Error()
+			if errorCode >= http.StatusInternalServerError {
+				statuses[i].Status = batchItemStatusFailed
+			} else {
+				statuses[i].Status = batchItemStatusRejected
+			}
+			continue
+		}
+
+		if result == nil {
+			statuses[i].Status = batchItemStatusDuplicate
+			continue
+		}
+
+		results[i] = result
+	}
+
+	// Wait for the items to be queued for publishing
+	for i, result := range results {
+		if result == nil {
+			continue
+		}
+
+		if _, err := result.Get(context.Background()); err != nil {
+			logger.LogError("[COLLECT][BATCH] Failed to publish item %d of type %s: %v", i, statuses[i].Type, err)
+			statuses[i].Status = batchItemStatusFailed
+			statuses[i].Error = "Failed to publish item"
+			continue
+		}
+
+		statuses[i].Status = batchItemStatusAccepted
+	}
+
+	return BatchResponse{Items: statuses}
+}
+
+// writeBatchResponse writes the status of each item of a batch
+func writeBatchResponse(w http.ResponseWriter, batchResponse BatchResponse) {
+	response, err := json.Marshal(batchResponse)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error getting brand: %v", err), http.StatusInternalServerError)
+		http.Error(w, "Failed to marshal response", http.StatusInternalServerError)
 		return
 	}
 
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
+
+// Handler to recommend similar articles based on precomputed similarities.
+// With the personalisation consent of the lead, the articles it has read are skipped and its favourite sections are boosted.
+// With filter_paid, the paid articles are only recommended to the subscribers.
+func getArticleContentBasedArticlesHandler(w http.ResponseWriter, r *http.Request) {
+	brand := getRequestBrand(r)
+
 	url := r.URL.Query().Get("url")
 	if url == "" {
 		http.Error(w, "Missing article url", http.StatusBadRequest)
 		return
 	}
+	url = normaliseURL(brand, url)
+
+	numResults := defaultRecommendationsCount
+	if numResultsParam := r.URL.Query().Get("num_results"); numResultsParam != "" {
+		var err error
+		numResults, err = strconv.Atoi(numResultsParam)
+		if err != nil || numResults < 1 || numResults > maxRecommendationsCount {
+			http.Error(w, fmt.Sprintf("'num_results' must be between 1 and %d", maxRecommendationsCount), http.StatusBadRequest)
+			return
+		}
+	}
+
+	filterPaid := false
+	if filterPaidParam := r.URL.Query().Get("filter_paid"); filterPaidParam != "" {
+		var err error
+		filterPaid, err = strconv.ParseBool(filterPaidParam)
+		if err != nil {
+			http.Error(w, "Invalid 'filter_paid'", http.StatusBadRequest)
+			return
+		}
+	}
+
+	leadUUID := r.URL.Query().Get("lead_uuid")
+	if leadUUID != "" && !isRequestLeadAllowed(r, brand, leadUUID) {
+		http.Error(w, "lead_uuid is not the lead of the request", http.StatusForbidden)
+		return
+	}
+
+	// The subscription of the lead decides which articles it can read, the anonymous leads are not subscribers
+	includePaid := !filterPaid
+	if filterPaid && leadUUID != "" {
+		isSubscriber, err := getLeadIsSubscriber(brand.Name, leadUUID)
+		if err != nil {
+			logger.LogError("[RECOMMENDATIONS] Failed to get subscription of lead %s for brand %s: %v", leadUUID, brand.Name, err)
+		}
+		includePaid = isSubscriber
+	}
+
+	// The recommendations are only personalised with the personalisation consent of the lead
+	if leadUUID != "" && !getLeadConsent(brand.Name, leadUUID).Personalisation {
+		leadUUID = ""
+	}
 
 	// Check cache first
-	cacheKey := fmt.Sprintf("similar_articles:%s:%s", brand.Name, url)
+	cacheKey := fmt.Sprintf("similar_articles:%s:%s:%s:%d:%t", brand.Name, url, leadUUID, numResults, includePaid)
 	cachedResponse, err := redisClient.Get(ctx, cacheKey).Result()
 	if err == nil {
 		w.Header().Set("Content-Type", "application/json")
@@ -691,55 +1060,12 @@ func getArticleContentBasedArticlesHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	// Retrieve similar articles from the content_based_articles table
-	rows, err := db.Query(`
-		SELECT 
-			p.url, 
-			p.title, 
-			p.description, 
-			p.section, 
-			p.sub_section, 
-			p.image, 
-			cba.similarity_score 
-		FROM 
-			content_based_articles cba
-		JOIN 
-			page p ON p.url = cba.article_url_2 AND p.brand = $1
-		WHERE 
-			cba.brand = $1
-			AND cba.article_url_1 = $2
-			AND cba.similarity_score > 0
-		ORDER BY 
-			cba.similarity_score DESC
-		LIMIT 10`, brand.Name, url)
+	similarArticles, err := getContentBasedArticles(brand.Name, url, leadUUID, numResults, includePaid)
 	if err != nil {
+		logger.LogError("[RECOMMENDATIONS] Failed to query similar articles of %s for brand %s: %v", url, brand.Name, err)
 		http.Error(w, "Failed to query similar articles", http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
-
-	// Define the structure to hold similar articles
-	type SimilarArticle struct {
-		Url         string  `json:"url"`
-		Title       string  `json:"title"`
-		Description string  `json:"description"`
-		Section     string  `json:"section"`
-		SubSection  *string `json:"sub_section"`
-		Image       *string `json:"image"`
-		Similarity  float64 `json:"similarity"`
-	}
-
-	var similarArticles []SimilarArticle
-
-	// Iterate through the results and collect similar articles
-	for rows.Next() {
-		var article SimilarArticle
-		if err := rows.Scan(&article.Url, &article.Title, &article.Description, &article.Section, &article.SubSection, &article.Image, &article.Similarity); err != nil {
-			http.Error(w, "Failed to scan article row", http.StatusInternalServerError)
-			return
-		}
-		similarArticles = append(similarArticles, article)
-	}
 
 	// Respond with similar articles
 	response, err := json.Marshal(similarArticles)
@@ -759,24 +1085,7 @@ func getArticleContentBasedArticlesHandler(w http.ResponseWriter, r *http.Reques
 
 // Route handler to get metrics for a specific article with optional date filtering and "dump" parameter
 func getArticleMetrics(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
-		return
-	}
-
-	// Extract host from the request's Host header
-	host := r.Host
-	if host == "" {
-		http.Error(w, "Host header is required", http.StatusBadRequest)
-		return
-	}
-
-	// Get the brand name
-	brand, err := getBrandFromHost(host)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Error getting brand: %v", err), http.StatusInternalServerError)
-		return
-	}
+	brand := getRequestBrand(r)
 
 	pageURL := r.URL.Query().Get("url")
 	startDate := r.URL.Query().Get("start_date")
@@ -788,6 +1097,7 @@ func getArticleMetrics(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Missing page URL", http.StatusBadRequest)
 		return
 	}
+	pageURL = normaliseURL(brand, pageURL)
 
 	// Check if the metrics for this URL are in the Redis cache, including optional dates in cache key
 	cacheKey := fmt.Sprintf("article_metrics:%s:%s:%s:%s:%t:%s", brand.Name, pageURL, startDate, endDate, dump, dumpRange)
@@ -948,183 +1258,8 @@ func getArticleMetrics(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// getTopArticles returns the top 10 articles with the best engagement score, including article details
-func getTopArticles(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
-		return
-	}
-
-	// Extract host from the request's Host header
-	host := r.Host
-	if host == "" {
-		http.Error(w, "Host header is required", http.StatusBadRequest)
-		return
-	}
-
-	// Get the brand name
-	brand, err := getBrandFromHost(host)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Error getting brand: %v", err), http.StatusInternalServerError)
-		return
-	}
-
-	// Retrieve GET parameters for section and sub_section
-	section := r.URL.Query().Get("section")
-	subSection := r.URL.Query().Get("sub_section")
-
-	// Cache key for Redis, include section and sub_section if present
-	cacheKey := fmt.Sprintf("top_articles:%s:%s:%s", brand.Name, section, subSection)
-
-	// Try to retrieve articles from Redis cache
-	cachedData, err := redisClient.Get(ctx, cacheKey).Result()
-	if err == redis.Nil {
-		// If the key does not exist in Redis, execute the SQL query
-
-		// Build the WHERE clause for section and sub_section
-		whereClause := "ta.brand = $1"
-		params := []interface{}{brand.Name}
-
-		if section != "" {
-			whereClause += " AND ta.section = $2"
-			params = append(params, section)
-		} else {
-			whereClause += " AND ta.section IS NULL"
-		}
-		if subSection != "" {
-			whereClause += " AND ta.sub_section = $3"
-			params = append(params, subSection)
-		} else {
-			whereClause += " AND ta.sub_section IS NULL"
-		}
-
-		// Construct the SQL query with the dynamic condition
-		query := fmt.Sprintf(`
-			SELECT 
-				ta.url,
-				p.title,
-				p.description,
-				p.image,
-				p.section,
-				p.sub_section,
-				SUM(ta.view_count) AS view_count,
-				ROUND(AVG(ta.avg_reading_rate), 2) AS avg_reading_rate,
-				ROUND(AVG(ta.avg_time_spent), 2) AS avg_time_spent,
-				ROUND(AVG(ta.recency_weight)) AS recency_weight,
-				ROUND(
-					AVG(ta.avg_reading_rate) * 0.3 +
-					AVG(ta.avg_time_spent) * 0.3 +
-					AVG(ta.recency_weight) * 0.4
-				) AS engagement_score
-			FROM 
-				top_articles ta
-			LEFT JOIN 
-				page p ON p.url = ta.url AND p.brand = '%s'
-			WHERE 
-				%s
-				AND ta.calculation_period >= NOW() - INTERVAL '2 DAY'
-				AND ta.calculation_period < NOW()
-			GROUP BY
-				ta.url, p.title, p.description, p.image, p.section, p.sub_section
-			ORDER BY 
-				engagement_score DESC
-			LIMIT 10
-		`, brand.Name, whereClause)
-
-		// Execute the SQL query with the parameters
-		rows, err := db.Query(query, params...)
-		if err != nil {
-			log.Println(err.Error())
-			http.Error(w, "Failed to query articles", http.StatusInternalServerError)
-			return
-		}
-		defer rows.Close()
-
-		// Prepare the response
-		var articles []struct {
-			URL             string  `json:"url"`
-			Title           string  `json:"title"`
-			Description     string  `json:"description"`
-			Image           *string `json:"image"`
-			Section         string  `json:"section"`
-			SubSection      *string `json:"sub_section"`
-			ViewCount       int     `json:"view_count"`
-			AvgReadingRate  float64 `json:"avg_reading_rate"`
-			AvgTimeSpent    float64 `json:"avg_time_spent"`
-			RecencyWeight   float64 `json:"recency_weight"`
-			EngagementScore float64 `json:"engagement_score"`
-		}
-
-		for rows.Next() {
-			var article struct {
-				URL             string  `json:"url"`
-				Title           string  `json:"title"`
-				Description     string  `json:"description"`
-				Image           *string `json:"image"`
-				Section         string  `json:"section"`
-				SubSection      *string `json:"sub_section"`
-				ViewCount       int     `json:"view_count"`
-				AvgReadingRate  float64 `json:"avg_reading_rate"`
-				AvgTimeSpent    float64 `json:"avg_time_spent"`
-				RecencyWeight   float64 `json:"recency_weight"`
-				EngagementScore float64 `json:"engagement_score"`
-			}
-
-			if err := rows.Scan(&article.URL, &article.Title, &article.Description, &article.Image, &article.Section, &article.SubSection, &article.ViewCount, &article.AvgReadingRate, &article.AvgTimeSpent, &article.RecencyWeight, &article.EngagementScore); err != nil {
-				http.Error(w, "Failed to scan article", http.StatusInternalServerError)
-				return
-			}
-
-			articles = append(articles, article)
-		}
-
-		// Convert the results to JSON
-		articlesJSON, err := json.Marshal(articles)
-		if err != nil {
-			http.Error(w, "Failed to marshal articles", http.StatusInternalServerError)
-			return
-		}
-
-		// Store the results in Redis with a TTL of 1 second
-		err = redisClient.Set(ctx, cacheKey, articlesJSON, 1*time.Second).Err()
-		if err != nil {
-			http.Error(w, "Failed to cache articles", http.StatusInternalServerError)
-			return
-		}
-
-		// Send the response
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(articlesJSON)
-	} else if err != nil {
-		// If an error other than a missing key occurs
-		http.Error(w, "Failed to retrieve cache", http.StatusInternalServerError)
-		return
-	} else {
-		// If data is present in the Redis cache, send it directly
-		w.Header().Set("Content-Type", "application/json")
-		w.Write([]byte(cachedData))
-	}
-}
-
 func getArticleTopNextArticles(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
-		return
-	}
-
-	// Extract host from the request's Host header
-	host := r.Host
-	if host == "" {
-		http.Error(w, "Host header is required", http.StatusBadRequest)
-		return
-	}
-
-	// Get the brand name
-	brand, err := getBrandFromHost(host)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Error getting brand: %v", err), http.StatusInternalServerError)
-		return
-	}
+	brand := getRequestBrand(r)
 
 	// Parse query parameters
 	url := r.URL.Query().Get("url")
@@ -1134,6 +1269,12 @@ func getArticleTopNextArticles(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Missing 'url' parameter", http.StatusBadRequest)
 		return
 	}
+	url = normaliseURL(brand, url)
+
+	if leadUuid != "" && !isRequestLeadAllowed(r, brand, leadUuid) {
+		http.Error(w, "lead_uuid is not the lead of the request", http.StatusForbidden)
+		return
+	}
 
 	// Get the number of results from the query parameters
 	numResults := r.URL.Query().Get("num_results")
@@ -1145,6 +1286,11 @@ func getArticleTopNextArticles(w http.ResponseWriter, r *http.Request) {
 		numResultsInt = 100 // Limit to a maximum of 100 results
 	}
 
+	// The recommendations are only personalised with the personalisation consent of the lead
+	if leadUuid != "" && !getLeadConsent(brand.Name, leadUuid).Personalisation {
+		leadUuid = ""
+	}
+
 	// Generate a cache key based on the URL, leadUuid (if provided), and number of results
 	cacheKey := fmt.Sprintf("top_next_articles:%s:%s:%s:%d", brand.Name, url, leadUuid, numResultsInt)
 
@@ -1354,24 +1500,7 @@ func getArticleTopNextArticles(w http.ResponseWriter, r *http.Request) {
 
 // getLeadEngagementScore retrieves the engagement score for a specific lead with Redis caching
 func getLeadEngagementScore(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
-		return
-	}
-
-	// Extract host from the request's Host header
-	host := r.Host
-	if host == "" {
-		http.Error(w, "Host header is required", http.StatusBadRequest)
-		return
-	}
-
-	// Get the brand name
-	brand, err := getBrandFromHost(host)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Error getting brand: %v", err), http.StatusInternalServerError)
-		return
-	}
+	brand := getRequestBrand(r)
 
 	// Extract lead_uuid from query parameters
 	leadUUID := r.URL.Query().Get("lead_uuid")
@@ -1380,6 +1509,12 @@ func getLeadEngagementScore(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The browsers only read the score of their own lead, the partners read any lead with the leads:read scope
+	if !isRequestLeadAllowed(r, brand, leadUUID) {
+		http.Error(w, "lead_uuid is not the lead of the request", http.StatusForbidden)
+		return
+	}
+
 	// Try to get cached data from Redis
 	cacheKey := fmt.Sprintf("lead_engagement_score:%s:%s", brand.Name, leadUUID)
 	cachedData, err := redisClient.Get(ctx, cacheKey).Result()
@@ -1604,34 +1739,8 @@ func generateUUID() string {
 	return newUUID.String()
 }
 
-// getClientIP returns the client's IP address from the request
-func getClientIP(r *http.Request) string {
-	// Try to get the IP from the X-Forwarded-For header
-	forwarded := r.Header.Get("X-Forwarded-For")
-	if forwarded != "" {
-		// X-Forwarded-For can contain multiple IPs, take the first one
-		ips := strings.Split(forwarded, ",")
-		clientIP := strings.TrimSpace(ips[0])
-		return clientIP
-	}
-
-	// Otherwise, try to get the IP from the X-Real-IP header
-	realIP := r.Header.Get("X-Real-IP")
-	if realIP != "" {
-		return realIP
-	}
-
-	// If none found, use the IP from RemoteAddr field
-	ip, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		return r.RemoteAddr // Return RemoteAddr directly in case of an error
-	}
-
-	return ip
-}
-
-// Initialize Redis and SQL clients
-func init() {
+// setup initializes the logger, the Redis and SQL clients and the event bus
+func setup() {
 	// Init logger
 	logger = &Logger{
 		logger: log.New(os.Stdout, "", log.LstdFlags),
@@ -1660,39 +1769,134 @@ func init() {
 	}
 	logger.LogInfo("[SYSTEM] Connected to PostgreSQL")
 
-	psClient, err = pubsub.NewClient(ctx, os.Getenv("GCP_PROJECT_ID"), option.WithCredentialsFile(os.Getenv("GCP_CREDENTIALS_FILE")))
+	bus, err := eventbus.NewEventBus(ctx, os.Getenv("EVENT_BUS"), logger)
 	if err != nil {
-		logger.LogFatal("[SYSTEM] Failed to create Pub/Sub client: %v", err)
+		logger.LogFatal("[SYSTEM] Failed to create event bus: %v", err)
+	}
+	logger.LogInfo("[SYSTEM] Connected to event bus")
+
+	// Publish in the background, spooling to disk when the event bus is unreachable
+	spoolDir := os.Getenv("SPOOL_DIR")
+	if spoolDir == "" {
+		spoolDir = "spool"
+	}
+
+	spoolMaxBytes, err := strconv.ParseInt(os.Getenv("SPOOL_MAX_BYTES"), 10, 64)
+	if err != nil || spoolMaxBytes < 1 {
+		spoolMaxBytes = 1 << 30 // Default to 1GB
+	}
+
+	spool, err := NewSpool(spoolDir, spoolMaxBytes)
+	if err != nil {
+		logger.LogFatal("[SYSTEM] Failed to create spool: %v", err)
+	}
+
+	queueSize, err := strconv.Atoi(os.Getenv("PUBLISH_QUEUE_SIZE"))
+	if err != nil || queueSize < 1 {
+		queueSize = 10000
 	}
-	logger.LogInfo("[SYSTEM] Connected to PubSub")
+
+	workers, err := strconv.Atoi(os.Getenv("PUBLISH_WORKERS"))
+	if err != nil || workers < 1 {
+		workers = 4
+	}
+
+	eventBus = NewAsyncPublisher(bus, spool, queueSize, workers, 5*time.Second)
+	logger.LogInfo("[SYSTEM] Started publisher with a queue of %d messages, %d workers and spool %s", queueSize, workers, spoolDir)
+
+	// Sign the lead identifiers issued in the cookies
+	if os.Getenv("LEAD_ID_SECRET") == "" {
+		logger.LogFatal("[SYSTEM] LEAD_ID_SECRET is required to sign the lead identifiers")
+	}
+
+	// Read the client IP from the forwarding headers of the trusted proxies only
+	if err := loadTrustedProxies(); err != nil {
+		logger.LogFatal("[SYSTEM] Invalid trusted proxies: %v", err)
+	}
+
+	// Classify the bots from the maintained pattern file and the request rate of the client IPs
+	botPatternsFile := os.Getenv("BOT_PATTERNS_FILE")
+	if botPatternsFile == "" {
+		botPatternsFile = "assets/bots/patterns.txt"
+	}
+
+	botMaxRequestsPerMinute, err := strconv.ParseInt(os.Getenv("BOT_MAX_REQUESTS_PER_MINUTE"), 10, 64)
+	if err != nil || botMaxRequestsPerMinute < 1 {
+		botMaxRequestsPerMinute = 120
+	}
+
+	botDetector, err = NewBotDetector(botPatternsFile, botMaxRequestsPerMinute)
+	if err != nil {
+		logger.LogFatal("[SYSTEM] Failed to load bot patterns: %v", err)
+	}
+	go botDetector.WatchPatterns(1 * time.Minute)
 }
 
 // Main function to start the server
 func main() {
+	setup()
+
+	router := NewRouter(withRequestID, withAccessLog, withRecovery)
+
+	// Middlewares of the routes called by the brand sites, the server routes authenticate with an API key instead.
+	// The public API routes are browser-safe, the private ones require an API key granting their scope.
+	publicAPI := func(scope string) []Middleware {
+		return []Middleware{withBrand, withCORS, withOptionalAPIKey(scope), withRateLimit}
+	}
+	privateAPI := func(scope string) []Middleware {
+		return []Middleware{withBrand, withAPIKey(scope), withRateLimit}
+	}
+	collect := []Middleware{withBrand, withCORS, withCollectOrigin, withCollectContentType, withRateLimit}
+	humanCollect := []Middleware{withBrand, withCORS, withCollectOrigin, withCollectContentType, withRateLimit, withoutKnownBots}
+	serverCollect := []Middleware{withBrand, withServerAuth}
+	amp := []Middleware{withBrand, withAMPOrigin}
+	pixel := []Middleware{withBrand, withAMPOrigin, withRateLimit}
+	admin := []Middleware{withAdmin, withBrand}
+
 	// Health check
-	http.HandleFunc("/health", healthCheckHandler)
+	router.Handle(http.MethodGet, "/health", healthCheckHandler)
+
+	// Admin
+	router.Handle(http.MethodGet, "/admin/v1/lead-event-types", listLeadEventTypesHandler, admin...)
+	router.Handle(http.MethodPut, "/admin/v1/lead-event-types", saveLeadEventTypeHandler, admin...)
+	router.Handle(http.MethodDelete, "/admin/v1/lead-event-types", deleteLeadEventTypeHandler, admin...)
+	router.Handle(http.MethodGet, "/admin/v1/api-keys", listAPIKeysHandler, admin...)
+	router.Handle(http.MethodPost, "/admin/v1/api-keys", createAPIKeyHandler, admin...)
+	router.Handle(http.MethodDelete, "/admin/v1/api-keys", revokeAPIKeyHandler, admin...)
 
 	// Collectors
-	http.HandleFunc("/collect/v1/page-data", collectPageDataHandler)
-	http.HandleFunc("/collect/v1/user-data", collectUserDataHandler)
-	http.HandleFunc("/collect/v1/lead-event", collectLeadEventDataHandler)
+	router.Handle(http.MethodPost, "/collect/v1/page-data", collectPageDataHandler, humanCollect...)
+	router.Handle(http.MethodPost, "/collect/v1/user-data", collectUserDataHandler, humanCollect...)
+	router.Handle(http.MethodPost, "/collect/v1/lead-event", collectLeadEventDataHandler, collect...)
+	router.Handle(http.MethodPost, "/collect/v1/batch", collectBatchHandler, collect...)
+	router.Handle(http.MethodPost, "/collect/v1/identify", identifyHandler, collect...)
+	router.Handle(http.MethodPost, "/collect/v1/conversion", collectConversionDataHandler, collect...)
+	router.Handle(http.MethodPost, "/collect/v1/server/lead-event", collectServerLeadEventDataHandler, serverCollect...)
+	router.Handle(http.MethodPost, "/collect/v1/server/conversion", collectServerConversionDataHandler, serverCollect...)
+	router.Handle(http.MethodGet, "/collect/v1/pixel.gif", collectPixelHandler, pixel...)
+	router.Handle(http.MethodPost, "/collect/v1/pixel.gif", collectPixelHandler, pixel...)
+	router.Handle(http.MethodGet, "/collect/v1/amp-analytics.json", ampAnalyticsConfigHandler, amp...)
+	router.Handle(http.MethodPost, "/collect/v2/events", collectEventsHandler, collect...)
 
 	// Leads
-	http.HandleFunc("/api/v1/lead/engagement-score", getLeadEngagementScore)
+	router.Handle(http.MethodGet, "/api/v1/lead/engagement-score", getLeadEngagementScore, publicAPI(scopeLeadsRead)...)
 
 	// Articles
-	http.HandleFunc("/api/v1/article/metrics", getArticleMetrics)
-	http.HandleFunc("/api/v1/articles/top-articles", getTopArticles)
-	http.HandleFunc("/api/v1/article/top-next-articles", getArticleTopNextArticles)
-	http.HandleFunc("/api/v1/article/content-based-articles", getArticleContentBasedArticlesHandler)
+	router.Handle(http.MethodGet, "/api/v1/article/metrics", getArticleMetrics, privateAPI(scopeMetricsRead)...)
+	router.Handle(http.MethodGet, "/api/v1/articles/top-articles", getTopArticles, publicAPI(scopeRecommendationsRead)...)
+	router.Handle(http.MethodGet, "/api/v1/article/top-next-articles", getArticleTopNextArticles, publicAPI(scopeRecommendationsRead)...)
+	router.Handle(http.MethodGet, "/api/v1/article/content-based-articles", getArticleContentBasedArticlesHandler, publicAPI(scopeRecommendationsRead)...)
+
+	// Recommendations
+	router.Handle(http.MethodGet, "/api/v1/recommendations", getRecommendationsHandler, publicAPI(scopeRecommendationsRead)...)
 
 	// Javascript SDK
-	http.HandleFunc("/weather.js", ServeJSLibrary)
+	router.Handle(http.MethodGet, "/weather.js", ServeJSLibrary)
 
 	// Exemple pages
-	http.HandleFunc("/test", ServeTestHome)
-	http.HandleFunc("/test/article-1.html", ServeTestArticle1)
-	http.HandleFunc("/test/article-2.html", ServeTestArticle2)
+	router.Handle(http.MethodGet, "/test", ServeTestHome)
+	router.Handle(http.MethodGet, "/test/article-1.html", ServeTestArticle1)
+	router.Handle(http.MethodGet, "/test/article-2.html", ServeTestArticle2)
 
 	// Use the PORT environment variable or default to 8080
 	port := os.Getenv("PORT")
@@ -1700,6 +1904,31 @@ func main() {
 		port = "8080"
 	}
 
+	server := &http.Server{Addr: ":" + port, Handler: router}
+
+	// Stop gracefully so that queued events are published or spooled
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		<-signals
+
+		logger.LogInfo("[SYSTEM] Shutting down server")
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+		defer cancel()
+
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			logger.LogError("[SYSTEM] Failed to shut down server: %v", err)
+		}
+	}()
+
 	logger.LogInfo("[SYSTEM] Server started on port :%s", port)
-	logger.LogFatal("[SYSTEM] " + http.ListenAndServe(":"+port, nil).Error())
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		logger.LogFatal("[SYSTEM] " + err.Error())
+	}
+
+	if err := eventBus.Close(); err != nil {
+		logger.LogError("[SYSTEM] Failed to close event bus: %v", err)
+	}
+	logger.LogInfo("[SYSTEM] Server stopped")
 }
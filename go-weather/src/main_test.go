@@ -0,0 +1,16 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	logger = &Logger{
+		logger: log.New(io.Discard, "", 0),
+	}
+
+	os.Exit(m.Run())
+}
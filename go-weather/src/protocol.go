@@ -0,0 +1,373 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"eventbus"
+	"messages"
+)
+
+// Schema versions of the collect protocol.
+// Version 1 is the /collect/v1 payloads, version 2 the /collect/v2 envelopes with snake_case data.
+const (
+	collectSchemaVersion1 = 1
+	collectSchemaVersion2 = 2
+)
+
+// Client event times further than this from the receiving time are not trusted, the event is dated when it was received
+const maxClientEventAge = 24 * time.Hour
+
+// EventMetadata is what the collect protocol tells of an event besides its data, it is carried by the message envelope.
+// EventTime is the corrected time of the event, ClientEventTime the time sent by the client.
+type EventMetadata struct {
+	EventTime       time.Time
+	ClientEventTime *time.Time
+	ReceivedAt      time.Time
+	SentAt          *time.Time
+	SDKVersion      string
+}
+
+// CollectRequest is the envelope of the collect requests, the data of the events depend on their type and on the schema version.
+// The v1 batches are upgraded into this envelope, keeping their schema version so that their data is decoded as v1 data.
+type CollectRequest struct {
+	SchemaVersion int            `json:"schema_version"`
+	BrandKey      string         `json:"brand_key"`
+	SDKVersion    string         `json:"sdk_version"`
+	SentAt        *time.Time     `json:"sent_at"`
+	Events        []CollectEvent `json:"events"`
+}
+
+// CollectEvent is an event of a collect request, data holds a PageDataV2, a UserDataV2, a LeadEventDataV2
+// or a ConversionDataV2 depending on the type
+type CollectEvent struct {
+	Type      string          `json:"type"`
+	EventTime *time.Time      `json:"event_time"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// Structs for storing the v2 page data, with the HTML of the page or the page data extracted by the SDK
+type PageDataV2 struct {
+	URL              string               `json:"url"`
+	Type             string               `json:"type"`
+	Language         string               `json:"language"`
+	PublicationDate  PublicationDateTime  `json:"publication_date"`
+	ModificationDate *PublicationDateTime `json:"modification_date"`
+	Title            string               `json:"title"`
+	Description      string               `json:"description"`
+	Content          string               `json:"content"`
+	Section          string               `json:"section"`
+	SubSection       *string              `json:"sub_section"`
+	Image            *string              `json:"image"`
+	IsPaid           bool                 `json:"is_paid"`
+	Author           *string              `json:"author"`
+	Keywords         []string             `json:"keywords"`
+	WordCount        int                  `json:"word_count"`
+	HTML             string               `json:"html"`
+}
+
+// Structs for storing the v2 user data
+type UserDataV2 struct {
+	LeadUUID      string `json:"lead_uuid"`
+	UserID        string `json:"user_id"`
+	Email         string `json:"email"`
+	FirstName     string `json:"first_name"`
+	LastName      string `json:"last_name"`
+	IsSubscriber  bool   `json:"is_subscriber"`
+	ConsentString string `json:"consent_string"`
+}
+
+// Structs for storing the v2 lead event data, the referrer type is no longer sent since the collector sets it
+type LeadEventDataV2 struct {
+	UUID             string                 `json:"uuid"`
+	LeadUUID         string                 `json:"lead_uuid"`
+	Name             string                 `json:"name"`
+	PageType         string                 `json:"page_type"`
+	PageLanguage     string                 `json:"page_language"`
+	Device           string                 `json:"device"`
+	URL              string                 `json:"url"`
+	LandingURL       string                 `json:"landing_url"`
+	Referrer         string                 `json:"referrer"`
+	RelevantReferrer string                 `json:"relevant_referrer"`
+	Metas            map[string]interface{} `json:"metas"`
+	Consent          bool                   `json:"consent"`
+	ConsentString    string                 `json:"consent_string"`
+}
+
+// Structs for storing the v2 conversion data
+type ConversionDataV2 struct {
+	UUID       string   `json:"uuid"`
+	LeadUUID   string   `json:"lead_uuid"`
+	Name       string   `json:"name"`
+	OfferID    string   `json:"offer_id"`
+	Price      *float64 `json:"price"`
+	Currency   string   `json:"currency"`
+	ArticleURL string   `json:"article_url"`
+	URL        string   `json:"url"`
+}
+
+func (d PageDataV2) pageDataPayload() PageDataPayload {
+	return PageDataPayload{
+		PageData: PageData{
+			URL:              d.URL,
+			Type:             d.Type,
+			Language:         d.Language,
+			PublicationDate:  d.PublicationDate,
+			ModificationDate: d.ModificationDate,
+			Title:            d.Title,
+			Description:      d.Description,
+			Content:          d.Content,
+			Section:          d.Section,
+			SubSection:       d.SubSection,
+			Image:            d.Image,
+			IsPaid:           d.IsPaid,
+			Author:           d.Author,
+			Keywords:         d.Keywords,
+			WordCount:        d.WordCount,
+		},
+		HTML: d.HTML,
+	}
+}
+
+func (d UserDataV2) userData() UserData {
+	return UserData{
+		LeadUUID:      d.LeadUUID,
+		UserID:        d.UserID,
+		Email:         d.Email,
+		FirstName:     d.FirstName,
+		LastName:      d.LastName,
+		IsSubscriber:  d.IsSubscriber,
+		ConsentString: d.ConsentString,
+	}
+}
+
+func (d LeadEventDataV2) leadEventData() LeadEventData {
+	return LeadEventData{
+		UUID:             d.UUID,
+		LeadUUID:         d.LeadUUID,
+		Name:             d.Name,
+		PageType:         d.PageType,
+		PageLanguage:     d.PageLanguage,
+		Device:           d.Device,
+		Url:              d.URL,
+		LandingUrl:       d.LandingURL,
+		Referrer:         d.Referrer,
+		RelevantReferrer: d.RelevantReferrer,
+		Metas:            d.Metas,
+		Consent:          d.Consent,
+		ConsentString:    d.ConsentString,
+	}
+}
+
+func (d ConversionDataV2) conversionData() ConversionData {
+	return ConversionData{
+		UUID:       d.UUID,
+		LeadUUID:   d.LeadUUID,
+		Name:       d.Name,
+		OfferID:    d.OfferID,
+		Price:      d.Price,
+		Currency:   d.Currency,
+		ArticleUrl: d.ArticleURL,
+		Url:        d.URL,
+	}
+}
+
+// newEventMetadata dates an event received from a client at receivedAt
+func newEventMetadata(clientEventTime *time.Time, sentAt *time.Time, sdkVersion string, receivedAt time.Time) EventMetadata {
+	metadata := EventMetadata{
+		EventTime:  receivedAt,
+		ReceivedAt: receivedAt,
+		SentAt:     sentAt,
+		SDKVersion: sdkVersion,
+	}
+
+	if clientEventTime != nil && !clientEventTime.IsZero() {
+		utcClientEventTime := clientEventTime.UTC()
+		metadata.ClientEventTime = &utcClientEventTime
+		metadata.EventTime = correctEventTime(utcClientEventTime, sentAt, receivedAt)
+	}
+
+	return metadata
+}
+
+// correctEventTime corrects the time of an event of the clock skew of the client, measured between the time the client
+// sent the request and the time the collector received it, the network latency included.
+// Without sending time the client time is used as is. The corrected time is never after the receiving time.
+func correctEventTime(clientEventTime time.Time, sentAt *time.Time, receivedAt time.Time) time.Time {
+	eventTime := clientEventTime
+	if sentAt != nil && !sentAt.IsZero() {
+		eventTime = eventTime.Add(receivedAt.Sub(*sentAt))
+	}
+
+	if eventTime.After(receivedAt) {
+		return receivedAt
+	}
+
+	if receivedAt.Sub(eventTime) > maxClientEventAge {
+		logger.LogWarn("[COLLECT] Event time %s is too far from the receiving time %s", clientEventTime.Format(time.RFC3339), receivedAt.Format(time.RFC3339))
+		return receivedAt
+	}
+
+	return eventTime.UTC()
+}
+
+// upgradeV1Batch translates a v1 batch into a collect request, the v1 items have no event time
+func upgradeV1Batch(batchItems []BatchItem) CollectRequest {
+	collectRequest := CollectRequest{
+		SchemaVersion: collectSchemaVersion1,
+		Events:        make([]CollectEvent, len(batchItems)),
+	}
+
+	for i, batchItem := range batchItems {
+		collectRequest.Events[i] = CollectEvent{
+			Type: batchItem.Type,
+			Data: batchItem.Data,
+		}
+	}
+
+	return collectRequest
+}
+
+// decodePageDataPayload decodes the page data of an event according to the schema version of the request
+func decodePageDataPayload(schemaVersion int, data json.RawMessage) (PageDataPayload, error) {
+	if schemaVersion == collectSchemaVersion1 {
+		var pageDataPayload PageDataPayload
+		err := json.Unmarshal(data, &pageDataPayload)
+		return pageDataPayload, err
+	}
+
+	var pageData PageDataV2
+	if err := json.Unmarshal(data, &pageData); err != nil {
+		return PageDataPayload{}, err
+	}
+	return pageData.pageDataPayload(), nil
+}
+
+// decodeUserData decodes the user data of an event according to the schema version of the request
+func decodeUserData(schemaVersion int, data json.RawMessage) (UserData, error) {
+	if schemaVersion == collectSchemaVersion1 {
+		var userData UserData
+		err := json.Unmarshal(data, &userData)
+		return userData, err
+	}
+
+	var userData UserDataV2
+	if err := json.Unmarshal(data, &userData); err != nil {
+		return UserData{}, err
+	}
+	return userData.userData(), nil
+}
+
+// decodeLeadEventData decodes the lead event data of an event according to the schema version of the request
+func decodeLeadEventData(schemaVersion int, data json.RawMessage) (LeadEventData, error) {
+	if schemaVersion == collectSchemaVersion1 {
+		var leadEventData LeadEventData
+		err := json.Unmarshal(data, &leadEventData)
+		return leadEventData, err
+	}
+
+	var leadEventData LeadEventDataV2
+	if err := json.Unmarshal(data, &leadEventData); err != nil {
+		return LeadEventData{}, err
+	}
+	return leadEventData.leadEventData(), nil
+}
+
+// decodeConversionData decodes the conversion data of an event according to the schema version of the request
+func decodeConversionData(schemaVersion int, data json.RawMessage) (ConversionData, error) {
+	if schemaVersion == collectSchemaVersion1 {
+		var conversionData ConversionData
+		err := json.Unmarshal(data, &conversionData)
+		return conversionData, err
+	}
+
+	var conversionData ConversionDataV2
+	if err := json.Unmarshal(data, &conversionData); err != nil {
+		return ConversionData{}, err
+	}
+	return conversionData.conversionData(), nil
+}
+
+// publishEvent publishes the payload of an event in a version 2 message on the topic of its type.
+// The events without metadata, like the ones of the v1 requests, are dated when they are published.
+func publishEvent(messageType string, brandName string, metadata EventMetadata, payload interface{}) (eventbus.PublishResult, error) {
+	receivedAt := metadata.ReceivedAt
+	if receivedAt.IsZero() {
+		receivedAt = time.Now().UTC()
+	}
+
+	eventTime := metadata.EventTime
+	if eventTime.IsZero() {
+		eventTime = receivedAt
+	}
+
+	msg, err := messages.NewEnvelopeMessage(messages.Envelope{
+		Type:            messageType,
+		Brand:           brandName,
+		EventTime:       eventTime,
+		ClientEventTime: metadata.ClientEventTime,
+		ReceivedAt:      &receivedAt,
+		SentAt:          metadata.SentAt,
+		SDKVersion:      metadata.SDKVersion,
+	}, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	// Publish the message to the event bus topic asynchronously
+	return eventBus.Publish(context.Background(), os.Getenv("ENV")+"-"+messageType, msg), nil
+}
+
+// Collect the events of a v2 collect request
+func collectEventsHandler(w http.ResponseWriter, r *http.Request) {
+	brand := getRequestBrand(r)
+
+	var collectRequest CollectRequest
+	r.Body = http.MaxBytesReader(w, r.Body, maxBatchBodySize)
+	if err := json.NewDecoder(r.Body).Decode(&collectRequest); err != nil {
+		logger.LogError("[COLLECT][V2] Invalid request payload: %v", err)
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	if collectRequest.SchemaVersion != collectSchemaVersion2 {
+		http.Error(w, fmt.Sprintf("Unsupported schema version %d", collectRequest.SchemaVersion), http.StatusBadRequest)
+		return
+	}
+
+	// The brand key is checked against the brand of the host, so that a misconfigured SDK does not collect for another brand
+	if collectRequest.BrandKey != "" && collectRequest.BrandKey != brand.Name {
+		logger.LogError("[COLLECT][V2] Brand key %s does not match brand %s", collectRequest.BrandKey, brand.Name)
+		http.Error(w, "Brand key does not match the host", http.StatusBadRequest)
+		return
+	}
+
+	if errorCode, err := validateCollectRequest(collectRequest); err != nil {
+		logger.LogError("[COLLECT][V2] Invalid collect request: %v", err)
+		http.Error(w, err.Error(), errorCode)
+		return
+	}
+
+	logger.LogInfo("[COLLECT][V2] Collecting %d events for brand %s with SDK %s", len(collectRequest.Events), brand.Name, collectRequest.SDKVersion)
+
+	writeBatchResponse(w, collectEvents(w, r, brand, collectRequest))
+}
+
+// validateCollectRequest checks the number of events of a collect request
+func validateCollectRequest(collectRequest CollectRequest) (int, error) {
+	if len(collectRequest.Events) == 0 {
+		return http.StatusBadRequest, errors.New("Batch is empty")
+	}
+
+	if len(collectRequest.Events) > maxBatchItems {
+		return http.StatusRequestEntityTooLarge, fmt.Errorf("Batch must not contain more than %d items", maxBatchItems)
+	}
+
+	return 0, nil
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"eventbus"
+)
+
+// Timeout of a single publish to the event bus made by the background workers
+const asyncPublishTimeout = 10 * time.Second
+
+// SpooledMessage is a message waiting in the queue or in the spool to be published
+type SpooledMessage struct {
+	Topic      string            `json:"topic"`
+	Data       []byte            `json:"data"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// AsyncPublisher publishes messages in the background through a bounded in-memory queue.
+// Messages are spooled to disk when the queue is full or the event bus is unreachable,
+// and the spool is drained once publishing works again.
+type AsyncPublisher struct {
+	bus           eventbus.Publisher
+	queue         chan *SpooledMessage
+	spool         *Spool
+	healthy       atomic.Bool
+	drainInterval time.Duration
+	workers       sync.WaitGroup
+	stop          chan struct{}
+	closeOnce     sync.Once
+	// closed is set under closeMutex so that no message is queued once the queue is closed
+	closed     bool
+	closeMutex sync.RWMutex
+}
+
+var errPublisherClosed = errors.New("Publisher is closed")
+
+// asyncPublishResult is the result of a publish to the AsyncPublisher, which only waits for the message to be queued or spooled
+type asyncPublishResult struct {
+	err error
+}
+
+func (r *asyncPublishResult) Get(ctx context.Context) (string, error) {
+	return "", r.err
+}
+
+func NewAsyncPublisher(bus eventbus.Publisher, spool *Spool, queueSize int, workers int, drainInterval time.Duration) *AsyncPublisher {
+	p := &AsyncPublisher{
+		bus:           bus,
+		queue:         make(chan *SpooledMessage, queueSize),
+		spool:         spool,
+		drainInterval: drainInterval,
+		stop:          make(chan struct{}),
+	}
+	p.healthy.Store(true)
+
+	for i := 0; i < workers; i++ {
+		p.workers.Add(1)
+		go p.work()
+	}
+
+	p.workers.Add(1)
+	go p.drainSpool()
+
+	return p
+}
+
+// Publish queues the message, or spools it when the queue is full or the event bus is unhealthy.
+// The messages published once the publisher is closed are rejected.
+func (p *AsyncPublisher) Publish(ctx context.Context, topic string, msg *eventbus.Message) eventbus.PublishResult {
+	p.closeMutex.RLock()
+	defer p.closeMutex.RUnlock()
+
+	if p.closed {
+		return &asyncPublishResult{err: errPublisherClosed}
+	}
+
+	spooledMessage := &SpooledMessage{
+		Topic:      topic,
+		Data:       msg.Data,
+		Attributes: msg.Attributes,
+	}
+
+	if p.healthy.Load() {
+		select {
+		case p.queue <- spooledMessage:
+			return &asyncPublishResult{}
+		default:
+			logger.LogWarn("[PUBLISHER] Queue is full, spooling message for topic %s", topic)
+		}
+	}
+
+	if err := p.spool.Append(spooledMessage); err != nil {
+		logger.LogError("[PUBLISHER] Failed to spool message for topic %s: %v", topic, err)
+		return &asyncPublishResult{err: err}
+	}
+
+	return &asyncPublishResult{}
+}
+
+// publish synchronously publishes a message to the event bus
+func (p *AsyncPublisher) publish(spooledMessage *SpooledMessage) error {
+	ctx, cancel := context.WithTimeout(context.Background(), asyncPublishTimeout)
+	defer cancel()
+
+	result := p.bus.Publish(ctx, spooledMessage.Topic, &eventbus.Message{
+		Data:       spooledMessage.Data,
+		Attributes: spooledMessage.Attributes,
+	})
+
+	_, err := result.Get(ctx)
+	return err
+}
+
+// work publishes the queued messages, spooling them when publishing fails
+func (p *AsyncPublisher) work() {
+	defer p.workers.Done()
+
+	for spooledMessage := range p.queue {
+		if !p.healthy.Load() {
+			if err := p.spool.Append(spooledMessage); err != nil {
+				logger.LogError("[PUBLISHER] Failed to spool message for topic %s: %v", spooledMessage.Topic, err)
+			}
+			continue
+		}
+
+		if err := p.publish(spooledMessage); err != nil {
+			if p.healthy.CompareAndSwap(true, false) {
+				logger.LogError("[PUBLISHER] Event bus is unreachable, spooling messages: %v", err)
+			}
+
+			if err := p.spool.Append(spooledMessage); err != nil {
+				logger.LogError("[PUBLISHER] Failed to spool message for topic %s: %v", spooledMessage.Topic, err)
+			}
+		}
+	}
+}
+
+// drainSpool periodically publishes the spooled messages
+func (p *AsyncPublisher) drainSpool() {
+	defer p.workers.Done()
+
+	ticker := time.NewTicker(p.drainInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			published, err := p.spool.Drain(p.publish)
+			if published > 0 {
+				logger.LogInfo("[PUBLISHER] Published %d spooled messages", published)
+			}
+
+			if err != nil && !errors.Is(err, errSpoolEmpty) {
+				logger.LogWarn("[PUBLISHER] Failed to drain spool: %v", err)
+				continue
+			}
+
+			// Nothing is left in the spool, let the workers publish again
+			if p.healthy.CompareAndSwap(false, true) {
+				logger.LogInfo("[PUBLISHER] Spool drained, publishing again")
+			}
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// Close stops accepting messages, publishes the queued messages and closes the event bus.
+// The messages that could not be published are left in the spool for the next start.
+func (p *AsyncPublisher) Close() error {
+	p.closeOnce.Do(func() {
+		p.closeMutex.Lock()
+		p.closed = true
+		close(p.queue)
+		p.closeMutex.Unlock()
+
+		close(p.stop)
+	})
+
+	// Wait for the workers and the spool drain, which may still be writing to the spool
+	p.workers.Wait()
+
+	if err := p.spool.Close(); err != nil {
+		logger.LogError("[PUBLISHER] Failed to close spool: %v", err)
+	}
+
+	return p.bus.Close()
+}
+
+var errSpoolEmpty = errors.New("Spool is empty")
+
+// Spool is an append-only file of messages, rotated into drain files when drained
+type Spool struct {
+	dir      string
+	maxBytes int64
+	file     *os.File
+	size     int64
+	mutex    sync.Mutex
+	drainMu  sync.Mutex
+}
+
+const (
+	spoolFileName       = "spool.jsonl"
+	spoolDrainExtension = ".draining"
+)
+
+func NewSpool(dir string, maxBytes int64) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	return &Spool{
+		dir:      dir,
+		maxBytes: maxBytes,
+	}, nil
+}
+
+// Append writes a message at the end of the spool
+func (s *Spool) Append(spooledMessage *SpooledMessage) error {
+	line, err := json.Marshal(spooledMessage)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.file == nil {
+		s.file, err = os.OpenFile(filepath.Join(s.dir, spoolFileName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return err
+		}
+
+		// The size limit applies to the whole spool, including the files being drained
+		s.size, err = s.diskSize()
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.maxBytes > 0 && s.size+int64(len(line)) > s.maxBytes {
+		return fmt.Errorf("Spool is full (%d bytes)", s.size)
+	}
+
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+
+	return err
+}
+
+// diskSize returns the size of all the spool files
+func (s *Spool) diskSize() (int64, error) {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*.jsonl*"))
+	if err != nil {
+		return 0, err
+	}
+
+	var size int64
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		size += info.Size()
+	}
+
+	return size, nil
+}
+
+// rotate moves the current spool file to a drain file so that appends continue in a new file
+func (s *Spool) rotate() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.file != nil {
+		if err := s.file.Close(); err != nil {
+			return err
+		}
+		s.file = nil
+		s.size = 0
+	}
+
+	spoolPath := filepath.Join(s.dir, spoolFileName)
+	info, err := os.Stat(spoolPath)
+	if os.IsNotExist(err) || (err == nil && info.Size() == 0) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	drainPath := filepath.Join(s.dir, fmt.Sprintf("spool-%d.jsonl%s", time.Now().UnixNano(), spoolDrainExtension))
+	return os.Rename(spoolPath, drainPath)
+}
+
+// Drain publishes the spooled messages in order, oldest drain file first.
+// It stops at the first failure and keeps the messages left to publish in their drain file.
+func (s *Spool) Drain(publish func(*SpooledMessage) error) (int, error) {
+	s.drainMu.Lock()
+	defer s.drainMu.Unlock()
+
+	if err := s.rotate(); err != nil {
+		return 0, err
+	}
+
+	drainPaths, err := filepath.Glob(filepath.Join(s.dir, "*"+spoolDrainExtension))
+	if err != nil {
+		return 0, err
+	}
+
+	if len(drainPaths) == 0 {
+		return 0, errSpoolEmpty
+	}
+
+	// Drain file names embed their rotation time
+	sort.Strings(drainPaths)
+
+	published := 0
+	for _, drainPath := range drainPaths {
+		n, err := s.drainFile(drainPath, publish)
+		published += n
+		if err != nil {
+			return published, err
+		}
+	}
+
+	return published, nil
+}
+
+// drainFile publishes the messages of a drain file, rewriting it with the messages left when publishing fails
+func (s *Spool) drainFile(drainPath string, publish func(*SpooledMessage) error) (int, error) {
+	file, err := os.Open(drainPath)
+	if err != nil {
+		return 0, err
+	}
+
+	var remaining [][]byte
+	var publishErr error
+	published := 0
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 10<<20)
+	for scanner.Scan() {
+		line := append([]byte(nil), scanner.Bytes()...)
+
+		if publishErr != nil {
+			remaining = append(remaining, line)
+			continue
+		}
+
+		var spooledMessage SpooledMessage
+		if err := json.Unmarshal(line, &spooledMessage); err != nil {
+			logger.LogError("[PUBLISHER] Dropping corrupted spooled message: %v", err)
+			continue
+		}
+
+		if err := publish(&spooledMessage); err != nil {
+			publishErr = err
+			remaining = append(remaining, line)
+			continue
+		}
+
+		published++
+	}
+	file.Close()
+
+	if err := scanner.Err(); err != nil {
+		return published, err
+	}
+
+	if publishErr == nil {
+		return published, os.Remove(drainPath)
+	}
+
+	// Keep the messages left to publish
+	tmpPath := drainPath + ".tmp"
+	tmpFile, err := os.Create(tmpPath)
+	if err != nil {
+		return published, err
+	}
+
+	writer := bufio.NewWriter(tmpFile)
+	for _, line := range remaining {
+		writer.Write(line)
+		writer.WriteByte('\n')
+	}
+
+	if err := writer.Flush(); err != nil {
+		tmpFile.Close()
+		return published, err
+	}
+
+	if err := tmpFile.Close(); err != nil {
+		return published, err
+	}
+
+	if err := os.Rename(tmpPath, drainPath); err != nil {
+		return published, err
+	}
+
+	return published, publishErr
+}
+
+// Close closes the current spool file
+func (s *Spool) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+
+	err := s.file.Close()
+	s.file = nil
+
+	return err
+}
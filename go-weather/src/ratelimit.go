@@ -0,0 +1,277 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Route of the brand rate limit applied to the routes without their own limit
+const rateLimitDefaultRoute = "*"
+
+// RateLimit is the token bucket of a route, clients can burst up to the capacity
+// and get back tokens at the refill rate
+type RateLimit struct {
+	Route           string  `json:"route"`
+	Capacity        int64   `json:"capacity"`
+	RefillPerSecond float64 `json:"refill_per_second"`
+}
+
+// tokenBucketScript takes a token from every bucket of KEYS if they all have one,
+// the capacity and the refill rate of each bucket being the pair of ARGV at its position.
+// It returns whether the request is allowed and the number of seconds to wait otherwise.
+var tokenBucketScript = redis.NewScript(`
+local clock = redis.call('TIME')
+local now = tonumber(clock[1]) * 1000 + math.floor(tonumber(clock[2]) / 1000)
+
+local tokens = {}
+local allowed = 1
+local retryAfter = 0
+
+for i, key in ipairs(KEYS) do
+	local capacity = tonumber(ARGV[i * 2 - 1])
+	local refill = tonumber(ARGV[i * 2])
+	local bucket = redis.call('HMGET', key, 'tokens', 'ts')
+	local available = tonumber(bucket[1]) or capacity
+	local ts = tonumber(bucket[2]) or now
+	available = math.min(capacity, available + math.max(0, now - ts) / 1000 * refill)
+	if available < 1 then
+		allowed = 0
+		retryAfter = math.max(retryAfter, math.ceil((1 - available) / refill))
+	end
+	tokens[i] = available
+end
+
+for i, key in ipairs(KEYS) do
+	local capacity = tonumber(ARGV[i * 2 - 1])
+	local refill = tonumber(ARGV[i * 2])
+	if allowed == 1 then
+		tokens[i] = tokens[i] - 1
+	end
+	redis.call('HSET', key, 'tokens', tostring(tokens[i]), 'ts', now)
+	redis.call('PEXPIRE', key, math.ceil(capacity / refill * 1000) + 1000)
+end
+
+return {allowed, retryAfter}
+`)
+
+// rateLimitBucket is a token bucket of a request
+type rateLimitBucket struct {
+	Key             string
+	Capacity        int64
+	RefillPerSecond float64
+}
+
+// defaultRateLimit returns the rate limit applied when the brand has none for the route
+func defaultRateLimit(route string) *RateLimit {
+	capacity, err := strconv.ParseInt(os.Getenv("RATE_LIMIT_CAPACITY"), 10, 64)
+	if err != nil || capacity < 1 {
+		capacity = 60
+	}
+
+	refillPerSecond, err := strconv.ParseFloat(os.Getenv("RATE_LIMIT_REFILL_PER_SECOND"), 64)
+	if err != nil || refillPerSecond <= 0 {
+		refillPerSecond = 1
+	}
+
+	return &RateLimit{
+		Route:           route,
+		Capacity:        capacity,
+		RefillPerSecond: refillPerSecond,
+	}
+}
+
+// rateLimitIPMultiplier returns the factor applied to the rate limit of the IP bucket shared by the identified leads
+func rateLimitIPMultiplier() int64 {
+	multiplier, err := strconv.ParseInt(os.Getenv("RATE_LIMIT_IP_MULTIPLIER"), 10, 64)
+	if err != nil || multiplier < 1 {
+		multiplier = 10
+	}
+
+	return multiplier
+}
+
+// getRateLimits retrieves the rate limits of a brand by route using Redis cache
+func getRateLimits(brandName string) (map[string]*RateLimit, error) {
+	var rateLimits []*RateLimit
+
+	// Check Redis cache
+	cacheKey := fmt.Sprintf("rate_limits:%s", brandName)
+	cachedRateLimits, err := redisClient.Get(ctx, cacheKey).Result()
+	if err != redis.Nil && err == nil {
+		if err := json.Unmarshal([]byte(cachedRateLimits), &rateLimits); err != nil {
+			logger.LogError("[RATE_LIMIT] Error unmarshalling rate limits: %v", err)
+			return nil, fmt.Errorf("Error unmarshalling rate limits: %v", err)
+		}
+
+		return indexRateLimits(rateLimits), nil
+	}
+
+	// Values not found in cache, retrieve from database
+	rows, err := db.Query("SELECT route, capacity, refill_per_second FROM brand_rate_limit WHERE brand = $1", brandName)
+	if err != nil {
+		logger.LogError("[RATE_LIMIT] Error querying database: %v", err)
+		return nil, fmt.Errorf("Error querying database: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var rateLimit RateLimit
+		if err := rows.Scan(&rateLimit.Route, &rateLimit.Capacity, &rateLimit.RefillPerSecond); err != nil {
+			logger.LogError("[RATE_LIMIT] Error scanning rate limit: %v", err)
+			return nil, fmt.Errorf("Error scanning rate limit: %v", err)
+		}
+		rateLimits = append(rateLimits, &rateLimit)
+	}
+
+	if err := rows.Err(); err != nil {
+		logger.LogError("[RATE_LIMIT] Error reading rate limits: %v", err)
+		return nil, fmt.Errorf("Error reading rate limits: %v", err)
+	}
+
+	rateLimitsJSON, err := json.Marshal(rateLimits)
+	if err != nil {
+		logger.LogError("[RATE_LIMIT] Error marshalling rate limits: %v", err)
+		return nil, fmt.Errorf("Error marshalling rate limits: %v", err)
+	}
+
+	// Cache the result with a 1-hour TTL
+	err = redisClient.Set(ctx, cacheKey, rateLimitsJSON, 1*time.Hour).Err()
+	if err != nil {
+		logger.LogError("[RATE_LIMIT] Error setting cache: %v", err)
+	}
+
+	return indexRateLimits(rateLimits), nil
+}
+
+func indexRateLimits(rateLimits []*RateLimit) map[string]*RateLimit {
+	index := make(map[string]*RateLimit, len(rateLimits))
+	for _, rateLimit := range rateLimits {
+		index[rateLimit.Route] = rateLimit
+	}
+	return index
+}
+
+// getRateLimit returns the rate limit of a brand route, falling back to the brand default and then to the global default
+func getRateLimit(brandName string, route string) *RateLimit {
+	rateLimits, err := getRateLimits(brandName)
+	if err != nil {
+		return defaultRateLimit(route)
+	}
+
+	if rateLimit, ok := rateLimits[route]; ok {
+		return rateLimit
+	}
+
+	if rateLimit, ok := rateLimits[rateLimitDefaultRoute]; ok {
+		return rateLimit
+	}
+
+	return defaultRateLimit(route)
+}
+
+// getRequestLeadUUID returns the Lead UUID of a request from the query parameters or the cookie
+func getRequestLeadUUID(r *http.Request) string {
+	if leadUUID := r.URL.Query().Get("lead_uuid"); leadUUID != "" {
+		return leadUUID
+	}
+
+	if cookie, err := r.Cookie(leadUUIDCookieName); err == nil {
+		return cookie.Value
+	}
+
+	return ""
+}
+
+// getRateLimitBuckets returns the buckets of a request.
+// The IP bucket is always applied, so that a client cannot get around it by rotating lead identifiers.
+// The readers with a signed lead identifier share a larger IP bucket, so that the ones behind a carrier-grade NAT
+// or an office network are not throttled together, and each of them is limited by the bucket of its lead.
+func getRateLimitBuckets(r *http.Request, brand *Brand, route string, rateLimit *RateLimit) []rateLimitBucket {
+	leadUUID, signed := getCookieLeadUUID(r, brand)
+	if !signed {
+		leadUUID = getRequestLeadUUID(r)
+	}
+
+	var buckets []rateLimitBucket
+
+	if ip := getClientIP(r); ip != "" {
+		// The IP is hashed so that it is not stored in Redis
+		ipHash := sha256.Sum256([]byte(ip))
+		bucket := rateLimitBucket{
+			Key:             fmt.Sprintf("rate_limit:%s:%s:ip:%s", brand.Name, route, hex.EncodeToString(ipHash[:8])),
+			Capacity:        rateLimit.Capacity,
+			RefillPerSecond: rateLimit.RefillPerSecond,
+		}
+
+		if signed {
+			multiplier := rateLimitIPMultiplier()
+			bucket.Key = fmt.Sprintf("rate_limit:%s:%s:lead_ip:%s", brand.Name, route, hex.EncodeToString(ipHash[:8]))
+			bucket.Capacity *= multiplier
+			bucket.RefillPerSecond *= float64(multiplier)
+		}
+
+		buckets = append(buckets, bucket)
+	}
+
+	if leadUUID != "" {
+		buckets = append(buckets, rateLimitBucket{
+			Key:             fmt.Sprintf("rate_limit:%s:%s:lead:%s", brand.Name, route, leadUUID),
+			Capacity:        rateLimit.Capacity,
+			RefillPerSecond: rateLimit.RefillPerSecond,
+		})
+	}
+
+	return buckets
+}
+
+// isRateLimited takes a token from the buckets of the request.
+// It returns the number of seconds to wait when the request is throttled.
+func isRateLimited(r *http.Request, brand *Brand) (bool, int64) {
+	route := r.URL.Path
+	rateLimit := getRateLimit(brand.Name, route)
+
+	buckets := getRateLimitBuckets(r, brand, route, rateLimit)
+	if len(buckets) == 0 {
+		return false, 0
+	}
+
+	keys := make([]string, 0, len(buckets))
+	args := make([]interface{}, 0, 2*len(buckets))
+	for _, bucket := range buckets {
+		keys = append(keys, bucket.Key)
+		args = append(args, bucket.Capacity, bucket.RefillPerSecond)
+	}
+
+	result, err := tokenBucketScript.Run(ctx, redisClient, keys, args...).Int64Slice()
+	if err != nil || len(result) != 2 {
+		// Let the request through rather than failing when Redis is unavailable
+		logger.LogError("[RATE_LIMIT] Failed to check rate limit for brand %s and route %s: %v", brand.Name, route, err)
+		return false, 0
+	}
+
+	return result[0] == 0, result[1]
+}
+
+// withRateLimit throttles the requests of a lead or a client IP exceeding the rate limit of the brand route
+func withRateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		brand := getRequestBrand(r)
+
+		if limited, retryAfter := isRateLimited(r, brand); limited {
+			logger.LogWarn("[RATE_LIMIT] Too many requests on %s for brand %s", r.URL.Path, brand.Name)
+			w.Header().Set("Retry-After", strconv.FormatInt(max(retryAfter, 1), 10))
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+// setupRateLimitTest points the Redis client to an in-memory server holding the rate limits of the brand.
+// The database is unreachable so that the rate limits are only read from the cache.
+func setupRateLimitTest(t *testing.T, brand *Brand, rateLimits []*RateLimit) *miniredis.Miniredis {
+	t.Helper()
+
+	server := miniredis.RunT(t)
+	server.SetTime(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	redisClient = redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { redisClient.Close() })
+
+	var err error
+	db, err = sql.Open("postgres", "host=127.0.0.1 port=1 connect_timeout=1 sslmode=disable")
+	if err != nil {
+		t.Fatalf("sql.Open() error = %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	rateLimitsJSON, err := json.Marshal(rateLimits)
+	if err != nil {
+		t.Fatalf("json.Marshal() error = %v", err)
+	}
+	server.Set("rate_limits:"+brand.Name, string(rateLimitsJSON))
+
+	t.Setenv("LEAD_ID_SECRET", "test-secret")
+
+	return server
+}
+
+// newRateLimitRequest creates a request of the brand from a client IP, with the signed identifier of a lead if any
+func newRateLimitRequest(brand *Brand, ip string, leadUUID string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/collect/v1/lead-event", nil)
+	r.RemoteAddr = ip + ":1234"
+	if leadUUID != "" {
+		r.AddCookie(&http.Cookie{Name: leadIDCookieName, Value: signLeadUUID(brand.Name, leadUUID)})
+	}
+
+	return r.WithContext(context.WithValue(r.Context(), brandContextKey, brand))
+}
+
+func serveRateLimited(r *http.Request) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	withRateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})).ServeHTTP(recorder, r)
+
+	return recorder
+}
+
+func TestTokenBucketScript(t *testing.T) {
+	brand := &Brand{Name: "test"}
+	server := setupRateLimitTest(t, brand, []*RateLimit{
+		{Route: rateLimitDefaultRoute, Capacity: 2, RefillPerSecond: 0.5},
+	})
+
+	r := newRateLimitRequest(brand, "192.0.2.1", "")
+
+	for i := 0; i < 2; i++ {
+		if limited, _ := isRateLimited(r, brand); limited {
+			t.Fatalf("request %d was limited within the capacity", i+1)
+		}
+	}
+
+	limited, retryAfter := isRateLimited(r, brand)
+	if !limited {
+		t.Fatal("request was not limited once the bucket was empty")
+	}
+	if retryAfter != 2 {
+		t.Errorf("retry after = %d, want 2", retryAfter)
+	}
+
+	// The throttled request did not take a token, one is back after 2 seconds
+	server.SetTime(time.Date(2024, 1, 1, 0, 0, 2, 0, time.UTC))
+
+	if limited, _ := isRateLimited(r, brand); limited {
+		t.Error("request was limited after the bucket was refilled")
+	}
+	if limited, _ := isRateLimited(r, brand); !limited {
+		t.Error("request was not limited once the refilled token was taken")
+	}
+}
+
+func TestTokenBucketScriptRouteLimit(t *testing.T) {
+	brand := &Brand{Name: "test"}
+	setupRateLimitTest(t, brand, []*RateLimit{
+		{Route: rateLimitDefaultRoute, Capacity: 1, RefillPerSecond: 1},
+		{Route: "/collect/v1/lead-event", Capacity: 3, RefillPerSecond: 1},
+	})
+
+	r := newRateLimitRequest(brand, "192.0.2.1", "")
+
+	for i := 0; i < 3; i++ {
+		if limited, _ := isRateLimited(r, brand); limited {
+			t.Fatalf("request %d was limited within the capacity of the route", i+1)
+		}
+	}
+
+	if limited, _ := isRateLimited(r, brand); !limited {
+		t.Error("request was not limited beyond the capacity of the route")
+	}
+}
+
+func TestWithRateLimitRetryAfter(t *testing.T) {
+	brand := &Brand{Name: "test"}
+	setupRateLimitTest(t, brand, []*RateLimit{
+		{Route: rateLimitDefaultRoute, Capacity: 1, RefillPerSecond: 0.1},
+	})
+
+	if recorder := serveRateLimited(newRateLimitRequest(brand, "192.0.2.1", "")); recorder.Code != http.StatusNoContent {
+		t.Fatalf("first request status = %d, want %d", recorder.Code, http.StatusNoContent)
+	}
+
+	recorder := serveRateLimited(newRateLimitRequest(brand, "192.0.2.1", ""))
+	if recorder.Code != http.StatusTooManyRequests {
+		t.Fatalf("second request status = %d, want %d", recorder.Code, http.StatusTooManyRequests)
+	}
+	if retryAfter := recorder.Header().Get("Retry-After"); retryAfter != "10" {
+		t.Errorf("Retry-After = %q, want %q", retryAfter, "10")
+	}
+}
+
+func TestWithRateLimitLeadCookie(t *testing.T) {
+	brand := &Brand{Name: "test"}
+	setupRateLimitTest(t, brand, []*RateLimit{
+		{Route: rateLimitDefaultRoute, Capacity: 1, RefillPerSecond: 0.1},
+	})
+
+	// The readers sharing an IP have their own bucket
+	for _, leadUUID := range []string{"3f6c1b9e-8a0e-4a53-9d43-2a1f6f0c0b01", "3f6c1b9e-8a0e-4a53-9d43-2a1f6f0c0b02"} {
+		if recorder := serveRateLimited(newRateLimitRequest(brand, "192.0.2.1", leadUUID)); recorder.Code != http.StatusNoContent {
+			t.Errorf("request of lead %s status = %d, want %d", leadUUID, recorder.Code, http.StatusNoContent)
+		}
+	}
+
+	if recorder := serveRateLimited(newRateLimitRequest(brand, "192.0.2.1", "3f6c1b9e-8a0e-4a53-9d43-2a1f6f0c0b01")); recorder.Code != http.StatusTooManyRequests {
+		t.Errorf("second request of the lead status = %d, want %d", recorder.Code, http.StatusTooManyRequests)
+	}
+
+	// A forged identifier falls back to the bucket of the IP
+	r := newRateLimitRequest(brand, "192.0.2.1", "")
+	r.AddCookie(&http.Cookie{Name: leadIDCookieName, Value: "3f6c1b9e-8a0e-4a53-9d43-2a1f6f0c0b03.forged"})
+	if recorder := serveRateLimited(r); recorder.Code != http.StatusNoContent {
+		t.Errorf("first request of the IP status = %d, want %d", recorder.Code, http.StatusNoContent)
+	}
+	if recorder := serveRateLimited(r); recorder.Code != http.StatusTooManyRequests {
+		t.Errorf("second request of the IP status = %d, want %d", recorder.Code, http.StatusTooManyRequests)
+	}
+}
+
+func TestWithRateLimitLeadCookieRotation(t *testing.T) {
+	brand := &Brand{Name: "test"}
+	setupRateLimitTest(t, brand, []*RateLimit{
+		{Route: rateLimitDefaultRoute, Capacity: 1, RefillPerSecond: 0.1},
+	})
+	t.Setenv("RATE_LIMIT_IP_MULTIPLIER", "3")
+
+	// The leads of an IP share its larger bucket, a client rotating signed identifiers is still throttled
+	leadUUIDs := []string{
+		"3f6c1b9e-8a0e-4a53-9d43-2a1f6f0c0b01",
+		"3f6c1b9e-8a0e-4a53-9d43-2a1f6f0c0b02",
+		"3f6c1b9e-8a0e-4a53-9d43-2a1f6f0c0b03",
+	}
+	for _, leadUUID := range leadUUIDs {
+		if recorder := serveRateLimited(newRateLimitRequest(brand, "192.0.2.1", leadUUID)); recorder.Code != http.StatusNoContent {
+			t.Errorf("request of lead %s status = %d, want %d", leadUUID, recorder.Code, http.StatusNoContent)
+		}
+	}
+
+	if recorder := serveRateLimited(newRateLimitRequest(brand, "192.0.2.1", "3f6c1b9e-8a0e-4a53-9d43-2a1f6f0c0b04")); recorder.Code != http.StatusTooManyRequests {
+		t.Errorf("request of a new lead beyond the capacity of the IP status = %d, want %d", recorder.Code, http.StatusTooManyRequests)
+	}
+
+	// Another IP has its own bucket
+	if recorder := serveRateLimited(newRateLimitRequest(brand, "192.0.2.2", "3f6c1b9e-8a0e-4a53-9d43-2a1f6f0c0b04")); recorder.Code != http.StatusNoContent {
+		t.Errorf("request of another IP status = %d, want %d", recorder.Code, http.StatusNoContent)
+	}
+}
+
+func TestWithRateLimitFailsOpen(t *testing.T) {
+	brand := &Brand{Name: "test"}
+	server := setupRateLimitTest(t, brand, []*RateLimit{
+		{Route: rateLimitDefaultRoute, Capacity: 1, RefillPerSecond: 0.1},
+	})
+	server.Close()
+
+	for i := 0; i < 3; i++ {
+		if recorder := serveRateLimited(newRateLimitRequest(brand, "192.0.2.1", "")); recorder.Code != http.StatusNoContent {
+			t.Fatalf("request %d status = %d, want %d", i+1, recorder.Code, http.StatusNoContent)
+		}
+	}
+}
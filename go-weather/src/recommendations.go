@@ -0,0 +1,599 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/lib/pq"
+)
+
+// Sources of the recommendation candidates
+const (
+	recommendationSourceContentBased = "content_based"
+	recommendationSourceTopNext      = "top_next"
+	recommendationSourceTop          = "top"
+	recommendationSourceLeadSection  = "lead_section"
+)
+
+const (
+	defaultRecommendationsCount = 10
+	maxRecommendationsCount     = 50
+
+	// Each source provides more candidates than requested, to make up for the read articles and the section diversity
+	recommendationCandidatesFactor = 3
+
+	// Number of favourite sections of a lead whose top articles are candidates
+	maxLeadSections = 3
+
+	// The sources are updated every minute
+	recommendationsCacheTTL = 1 * time.Minute
+
+	// Boost of the similar articles in the favourite section of a lead, relative to their similarity
+	contentBasedSectionBoost = 0.5
+)
+
+// RecommendationWeights are the blend weights of the recommendation sources of a brand.
+// MaxPerSection is the maximum number of recommendations of a section, unless there are not enough other sections.
+type RecommendationWeights struct {
+	ContentBased  float64 `json:"content_based"`
+	TopNext       float64 `json:"top_next"`
+	Top           float64 `json:"top"`
+	LeadSection   float64 `json:"lead_section"`
+	MaxPerSection int     `json:"max_per_section"`
+}
+
+var defaultRecommendationWeights = RecommendationWeights{
+	ContentBased:  0.35,
+	TopNext:       0.3,
+	Top:           0.15,
+	LeadSection:   0.2,
+	MaxPerSection: 3,
+}
+
+// withDefaults returns the default weights of the brands which did not set theirs
+func (weights RecommendationWeights) withDefaults() RecommendationWeights {
+	if weights.ContentBased == 0 && weights.TopNext == 0 && weights.Top == 0 && weights.LeadSection == 0 {
+		weights.ContentBased = defaultRecommendationWeights.ContentBased
+		weights.TopNext = defaultRecommendationWeights.TopNext
+		weights.Top = defaultRecommendationWeights.Top
+		weights.LeadSection = defaultRecommendationWeights.LeadSection
+	}
+
+	if weights.MaxPerSection <= 0 {
+		weights.MaxPerSection = defaultRecommendationWeights.MaxPerSection
+	}
+
+	return weights
+}
+
+// weight returns the blend weight of a source
+func (weights RecommendationWeights) weight(source string) float64 {
+	switch source {
+	case recommendationSourceContentBased:
+		return weights.ContentBased
+	case recommendationSourceTopNext:
+		return weights.TopNext
+	case recommendationSourceTop:
+		return weights.Top
+	case recommendationSourceLeadSection:
+		return weights.LeadSection
+	}
+	return 0
+}
+
+// Structs for storing a recommended article, with the sources which recommended it
+type Recommendation struct {
+	URL         string   `json:"url"`
+	Title       string   `json:"title"`
+	Description string   `json:"description"`
+	Image       *string  `json:"image"`
+	Section     string   `json:"section"`
+	SubSection  *string  `json:"sub_section"`
+	Score       float64  `json:"score"`
+	Sources     []string `json:"sources"`
+}
+
+// Structs for storing a similar article, the score is the similarity boosted by the section affinity of the lead
+type SimilarArticle struct {
+	Url         string  `json:"url"`
+	Title       string  `json:"title"`
+	Description string  `json:"description"`
+	Section     string  `json:"section"`
+	SubSection  *string `json:"sub_section"`
+	Image       *string `json:"image"`
+	Similarity  float64 `json:"similarity"`
+	Score       float64 `json:"score"`
+}
+
+// Structs for the recommendations response
+type RecommendationsResponse struct {
+	Recommendations []Recommendation `json:"recommendations"`
+	Personalised    bool             `json:"personalised"`
+}
+
+// RecommendationCandidates are the candidate URLs with their score for each source, normalised between 0 and 1
+type RecommendationCandidates map[string]map[string]float64
+
+// add adds the candidates of a source, their scores are normalised by the best score of the source
+func (candidates RecommendationCandidates) add(source string, scores map[string]float64) {
+	maxScore := 0.0
+	for _, score := range scores {
+		maxScore = max(maxScore, score)
+	}
+
+	for url, score := range scores {
+		if candidates[url] == nil {
+			candidates[url] = map[string]float64{}
+		}
+
+		if maxScore > 0 {
+			candidates[url][source] = max(0, score) / maxScore
+		} else {
+			candidates[url][source] = 0
+		}
+	}
+}
+
+// urls returns the candidate URLs
+func (candidates RecommendationCandidates) urls() []string {
+	urls := make([]string, 0, len(candidates))
+	for url := range candidates {
+		urls = append(urls, url)
+	}
+	return urls
+}
+
+// getContentBasedCandidates returns the articles similar to an article, with their similarity
+func getContentBasedCandidates(brandName string, url string, limit int) (map[string]float64, error) {
+	rows, err := db.Query(`
+		SELECT article_url_2, similarity_score
+		FROM content_based_articles
+		WHERE brand = $1 AND article_url_1 = $2 AND similarity_score > 0
+		ORDER BY similarity_score DESC
+		LIMIT $3`, brandName, url, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanCandidateScores(rows)
+}
+
+// getTopNextCandidates returns the articles read after an article, with their engagement score
+func getTopNextCandidates(brandName string, url string, limit int) (map[string]float64, error) {
+	rows, err := db.Query(`
+		SELECT
+			next_url,
+			(SUM(view_count) * 0.4) + (AVG(avg_reading_rate) * 0.3) + (AVG(avg_time_spent) * 0.3) AS engagement_score
+		FROM top_next_articles
+		WHERE
+			brand = $1
+			AND initial_url = $2
+			AND calculation_period >= NOW() - INTERVAL '2 DAY'
+			AND calculation_period < NOW()
+		GROUP BY next_url
+		ORDER BY engagement_score DESC
+		LIMIT $3`, brandName, url, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanCandidateScores(rows)
+}
+
+// getTopCandidates returns the top articles of the last 24 hours of the brand or of one of its sections, with their engagement score
+func getTopCandidates(brandName string, section string, limit int) (map[string]float64, error) {
+	query, params := TopArticlesQuery{Section: section, Count: limit, Window: defaultTopArticlesWindow}.sql(brandName)
+
+	rows, err := db.Query(query, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	scores := map[string]float64{}
+	for rows.Next() {
+		var article TopArticle
+		if err := rows.Scan(&article.URL, &article.Title, &article.Description, &article.Image, &article.Section, &article.SubSection, &article.ViewCount, &article.AvgReadingRate, &article.AvgTimeSpent, &article.RecencyWeight, &article.EngagementScore); err != nil {
+			return nil, err
+		}
+		scores[article.URL] = article.EngagementScore
+	}
+
+	return scores, rows.Err()
+}
+
+// getLeadSectionAffinities returns the favourite sections of a lead, with the number of articles read in each
+func getLeadSectionAffinities(brandName string, leadUUID string) (map[string]float64, error) {
+	rows, err := db.Query(`
+		SELECT section, SUM(article_count) AS article_count
+		FROM lead_section_article_count
+		WHERE brand = $1 AND lead_uuid = $2 AND section IS NOT NULL
+		GROUP BY section
+		ORDER BY article_count DESC
+		LIMIT $3`, brandName, leadUUID, maxLeadSections)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanCandidateScores(rows)
+}
+
+// scanCandidateScores reads rows of a key and a score
+func scanCandidateScores(rows *sql.Rows) (map[string]float64, error) {
+	scores := map[string]float64{}
+	for rows.Next() {
+		var key string
+		var score float64
+		if err := rows.Scan(&key, &score); err != nil {
+			return nil, err
+		}
+		scores[key] = score
+	}
+
+	return scores, rows.Err()
+}
+
+// getLeadIsSubscriber returns the subscription of a lead, the leads without user are not subscribers
+func getLeadIsSubscriber(brandName string, leadUUID string) (bool, error) {
+	var isSubscriber bool
+	err := db.QueryRow(`SELECT is_subscriber FROM "user" WHERE brand = $1 AND lead_uuid = $2`, brandName, leadUUID).Scan(&isSubscriber)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+
+	return isSubscriber, err
+}
+
+// getContentBasedArticles returns the articles most similar to an article.
+// For a lead, the articles it has read are skipped and the ones of its favourite sections are boosted.
+func getContentBasedArticles(brandName string, url string, leadUUID string, count int, includePaid bool) ([]SimilarArticle, error) {
+	params := []interface{}{brandName, url}
+	conditions := ""
+
+	if leadUUID != "" {
+		params = append(params, leadUUID)
+		conditions += fmt.Sprintf(`
+			AND NOT EXISTS (
+				SELECT 1 FROM lead_read_articles lra
+				WHERE lra.brand = $1 AND lra.lead_uuid = $%d AND lra.url = cba.article_url_2
+			)`, len(params))
+	}
+
+	if !includePaid {
+		conditions += `
+			AND p.is_paid IS NOT TRUE`
+	}
+
+	// The boost can reorder the candidates, more of them are selected than returned
+	candidateCount := count
+	if leadUUID != "" {
+		candidateCount = count * recommendationCandidatesFactor
+	}
+	params = append(params, candidateCount)
+
+	rows, err := db.Query(fmt.Sprintf(`
+		SELECT
+			p.url,
+			p.title,
+			p.description,
+			p.section,
+			p.sub_section,
+			p.image,
+			cba.similarity_score
+		FROM
+			content_based_articles cba
+		JOIN
+			page p ON p.url = cba.article_url_2 AND p.brand = $1
+		WHERE
+			cba.brand = $1
+			AND cba.article_url_1 = $2
+			AND cba.similarity_score > 0%s
+		ORDER BY
+			cba.similarity_score DESC
+		LIMIT $%d`, conditions, len(params)), params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	similarArticles := []SimilarArticle{}
+	for rows.Next() {
+		var article SimilarArticle
+		if err := rows.Scan(&article.Url, &article.Title, &article.Description, &article.Section, &article.SubSection, &article.Image, &article.Similarity); err != nil {
+			return nil, err
+		}
+		article.Score = article.Similarity
+		similarArticles = append(similarArticles, article)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if leadUUID == "" {
+		return similarArticles, nil
+	}
+
+	sectionAffinities, err := getLeadSectionAffinities(brandName, leadUUID)
+	if err != nil {
+		// The similar articles are still relevant without the boost
+		logger.LogError("[RECOMMENDATIONS] Failed to get section affinities of lead %s for brand %s: %v", leadUUID, brandName, err)
+	}
+
+	maxAffinity := 0.0
+	for _, affinity := range sectionAffinities {
+		maxAffinity = max(maxAffinity, affinity)
+	}
+
+	if maxAffinity > 0 {
+		for i := range similarArticles {
+			affinity := sectionAffinities[similarArticles[i].Section] / maxAffinity
+			similarArticles[i].Score = similarArticles[i].Similarity * (1 + contentBasedSectionBoost*affinity)
+		}
+
+		sort.SliceStable(similarArticles, func(i, j int) bool {
+			return similarArticles[i].Score > similarArticles[j].Score
+		})
+	}
+
+	if len(similarArticles) > count {
+		similarArticles = similarArticles[:count]
+	}
+
+	return similarArticles, nil
+}
+
+// getLeadReadArticles returns the URLs already read by a lead among some URLs
+func getLeadReadArticles(brandName string, leadUUID string, urls []string) (map[string]bool, error) {
+	rows, err := db.Query("SELECT url FROM lead_read_articles WHERE brand = $1 AND lead_uuid = $2 AND url = ANY($3)", brandName, leadUUID, pq.Array(urls))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	readArticles := map[string]bool{}
+	for rows.Next() {
+		var url string
+		if err := rows.Scan(&url); err != nil {
+			return nil, err
+		}
+		readArticles[url] = true
+	}
+
+	return readArticles, rows.Err()
+}
+
+// getRecommendationPages returns the pages of some URLs, the URLs without page cannot be recommended
+func getRecommendationPages(brandName string, urls []string) (map[string]Recommendation, error) {
+	rows, err := db.Query("SELECT url, title, description, image, section, sub_section FROM page WHERE brand = $1 AND url = ANY($2)", brandName, pq.Array(urls))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pages := map[string]Recommendation{}
+	for rows.Next() {
+		var page Recommendation
+		if err := rows.Scan(&page.URL, &page.Title, &page.Description, &page.Image, &page.Section, &page.SubSection); err != nil {
+			return nil, err
+		}
+		pages[page.URL] = page
+	}
+
+	return pages, rows.Err()
+}
+
+// diversifySections keeps the best recommendations while limiting the number of recommendations of a section.
+// The recommendations beyond the limit are only used when there are not enough other sections.
+func diversifySections(recommendations []Recommendation, count int, maxPerSection int) []Recommendation {
+	diversified := make([]Recommendation, 0, count)
+	var overflow []Recommendation
+
+	sectionCounts := map[string]int{}
+	for _, recommendation := range recommendations {
+		if len(diversified) == count {
+			break
+		}
+
+		if sectionCounts[recommendation.Section] >= maxPerSection {
+			overflow = append(overflow, recommendation)
+			continue
+		}
+
+		sectionCounts[recommendation.Section]++
+		diversified = append(diversified, recommendation)
+	}
+
+	for _, recommendation := range overflow {
+		if len(diversified) == count {
+			break
+		}
+		diversified = append(diversified, recommendation)
+	}
+
+	return diversified
+}
+
+// getRecommendations blends the candidates of all the sources for an article and, when personalised, a lead.
+// A source which fails or has no candidates is skipped, the others still provide recommendations.
+func getRecommendations(brand *Brand, url string, leadUUID string, count int) ([]Recommendation, error) {
+	weights := brand.RecommendationWeights.withDefaults()
+	candidateCount := count * recommendationCandidatesFactor
+
+	candidates := RecommendationCandidates{}
+
+	contentBasedScores, err := getContentBasedCandidates(brand.Name, url, candidateCount)
+	if err != nil {
+		logger.LogError("[RECOMMENDATIONS] Failed to get content based candidates for brand %s: %v", brand.Name, err)
+	}
+	candidates.add(recommendationSourceContentBased, contentBasedScores)
+
+	topNextScores, err := getTopNextCandidates(brand.Name, url, candidateCount)
+	if err != nil {
+		logger.LogError("[RECOMMENDATIONS] Failed to get top next candidates for brand %s: %v", brand.Name, err)
+	}
+	candidates.add(recommendationSourceTopNext, topNextScores)
+
+	topScores, err := getTopCandidates(brand.Name, "", candidateCount)
+	if err != nil {
+		logger.LogError("[RECOMMENDATIONS] Failed to get top candidates for brand %s: %v", brand.Name, err)
+	}
+	candidates.add(recommendationSourceTop, topScores)
+
+	// The top articles of the favourite sections of the lead are candidates too, scored by their section below
+	var sectionAffinities map[string]float64
+	if leadUUID != "" {
+		sectionAffinities, err = getLeadSectionAffinities(brand.Name, leadUUID)
+		if err != nil {
+			logger.LogError("[RECOMMENDATIONS] Failed to get section affinities of lead %s for brand %s: %v", leadUUID, brand.Name, err)
+		}
+
+		for section := range sectionAffinities {
+			sectionScores, err := getTopCandidates(brand.Name, section, candidateCount)
+			if err != nil {
+				logger.LogError("[RECOMMENDATIONS] Failed to get top candidates of section %s for brand %s: %v", section, brand.Name, err)
+				continue
+			}
+
+			for candidateURL := range sectionScores {
+				if candidates[candidateURL] == nil {
+					candidates[candidateURL] = map[string]float64{}
+				}
+			}
+		}
+	}
+
+	delete(candidates, url)
+	if len(candidates) == 0 {
+		return []Recommendation{}, nil
+	}
+
+	if leadUUID != "" {
+		readArticles, err := getLeadReadArticles(brand.Name, leadUUID, candidates.urls())
+		if err != nil {
+			logger.LogError("[RECOMMENDATIONS] Failed to get read articles of lead %s for brand %s: %v", leadUUID, brand.Name, err)
+		}
+
+		for readURL := range readArticles {
+			delete(candidates, readURL)
+		}
+	}
+
+	pages, err := getRecommendationPages(brand.Name, candidates.urls())
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get pages: %v", err)
+	}
+
+	maxAffinity := 0.0
+	for _, affinity := range sectionAffinities {
+		maxAffinity = max(maxAffinity, affinity)
+	}
+
+	recommendations := make([]Recommendation, 0, len(pages))
+	for candidateURL, scores := range candidates {
+		recommendation, ok := pages[candidateURL]
+		if !ok {
+			continue
+		}
+
+		if affinity, ok := sectionAffinities[recommendation.Section]; ok && maxAffinity > 0 {
+			scores[recommendationSourceLeadSection] = affinity / maxAffinity
+		}
+
+		recommendation.Sources = []string{}
+		for source, score := range scores {
+			recommendation.Score += weights.weight(source) * score
+			recommendation.Sources = append(recommendation.Sources, source)
+		}
+		sort.Strings(recommendation.Sources)
+
+		recommendations = append(recommendations, recommendation)
+	}
+
+	sort.Slice(recommendations, func(i, j int) bool {
+		if recommendations[i].Score != recommendations[j].Score {
+			return recommendations[i].Score > recommendations[j].Score
+		}
+		return recommendations[i].URL < recommendations[j].URL
+	})
+
+	return diversifySections(recommendations, count, weights.MaxPerSection), nil
+}
+
+// Handler to recommend articles after an article, blending the similar articles, the articles read next,
+// the top articles and, with the personalisation consent of the lead, its favourite sections and its reading history
+func getRecommendationsHandler(w http.ResponseWriter, r *http.Request) {
+	brand := getRequestBrand(r)
+
+	url := r.URL.Query().Get("url")
+	if url == "" {
+		http.Error(w, "Missing 'url' parameter", http.StatusBadRequest)
+		return
+	}
+	url = normaliseURL(brand, url)
+
+	count := defaultRecommendationsCount
+	if numResults := r.URL.Query().Get("num_results"); numResults != "" {
+		var err error
+		count, err = strconv.Atoi(numResults)
+		if err != nil || count < 1 || count > maxRecommendationsCount {
+			http.Error(w, fmt.Sprintf("'num_results' must be between 1 and %d", maxRecommendationsCount), http.StatusBadRequest)
+			return
+		}
+	}
+
+	leadUUID := r.URL.Query().Get("lead_uuid")
+	if leadUUID != "" {
+		if !isRequestLeadAllowed(r, brand, leadUUID) {
+			http.Error(w, "lead_uuid is not the lead of the request", http.StatusForbidden)
+			return
+		}
+
+		// The recommendations are only personalised with the personalisation consent of the lead
+		if !getLeadConsent(brand.Name, leadUUID).Personalisation {
+			leadUUID = ""
+		}
+	}
+
+	cacheKey := fmt.Sprintf("recommendations:%s:%s:%s:%d", brand.Name, url, leadUUID, count)
+	cachedData, err := redisClient.Get(ctx, cacheKey).Result()
+	if err == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(cachedData))
+		return
+	} else if err != redis.Nil {
+		logger.LogError("[RECOMMENDATIONS] Failed to retrieve cache: %v", err)
+	}
+
+	recommendations, err := getRecommendations(brand, url, leadUUID, count)
+	if err != nil {
+		logger.LogError("[RECOMMENDATIONS] Failed to recommend articles for %s of brand %s: %v", url, brand.Name, err)
+		http.Error(w, "Failed to recommend articles", http.StatusInternalServerError)
+		return
+	}
+
+	response, err := json.Marshal(RecommendationsResponse{
+		Recommendations: recommendations,
+		Personalised:    leadUUID != "",
+	})
+	if err != nil {
+		http.Error(w, "Failed to marshal response", http.StatusInternalServerError)
+		return
+	}
+
+	if err := redisClient.Set(ctx, cacheKey, response, recommendationsCacheTTL).Err(); err != nil {
+		logger.LogError("[RECOMMENDATIONS] Failed to cache recommendations: %v", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Keys of the values stored in the request context
+type contextKey string
+
+const (
+	requestIDContextKey contextKey = "request_id"
+	brandContextKey     contextKey = "brand"
+	apiKeyContextKey    contextKey = "api_key"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// Request IDs set by the load balancer or the clients are kept when they are sane
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// Middleware wraps a handler with a concern shared by several routes
+type Middleware func(http.Handler) http.Handler
+
+// Router registers the routes on a method-aware mux, the mux answers 405 to the other methods of a path.
+// The router middlewares apply to every request, the route middlewares to the requests of the route.
+type Router struct {
+	mux         *http.ServeMux
+	middlewares []Middleware
+	handler     http.Handler
+	methods     map[string][]string
+}
+
+func NewRouter(middlewares ...Middleware) *Router {
+	router := &Router{
+		mux:         http.NewServeMux(),
+		middlewares: middlewares,
+		methods:     make(map[string][]string),
+	}
+	router.handler = chain(router.mux, middlewares...)
+
+	return router
+}
+
+// chain applies the middlewares to a handler, the first middleware being the outermost
+func chain(handler http.Handler, middlewares ...Middleware) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// Handle registers the handler of a method and a path.
+// The CORS preflight of the path is answered for the origins of the brand.
+func (router *Router) Handle(method string, path string, handler http.HandlerFunc, middlewares ...Middleware) {
+	router.mux.Handle(method+" "+path, chain(handler, middlewares...))
+
+	if _, ok := router.methods[path]; !ok {
+		router.mux.Handle(http.MethodOptions+" "+path, chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			preflightHandler(w, r, router.methods[path])
+		}), withBrand))
+	}
+	router.methods[path] = append(router.methods[path], method)
+}
+
+func (router *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	router.handler.ServeHTTP(w, r)
+}
+
+// statusRecorder records the status and the size of a response for the access log and the panic recovery
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(data []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	size, err := s.ResponseWriter.Write(data)
+	s.size += size
+	return size, err
+}
+
+// Unwrap lets the http.ResponseController reach the underlying writer
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// getRequestID returns the ID of a request, set by withRequestID
+func getRequestID(r *http.Request) string {
+	requestID, _ := r.Context().Value(requestIDContextKey).(string)
+	return requestID
+}
+
+// getRequestBrand returns the brand of a request, set by withBrand
+func getRequestBrand(r *http.Request) *Brand {
+	brand, _ := r.Context().Value(brandContextKey).(*Brand)
+	return brand
+}
+
+// getRequestAPIKey returns the API key of a request, set by withAPIKey and withOptionalAPIKey.
+// It is nil for the anonymous requests of the browsers.
+func getRequestAPIKey(r *http.Request) *cachedAPIKey {
+	apiKey, _ := r.Context().Value(apiKeyContextKey).(*cachedAPIKey)
+	return apiKey
+}
+
+// withRequestID identifies a request in the logs and in the response headers
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(requestIDHeader)
+		if !requestIDPattern.MatchString(requestID) {
+			requestID = generateUUID()
+		}
+
+		w.Header().Set(requestIDHeader, requestID)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDContextKey, requestID)))
+	})
+}
+
+// withAccessLog logs the status, the size and the duration of every request
+func withAccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		startTime := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+
+		next.ServeHTTP(recorder, r)
+
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+
+		logger.LogInfo("[ACCESS] %s %s %s %s %d %dB %dms", getRequestID(r), r.Host, r.Method, r.URL.Path, recorder.status, recorder.size, time.Since(startTime).Milliseconds())
+	})
+}
+
+// withRecovery answers 500 to a request whose handler panicked, instead of dropping the connection
+func withRecovery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: w}
+
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				if recovered == http.ErrAbortHandler {
+					panic(recovered)
+				}
+
+				logger.LogError("[PANIC] %s %s %s: %v\n%s", getRequestID(r), r.Method, r.URL.Path, recovered, debug.Stack())
+
+				if recorder.status == 0 {
+					http.Error(recorder, "Internal server error", http.StatusInternalServerError)
+				}
+			}
+		}()
+
+		next.ServeHTTP(recorder, r)
+	})
+}
+
+// withBrand resolves the brand of the request host and stores it in the request context
+func withBrand(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host == "" {
+			http.Error(w, "Host header is required", http.StatusBadRequest)
+			return
+		}
+
+		brand, err := getBrandFromHost(r.Host)
+		if err != nil {
+			logger.LogError("[BRAND] Error getting brand of host %s: %v", r.Host, err)
+			http.Error(w, fmt.Sprintf("Error getting brand: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), brandContextKey, brand)))
+	})
+}
+
+// isBrandOrigin checks if an origin is the brand site or the collector host
+func isBrandOrigin(brand *Brand, origin string) bool {
+	parsedOrigin, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+
+	return parsedOrigin.Host == brand.SiteHost || parsedOrigin.Host == brand.Host
+}
+
+// withCORS lets the brand site read the responses of the collector host, with the cookies of the lead
+func withCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if origin := r.Header.Get("Origin"); origin != "" && isBrandOrigin(getRequestBrand(r), origin) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+			w.Header().Add("Vary", "Origin")
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// preflightHandler answers the CORS preflight of a path for the origins of the brand
+func preflightHandler(w http.ResponseWriter, r *http.Request, methods []string) {
+	origin := r.Header.Get("Origin")
+	if origin == "" || !isBrandOrigin(getRequestBrand(r), origin) {
+		http.Error(w, "Origin is not allowed", http.StatusForbidden)
+		return
+	}
+
+	allowedMethods := append([]string{}, methods...)
+	sort.Strings(allowedMethods)
+
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+	w.Header().Set("Access-Control-Allow-Methods", strings.Join(allowedMethods, ", "))
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Max-Age", "86400")
+	w.Header().Add("Vary", "Origin")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// withCollectOrigin rejects the collect requests coming from another site than the brand one
+func withCollectOrigin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if _, err := url.Parse(origin); err != nil {
+			http.Error(w, "Invalid Origin header", http.StatusBadRequest)
+			return
+		}
+
+		if !isBrandOrigin(getRequestBrand(r), origin) {
+			logger.LogError("[COLLECT] Origin %s is not allowed for brand %s", origin, getRequestBrand(r).Name)
+			http.Error(w, "Origin header must match Site host", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withCollectContentType rejects the collect requests whose body is not JSON
+func withCollectContentType(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isCollectContentType(r) {
+			http.Error(w, "Content type must be JSON", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withoutKnownBots rejects the requests of the known bots, for the collectors whose data is not tagged with a bot classification
+func withoutKnownBots(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if botDetector.ClassifyRequest(r, getRequestBrand(r).Name) == botClassificationKnownBot {
+			logger.LogInfo("[COLLECT] Rejected %s request of known bot: %s", r.URL.Path, r.UserAgent())
+			http.Error(w, "User agent is not allowed", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withAMPOrigin rejects the requests coming from another site than the brand one or an AMP cache
+func withAMPOrigin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if origin := r.Header.Get("Origin"); origin != "" && !isAMPOrigin(getRequestBrand(r), origin) {
+			logger.LogError("[COLLECT][AMP] Origin %s is not allowed for brand %s", origin, getRequestBrand(r).Name)
+			http.Error(w, "Origin header must match Site host or an AMP cache", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withAdmin rejects the requests without the admin API key
+func withAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isAdminRequest(r) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withServerAuth authenticates a server-to-server request with the API key of the brand.
+// The body is read to check its signature, then handed over to the handler.
+func withServerAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, errorCode, err := authenticateServerRequest(r, getRequestBrand(r))
+		if err != nil {
+			logger.LogError("[COLLECT][SERVER] Request is not allowed: %v", err)
+			http.Error(w, err.Error(), errorCode)
+			return
+		}
+
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withAPIKey rejects the requests without an API key of the brand granting the scope, for the private endpoints
+func withAPIKey(scope string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			apiKey, errorCode, err := authenticateAPIKey(r, getRequestBrand(r), scope)
+			if err != nil {
+				logger.LogError("[API] Request to %s is not allowed: %v", r.URL.Path, err)
+				http.Error(w, err.Error(), errorCode)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey, apiKey)))
+		})
+	}
+}
+
+// withOptionalAPIKey lets the browsers call the public endpoints anonymously,
+// the requests with an API key are rejected unless the key grants the scope
+func withOptionalAPIKey(scope string) Middleware {
+	return func(next http.Handler) http.Handler {
+		authenticated := withAPIKey(scope)(next)
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !hasAPIKey(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			authenticated.ServeHTTP(w, r)
+		})
+	}
+}
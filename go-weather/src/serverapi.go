@@ -0,0 +1,471 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/lib/pq"
+	"golang.org/x/net/context"
+)
+
+const (
+	// Maximum age of a signed request
+	signatureTolerance = 5 * time.Minute
+
+	// Server events can be sent late, but not older than this or in the future
+	maxServerEventAge  = 30 * 24 * time.Hour
+	maxServerEventSkew = 5 * time.Minute
+
+	maxServerEventBodySize = 1 << 20
+)
+
+// Scopes of the API keys.
+// The keys created before the scopes only had access to the server collect, they keep the events:write scope.
+const (
+	scopeEventsWrite         = "events:write"
+	scopeMetricsRead         = "metrics:read"
+	scopeLeadsRead           = "leads:read"
+	scopeRecommendationsRead = "recommendations:read"
+)
+
+var apiKeyScopes = map[string]bool{
+	scopeEventsWrite:         true,
+	scopeMetricsRead:         true,
+	scopeLeadsRead:           true,
+	scopeRecommendationsRead: true,
+}
+
+// APIKey is a per-brand key authenticating the server-to-server requests and the partners of the read API.
+// Only the SHA-256 hash of the key is stored, the HMAC secret is optional.
+type APIKey struct {
+	ID         string     `json:"id"`
+	Brand      string     `json:"brand"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	HMACSecret string     `json:"-"`
+	CreatedAt  time.Time  `json:"created_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+// Structs for storing the API key cache, which includes the HMAC secret
+type cachedAPIKey struct {
+	ID         string   `json:"id"`
+	Brand      string   `json:"brand"`
+	Name       string   `json:"name"`
+	Scopes     []string `json:"scopes"`
+	HMACSecret string   `json:"hmac_secret"`
+}
+
+// hasScope checks if the API key grants a scope
+func (apiKey *cachedAPIKey) hasScope(scope string) bool {
+	for _, apiKeyScope := range apiKey.Scopes {
+		if apiKeyScope == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Structs for storing lead event data sent by a server
+type ServerLeadEventData struct {
+	LeadEventData
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Structs for the created API key, the key and the secret are only returned once
+type CreatedAPIKey struct {
+	APIKey
+	Key        string `json:"key"`
+	HMACSecret string `json:"hmac_secret,omitempty"`
+}
+
+func hashAPIKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+// generateSecret returns a random hex string with the given prefix
+func generateSecret(prefix string) (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+
+	return prefix + hex.EncodeToString(secret), nil
+}
+
+// getAPIKeyScopes returns the scopes of an API key, the keys created before the scopes are server keys
+func getAPIKeyScopes(scopes []string) []string {
+	if len(scopes) == 0 {
+		return []string{scopeEventsWrite}
+	}
+	return scopes
+}
+
+// getAPIKey retrieves the active API key matching a key using Redis cache
+func getAPIKey(key string) (*cachedAPIKey, error) {
+	var apiKey cachedAPIKey
+
+	keyHash := hashAPIKey(key)
+
+	// Check Redis cache
+	cacheKey := fmt.Sprintf("api_key:%s", keyHash)
+	cachedKey, err := redisClient.Get(ctx, cacheKey).Result()
+	if err != redis.Nil && err == nil {
+		if err := json.Unmarshal([]byte(cachedKey), &apiKey); err != nil {
+			logger.LogError("[API_KEY] Error unmarshalling API key: %v", err)
+			return nil, fmt.Errorf("Error unmarshalling API key: %v", err)
+		}
+		apiKey.Scopes = getAPIKeyScopes(apiKey.Scopes)
+
+		return &apiKey, nil
+	}
+
+	// Values not found in cache, retrieve from database
+	var hmacSecret sql.NullString
+	err = db.QueryRow("SELECT id, brand, name, scopes, hmac_secret FROM api_key WHERE key_hash = $1 AND revoked_at IS NULL", keyHash).Scan(&apiKey.ID, &apiKey.Brand, &apiKey.Name, pq.Array(&apiKey.Scopes), &hmacSecret)
+	if err != nil {
+		return nil, err
+	}
+	apiKey.HMACSecret = hmacSecret.String
+	apiKey.Scopes = getAPIKeyScopes(apiKey.Scopes)
+
+	apiKeyJSON, err := json.Marshal(apiKey)
+	if err != nil {
+		logger.LogError("[API_KEY] Error marshalling API key: %v", err)
+		return nil, fmt.Errorf("Error marshalling API key: %v", err)
+	}
+
+	// Cache the result with a short TTL so that revocations apply quickly
+	err = redisClient.Set(ctx, cacheKey, apiKeyJSON, 5*time.Minute).Err()
+	if err != nil {
+		logger.LogError("[API_KEY] Error setting cache: %v", err)
+	}
+
+	return &apiKey, nil
+}
+
+// verifySignature checks the X-Weather-Signature header, formatted as t=<unix timestamp>,v1=<hex HMAC-SHA256>.
+// The signed payload is the timestamp and the body joined by a dot.
+func verifySignature(header string, body []byte, secret string) error {
+	var timestamp, signature string
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			signature = value
+		}
+	}
+
+	if timestamp == "" || signature == "" {
+		return errors.New("Missing or malformed signature")
+	}
+
+	unixTimestamp, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("Invalid signature timestamp")
+	}
+
+	signedAt := time.Unix(unixTimestamp, 0)
+	if time.Since(signedAt) > signatureTolerance || time.Until(signedAt) > signatureTolerance {
+		return errors.New("Signature timestamp is outside the tolerance")
+	}
+
+	expectedSignature, err := hex.DecodeString(signature)
+	if err != nil {
+		return errors.New("Invalid signature")
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	if !hmac.Equal(mac.Sum(nil), expectedSignature) {
+		return errors.New("Invalid signature")
+	}
+
+	return nil
+}
+
+// hasAPIKey checks if the request carries an API key, the browsers never do
+func hasAPIKey(r *http.Request) bool {
+	return r.Header.Get("Authorization") != ""
+}
+
+// authenticateAPIKey returns the API key of a request, checking that it belongs to the brand and grants the scope
+func authenticateAPIKey(r *http.Request, brand *Brand, scope string) (*cachedAPIKey, int, error) {
+	key, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found || key == "" {
+		return nil, http.StatusUnauthorized, errors.New("Missing API key")
+	}
+
+	apiKey, err := getAPIKey(key)
+	if err == sql.ErrNoRows {
+		return nil, http.StatusUnauthorized, errors.New("Invalid API key")
+	} else if err != nil {
+		logger.LogError("[API_KEY] Error getting API key: %v", err)
+		return nil, http.StatusInternalServerError, errors.New("Error getting API key")
+	}
+
+	if subtle.ConstantTimeCompare([]byte(apiKey.Brand), []byte(brand.Name)) != 1 {
+		return nil, http.StatusForbidden, errors.New("API key does not belong to the brand")
+	}
+
+	if !apiKey.hasScope(scope) {
+		return nil, http.StatusForbidden, fmt.Errorf("API key does not grant the %s scope", scope)
+	}
+
+	return apiKey, 0, nil
+}
+
+// authenticateServerRequest authenticates a server-to-server request with the API key of the brand and reads its body.
+// The browser checks on the Origin header and the user agent do not apply.
+func authenticateServerRequest(r *http.Request, brand *Brand) ([]byte, int, error) {
+	apiKey, errorCode, err := authenticateAPIKey(r, brand, scopeEventsWrite)
+	if err != nil {
+		return nil, errorCode, err
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxServerEventBodySize+1))
+	if err != nil {
+		return nil, http.StatusBadRequest, errors.New("Unable to read request body")
+	}
+	if len(body) > maxServerEventBodySize {
+		return nil, http.StatusRequestEntityTooLarge, errors.New("Request body is too large")
+	}
+
+	// Keys with an HMAC secret must sign their requests
+	if apiKey.HMACSecret != "" {
+		if err := verifySignature(r.Header.Get("X-Weather-Signature"), body, apiKey.HMACSecret); err != nil {
+			return nil, http.StatusUnauthorized, err
+		}
+	}
+
+	return body, 0, nil
+}
+
+// getServerEventTime returns the time of a server event, the events without timestamp happen now
+func getServerEventTime(timestamp time.Time) (time.Time, error) {
+	if timestamp.IsZero() {
+		return time.Now().UTC(), nil
+	}
+
+	eventAge := time.Since(timestamp)
+	if eventAge > maxServerEventAge || eventAge < -maxServerEventSkew {
+		return time.Time{}, errors.New("Timestamp is out of range")
+	}
+
+	return timestamp.UTC(), nil
+}
+
+// Collect Lead Event Data sent by a server
+func collectServerLeadEventDataHandler(w http.ResponseWriter, r *http.Request) {
+	brand := getRequestBrand(r)
+
+	var serverLeadEventData ServerLeadEventData
+	if err := json.NewDecoder(r.Body).Decode(&serverLeadEventData); err != nil {
+		logger.LogError("[COLLECT][SERVER][LEAD_EVENT] Invalid request payload: %v", err)
+		http.Error(w, "Invalid request payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	leadEventData := serverLeadEventData.LeadEventData
+
+	// Servers identify the lead themselves, there is no cookie to fall back on
+	if leadEventData.LeadUUID == "" {
+		http.Error(w, "Missing 'leadUuid'", http.StatusBadRequest)
+		return
+	}
+
+	eventTime, err := getServerEventTime(serverLeadEventData.Timestamp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	leadEventData.Metadata.EventTime = eventTime
+
+	// Validate event name and metas against the built-in events and the brand registry
+	if errorCode, err := validateLeadEvent(brand, leadEventData); err != nil {
+		logger.LogError("[COLLECT][SERVER][LEAD_EVENT] Invalid lead event %s: %v", leadEventData.Name, err)
+		http.Error(w, err.Error(), errorCode)
+		return
+	}
+
+	// Servers retry, the same event UUID is only collected once
+	result, errorCode, err := collectLeadEventData(r, brand, leadEventData, botClassificationHuman, leadEventSourceServer)
+	if err != nil {
+		logger.LogError("[COLLECT][SERVER][LEAD_EVENT] Failed to collect lead event %s: %v", leadEventData.Name, err)
+		http.Error(w, err.Error(), errorCode)
+		return
+	}
+
+	if result != nil {
+		if _, err := result.Get(context.Background()); err != nil {
+			logger.LogError("[COLLECT][SERVER][LEAD_EVENT] Failed to publish lead event data: %v", err)
+
+			// Let the server retry the event, the ones without UUID get a new one on retry
+			releaseLeadEvent(brand.Name, leadEventData)
+
+			http.Error(w, "Failed to publish lead event data", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// List the API keys of a brand
+func listAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	brand := getRequestBrand(r)
+
+	rows, err := db.Query("SELECT id, brand, name, scopes, created_at, revoked_at FROM api_key WHERE brand = $1 ORDER BY created_at", brand.Name)
+	if err != nil {
+		logger.LogError("[API_KEY] Error querying database: %v", err)
+		http.Error(w, "Failed to get API keys", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	apiKeys := []APIKey{}
+	for rows.Next() {
+		var apiKey APIKey
+		if err := rows.Scan(&apiKey.ID, &apiKey.Brand, &apiKey.Name, pq.Array(&apiKey.Scopes), &apiKey.CreatedAt, &apiKey.RevokedAt); err != nil {
+			logger.LogError("[API_KEY] Error scanning API key: %v", err)
+			http.Error(w, "Failed to get API keys", http.StatusInternalServerError)
+			return
+		}
+		apiKey.Scopes = getAPIKeyScopes(apiKey.Scopes)
+		apiKeys = append(apiKeys, apiKey)
+	}
+
+	if err := rows.Err(); err != nil {
+		logger.LogError("[API_KEY] Error reading API keys: %v", err)
+		http.Error(w, "Failed to get API keys", http.StatusInternalServerError)
+		return
+	}
+
+	response, err := json.Marshal(apiKeys)
+	if err != nil {
+		http.Error(w, "Failed to marshal response", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
+
+// Create an API key for a brand, its key and HMAC secret are only returned once.
+// The keys without scopes are server keys collecting events.
+func createAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	brand := getRequestBrand(r)
+
+	var request struct {
+		Name   string   `json:"name"`
+		Scopes []string `json:"scopes"`
+		Signed bool     `json:"signed"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Name == "" {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	for _, scope := range request.Scopes {
+		if !apiKeyScopes[scope] {
+			http.Error(w, fmt.Sprintf("Invalid scope: %s", scope), http.StatusBadRequest)
+			return
+		}
+	}
+
+	key, err := generateSecret("wk_")
+	if err != nil {
+		http.Error(w, "Failed to generate API key", http.StatusInternalServerError)
+		return
+	}
+
+	createdAPIKey := CreatedAPIKey{
+		APIKey: APIKey{
+			ID:        generateUUID(),
+			Brand:     brand.Name,
+			Name:      request.Name,
+			Scopes:    getAPIKeyScopes(request.Scopes),
+			CreatedAt: time.Now().UTC(),
+		},
+		Key: key,
+	}
+
+	var hmacSecret sql.NullString
+	if request.Signed {
+		createdAPIKey.HMACSecret, err = generateSecret("whs_")
+		if err != nil {
+			http.Error(w, "Failed to generate HMAC secret", http.StatusInternalServerError)
+			return
+		}
+		hmacSecret = sql.NullString{String: createdAPIKey.HMACSecret, Valid: true}
+	}
+
+	_, err = db.Exec("INSERT INTO api_key (id, brand, name, scopes, key_hash, hmac_secret, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7)",
+		createdAPIKey.ID, brand.Name, createdAPIKey.Name, pq.Array(createdAPIKey.Scopes), hashAPIKey(key), hmacSecret, createdAPIKey.CreatedAt)
+	if err != nil {
+		logger.LogError("[API_KEY] Failed to save API key for brand %s: %v", brand.Name, err)
+		http.Error(w, "Failed to save API key", http.StatusInternalServerError)
+		return
+	}
+
+	logger.LogInfo("[API_KEY] Created API key %s (%s) with scopes %s for brand %s", createdAPIKey.ID, createdAPIKey.Name, strings.Join(createdAPIKey.Scopes, ","), brand.Name)
+
+	response, err := json.Marshal(createdAPIKey)
+	if err != nil {
+		http.Error(w, "Failed to marshal response", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(response)
+}
+
+// Revoke an API key of a brand
+func revokeAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	brand := getRequestBrand(r)
+
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "Missing 'id' parameter", http.StatusBadRequest)
+		return
+	}
+
+	var keyHash string
+	err := db.QueryRow("UPDATE api_key SET revoked_at = NOW() WHERE brand = $1 AND id = $2 AND revoked_at IS NULL RETURNING key_hash", brand.Name, id).Scan(&keyHash)
+	if err == sql.ErrNoRows {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		logger.LogError("[API_KEY] Failed to revoke API key %s for brand %s: %v", id, brand.Name, err)
+		http.Error(w, "Failed to revoke API key", http.StatusInternalServerError)
+		return
+	}
+
+	if err := redisClient.Del(ctx, fmt.Sprintf("api_key:%s", keyHash)).Err(); err != nil {
+		logger.LogError("[API_KEY] Error invalidating cache: %v", err)
+	}
+
+	logger.LogInfo("[API_KEY] Revoked API key %s for brand %s", id, brand.Name)
+
+	w.WriteHeader(http.StatusNoContent)
+}
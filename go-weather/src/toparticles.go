@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	defaultTopArticlesCount  = 10
+	maxTopArticlesCount      = 100
+	defaultTopArticlesWindow = "24h"
+
+	// The top articles are cached briefly, they are updated every minute
+	topArticlesCacheTTL = 1 * time.Second
+)
+
+var (
+	// Time windows of the top articles, the top articles are kept 7 days
+	topArticlesWindows = map[string]string{
+		"1h":  "1 hour",
+		"6h":  "6 hours",
+		"24h": "24 hours",
+		"7d":  "7 days",
+	}
+
+	// Publication age cut-off, in hours or days
+	publicationAgeExpression = regexp.MustCompile(`^([1-9][0-9]{0,3})([hd])$`)
+)
+
+// TopArticlesQuery is the shape of a top list, read from the query parameters of the request
+type TopArticlesQuery struct {
+	Section    string
+	SubSection string
+	Count      int
+	Window     string
+	Language   string
+	IsPaid     *bool
+	PageType   string
+	MaxAge     string
+	Cursor     *TopArticlesCursor
+}
+
+// TopArticlesCursor is the position of the last article of a page, in the order of the top list
+type TopArticlesCursor struct {
+	EngagementScore float64 `json:"s"`
+	URL             string  `json:"u"`
+}
+
+// Structs for storing a top article
+type TopArticle struct {
+	URL             string  `json:"url"`
+	Title           string  `json:"title"`
+	Description     string  `json:"description"`
+	Image           *string `json:"image"`
+	Section         string  `json:"section"`
+	SubSection      *string `json:"sub_section"`
+	ViewCount       int     `json:"view_count"`
+	AvgReadingRate  float64 `json:"avg_reading_rate"`
+	AvgTimeSpent    float64 `json:"avg_time_spent"`
+	RecencyWeight   float64 `json:"recency_weight"`
+	EngagementScore float64 `json:"engagement_score"`
+}
+
+// Structs for the top articles response, the next cursor is null on the last page
+type TopArticlesResponse struct {
+	Articles   []TopArticle `json:"articles"`
+	Window     string       `json:"window"`
+	NextCursor *string      `json:"next_cursor"`
+}
+
+// encodeTopArticlesCursor returns the opaque cursor of the page following an article
+func encodeTopArticlesCursor(article TopArticle) (string, error) {
+	cursorJSON, err := json.Marshal(TopArticlesCursor{EngagementScore: article.EngagementScore, URL: article.URL})
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(cursorJSON), nil
+}
+
+// decodeTopArticlesCursor reads a cursor returned by encodeTopArticlesCursor
+func decodeTopArticlesCursor(cursor string) (*TopArticlesCursor, error) {
+	cursorJSON, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, errors.New("Invalid 'cursor'")
+	}
+
+	var topArticlesCursor TopArticlesCursor
+	if err := json.Unmarshal(cursorJSON, &topArticlesCursor); err != nil || topArticlesCursor.URL == "" {
+		return nil, errors.New("Invalid 'cursor'")
+	}
+
+	return &topArticlesCursor, nil
+}
+
+// parseTopArticlesQuery reads and validates the query parameters of a top list
+func parseTopArticlesQuery(r *http.Request) (TopArticlesQuery, error) {
+	values := r.URL.Query()
+
+	topArticlesQuery := TopArticlesQuery{
+		Section:    values.Get("section"),
+		SubSection: values.Get("sub_section"),
+		Count:      defaultTopArticlesCount,
+		Window:     defaultTopArticlesWindow,
+		Language:   values.Get("language"),
+		PageType:   values.Get("page_type"),
+	}
+
+	// The sub sections are only ranked within their section
+	if topArticlesQuery.SubSection != "" && topArticlesQuery.Section == "" {
+		return topArticlesQuery, errors.New("'sub_section' requires 'section'")
+	}
+
+	if numResults := values.Get("num_results"); numResults != "" {
+		count, err := strconv.Atoi(numResults)
+		if err != nil || count < 1 || count > maxTopArticlesCount {
+			return topArticlesQuery, fmt.Errorf("'num_results' must be between 1 and %d", maxTopArticlesCount)
+		}
+		topArticlesQuery.Count = count
+	}
+
+	if window := values.Get("window"); window != "" {
+		if _, ok := topArticlesWindows[window]; !ok {
+			return topArticlesQuery, errors.New("'window' must be one of 1h, 6h, 24h or 7d")
+		}
+		topArticlesQuery.Window = window
+	}
+
+	if isPaid := values.Get("is_paid"); isPaid != "" {
+		value, err := strconv.ParseBool(isPaid)
+		if err != nil {
+			return topArticlesQuery, errors.New("Invalid 'is_paid'")
+		}
+		topArticlesQuery.IsPaid = &value
+	}
+
+	if maxAge := values.Get("max_age"); maxAge != "" {
+		matches := publicationAgeExpression.FindStringSubmatch(maxAge)
+		if matches == nil {
+			return topArticlesQuery, errors.New("'max_age' must be a number of hours or days, like 12h or 3d")
+		}
+
+		unit := "hours"
+		if matches[2] == "d" {
+			unit = "days"
+		}
+		topArticlesQuery.MaxAge = matches[1] + " " + unit
+	}
+
+	if cursor := values.Get("cursor"); cursor != "" {
+		topArticlesCursor, err := decodeTopArticlesCursor(cursor)
+		if err != nil {
+			return topArticlesQuery, err
+		}
+		topArticlesQuery.Cursor = topArticlesCursor
+	}
+
+	return topArticlesQuery, nil
+}
+
+// cacheKey is the Redis key of a page of a top list
+func (q TopArticlesQuery) cacheKey(brandName string, cursor string) string {
+	isPaid := ""
+	if q.IsPaid != nil {
+		isPaid = strconv.FormatBool(*q.IsPaid)
+	}
+
+	return fmt.Sprintf("top_articles:%s:%s:%s:%d:%s:%s:%s:%s:%s:%s", brandName, q.Section, q.SubSection, q.Count, q.Window, q.Language, isPaid, q.PageType, q.MaxAge, cursor)
+}
+
+// sql builds the parameterised query of a page of a top list.
+// One more article than the page size is selected to know if there is a next page.
+func (q TopArticlesQuery) sql(brandName string) (string, []interface{}) {
+	params := []interface{}{brandName}
+	param := func(value interface{}) string {
+		params = append(params, value)
+		return fmt.Sprintf("$%d", len(params))
+	}
+
+	conditions := []string{
+		"ta.brand = $1",
+		fmt.Sprintf("ta.calculation_period >= date_trunc('hour', NOW() - %s::interval)", param(topArticlesWindows[q.Window])),
+		"ta.calculation_period < NOW()",
+	}
+
+	// The top articles of the whole site have no section, the ones of a section have no sub section
+	if q.Section != "" {
+		conditions = append(conditions, "ta.section = "+param(q.Section))
+	} else {
+		conditions = append(conditions, "ta.section IS NULL")
+	}
+	if q.SubSection != "" {
+		conditions = append(conditions, "ta.sub_section = "+param(q.SubSection))
+	} else {
+		conditions = append(conditions, "ta.sub_section IS NULL")
+	}
+
+	if q.Language != "" {
+		conditions = append(conditions, "p.language = "+param(q.Language))
+	}
+	if q.IsPaid != nil {
+		conditions = append(conditions, "p.is_paid = "+param(*q.IsPaid))
+	}
+	if q.PageType != "" {
+		conditions = append(conditions, "p.type = "+param(q.PageType))
+	}
+	if q.MaxAge != "" {
+		conditions = append(conditions, fmt.Sprintf("p.publication_date >= NOW() - %s::interval", param(q.MaxAge)))
+	}
+
+	cursorCondition := "TRUE"
+	if q.Cursor != nil {
+		score := param(q.Cursor.EngagementScore)
+		cursorCondition = fmt.Sprintf("(engagement_score < %s OR (engagement_score = %s AND url > %s))", score, score, param(q.Cursor.URL))
+	}
+
+	query := fmt.Sprintf(`
+		SELECT
+			url, title, description, image, section, sub_section, view_count, avg_reading_rate, avg_time_spent, recency_weight, engagement_score
+		FROM (
+			SELECT
+				ta.url,
+				p.title,
+				p.description,
+				p.image,
+				p.section,
+				p.sub_section,
+				SUM(ta.view_count) AS view_count,
+				ROUND(AVG(ta.avg_reading_rate), 2) AS avg_reading_rate,
+				ROUND(AVG(ta.avg_time_spent), 2) AS avg_time_spent,
+				ROUND(AVG(ta.recency_weight)) AS recency_weight,
+				ROUND(
+					AVG(ta.avg_reading_rate) * 0.3 +
+					AVG(ta.avg_time_spent) * 0.3 +
+					AVG(ta.recency_weight) * 0.4
+				) AS engagement_score
+			FROM
+				top_articles ta
+			LEFT JOIN
+				page p ON p.url = ta.url AND p.brand = ta.brand
+			WHERE
+				%s
+			GROUP BY
+				ta.url, p.title, p.description, p.image, p.section, p.sub_section
+		) ranked_articles
+		WHERE
+			%s
+		ORDER BY
+			engagement_score DESC, url
+		LIMIT %s
+	`, strings.Join(conditions, "\n\t\t\t\tAND "), cursorCondition, param(q.Count+1))
+
+	return query, params
+}
+
+// Handler to rank the articles of a brand, its section fronts and its newsletters by engagement
+func getTopArticles(w http.ResponseWriter, r *http.Request) {
+	brand := getRequestBrand(r)
+
+	topArticlesQuery, err := parseTopArticlesQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Try to retrieve articles from Redis cache
+	cacheKey := topArticlesQuery.cacheKey(brand.Name, r.URL.Query().Get("cursor"))
+	cachedData, err := redisClient.Get(ctx, cacheKey).Result()
+	if err == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(cachedData))
+		return
+	} else if err != redis.Nil {
+		http.Error(w, "Failed to retrieve cache", http.StatusInternalServerError)
+		return
+	}
+
+	query, params := topArticlesQuery.sql(brand.Name)
+	rows, err := db.Query(query, params...)
+	if err != nil {
+		logger.LogError("[TOP_ARTICLES] Failed to query top articles for brand %s: %v", brand.Name, err)
+		http.Error(w, "Failed to query articles", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	response := TopArticlesResponse{
+		Articles: []TopArticle{},
+		Window:   topArticlesQuery.Window,
+	}
+
+	for rows.Next() {
+		var article TopArticle
+		if err := rows.Scan(&article.URL, &article.Title, &article.Description, &article.Image, &article.Section, &article.SubSection, &article.ViewCount, &article.AvgReadingRate, &article.AvgTimeSpent, &article.RecencyWeight, &article.EngagementScore); err != nil {
+			logger.LogError("[TOP_ARTICLES] Failed to scan top article: %v", err)
+			http.Error(w, "Failed to scan article", http.StatusInternalServerError)
+			return
+		}
+
+		response.Articles = append(response.Articles, article)
+	}
+
+	if err := rows.Err(); err != nil {
+		logger.LogError("[TOP_ARTICLES] Failed to read top articles for brand %s: %v", brand.Name, err)
+		http.Error(w, "Failed to query articles", http.StatusInternalServerError)
+		return
+	}
+
+	if len(response.Articles) > topArticlesQuery.Count {
+		response.Articles = response.Articles[:topArticlesQuery.Count]
+
+		nextCursor, err := encodeTopArticlesCursor(response.Articles[len(response.Articles)-1])
+		if err != nil {
+			http.Error(w, "Failed to encode cursor", http.StatusInternalServerError)
+			return
+		}
+		response.NextCursor = &nextCursor
+	}
+
+	responseJSON, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, "Failed to marshal articles", http.StatusInternalServerError)
+		return
+	}
+
+	if err := redisClient.Set(ctx, cacheKey, responseJSON, topArticlesCacheTTL).Err(); err != nil {
+		logger.LogError("[TOP_ARTICLES] Failed to cache top articles: %v", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(responseJSON)
+}
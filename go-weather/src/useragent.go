@@ -0,0 +1,143 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Device classes of the lead events
+const (
+	deviceClassDesktop = "desktop"
+	deviceClassMobile  = "mobile"
+	deviceClassTablet  = "tablet"
+	deviceClassTV      = "tv"
+	deviceClassConsole = "console"
+	deviceClassBot     = "bot"
+)
+
+// UserAgent is what the collector knows of the client from its User-Agent header
+type UserAgent struct {
+	DeviceClass    string
+	OSFamily       string
+	OSVersion      string
+	BrowserFamily  string
+	BrowserVersion string
+	IsBot          bool
+}
+
+// userAgentRule matches a family, the first group of the expression being its version
+type userAgentRule struct {
+	family     string
+	expression *regexp.Regexp
+}
+
+// Generic bot signatures, the known bots are matched by the bot detector patterns.
+// "bot" is anchored like in the bot patterns, so that the phone models ending with it (CUBOT) are not bots.
+var genericBotExpression = regexp.MustCompile(`(?i)\bbot\b|[a-z0-9]bot/|[-_]bot\b|compatible;[^)]*bot|crawl|spider|slurp|headless|lighthouse|phantomjs|^curl/|^wget/|python-requests|go-http-client|okhttp|^java/`)
+
+var (
+	tvExpression      = regexp.MustCompile(`(?i)smart-?tv|googletv|appletv|hbbtv|netcast|web0s|tizen.+tv|\bcrkey\b|\baft[a-z]`)
+	consoleExpression = regexp.MustCompile(`(?i)playstation|xbox|nintendo`)
+	tabletExpression  = regexp.MustCompile(`(?i)ipad|tablet|kindle|silk/|playbook`)
+	mobileExpression  = regexp.MustCompile(`(?i)mobi|iphone|ipod|windows phone|blackberry|opera mini`)
+	androidExpression = regexp.MustCompile(`(?i)android`)
+)
+
+// Operating systems, in matching order: the iOS user agents also contain Mac OS X and the Android ones Linux
+var osRules = []userAgentRule{
+	{"Windows Phone", regexp.MustCompile(`Windows Phone(?: OS)? ([\d.]+)`)},
+	{"iOS", regexp.MustCompile(`(?:iPhone|iPad|iPod).*? OS (\d+(?:_\d+)*)`)},
+	{"Android", regexp.MustCompile(`Android ?([\d.]*)`)},
+	{"Chrome OS", regexp.MustCompile(`CrOS \S+ ([\d.]+)`)},
+	{"Windows", regexp.MustCompile(`Windows NT ([\d.]+)`)},
+	{"macOS", regexp.MustCompile(`Mac OS X ?(\d+(?:[_.]\d+)*)?`)},
+	{"Linux", regexp.MustCompile(`Linux()`)},
+}
+
+// Browsers, in matching order: most browsers also identify as Chrome and Safari
+var browserRules = []userAgentRule{
+	{"Facebook", regexp.MustCompile(`FBA[NV]/([\d.]+)`)},
+	{"Instagram", regexp.MustCompile(`Instagram ([\d.]+)`)},
+	{"Edge", regexp.MustCompile(`Edg(?:e|A|iOS)?/([\d.]+)`)},
+	{"Opera", regexp.MustCompile(`(?:OPR|OPiOS|Opera)/([\d.]+)`)},
+	{"Samsung Internet", regexp.MustCompile(`SamsungBrowser/([\d.]+)`)},
+	{"Yandex", regexp.MustCompile(`YaBrowser/([\d.]+)`)},
+	{"Firefox", regexp.MustCompile(`(?:Firefox|FxiOS)/([\d.]+)`)},
+	{"Chrome WebView", regexp.MustCompile(`; wv\).+Chrome/([\d.]+)`)},
+	{"Chrome", regexp.MustCompile(`(?:Chrome|CriOS)/([\d.]+)`)},
+	{"Safari", regexp.MustCompile(`Version/([\d.]+).*Safari/`)},
+	{"Internet Explorer", regexp.MustCompile(`(?:MSIE |Trident/.*rv:)([\d.]+)`)},
+}
+
+// Marketing names of the Windows NT versions
+var windowsVersions = map[string]string{
+	"5.1":  "XP",
+	"6.0":  "Vista",
+	"6.1":  "7",
+	"6.2":  "8",
+	"6.3":  "8.1",
+	"10.0": "10",
+}
+
+// ParseUserAgent parses a User-Agent header into the device class, the OS, the browser and a bot flag.
+// Versions are kept to their major and minor numbers, unknown parts are left empty.
+func ParseUserAgent(userAgent string) UserAgent {
+	userAgent = strings.TrimSpace(userAgent)
+	if userAgent == "" {
+		return UserAgent{}
+	}
+
+	var parsed UserAgent
+	parsed.OSFamily, parsed.OSVersion = matchUserAgentRules(osRules, userAgent)
+	parsed.BrowserFamily, parsed.BrowserVersion = matchUserAgentRules(browserRules, userAgent)
+
+	if parsed.OSFamily == "Windows" {
+		if version, ok := windowsVersions[parsed.OSVersion]; ok {
+			parsed.OSVersion = version
+		}
+	}
+
+	parsed.IsBot = genericBotExpression.MatchString(userAgent)
+	parsed.DeviceClass = userAgentDeviceClass(userAgent, parsed)
+
+	return parsed
+}
+
+func matchUserAgentRules(rules []userAgentRule, userAgent string) (string, string) {
+	for _, rule := range rules {
+		if match := rule.expression.FindStringSubmatch(userAgent); match != nil {
+			return rule.family, shortVersion(match[1])
+		}
+	}
+	return "", ""
+}
+
+// userAgentDeviceClass classifies the device, the Android tablets being the Android devices without Mobile
+func userAgentDeviceClass(userAgent string, parsed UserAgent) string {
+	switch {
+	case parsed.IsBot:
+		return deviceClassBot
+	case tvExpression.MatchString(userAgent):
+		return deviceClassTV
+	case consoleExpression.MatchString(userAgent):
+		return deviceClassConsole
+	case tabletExpression.MatchString(userAgent):
+		return deviceClassTablet
+	case mobileExpression.MatchString(userAgent):
+		return deviceClassMobile
+	case androidExpression.MatchString(userAgent):
+		return deviceClassTablet
+	}
+	return deviceClassDesktop
+}
+
+// shortVersion keeps the major and minor numbers of a version, which may be separated by underscores
+func shortVersion(version string) string {
+	parts := strings.FieldsFunc(version, func(r rune) bool {
+		return r == '.' || r == '_'
+	})
+	if len(parts) > 2 {
+		parts = parts[:2]
+	}
+	return strings.Join(parts, ".")
+}
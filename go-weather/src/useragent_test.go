@@ -0,0 +1,165 @@
+package main
+
+import "testing"
+
+func TestParseUserAgent(t *testing.T) {
+	tests := []struct {
+		name      string
+		userAgent string
+		want      UserAgent
+	}{
+		{
+			"empty",
+			"",
+			UserAgent{},
+		},
+		{
+			"windows chrome",
+			"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.6099.130 Safari/537.36",
+			UserAgent{DeviceClass: deviceClassDesktop, OSFamily: "Windows", OSVersion: "10", BrowserFamily: "Chrome", BrowserVersion: "120.0"},
+		},
+		{
+			"windows 7 firefox",
+			"Mozilla/5.0 (Windows NT 6.1; Win64; x64; rv:115.0) Gecko/20100101 Firefox/115.0",
+			UserAgent{DeviceClass: deviceClassDesktop, OSFamily: "Windows", OSVersion: "7", BrowserFamily: "Firefox", BrowserVersion: "115.0"},
+		},
+		{
+			"windows edge",
+			"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36 Edg/120.0.2210.91",
+			UserAgent{DeviceClass: deviceClassDesktop, OSFamily: "Windows", OSVersion: "10", BrowserFamily: "Edge", BrowserVersion: "120.0"},
+		},
+		{
+			"macos safari",
+			"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.2.1 Safari/605.1.15",
+			UserAgent{DeviceClass: deviceClassDesktop, OSFamily: "macOS", OSVersion: "10.15", BrowserFamily: "Safari", BrowserVersion: "17.2"},
+		},
+		{
+			"iphone safari",
+			"Mozilla/5.0 (iPhone; CPU iPhone OS 17_2_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.2 Mobile/15E148 Safari/604.1",
+			UserAgent{DeviceClass: deviceClassMobile, OSFamily: "iOS", OSVersion: "17.2", BrowserFamily: "Safari", BrowserVersion: "17.2"},
+		},
+		{
+			"iphone chrome",
+			"Mozilla/5.0 (iPhone; CPU iPhone OS 16_6 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) CriOS/120.0.6099.119 Mobile/15E148 Safari/604.1",
+			UserAgent{DeviceClass: deviceClassMobile, OSFamily: "iOS", OSVersion: "16.6", BrowserFamily: "Chrome", BrowserVersion: "120.0"},
+		},
+		{
+			"iphone facebook",
+			"Mozilla/5.0 (iPhone; CPU iPhone OS 17_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Mobile/15E148 [FBAN/FBIOS;FBAV/443.0.0.32.118;FBBV/534148413]",
+			UserAgent{DeviceClass: deviceClassMobile, OSFamily: "iOS", OSVersion: "17.1", BrowserFamily: "Facebook", BrowserVersion: "443.0"},
+		},
+		{
+			"ipad",
+			"Mozilla/5.0 (iPad; CPU OS 15_7 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/15.6 Mobile/15E148 Safari/604.1",
+			UserAgent{DeviceClass: deviceClassTablet, OSFamily: "iOS", OSVersion: "15.7", BrowserFamily: "Safari", BrowserVersion: "15.6"},
+		},
+		{
+			"android phone",
+			"Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.6099.144 Mobile Safari/537.36",
+			UserAgent{DeviceClass: deviceClassMobile, OSFamily: "Android", OSVersion: "14", BrowserFamily: "Chrome", BrowserVersion: "120.0"},
+		},
+		{
+			"android webview",
+			"Mozilla/5.0 (Linux; Android 13; SM-S911B Build/TP1A.220624.014; wv) AppleWebKit/537.36 (KHTML, like Gecko) Version/4.0 Chrome/119.0.6045.163 Mobile Safari/537.36",
+			UserAgent{DeviceClass: deviceClassMobile, OSFamily: "Android", OSVersion: "13", BrowserFamily: "Chrome WebView", BrowserVersion: "119.0"},
+		},
+		{
+			"android samsung internet",
+			"Mozilla/5.0 (Linux; Android 12; SAMSUNG SM-A525F) AppleWebKit/537.36 (KHTML, like Gecko) SamsungBrowser/23.0 Chrome/115.0.0.0 Mobile Safari/537.36",
+			UserAgent{DeviceClass: deviceClassMobile, OSFamily: "Android", OSVersion: "12", BrowserFamily: "Samsung Internet", BrowserVersion: "23.0"},
+		},
+		{
+			"android tablet",
+			"Mozilla/5.0 (Linux; Android 13; SM-X700) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36",
+			UserAgent{DeviceClass: deviceClassTablet, OSFamily: "Android", OSVersion: "13", BrowserFamily: "Chrome", BrowserVersion: "120.0"},
+		},
+		{
+			"kindle",
+			"Mozilla/5.0 (Linux; Android 9; KFMAWI) AppleWebKit/537.36 (KHTML, like Gecko) Silk/120.3.1 like Chrome/120.0.6099.230 Safari/537.36",
+			UserAgent{DeviceClass: deviceClassTablet, OSFamily: "Android", OSVersion: "9", BrowserFamily: "Chrome", BrowserVersion: "120.0"},
+		},
+		{
+			"cubot phone",
+			"Mozilla/5.0 (Linux; Android 9; CUBOT P30 Build/PPR1.180610.011) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/90.0.4430.91 Mobile Safari/537.36",
+			UserAgent{DeviceClass: deviceClassMobile, OSFamily: "Android", OSVersion: "9", BrowserFamily: "Chrome", BrowserVersion: "90.0"},
+		},
+		{
+			"cubot phone without build",
+			"Mozilla/5.0 (Linux; Android 10; CUBOT_X30) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/96.0.4664.45 Mobile Safari/537.36",
+			UserAgent{DeviceClass: deviceClassMobile, OSFamily: "Android", OSVersion: "10", BrowserFamily: "Chrome", BrowserVersion: "96.0"},
+		},
+		{
+			"chrome os",
+			"Mozilla/5.0 (X11; CrOS x86_64 14541.0.0) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36",
+			UserAgent{DeviceClass: deviceClassDesktop, OSFamily: "Chrome OS", OSVersion: "14541.0", BrowserFamily: "Chrome", BrowserVersion: "120.0"},
+		},
+		{
+			"linux firefox",
+			"Mozilla/5.0 (X11; Ubuntu; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0",
+			UserAgent{DeviceClass: deviceClassDesktop, OSFamily: "Linux", BrowserFamily: "Firefox", BrowserVersion: "121.0"},
+		},
+		{
+			"samsung tv",
+			"Mozilla/5.0 (SMART-TV; LINUX; Tizen 6.0) AppleWebKit/537.36 (KHTML, like Gecko) 76.0.3809.146/6.0 TV Safari/537.36",
+			UserAgent{DeviceClass: deviceClassTV},
+		},
+		{
+			"lg tv",
+			"Mozilla/5.0 (Web0S; Linux/SmartTV) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/79.0.3945.79 Safari/537.36 WebAppManager",
+			UserAgent{DeviceClass: deviceClassTV, OSFamily: "Linux", BrowserFamily: "Chrome", BrowserVersion: "79.0"},
+		},
+		{
+			"fire tv",
+			"Mozilla/5.0 (Linux; Android 9; AFTKA) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/108.0.5359.220 Safari/537.36",
+			UserAgent{DeviceClass: deviceClassTV, OSFamily: "Android", OSVersion: "9", BrowserFamily: "Chrome", BrowserVersion: "108.0"},
+		},
+		{
+			"playstation",
+			"Mozilla/5.0 (PlayStation; PlayStation 5/2.26) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/13.0 Safari/605.1.15",
+			UserAgent{DeviceClass: deviceClassConsole, BrowserFamily: "Safari", BrowserVersion: "13.0"},
+		},
+		{
+			"xbox",
+			"Mozilla/5.0 (Windows NT 10.0; Win64; x64; Xbox; Xbox One) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36 Edge/44.18363.8131",
+			UserAgent{DeviceClass: deviceClassConsole, OSFamily: "Windows", OSVersion: "10", BrowserFamily: "Edge", BrowserVersion: "44.18363"},
+		},
+		{
+			"googlebot",
+			"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)",
+			UserAgent{DeviceClass: deviceClassBot, IsBot: true},
+		},
+		{
+			"googlebot smartphone",
+			"Mozilla/5.0 (Linux; Android 6.0.1; Nexus 5X Build/MMB29P) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.6099.129 Mobile Safari/537.36 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)",
+			UserAgent{DeviceClass: deviceClassBot, OSFamily: "Android", OSVersion: "6.0", BrowserFamily: "Chrome", BrowserVersion: "120.0", IsBot: true},
+		},
+		{
+			"unnamed product bot",
+			"AcmeBot/1.2",
+			UserAgent{DeviceClass: deviceClassBot, IsBot: true},
+		},
+		{
+			"hyphenated bot",
+			"acme-bot",
+			UserAgent{DeviceClass: deviceClassBot, IsBot: true},
+		},
+		{
+			"headless chrome",
+			"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) HeadlessChrome/120.0.0.0 Safari/537.36",
+			UserAgent{DeviceClass: deviceClassBot, OSFamily: "Linux", BrowserFamily: "Chrome", BrowserVersion: "120.0", IsBot: true},
+		},
+		{
+			"curl",
+			"curl/8.4.0",
+			UserAgent{DeviceClass: deviceClassBot, IsBot: true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ParseUserAgent(tt.userAgent); got != tt.want {
+				t.Errorf("ParseUserAgent(%q) = %+v, want %+v", tt.userAgent, got, tt.want)
+			}
+		})
+	}
+}